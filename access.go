@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accessLogFileName is the HTTP access log in the logs directory
+const accessLogFileName = "access.log"
+
+// accessTimeFormat is the timestamp format of the combined log format
+const accessTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogConfig configures the HTTP access log
+type AccessLogConfig struct {
+	// Enabled writes logs/access.log; turn it off for privacy-sensitive deployments
+	Enabled bool `yaml:"enabled"`
+
+	// Format is "combined" (the default) or "json"
+	Format string `yaml:"format"`
+}
+
+// accessEntry is a single access log record
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	LatencyMs  float64   `json:"latency_ms"`
+	Token      string    `json:"token,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+
+	// Event is "connect" or "disconnect" for WebSocket connections
+	Event string `json:"event,omitempty"`
+}
+
+// AccessLog writes HTTP requests and WebSocket sessions to logs/access.log
+type AccessLog struct {
+	writer *rotatingWriter
+	format string
+}
+
+// NewAccessLog opens the access log, or returns nil when it is disabled
+func NewAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	if !cfg.Enabled || !writable() {
+		return nil, nil
+	}
+	if cfg.Format != "" && cfg.Format != "combined" && cfg.Format != "json" {
+		return nil, fmt.Errorf("invalid access log format %q", cfg.Format)
+	}
+
+	writer, err := newRotatingWriter(filepath.Join(logsDir, accessLogFileName), maxAppLogSize, maxAppLogFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLog{writer: writer, format: cfg.Format}, nil
+}
+
+// middleware logs every request except WebSocket upgrades, which are logged
+// when the connection opens and closes
+func (a *AccessLog) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		if c.IsWebsocket() {
+			return
+		}
+
+		path := c.Request.URL.Path
+		if c.Request.URL.RawQuery != "" {
+			path += "?" + redactedQuery(c.Request.URL)
+		}
+		a.write(accessEntry{
+			Time:       start,
+			RemoteAddr: c.ClientIP(),
+			Method:     c.Request.Method,
+			Path:       path,
+			Proto:      c.Request.Proto,
+			Status:     c.Writer.Status(),
+			Bytes:      c.Writer.Size(),
+			LatencyMs:  float64(time.Since(start).Microseconds()) / 1000,
+			Token:      tokenName(c),
+			Referer:    c.Request.Referer(),
+			UserAgent:  c.Request.UserAgent(),
+			RequestID:  requestID(c),
+		})
+	}
+}
+
+// logWebSocket records a WebSocket client connecting or disconnecting; the
+// latency of a disconnect is the session duration
+func (a *AccessLog) logWebSocket(event string, client *Client) {
+	entry := accessEntry{
+		Time:       time.Now(),
+		RemoteAddr: client.remoteAddr,
+		Method:     "GET",
+		Path:       "/ws",
+		Proto:      "HTTP/1.1",
+		Status:     101,
+		Token:      client.token.name,
+		RequestID:  client.connID,
+		Event:      event,
+	}
+	if event == "disconnect" {
+		entry.LatencyMs = float64(time.Since(client.connectedAt).Microseconds()) / 1000
+	}
+	a.write(entry)
+}
+
+// write formats and appends an entry
+func (a *AccessLog) write(entry accessEntry) {
+	var line []byte
+	if a.format == "json" {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Error encoding access log entry: %v", err)
+			return
+		}
+		line = append(data, '\n')
+	} else {
+		bytes := "-"
+		if entry.Bytes > 0 {
+			bytes = fmt.Sprintf("%d", entry.Bytes)
+		}
+		// The token name takes the authenticated user's place
+		text := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s %q %q %.3fms",
+			entry.RemoteAddr, orDash(entry.Token), entry.Time.Format(accessTimeFormat), entry.Method, entry.Path, entry.Proto,
+			entry.Status, bytes, orDash(entry.Referer), orDash(entry.UserAgent), entry.LatencyMs)
+		if entry.RequestID != "" {
+			text += " id=" + entry.RequestID
+		}
+		if entry.Event != "" {
+			text += " ws=" + entry.Event
+		}
+		line = []byte(text + "\n")
+	}
+
+	if _, err := a.writer.Write(line); err != nil {
+		log.Printf("Error writing access log: %v", err)
+	}
+}
+
+// orDash returns s, or "-" if it is empty, as the combined log format expects
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Close closes the access log file
+func (a *AccessLog) Close() error {
+	return a.writer.Close()
+}
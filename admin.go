@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireAdmin returns middleware that only lets requests carrying a token
+// with the admin scope through. Refused requests and those that change
+// state are written to the audit log.
+func requireAdmin(store *ConfigStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := store.Get()
+		if !cfg.adminEnabled() {
+			apiError(c, http.StatusForbidden, "admin API disabled: no admin token or login with the admin scope configured")
+			return
+		}
+
+		token, ok := authenticate(c, cfg)
+		if !ok {
+			recordAuthFailure(c, http.StatusUnauthorized)
+			apiError(c, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		c.Set(tokenKey, token)
+		if !token.allows(scopeAdmin) {
+			recordAuthFailure(c, http.StatusForbidden)
+			apiError(c, http.StatusForbidden, "token lacks the admin scope")
+			return
+		}
+
+		c.Next()
+		if isMutatingRequest(c) || c.GetString(auditActionKey) != "" {
+			recordAudit(c)
+		}
+	}
+}
+
+// auditLog records an administrative action in the application log and
+// names it in the request's audit log entry
+func auditLog(c *gin.Context, action string, details string) {
+	c.Set(auditActionKey, action)
+	c.Set(auditDetailKey, details)
+	logf(c, "Admin action %s by %s (%s): %s", action, tokenName(c), c.ClientIP(), details)
+}
+
+// queryNonNegative parses an optional non-negative integer query parameter
+func queryNonNegative(c *gin.Context, name string, fallback int64) (int64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s parameter", name)
+	}
+	return n, nil
+}
+
+// logFileError responds to a failed log file operation
+func logFileError(c *gin.Context, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		apiError(c, http.StatusNotFound, "log file not found")
+		return
+	}
+	respondError(c, err)
+}
+
+// registerLogAdminRoutes registers the log file deletion and archival
+// endpoints, which require the admin token
+func registerLogAdminRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	admin := requireAdmin(chatServer.config)
+
+	api.DELETE("/logs/:filename", admin, func(c *gin.Context) {
+		filename := c.Param("filename")
+		if err := chatServer.logger.DeleteLog(filename); err != nil {
+			auditLog(c, "delete_log", filename+" failed: "+err.Error())
+			logFileError(c, err)
+			return
+		}
+
+		auditLog(c, "delete_log", filename)
+		c.JSON(http.StatusOK, gin.H{"deleted": filename})
+	})
+
+	api.POST("/logs/:filename/archive", admin, func(c *gin.Context) {
+		filename := c.Param("filename")
+		archived, err := chatServer.logger.ArchiveLog(filename)
+		if err != nil {
+			auditLog(c, "archive_log", filename+" failed: "+err.Error())
+			logFileError(c, err)
+			return
+		}
+
+		auditLog(c, "archive_log", filename+" -> "+archived)
+		c.JSON(http.StatusOK, gin.H{"archived": filename, "path": archived})
+	})
+}
+
+// registerAdminRoutes registers the administrative API endpoints
+func registerAdminRoutes(admin *gin.RouterGroup, chatServer *ChatServer) {
+	// Content filter endpoints
+	admin.GET("/filters", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.filters.Rules())
+	})
+
+	admin.PUT("/filters", func(c *gin.Context) {
+		var rules []FilterRule
+		if err := c.ShouldBindJSON(&rules); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := chatServer.filters.SetRules(rules); err != nil {
+			auditLog(c, "set_filters", "failed: "+err.Error())
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		auditLog(c, "set_filters", fmt.Sprintf("%d rules", len(rules)))
+		c.JSON(http.StatusOK, chatServer.filters.Rules())
+	})
+
+	// WebSocket client endpoints
+	admin.GET("/clients", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.Clients())
+	})
+
+	admin.DELETE("/clients/:id", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, "invalid client id")
+			return
+		}
+
+		if !chatServer.DisconnectClient(id) {
+			apiError(c, http.StatusNotFound, "client not found")
+			return
+		}
+
+		auditLog(c, "disconnect_client", strconv.FormatUint(id, 10))
+		c.JSON(http.StatusOK, gin.H{"disconnected": id})
+	})
+
+	// Recent raw upstream frames, while debugging is on
+	admin.GET("/raw", func(c *gin.Context) {
+		if chatServer.raw == nil {
+			apiError(c, http.StatusNotFound, "debug is not enabled")
+			return
+		}
+		c.JSON(http.StatusOK, chatServer.raw.Frames())
+	})
+
+	// Log file management endpoints
+	admin.POST("/rotate", func(c *gin.Context) {
+		oldFile, newFile, err := chatServer.logger.Rotate()
+		if err != nil {
+			auditLog(c, "rotate", "failed: "+err.Error())
+			respondError(c, err)
+			return
+		}
+
+		auditLog(c, "rotate", fmt.Sprintf("%s -> %s", oldFile, newFile))
+		c.JSON(http.StatusOK, gin.H{"closed": oldFile, "opened": newFile})
+	})
+
+	admin.POST("/prune", func(c *gin.Context) {
+		cfg := chatServer.Config()
+		kind := c.DefaultQuery("kind", logKindChat)
+		retention := cfg.Retention
+		if kindRetention, ok := cfg.KindRetention[kind]; ok && kind != logKindChat {
+			retention = kindRetention
+		}
+
+		keepDays, err := queryNonNegative(c, "keep_days", int64(retention.KeepDays))
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		maxFiles, err := queryNonNegative(c, "max_files", int64(retention.MaxFiles))
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		keepBytes, err := queryNonNegative(c, "keep_bytes", retention.KeepBytes)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		retention.KeepDays = int(keepDays)
+		retention.MaxFiles = int(maxFiles)
+		retention.KeepBytes = keepBytes
+
+		deleted, err := chatServer.logger.PruneKind(kind, retention)
+		if err != nil {
+			auditLog(c, "prune", "failed: "+err.Error())
+			respondError(c, err)
+			return
+		}
+
+		auditLog(c, "prune", fmt.Sprintf("deleted %d %s files %v", len(deleted), kind, deleted))
+		c.JSON(http.StatusOK, gin.H{"deleted": deleted, "retention": retention})
+	})
+
+	// Digest endpoints
+	admin.POST("/digest", func(c *gin.Context) {
+		date := time.Now()
+		if value := c.Query("date"); value != "" {
+			var err error
+			date, err = time.ParseInLocation(logDateFormat, value, time.Local)
+			if err != nil {
+				apiError(c, http.StatusBadRequest, "invalid date")
+				return
+			}
+		}
+
+		digest, err := chatServer.GenerateDigest(date)
+		if err != nil {
+			auditLog(c, "digest", "failed: "+err.Error())
+			respondError(c, err)
+			return
+		}
+
+		auditLog(c, "digest", digest.Date)
+		c.JSON(http.StatusOK, digest)
+	})
+
+	// Backup of the logs directory, one at a time
+	admin.GET("/backup", func(c *gin.Context) {
+		if !backupRunning.CompareAndSwap(false, true) {
+			apiError(c, http.StatusTooManyRequests, "a backup is already running")
+			return
+		}
+		defer backupRunning.Store(false)
+
+		filename := fmt.Sprintf("cylog-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
+		c.Header("Content-Type", "application/gzip")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Status(http.StatusOK)
+		files, err := chatServer.WriteBackup(c.Writer)
+		if err != nil {
+			auditLog(c, "backup", "failed: "+err.Error())
+			return
+		}
+
+		auditLog(c, "backup", fmt.Sprintf("%s with %d files", filename, files))
+	})
+
+	// Logging can be paused while messages are still broadcast
+	admin.POST("/logging/pause", func(c *gin.Context) {
+		if chatServer.PauseLogging() {
+			auditLog(c, "pause_logging", "paused")
+		}
+		c.JSON(http.StatusOK, chatServer.LoggingStatus())
+	})
+
+	admin.POST("/logging/resume", func(c *gin.Context) {
+		if chatServer.ResumeLogging() {
+			auditLog(c, "resume_logging", "resumed")
+		}
+		c.JSON(http.StatusOK, chatServer.LoggingStatus())
+	})
+
+	admin.GET("/logging/sampling", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.SamplingStatus())
+	})
+
+	admin.PUT("/logging/sampling", func(c *gin.Context) {
+		var req SamplingRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Rate < 1 {
+			apiError(c, http.StatusBadRequest, "rate must be a positive integer; 1 logs every message")
+			return
+		}
+		status := chatServer.SetSampling(req.Rate)
+		auditLog(c, "set_sampling", fmt.Sprintf("1 in %d", req.Rate))
+		c.JSON(http.StatusOK, status)
+	})
+
+	admin.DELETE("/logging/sampling", func(c *gin.Context) {
+		status := chatServer.SetSampling(0)
+		auditLog(c, "reset_sampling", fmt.Sprintf("config rate 1 in %d", status.Rate))
+		c.JSON(http.StatusOK, status)
+	})
+
+	// Channel endpoints
+	admin.POST("/channels", func(c *gin.Context) {
+		var req JoinRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !validChannelName(req.Name) {
+			apiError(c, http.StatusBadRequest, "invalid channel name")
+			return
+		}
+
+		joined, err := chatServer.JoinChannel(req.Name, req.Password)
+		if errors.Is(err, errShuttingDown) {
+			apiError(c, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if err != nil {
+			auditLog(c, "join_channel", req.Name+" failed: "+err.Error())
+			respondError(c, err)
+			return
+		}
+
+		// Joining a channel cylog is in again changes nothing
+		status := http.StatusOK
+		if joined {
+			auditLog(c, "join_channel", req.Name)
+			status = http.StatusCreated
+		}
+		info, ok := chatServer.Channel(req.Name)
+		if !ok {
+			apiError(c, http.StatusNotFound, errUnknownChannel.Error())
+			return
+		}
+		c.JSON(status, info)
+	})
+
+	admin.DELETE("/channels/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		if err := chatServer.LeaveChannel(name); err != nil {
+			if errors.Is(err, errUnknownChannel) {
+				apiError(c, http.StatusNotFound, err.Error())
+				return
+			}
+			auditLog(c, "leave_channel", name+" failed: "+err.Error())
+			respondError(c, err)
+			return
+		}
+
+		auditLog(c, "leave_channel", name)
+		c.JSON(http.StatusOK, gin.H{"left": name})
+	})
+
+	admin.POST("/restart", func(c *gin.Context) {
+		auditLog(c, "restart", "requested")
+		chatServer.RequestRestart()
+		c.JSON(http.StatusAccepted, gin.H{"restarting": true})
+	})
+
+	// Configuration endpoints
+	admin.POST("/reload", func(c *gin.Context) {
+		result, err := chatServer.ReloadConfig()
+		if err != nil {
+			auditLog(c, "reload", "failed: "+err.Error())
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		auditLog(c, "reload", fmt.Sprintf("applied %v, rejected %v", result.Applied, result.Rejected))
+		c.JSON(http.StatusOK, result)
+	})
+}
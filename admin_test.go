@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// routeParam matches the parameters of a route path, like :filename
+var routeParam = regexp.MustCompile(`[:*][^/]+`)
+
+// isAdminRoute reports whether a route needs the admin scope: everything
+// under the admin and debug groups, and the operations the OpenAPI
+// document marks as admin
+func isAdminRoute(method, path string) bool {
+	if strings.HasPrefix(path, "/api/v1/admin/") || strings.HasPrefix(path, "/debug/") {
+		return true
+	}
+	api, ok := strings.CutPrefix(path, "/api/v1")
+	if !ok {
+		return false
+	}
+	for _, op := range append(apiOperations, channelOperations...) {
+		if op.Admin && op.Method == method && op.Path == api {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAdminRoutesForbidViewers(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RequireTokens = true
+	cfg.AdminToken = "admin-secret"
+	cfg.Tokens = []APIToken{{Name: "viewer", Hash: hashToken("viewer-secret"), Scopes: []string{scopeRead, scopeIngest}}}
+	cfg.Debug.Enabled = true
+	_, router := newTestServer(t, cfg)
+
+	checked := 0
+	for _, route := range router.Routes() {
+		if !isAdminRoute(route.Method, route.Path) {
+			continue
+		}
+		checked++
+		path := routeParam.ReplaceAllString(route.Path, "x")
+		req := httptest.NewRequest(route.Method, path, nil)
+		req.Header.Set("Authorization", "Bearer viewer-secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with a viewer token: status %d, want 403", route.Method, route.Path, w.Code)
+		}
+	}
+
+	// Every operation documented as admin must be among the routes checked
+	for _, op := range apiOperations {
+		if !op.Admin {
+			continue
+		}
+		found := false
+		for _, route := range router.Routes() {
+			if route.Method == op.Method && route.Path == "/api/v1"+op.Path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("admin operation %s %s is not registered", op.Method, op.Path)
+		}
+	}
+	if checked == 0 {
+		t.Fatal("no admin routes found")
+	}
+}
+
+func TestAdminEnabled(t *testing.T) {
+	login := LoginConfig{Username: "admin", PasswordHash: "$2a$10$unused"}
+	tests := []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"nothing configured", Config{}, false},
+		{"admin token", Config{AdminToken: "secret"}, true},
+		{"token with the admin scope", Config{Tokens: []APIToken{{Name: "ops", Scopes: []string{scopeAdmin}}}}, true},
+		{"tokens without the admin scope", Config{Tokens: []APIToken{{Name: "bot", Scopes: []string{scopeRead, scopeIngest}}}}, false},
+		{"login with the admin scope", Config{Login: LoginConfig{Username: login.Username, PasswordHash: login.PasswordHash, Scopes: []string{scopeAdmin}}}, true},
+		{"login with the default scopes", Config{Login: login}, false},
+		{"admin scope without a login", Config{Login: LoginConfig{Scopes: []string{scopeAdmin}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.adminEnabled(); got != tt.want {
+				t.Errorf("adminEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminRotateAndPruneWhileLogging(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminToken = "admin-secret"
+	chatServer, router := newTestServer(t, cfg)
+	logger := chatServer.logger
+
+	// Old files for the prunes to delete while messages are written
+	old := make(map[string]bool)
+	for day := 1; day <= 20; day++ {
+		name := logFileName(logKindChat, fmt.Sprintf("2020-01-%02d", day), 0)
+		if err := os.WriteFile(filepath.Join(logger.dir, name), []byte("old\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		old[name] = true
+	}
+
+	post := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	const writers, perWriter = 4, 200
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				msg := Message{ID: "test", Type: messageTypeChat, Username: "alice", Timestamp: logger.clock.Now(), Content: fmt.Sprintf("message %d-%d", writer, i)}
+				if err := logger.LogMessages([]Message{msg}); err != nil {
+					t.Errorf("logging a message: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	var mutex sync.Mutex
+	opened := make(map[string]bool)
+	pruned := make(map[string]bool)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			w := post("/api/v1/admin/rotate")
+			var rotated struct{ Closed, Opened string }
+			if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &rotated) != nil {
+				t.Errorf("rotating: status %d: %s", w.Code, w.Body.String())
+				return
+			}
+			mutex.Lock()
+			if opened[rotated.Opened] || rotated.Opened == rotated.Closed {
+				t.Errorf("rotation %d reopened %s", i, rotated.Opened)
+			}
+			opened[rotated.Opened] = true
+			mutex.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			w := post("/api/v1/admin/prune?keep_days=1")
+			var result struct{ Deleted []string }
+			if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &result) != nil {
+				t.Errorf("pruning: status %d: %s", w.Code, w.Body.String())
+				return
+			}
+			mutex.Lock()
+			for _, name := range result.Deleted {
+				if !old[name] || pruned[name] {
+					t.Errorf("prune %d deleted %s", i, name)
+				}
+				pruned[name] = true
+			}
+			mutex.Unlock()
+		}
+	}()
+	wg.Wait()
+
+	// Rotations apply the configured retention too, so some of the old
+	// files may be gone before a prune gets to them
+	for name := range old {
+		if _, err := os.Stat(filepath.Join(logger.dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s not pruned: %v", name, err)
+		}
+	}
+
+	// Every message is in exactly one of today's files, whole
+	counts := make(map[string]int)
+	for _, name := range chatLogs(t, logger) {
+		content, err := os.ReadFile(filepath.Join(logger.dir, name))
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line == "" {
+				continue
+			}
+			msg, ok := parseLogEntry(line)
+			if !ok {
+				t.Errorf("%s has a broken line %q", name, line)
+				continue
+			}
+			counts[msg.Content]++
+		}
+	}
+	for writer := 0; writer < writers; writer++ {
+		for i := 0; i < perWriter; i++ {
+			if content := fmt.Sprintf("message %d-%d", writer, i); counts[content] != 1 {
+				t.Errorf("%q logged %d times, want once", content, counts[content])
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aliasesFileName is the file in the logs directory the alias map is persisted to
+const aliasesFileName = "aliases.json"
+
+// AliasGroup is a set of usernames belonging to the same person. Canonical is
+// the name results are merged under; when empty, the first member is used.
+type AliasGroup struct {
+	Canonical string   `json:"canonical,omitempty"`
+	Members   []string `json:"members"`
+}
+
+// AliasMap groups usernames so results can be merged at query time
+type AliasMap struct {
+	path      string
+	groups    []AliasGroup
+	canonical map[string]string
+	mutex     sync.RWMutex
+}
+
+// NewAliasMap creates an alias map, loading the persisted groups if present
+func NewAliasMap(path string) (*AliasMap, error) {
+	aliases := &AliasMap{path: path, canonical: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return aliases, nil
+		}
+		return nil, fmt.Errorf("failed to read aliases file: %w", err)
+	}
+
+	var groups []AliasGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse aliases file: %w", err)
+	}
+
+	groups, canonical, err := indexAliasGroups(groups)
+	if err != nil {
+		return nil, fmt.Errorf("invalid aliases file: %w", err)
+	}
+	aliases.groups = groups
+	aliases.canonical = canonical
+
+	return aliases, nil
+}
+
+// indexAliasGroups validates alias groups, selects each group's canonical
+// name, and builds the case-insensitive lookup from member to canonical name.
+// A username may belong to at most one group.
+func indexAliasGroups(groups []AliasGroup) ([]AliasGroup, map[string]string, error) {
+	canonical := make(map[string]string)
+	normalized := make([]AliasGroup, 0, len(groups))
+
+	for i, group := range groups {
+		group.Canonical = strings.TrimSpace(group.Canonical)
+		members := make([]string, 0, len(group.Members)+1)
+		seen := make(map[string]bool)
+		for _, member := range group.Members {
+			member = strings.TrimSpace(member)
+			key := normalizeUsername(member)
+			if member == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			members = append(members, member)
+		}
+
+		if group.Canonical != "" && !seen[normalizeUsername(group.Canonical)] {
+			members = append(members, group.Canonical)
+		}
+		if len(members) < 2 {
+			return nil, nil, fmt.Errorf("group %d: needs at least two usernames", i)
+		}
+		if group.Canonical == "" {
+			group.Canonical = members[0]
+		}
+
+		for _, member := range members {
+			key := normalizeUsername(member)
+			if existing, ok := canonical[key]; ok {
+				return nil, nil, fmt.Errorf("group %d: %s already belongs to the group of %s", i, member, existing)
+			}
+			canonical[key] = group.Canonical
+		}
+
+		normalized = append(normalized, AliasGroup{Canonical: group.Canonical, Members: members})
+	}
+
+	return normalized, canonical, nil
+}
+
+// Groups returns the current alias groups
+func (a *AliasMap) Groups() []AliasGroup {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	groups := make([]AliasGroup, len(a.groups))
+	copy(groups, a.groups)
+	return groups
+}
+
+// SetGroups validates, replaces and persists the alias groups
+func (a *AliasMap) SetGroups(groups []AliasGroup) error {
+	groups, canonical, err := indexAliasGroups(groups)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode aliases: %w", err)
+	}
+	if err := writeFileAtomic(a.path, data); err != nil {
+		return fmt.Errorf("failed to write aliases file: %w", err)
+	}
+
+	a.mutex.Lock()
+	a.groups = groups
+	a.canonical = canonical
+	a.mutex.Unlock()
+	return nil
+}
+
+// Resolve returns the canonical name for username, or username itself if it
+// isn't part of an alias group
+func (a *AliasMap) Resolve(username string) string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if canonical, ok := a.canonical[normalizeUsername(username)]; ok {
+		return canonical
+	}
+	return username
+}
+
+// aliasesPath returns the default location of the alias map
+func aliasesPath() string {
+	return filepath.Join(logsDir, aliasesFileName)
+}
+
+// wantsAliasResolution reports whether the request asked for alias groups to be merged
+func wantsAliasResolution(c *gin.Context) bool {
+	return c.Query("resolve_aliases") == "1"
+}
+
+// registerAliasRoutes registers the alias map endpoints
+func registerAliasRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/users/aliases", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.aliases.Groups())
+	})
+
+	api.PUT("/users/aliases", requireAdmin(chatServer.config), func(c *gin.Context) {
+		var groups []AliasGroup
+		if err := c.ShouldBindJSON(&groups); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := chatServer.aliases.SetGroups(groups); err != nil {
+			auditLog(c, "set_aliases", "failed: "+err.Error())
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		auditLog(c, "set_aliases", fmt.Sprintf("%d groups", len(groups)))
+		c.JSON(http.StatusOK, chatServer.aliases.Groups())
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIndexAliasGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []AliasGroup
+		want   []AliasGroup
+		lookup map[string]string
+		err    string
+	}{
+		{
+			name:   "first member is canonical",
+			groups: []AliasGroup{{Members: []string{"Alice", "alice_", "ALICE2"}}},
+			want:   []AliasGroup{{Canonical: "Alice", Members: []string{"Alice", "alice_", "ALICE2"}}},
+			lookup: map[string]string{"alice": "Alice", "ALICE_": "Alice", "alice2": "Alice"},
+		},
+		{
+			name:   "explicit canonical",
+			groups: []AliasGroup{{Canonical: "alice_", Members: []string{"Alice", "alice_"}}},
+			want:   []AliasGroup{{Canonical: "alice_", Members: []string{"Alice", "alice_"}}},
+			lookup: map[string]string{"alice": "alice_", "alice_": "alice_"},
+		},
+		{
+			name:   "canonical outside the members joins them",
+			groups: []AliasGroup{{Canonical: " Bob ", Members: []string{"bobby"}}},
+			want:   []AliasGroup{{Canonical: "Bob", Members: []string{"bobby", "Bob"}}},
+			lookup: map[string]string{"bob": "Bob", "BOBBY": "Bob"},
+		},
+		{
+			name:   "duplicates and blanks dropped",
+			groups: []AliasGroup{{Members: []string{" carol ", "Carol", "", "carol2", "CAROL2"}}},
+			want:   []AliasGroup{{Canonical: "carol", Members: []string{"carol", "carol2"}}},
+			lookup: map[string]string{"CAROL": "carol", "carol2": "carol"},
+		},
+		{
+			name:   "separate groups",
+			groups: []AliasGroup{{Members: []string{"alice", "alice_"}}, {Members: []string{"bob", "bob_"}}},
+			want:   []AliasGroup{{Canonical: "alice", Members: []string{"alice", "alice_"}}, {Canonical: "bob", Members: []string{"bob", "bob_"}}},
+			lookup: map[string]string{"alice_": "alice", "bob_": "bob"},
+		},
+		{
+			name:   "overlapping groups",
+			groups: []AliasGroup{{Members: []string{"alice", "alice_"}}, {Members: []string{"bob", "Alice_"}}},
+			err:    "group 1: Alice_ already belongs to the group of alice",
+		},
+		{
+			name:   "overlap through a canonical name",
+			groups: []AliasGroup{{Members: []string{"alice", "alice_"}}, {Canonical: "ALICE", Members: []string{"bob"}}},
+			err:    "group 1: ALICE already belongs to the group of alice",
+		},
+		{
+			name:   "overlap once normalized",
+			groups: []AliasGroup{{Members: []string{"alice", "bob"}}, {Members: []string{"carol", "al\u200bice"}}},
+			err:    "already belongs to the group of alice",
+		},
+		{
+			name:   "single member",
+			groups: []AliasGroup{{Members: []string{"alice", "ALICE"}}},
+			err:    "group 0: needs at least two usernames",
+		},
+		{
+			name:   "canonical alone",
+			groups: []AliasGroup{{Canonical: "alice", Members: []string{" "}}},
+			err:    "group 0: needs at least two usernames",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, canonical, err := indexAliasGroups(tt.groups)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("indexing: %v", err)
+			}
+			if !reflect.DeepEqual(groups, tt.want) {
+				t.Errorf("groups = %+v, want %+v", groups, tt.want)
+			}
+			for name, want := range tt.lookup {
+				if got := canonical[normalizeUsername(name)]; got != want {
+					t.Errorf("canonical name of %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
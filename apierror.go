@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API error codes, stable for clients to branch on unlike the messages
+const (
+	codeInvalidArgument = "invalid_argument"
+	codeUnauthorized    = "unauthorized"
+	codeForbidden       = "forbidden"
+	codeNotFound        = "not_found"
+	codeConflict        = "conflict"
+	codeRateLimited     = "rate_limited"
+	codeUnavailable     = "unavailable"
+	codeInternal        = "internal"
+)
+
+// requestIDHeader carries the request ID, taken from the request when a
+// proxy set one and echoed in the response
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the gin context key of the request ID
+const requestIDKey = "request_id"
+
+// requestIDPattern matches request IDs accepted from clients and proxies
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// APIError is an error with the status and code of its API response
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// Error returns the message of the error
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// newAPIError returns an error responded to with status and its code
+func newAPIError(status int, message string) *APIError {
+	return &APIError{Status: status, Code: statusCode(status), Message: message}
+}
+
+// APIErrorResponse is the body of every API error response
+type APIErrorResponse struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// statusCode returns the error code of an HTTP status
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return codeInvalidArgument
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	return codeInternal
+}
+
+// classifyError returns the API error for err: an APIError as is, the
+// common sentinel errors with their status, and anything else as internal
+func classifyError(err error) *APIError {
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, errLiveLogFile), errors.Is(err, errDryRun):
+		return newAPIError(http.StatusConflict, err.Error())
+	case errors.Is(err, errInvalidLogFilename):
+		return newAPIError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, os.ErrNotExist):
+		return newAPIError(http.StatusNotFound, "not found")
+	}
+	return newAPIError(http.StatusInternalServerError, "internal error")
+}
+
+// requestID returns the ID of the request, empty outside the API middleware
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// apiError responds with status, its error code and message, and stops
+// the handler chain
+func apiError(c *gin.Context, status int, message string) {
+	writeAPIError(c, newAPIError(status, message), nil)
+}
+
+// respondError responds to a failed operation by classifying err. Internal
+// errors are logged with the request ID rather than shown to the client.
+func respondError(c *gin.Context, err error) {
+	writeAPIError(c, loggedError(c, err), nil)
+}
+
+// loggedError classifies err, logging it when it is internal
+func loggedError(c *gin.Context, err error) *APIError {
+	apiErr := classifyError(err)
+	if apiErr.Code == codeInternal {
+		logf(c, "Error in %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+	}
+	return apiErr
+}
+
+// writeAPIError writes the error response, with any extra fields a client
+// may use to recover, and stops the handler chain
+func writeAPIError(c *gin.Context, apiErr *APIError, extra gin.H) {
+	if len(extra) == 0 {
+		c.AbortWithStatusJSON(apiErr.Status, APIErrorResponse{Error: apiErr.Message, Code: apiErr.Code, RequestID: requestID(c)})
+		return
+	}
+	body := gin.H{"error": apiErr.Message, "code": apiErr.Code}
+	if id := requestID(c); id != "" {
+		body["request_id"] = id
+	}
+	for key, value := range extra {
+		body[key] = value
+	}
+	c.AbortWithStatusJSON(apiErr.Status, body)
+}
+
+// apiMiddleware assigns every request an ID, echoed in X-Request-ID,
+// recorded in the access log and carried by the request context for logf,
+// and responds to errors handlers added with c.Error without writing a
+// response
+func apiMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newErrorID()
+		}
+		c.Set(requestIDKey, id)
+		c.Request = c.Request.WithContext(withLogID(c.Request.Context(), id))
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+
+		if len(c.Errors) > 0 && !c.Writer.Written() {
+			respondError(c, c.Errors.Last().Err)
+		}
+	}
+}
+
+// apiNotFound responds to unknown API routes with a not_found error, and
+// to other unknown paths with the usual page
+func apiNotFound(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		apiError(c, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+	c.String(http.StatusNotFound, "404 page not found")
+}
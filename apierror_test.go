@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIErrorShape(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminToken = "secret"
+	_, router := newTestServer(t, cfg)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		requestID string
+		status    int
+		code      string
+	}{
+		{"unknown endpoint", http.MethodGet, "/api/v1/nope", "", http.StatusNotFound, codeNotFound},
+		{"invalid log filename", http.MethodGet, "/api/v1/logs/passwd", "", http.StatusBadRequest, codeInvalidArgument},
+		{"missing log file", http.MethodGet, "/api/v1/logs/chat-2001-01-01.log", "", http.StatusNotFound, codeNotFound},
+		{"invalid page limit", http.MethodGet, "/api/v2/messages?limit=0", "", http.StatusBadRequest, codeInvalidArgument},
+		{"invalid tail window", http.MethodGet, "/api/v1/tail?since=yesterday", "", http.StatusBadRequest, codeInvalidArgument},
+		{"admin without a token", http.MethodGet, "/api/v1/admin/clients", "", http.StatusUnauthorized, codeUnauthorized},
+		{"proxy request ID", http.MethodGet, "/api/v1/nope", "proxy-42", http.StatusNotFound, codeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.requestID != "" {
+				req.Header.Set(requestIDHeader, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var body APIErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding the error response %q: %v", w.Body, err)
+			}
+			if body.Code != tt.code {
+				t.Errorf("code = %q, want %q", body.Code, tt.code)
+			}
+			if body.Error == "" {
+				t.Error("no error message")
+			}
+			header := w.Header().Get(requestIDHeader)
+			if header == "" || body.RequestID != header {
+				t.Errorf("request_id = %q, want the %s header %q", body.RequestID, requestIDHeader, header)
+			}
+			if tt.requestID != "" && header != tt.requestID {
+				t.Errorf("%s = %q, want the proxy's %q", requestIDHeader, header, tt.requestID)
+			}
+		})
+	}
+}
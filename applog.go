@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Application log rotation limits
+const (
+	appLogFileName = "app.log"
+	maxAppLogSize  = 10 * 1024 * 1024 // 10 MB
+	maxAppLogFiles = 5
+)
+
+// rotatingWriter is an io.Writer over a file that is rotated by size to
+// numbered backups (app.log.1 is the newest). The file is swapped under a
+// lock, so writers such as a MultiWriter holding it keep working.
+type rotatingWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+}
+
+// newRotatingWriter opens path for appending, rotating once it exceeds
+// maxSize and keeping at most maxFiles files including the live one
+func newRotatingWriter(path string, maxSize int64, maxFiles int) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the live file; the caller must hold mutex unless w is new
+func (w *rotatingWriter) open() error {
+	file, err := openFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write writes p to the live file, rotating first if p would push it past maxSize
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return 0, fmt.Errorf("log file is closed")
+	}
+
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			// Keep logging to the old file rather than losing lines
+			fmt.Fprintf(os.Stderr, "Error rotating %s: %v\n", w.path, err)
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	logUsage.Add(filepath.Base(w.path), int64(n))
+	return n, err
+}
+
+// rotate shifts the backups up by one, dropping the oldest, and reopens the
+// live file; the caller must hold mutex
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	if w.maxFiles > 1 {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles-1))
+		for i := w.maxFiles - 2; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			w.open()
+			return err
+		}
+	} else if err := os.Truncate(w.path, 0); err != nil {
+		w.open()
+		return err
+	}
+
+	// The backups were all renamed, so their sizes are re-read
+	names := make([]string, 0, w.maxFiles)
+	names = append(names, filepath.Base(w.path))
+	for i := 1; i < w.maxFiles; i++ {
+		names = append(names, fmt.Sprintf("%s.%d", filepath.Base(w.path), i))
+	}
+	defer logUsage.Refresh(names...)
+
+	return w.open()
+}
+
+// Close flushes and closes the live file; later writes fail
+func (w *rotatingWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditFileName is the append-only record of admin actions in the logs
+// directory; it is not a log kind, so retention and the size cap skip it
+const auditFileName = "audit.log"
+
+// Audit log paging
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// Context keys set by auditLog
+const (
+	auditActionKey = "audit_action"
+	auditDetailKey = "audit_detail"
+)
+
+// auditAuthFailed is the action recorded for a request with a wrong token,
+// or one without the admin scope
+const auditAuthFailed = "auth_failed"
+
+// AuditEntry records an admin request
+type AuditEntry struct {
+	Time   time.Time         `json:"time"`
+	Token  string            `json:"token,omitempty"`
+	IP     string            `json:"ip"`
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+	Status int               `json:"status"`
+	Detail string            `json:"detail,omitempty"`
+}
+
+// AuditPage is a page of the audit log, newest first
+type AuditPage struct {
+	Total   int          `json:"total"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+// AuditTrail appends admin actions to audit.log
+type AuditTrail struct {
+	mutex sync.Mutex
+}
+
+// auditTrail is the application-wide audit log
+var auditTrail = &AuditTrail{}
+
+// auditPath returns where admin actions are recorded
+func auditPath() string {
+	return filepath.Join(logsDir, auditFileName)
+}
+
+// Record appends an entry to the audit log
+func (a *AuditTrail) Record(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	file, err := openFile(auditPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// Entries returns limit entries of the audit log after skipping offset,
+// newest first, and the total number of entries
+func (a *AuditTrail) Entries(offset, limit int) (AuditPage, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	page := AuditPage{Entries: make([]AuditEntry, 0)}
+	file, err := os.Open(auditPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return page, nil
+	}
+	if err != nil {
+		return page, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return page, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	page.Total = len(entries)
+	for i := len(entries) - 1 - offset; i >= 0 && len(page.Entries) < limit; i-- {
+		page.Entries = append(page.Entries, entries[i])
+	}
+	return page, nil
+}
+
+// recordAudit writes the audit entry of a finished admin request; status
+// is taken from the response
+func recordAudit(c *gin.Context) {
+	action := c.GetString(auditActionKey)
+	if action == "" {
+		action = c.Request.Method + " " + c.FullPath()
+	}
+	entry := auditEntry(c, action, c.Writer.Status())
+	entry.Detail = c.GetString(auditDetailKey)
+	if err := auditTrail.Record(entry); err != nil {
+		captureError("audit", err)
+	}
+}
+
+// recordAuthFailure writes the audit entry of a request refused with status
+func recordAuthFailure(c *gin.Context, status int) {
+	if err := auditTrail.Record(auditEntry(c, auditAuthFailed, status)); err != nil {
+		captureError("audit", err)
+	}
+}
+
+// auditEntry describes a request for the audit log. Request bodies are left
+// out, since they can hold passwords, and so is a token query parameter.
+func auditEntry(c *gin.Context, action string, status int) AuditEntry {
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Token:  tokenName(c),
+		IP:     c.ClientIP(),
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Action: action,
+		Status: status,
+	}
+	params := make(map[string]string)
+	for _, param := range c.Params {
+		params[param.Key] = param.Value
+	}
+	for key, values := range c.Request.URL.Query() {
+		if key != "token" {
+			params[key] = values[0]
+		}
+	}
+	if len(params) > 0 {
+		entry.Params = params
+	}
+	return entry
+}
+
+// isMutatingRequest reports whether a request can change state, so that an
+// admin request is audited even without an auditLog call
+func isMutatingRequest(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// registerAuditRoutes registers the admin endpoint reading the audit log
+func registerAuditRoutes(admin *gin.RouterGroup) {
+	admin.GET("/audit", func(c *gin.Context) {
+		offset, err := queryNonNegative(c, "offset", 0)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit, err := queryNonNegative(c, "limit", defaultAuditLimit)
+		if err != nil || limit == 0 || limit > maxAuditLimit {
+			apiError(c, http.StatusBadRequest, fmt.Sprintf("invalid limit parameter: must be between 1 and %d", maxAuditLimit))
+			return
+		}
+
+		page, err := auditTrail.Entries(int(offset), int(limit))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, page)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultBroadcastQueueSize is how many messages wait for the hub before
+// the oldest are dropped
+const defaultBroadcastQueueSize = 1024
+
+// broadcastDropped counts messages dropped from a full broadcast queue
+var broadcastDropped = metrics.Counter("cylog_broadcast_dropped_total", "Messages dropped from the broadcast queue because the hub fell behind")
+
+// broadcastQueue holds messages for the hub. Pushing never blocks, so a slow
+// hub can't stall the Cytube reader: when the queue is full the oldest
+// message that isn't chat is dropped, or else the oldest chat message.
+// Messages are queued for logging separately, so dropping only affects
+// live clients.
+type broadcastQueue struct {
+	messages []Message
+	size     int
+	dropped  int
+	closed   bool
+	mutex    sync.Mutex
+
+	// ready is signaled when messages are waiting
+	ready chan struct{}
+}
+
+// newBroadcastQueue creates a queue holding up to size messages
+func newBroadcastQueue(size int) *broadcastQueue {
+	if size <= 0 {
+		size = defaultBroadcastQueueSize
+	}
+	return &broadcastQueue{
+		messages: make([]Message, 0, size),
+		size:     size,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// isChatMessage reports whether a message is chat said by a user, which is
+// kept over other messages when load is shed
+func isChatMessage(msg Message) bool {
+	kind := msg.Kind()
+	return kind == messageTypeChat || kind == messageTypeAction
+}
+
+// Push queues a message, dropping one first if the queue is full
+func (q *broadcastQueue) Push(msg Message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	if len(q.messages) >= q.size {
+		drop := 0
+		for i, queued := range q.messages {
+			if !isChatMessage(queued) {
+				drop = i
+				break
+			}
+		}
+		q.messages = append(q.messages[:drop], q.messages[drop+1:]...)
+		q.dropped++
+		broadcastDropped.Inc()
+	}
+	q.messages = append(q.messages, msg)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pop returns the oldest queued message. When that empties a queue that
+// dropped messages, it also returns how many, once.
+func (q *broadcastQueue) Pop() (Message, bool, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.messages) == 0 {
+		return Message{}, false, 0
+	}
+	msg := q.messages[0]
+	q.messages[0] = Message{}
+	q.messages = q.messages[1:]
+
+	dropped := 0
+	if len(q.messages) == 0 {
+		dropped, q.dropped = q.dropped, 0
+	} else {
+		select {
+		case q.ready <- struct{}{}:
+		default:
+		}
+	}
+	return msg, true, dropped
+}
+
+// Close stops accepting messages and returns those still queued
+func (q *broadcastQueue) Close() []Message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	messages := q.messages
+	q.messages = nil
+	return messages
+}
+
+// Len returns the number of queued messages
+func (q *broadcastQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.messages)
+}
+
+// deliverQueued delivers the next queued message; once a backlog that
+// dropped messages has cleared, clients are told how many they missed
+func (s *ChatServer) deliverQueued() {
+	message, ok, dropped := s.backlog.Pop()
+	if !ok {
+		return
+	}
+	s.deliverMessage(message)
+	if dropped == 0 {
+		return
+	}
+
+	log.Printf("Broadcast backlog cleared after dropping %d messages", dropped)
+	now := time.Now()
+	content := fmt.Sprintf("Message backlog dropped %d messages", dropped)
+	s.deliverMessage(Message{
+		ID:        fmt.Sprintf("%d", now.UnixNano()),
+		Seq:       atomic.AddUint64(&s.seq, 1),
+		Type:      messageTypeSystem,
+		Username:  "System",
+		Timestamp: now,
+		Content:   content,
+		HTML:      html.EscapeString(content),
+		Meta:      map[string]interface{}{"event": "backlog_dropped", "dropped": dropped},
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBroadcastQueueUnderStalledHub(t *testing.T) {
+	const (
+		size = 1024
+		rate = 10000 // messages per second
+	)
+	chatServer, _ := newTestServer(t, defaultConfig())
+	chatServer.backlog = newBroadcastQueue(size)
+
+	// A second of upstream traffic, every tenth message a userlist update,
+	// with nothing taking messages off the queue
+	var slowest time.Duration
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for n := 0; n < rate; {
+		<-ticker.C
+		for end := n + rate/1000; n < end; n++ {
+			msg := Message{ID: fmt.Sprint(n), Type: messageTypeChat, Username: "alice", Content: fmt.Sprint(n)}
+			if n%10 == 0 {
+				msg.Type = messageTypeUserlist
+			}
+			start := time.Now()
+			chatServer.broadcastMessage(msg)
+			slowest = max(slowest, time.Since(start))
+		}
+	}
+
+	if slowest > 50*time.Millisecond {
+		t.Errorf("queuing a message took up to %s with the hub stalled", slowest)
+	}
+	if n := chatServer.backlog.Len(); n != size {
+		t.Errorf("%d messages queued, want the %d that fit", n, size)
+	}
+	if c := cap(chatServer.backlog.messages); c > size {
+		t.Errorf("queue grew to a capacity of %d, want at most %d", c, size)
+	}
+
+	// The newest chat is what's left, and the hub hears what it missed once
+	var want []string
+	for n := rate - 1; len(want) < size; n-- {
+		if n%10 != 0 {
+			want = append([]string{fmt.Sprint(n)}, want...)
+		}
+	}
+	var dropped int
+	for i := 0; ; i++ {
+		msg, ok, d := chatServer.backlog.Pop()
+		if !ok {
+			break
+		}
+		if msg.Type != messageTypeChat {
+			t.Fatalf("message %s of type %s kept over chat", msg.ID, msg.Type)
+		}
+		if msg.Content != want[i] {
+			t.Fatalf("message %d is %s, want %s", i, msg.Content, want[i])
+		}
+		dropped += d
+	}
+	if dropped != rate-size {
+		t.Errorf("reported %d dropped messages, want %d", dropped, rate-size)
+	}
+}
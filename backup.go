@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// backupManifestName is the first entry of a backup archive, describing it
+const backupManifestName = "cylog-backup.json"
+
+// backupVersion is the archive layout version written to the manifest
+const backupVersion = 1
+
+// backupRunning is set while a backup streams, limiting them to one at a
+// time since each reads the whole logs directory
+var backupRunning atomic.Bool
+
+// backupManifest describes a backup archive
+type backupManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     int       `json:"files"`
+}
+
+// backupExcluded are the files of the logs directory left out of backups:
+// the state file is replaced by a snapshot of the running server, and the
+// others are secrets, the session signing key and the channel password
+var backupExcluded = map[string]bool{
+	stateFileName:      true,
+	sessionKeyFileName: true,
+	channelFileName:    true,
+}
+
+// backupFile is a file of the logs directory as it was when a backup began
+type backupFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// backupFiles lists the files of the logs directory with their sizes.
+// Lines are written under the logger lock, so holding it makes the sizes
+// end on whole lines; a backup copies only that much of each file.
+func (l *Logger) backupFiles() ([]backupFile, error) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	files := make([]backupFile, 0)
+	err := filepath.WalkDir(l.dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(l.dir, filePath)
+		if err != nil {
+			return err
+		}
+		// Previews are a cache, fetched again when missing
+		if entry.IsDir() && name == previewsDirName {
+			return filepath.SkipDir
+		}
+		if !entry.Type().IsRegular() || strings.HasSuffix(name, ".tmp") || backupExcluded[name] {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, backupFile{name: filepath.ToSlash(name), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list logs directory: %w", err)
+	}
+	return files, nil
+}
+
+// WriteBackup writes a tar.gz of the logs directory, including digests,
+// aliases, presence and the recent message buffer, to w, returning the
+// number of files
+func (s *ChatServer) WriteBackup(w io.Writer) (int, error) {
+	// Write out what is only kept in memory
+	if err := s.presence.Flush(); err != nil {
+		return 0, err
+	}
+	if err := s.ingest.Flush(); err != nil {
+		return 0, err
+	}
+	if err := s.logger.meta.Save(); err != nil {
+		return 0, err
+	}
+	state, err := s.encodeState()
+	if err != nil {
+		return 0, err
+	}
+	files, err := s.logger.backupFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	manifest, err := json.Marshal(backupManifest{Version: backupVersion, CreatedAt: now, Files: len(files) + 1})
+	if err != nil {
+		return 0, err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	if err := writeBackupEntry(archive, backupManifestName, manifest, now); err != nil {
+		return 0, err
+	}
+	if err := writeBackupEntry(archive, path.Join(logsDir, stateFileName), state, now); err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		if err := s.logger.writeBackupFile(archive, file); err != nil {
+			return 0, fmt.Errorf("failed to back up %s: %w", file.name, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	return len(files) + 1, nil
+}
+
+// writeBackupEntry adds a file with the given content to a backup archive
+func writeBackupEntry(archive *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(data)
+	return err
+}
+
+// writeBackupFile adds a file of the logs directory to a backup archive,
+// copying as much of it as there was when the backup began
+func (l *Logger) writeBackupFile(archive *tar.Writer, file backupFile) error {
+	source, err := os.Open(filepath.Join(l.dir, filepath.FromSlash(file.name)))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	header := &tar.Header{Name: path.Join(logsDir, file.name), Mode: 0644, Size: file.size, ModTime: file.modTime, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.CopyN(archive, source, file.size)
+	return err
+}
+
+// runRestoreCommand implements "cylog restore <archive> [--force]", which
+// unpacks a backup into the logs directory. It refuses to replace a logs
+// directory that has files unless --force is given.
+func runRestoreCommand(args []string) int {
+	archive := ""
+	force := false
+	valid := true
+	for _, arg := range args {
+		switch {
+		case arg == "--force":
+			force = true
+		case archive == "" && !strings.HasPrefix(arg, "-"):
+			archive = arg
+		default:
+			valid = false
+		}
+	}
+	if archive == "" || !valid {
+		fmt.Fprintln(os.Stderr, "usage: cylog restore <archive> [--force]")
+		return 2
+	}
+
+	replaced, err := restoreBackup(archive, force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to restore %s: %v\n", archive, err)
+		return 1
+	}
+	if replaced != "" {
+		fmt.Printf("Moved the previous logs directory to %s\n", replaced)
+	}
+	fmt.Printf("Restored %s into %s\n", archive, logsDir)
+	return 0
+}
+
+// restoreBackup unpacks a backup archive next to the logs directory and
+// swaps it in once every entry checked out, so a bad archive leaves the
+// logs directory alone. A replaced logs directory is moved aside rather
+// than deleted; its new path is returned.
+func restoreBackup(archive string, force bool) (string, error) {
+	entries, err := os.ReadDir(logsDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if len(entries) > 0 && !force {
+		return "", fmt.Errorf("%s already has files; use --force to replace it", logsDir)
+	}
+
+	tmpDir := logsDir + ".restore"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return "", err
+	}
+	if err := extractBackup(archive, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+
+	replaced := ""
+	switch {
+	case len(entries) > 0:
+		replaced = logsDir + ".old-" + time.Now().Format("20060102-150405")
+		if err := os.Rename(logsDir, replaced); err != nil {
+			os.RemoveAll(tmpDir)
+			return "", fmt.Errorf("failed to move %s aside: %w", logsDir, err)
+		}
+	case err == nil:
+		// An empty logs directory
+		if err := os.Remove(logsDir); err != nil {
+			os.RemoveAll(tmpDir)
+			return "", err
+		}
+	}
+	if err := os.Rename(tmpDir, logsDir); err != nil {
+		return replaced, err
+	}
+	return replaced, nil
+}
+
+// extractBackup unpacks a backup archive into dir, checking the manifest
+// and that every entry is a regular file inside the logs directory
+func extractBackup(archive, dir string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("not a backup archive: %w", err)
+	}
+	reader := tar.NewReader(gz)
+
+	header, err := reader.Next()
+	if err != nil || header.Name != backupManifestName {
+		return fmt.Errorf("not a backup archive: missing %s", backupManifestName)
+	}
+	var manifest backupManifest
+	if err := json.NewDecoder(io.LimitReader(reader, 1<<20)).Decode(&manifest); err != nil {
+		return fmt.Errorf("invalid backup manifest: %w", err)
+	}
+	if manifest.Version != backupVersion {
+		return fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	count := 0
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt backup archive: %w", err)
+		}
+
+		name, ok := strings.CutPrefix(header.Name, logsDir+"/")
+		if !ok || header.Typeflag != tar.TypeReg || !filepath.IsLocal(filepath.FromSlash(name)) {
+			return fmt.Errorf("unexpected entry %q in backup archive", header.Name)
+		}
+		if err := extractBackupFile(reader, filepath.Join(dir, filepath.FromSlash(name)), header.ModTime); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+		count++
+	}
+
+	if count != manifest.Files {
+		return fmt.Errorf("backup archive is incomplete: %d of %d files", count, manifest.Files)
+	}
+	return nil
+}
+
+// extractBackupFile writes the current archive entry to path
+func extractBackupFile(reader io.Reader, path string, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupLeavesOutSecrets(t *testing.T) {
+	chatServer, _ := newTestServer(t, defaultConfig())
+	for _, name := range []string{sessionKeyFileName, channelFileName} {
+		if err := os.WriteFile(filepath.Join(logsDir, name), []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logChat(t, chatServer.logger, "hello")
+
+	var buf bytes.Buffer
+	if _, err := chatServer.WriteBackup(&buf); err != nil {
+		t.Fatalf("writing backup: %v", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(gz)
+	names := make(map[string]bool)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[header.Name] = true
+	}
+
+	for _, secret := range []string{sessionKeyFileName, channelFileName} {
+		if names[logsDir+"/"+secret] {
+			t.Errorf("backup includes %s", secret)
+		}
+	}
+	if len(names) < 3 {
+		t.Errorf("backup has %v, want the manifest, the state and the chat log", names)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Batch defaults
+const (
+	defaultMaxBatch             = 100
+	defaultReorderWindowSeconds = 10
+)
+
+// maxBatchLateness is how long before their receipt batched messages may
+// have been observed; exports read this far past the end of their range
+// for late messages logged after it
+const maxBatchLateness = 24 * time.Hour
+
+// lateTag marks log lines of batched messages that arrived too late to be
+// placed in order, so they keep their Late flag when read back
+const lateTag = "late"
+
+// Statuses of batched messages in a batched frame
+const (
+	batchAccepted  = "accepted"
+	batchDuplicate = "duplicate"
+	batchRejected  = "rejected"
+)
+
+// BatchFrame is sent by bridges to deliver messages they observed, possibly
+// out of order or some time ago, each with the time it was observed
+type BatchFrame struct {
+	Type string `json:"type"`
+
+	// Source identifies the bridge installation; a batch without one is
+	// assigned one in the acknowledgement, for the bridge to keep
+	Source string `json:"source,omitempty"`
+
+	// Bridge is the version of the bridge script, if it differs from the
+	// one declared in the hello frame; batches from bridges older than
+	// websocket.min_bridge_version are refused
+	Bridge int `json:"bridge,omitempty"`
+
+	Messages []BatchMessage `json:"messages"`
+}
+
+// BatchMessage is a message in a batch frame
+type BatchMessage struct {
+	// UUID is generated by the bridge so a message sent again, such as
+	// after the bridge slept before it saw the acknowledgement, is only
+	// ingested once; messages without one are never taken as duplicates
+	UUID string `json:"uuid,omitempty"`
+
+	Username  string    `json:"username"`
+	Content   string    `json:"content"`
+	HTML      string    `json:"html"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// BatchedFrame acknowledges a batch frame: how many of its messages were
+// accepted, how many of those were late, and how many were duplicates or
+// rejected, with the status of each message in the order they were sent
+type BatchedFrame struct {
+	Type      string        `json:"type"`
+	Source    string        `json:"source"`
+	Accepted  int           `json:"accepted"`
+	Late      int           `json:"late"`
+	Duplicate int           `json:"duplicate"`
+	Rejected  int           `json:"rejected"`
+	Items     []BatchResult `json:"items"`
+}
+
+// BatchResult is the status of a batched message: accepted, duplicate or
+// rejected with the error
+type BatchResult struct {
+	UUID   string `json:"uuid,omitempty"`
+	Status string `json:"status"`
+	Late   bool   `json:"late,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// isLateEntry reports whether a message arrived too late to be placed in order
+func isLateEntry(msg Message) bool {
+	for _, tag := range msg.Tags {
+		if tag == lateTag {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestBatch checks and ingests the messages of a batch frame in the order
+// they were observed. Invalid messages are skipped and reported in the
+// returned error alongside the acknowledgement, and messages whose UUID was
+// already received are skipped quietly; an invalid frame is rejected whole.
+func (s *ChatServer) ingestBatch(client *Client, data []byte, received time.Time) (BatchedFrame, error) {
+	var frame BatchFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return BatchedFrame{}, fmt.Errorf("invalid batch: %w", err)
+	}
+	declared := frame.Bridge
+	if declared == 0 {
+		declared = client.bridgeVersion()
+	}
+	if err := checkBridgeVersion(s.Config(), declared); err != nil {
+		return BatchedFrame{}, err
+	}
+	limits := s.Config().WebSocket
+	if len(frame.Messages) > limits.MaxBatch {
+		return BatchedFrame{}, fmt.Errorf("invalid batch: more than %d messages", limits.MaxBatch)
+	}
+	if frame.Source == "" {
+		source, err := newIngestSource()
+		if err != nil {
+			return BatchedFrame{}, fmt.Errorf("failed to assign a source: %w", err)
+		}
+		frame.Source = source
+	} else if !ingestIDPattern.MatchString(frame.Source) {
+		return BatchedFrame{}, fmt.Errorf("invalid batch: source must be 1 to 64 letters, digits, _ or -")
+	}
+
+	ack := BatchedFrame{Type: frameTypeBatched, Source: frame.Source, Items: make([]BatchResult, len(frame.Messages))}
+	var firstErr error
+	var lastUUID string
+	msgs := make([]Message, 0, len(frame.Messages))
+	for i, sent := range frame.Messages {
+		result := &ack.Items[i]
+		result.UUID = sent.UUID
+
+		msg, err := s.checkClientMessage(client, Message{Username: sent.Username, Content: sent.Content, HTML: sent.HTML})
+		if err == nil {
+			err = placeBatchedMessage(&msg, sent.Timestamp, received, limits.ReorderWindow())
+		}
+		if err == nil && sent.UUID != "" && !ingestIDPattern.MatchString(sent.UUID) {
+			err = fmt.Errorf("invalid message: uuid must be 1 to 64 letters, digits, _ or -")
+		}
+		if err != nil {
+			ack.Rejected++
+			result.Status = batchRejected
+			result.Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		// Claimed only once valid, so a corrected message can be resent
+		if sent.UUID != "" && !s.ingest.Claim(frame.Source, sent.UUID, received) {
+			ingestDuplicates.Inc()
+			ack.Duplicate++
+			result.Status = batchDuplicate
+			continue
+		}
+
+		result.Status = batchAccepted
+		result.Late = msg.Late
+		if msg.Late {
+			ack.Late++
+		}
+		if sent.UUID != "" {
+			lastUUID = sent.UUID
+		}
+		msgs = append(msgs, msg)
+	}
+
+	sortByTimestamp(msgs)
+	for _, msg := range msgs {
+		s.ingestMessage(msg)
+	}
+	ack.Accepted = len(msgs)
+	if lastUUID != "" {
+		s.ingest.Advance(frame.Source, lastUUID, received)
+	}
+
+	if firstErr != nil {
+		return ack, fmt.Errorf("%d of %d batched messages rejected: %w", ack.Rejected, len(frame.Messages), firstErr)
+	}
+	return ack, nil
+}
+
+// placeBatchedMessage sets a batched message's timestamp to when it was
+// observed. Messages observed within the reorder window are placed in order
+// among the recent messages; older ones are marked late and appended, and
+// the logs record both when they arrive. A missing or future time, as from
+// a skewed clock, is taken as the time of receipt.
+func placeBatchedMessage(msg *Message, observed, received time.Time, window time.Duration) error {
+	if observed.IsZero() || observed.After(received) {
+		msg.Timestamp = received
+		return nil
+	}
+
+	age := received.Sub(observed)
+	if age > maxBatchLateness {
+		return fmt.Errorf("invalid message: observed more than %s ago", maxBatchLateness)
+	}
+	msg.Timestamp = observed
+	if age <= window {
+		msg.reorder = true
+		return nil
+	}
+	msg.Late = true
+	msg.Tags = append(msg.Tags, lateTag)
+	return nil
+}
+
+// insertByTimestamp inserts a message into msgs, which are in timestamp
+// order at their end, after the last message that isn't newer than it.
+// Late messages sit where they arrived, so they are passed over.
+func insertByTimestamp(msgs []Message, msg Message) []Message {
+	i := len(msgs)
+	for i > 0 && (msgs[i-1].Late || msgs[i-1].Timestamp.After(msg.Timestamp)) {
+		i--
+	}
+	msgs = append(msgs, Message{})
+	copy(msgs[i+1:], msgs[i:])
+	msgs[i] = msg
+	return msgs
+}
+
+// sortByTimestamp orders messages by timestamp, keeping the order of those
+// with the same one; late batched messages are logged when they arrive,
+// after newer messages
+func sortByTimestamp(msgs []Message) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Timestamp.Before(msgs[j].Timestamp)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cylog/internal/testsupport"
+)
+
+// exportTranscript fetches the HTML transcript of yesterday and today
+func exportTranscript(t *testing.T, baseURL string) string {
+	t.Helper()
+
+	now := time.Now()
+	url := baseURL + "/api/v1/export.html?from=" + now.AddDate(0, 0, -1).Format(logDateFormat) + "&to=" + now.Format(logDateFormat)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("fetching the transcript: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestShuffledBatchesExportInOrder(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	_, baseURL := runTestServer(t.Context(), t, defaultConfig(), upstream)
+	client := testsupport.Dial(t, baseURL, "/ws")
+	client.WaitFor(e2eTimeout, frameContaining(`"type":"hello"`))
+	client.Send(map[string]interface{}{"type": "hello", "bot": true})
+
+	// Messages observed a second apart over the last two minutes, most of
+	// them too long ago to be placed among the recent ones
+	now := time.Now().Truncate(time.Second)
+	var sent []BatchMessage
+	for i := 0; i < 20; i++ {
+		sent = append(sent, BatchMessage{
+			Username:  "alice",
+			Content:   "observed " + string(rune('a'+i)),
+			Timestamp: now.Add(time.Duration(i-20) * 6 * time.Second),
+		})
+	}
+	shuffled := append([]BatchMessage(nil), sent...)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+	// Two batches, each out of order, the later half arriving first
+	for _, batch := range [][]BatchMessage{shuffled[10:], shuffled[:10]} {
+		client.Send(BatchFrame{Type: frameTypeBatch, Messages: batch})
+		frame := client.WaitFor(e2eTimeout, frameContaining(`"type":"batched"`))
+		var ack BatchedFrame
+		if err := json.Unmarshal(frame, &ack); err != nil {
+			t.Fatalf("decoding the acknowledgement: %v", err)
+		}
+		if ack.Accepted != len(batch) {
+			t.Fatalf("accepted %d of %d: %s", ack.Accepted, len(batch), frame)
+		}
+	}
+
+	var transcript string
+	testsupport.Eventually(t, e2eTimeout, "batched messages missing from the transcript", func() bool {
+		transcript = exportTranscript(t, baseURL)
+		return strings.Contains(transcript, sent[0].Content) && strings.Contains(transcript, sent[len(sent)-1].Content)
+	})
+	last := -1
+	for _, msg := range sent {
+		at := strings.Index(transcript, msg.Content)
+		if at < 0 {
+			t.Fatalf("%q missing from the transcript", msg.Content)
+		}
+		if at < last {
+			t.Errorf("%q is out of order in the transcript", msg.Content)
+		}
+		last = at
+	}
+}
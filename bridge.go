@@ -0,0 +1,136 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bridgeVersion is the version of the Tampermonkey bridge script this
+// server serves. It is bumped whenever the script changes; bridges declare
+// theirs in their hello frame, and those from before versioning count as 1.
+const bridgeVersion = 3
+
+// bridgeTokenPlaceholder stands in for the ingest token in the served
+// script when tokens are required; the user replaces it with theirs
+const bridgeTokenPlaceholder = "PASTE_INGEST_TOKEN_HERE"
+
+// Paths the bridge script is served from and the API it calls lives under
+const (
+	bridgeBasePath   = "/api/v1"
+	bridgeScriptPath = bridgeBasePath + "/tampermonkey/bridge.user.js"
+)
+
+// bridgeEndpoints are the server endpoints the bridge script relies on
+var bridgeEndpoints = []string{
+	"GET /ws",
+	"GET " + bridgeBasePath + "/ingest/cursor",
+	"GET " + bridgeBasePath + "/tampermonkey/manifest",
+}
+
+// errBridgeOutdated refuses messages from a bridge older than
+// websocket.min_bridge_version
+var errBridgeOutdated = errors.New("bridge script outdated")
+
+//go:embed templates/bridge.user.js
+var bridgeScriptSource string
+
+// bridgeScriptTemplate renders the bridge script for the server it is
+// installed from
+var bridgeScriptTemplate = template.Must(template.New("bridge").Parse(bridgeScriptSource))
+
+// bridgeScript is the data of the bridge script
+type bridgeScript struct {
+	Origin           string
+	Host             string
+	BasePath         string
+	Token            string
+	TokenPlaceholder string
+	Protocol         int
+	Version          int
+}
+
+// BridgeManifest describes the bridge script this server serves and what
+// it needs, so a bridge can tell it has drifted from the server
+type BridgeManifest struct {
+	Version int `json:"version"`
+
+	// MinVersion is the oldest bridge whose messages are accepted; zero
+	// accepts any
+	MinVersion int    `json:"min_version"`
+	Protocol   int    `json:"protocol"`
+	Script     string `json:"script"`
+
+	Endpoints []string `json:"endpoints"`
+
+	// TokenRequired is set when sending messages needs a token with
+	// TokenScope
+	TokenRequired bool   `json:"token_required"`
+	TokenScope    string `json:"token_scope"`
+}
+
+// bridgeManifest returns the manifest of the bridge script
+func bridgeManifest(cfg *Config) BridgeManifest {
+	return BridgeManifest{
+		Version:       bridgeVersion,
+		MinVersion:    cfg.WebSocket.MinBridgeVersion,
+		Protocol:      protocolVersion,
+		Script:        bridgeScriptPath,
+		Endpoints:     bridgeEndpoints,
+		TokenRequired: cfg.authRequired(),
+		TokenScope:    scopeIngest,
+	}
+}
+
+// checkBridgeVersion refuses messages from a bridge older than the
+// minimum; a client that doesn't declare a version is from version 1
+func checkBridgeVersion(cfg *Config, declared int) error {
+	if declared == 0 {
+		declared = 1
+	}
+	if min := cfg.WebSocket.MinBridgeVersion; declared < min {
+		return fmt.Errorf("%w: version %d is below the minimum %d; install version %d from %s", errBridgeOutdated, declared, min, bridgeVersion, bridgeScriptPath)
+	}
+	return nil
+}
+
+// requestOrigin returns the scheme and host a request was made to
+func requestOrigin(c *gin.Context) string {
+	scheme := "http"
+	if isHTTPS(c) {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// registerBridgeRoutes registers the bridge script, rendered for the host
+// it is installed from, and its manifest. Bridges may only have the ingest
+// scope, so the manifest is outside the read scope.
+func registerBridgeRoutes(router *gin.Engine, chatServer *ChatServer) {
+	router.GET(bridgeScriptPath, requireScope(chatServer.config, scopeRead), func(c *gin.Context) {
+		script := bridgeScript{
+			Origin:           requestOrigin(c),
+			Host:             c.Request.Host,
+			BasePath:         bridgeBasePath,
+			TokenPlaceholder: bridgeTokenPlaceholder,
+			Protocol:         protocolVersion,
+			Version:          bridgeVersion,
+		}
+		if chatServer.Config().authRequired() {
+			script.Token = bridgeTokenPlaceholder
+		}
+		c.Header("Content-Type", "application/javascript; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := bridgeScriptTemplate.Execute(c.Writer, script); err != nil {
+			logf(c, "Error rendering bridge script: %v", err)
+		}
+	})
+
+	router.GET(bridgeBasePath+"/tampermonkey/manifest", requireScope(chatServer.config, scopeRead, scopeIngest), func(c *gin.Context) {
+		c.JSON(http.StatusOK, bridgeManifest(chatServer.Config()))
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// channelFileName is the file in the logs directory recording the channels
+// joined or left through the admin API; it overrides the config file
+const channelFileName = ".channel.json"
+
+// Errors returned when joining or leaving a channel
+var (
+	errUnknownChannel = errors.New("unknown channel")
+	errShuttingDown   = errors.New("cylog is shutting down")
+)
+
+// channelRecord is the content of the channel file: the default channel,
+// where an empty name means it was left, and the channels joined besides it
+type channelRecord struct {
+	Name     string          `json:"name"`
+	Password string          `json:"password,omitempty"`
+	Extra    []channelRecord `json:"extra,omitempty"`
+}
+
+// JoinRequest is the body of a channel join request
+type JoinRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// channelNamePattern matches the channel names Cytube accepts; names end up
+// in log filenames and URLs, so nothing else is allowed
+var channelNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,30}$`)
+
+// channelScopedPaths are the data endpoints also served under
+// /api/v1/channels/:channel
+var channelScopedPaths = map[string]bool{
+	"/messages":            true,
+	"/logs":                true,
+	"/logs/:filename":      true,
+	"/logs/:filename/meta": true,
+	"/search":              true,
+	"/stats/users":         true,
+	"/stats/activity":      true,
+	"/stats/terms":         true,
+}
+
+// ChannelInfo describes a channel cylog is in
+type ChannelInfo struct {
+	Name string `json:"name"`
+
+	// Default is set on the channel the unscoped endpoints serve
+	Default  bool           `json:"default"`
+	Upstream UpstreamStatus `json:"upstream"`
+	Users    int            `json:"users"`
+}
+
+// validChannelName reports whether name is a valid Cytube channel name
+func validChannelName(name string) bool {
+	return channelNamePattern.MatchString(name)
+}
+
+// Channels returns the channels cylog is in: the default channel, which
+// the unscoped endpoints serve, then those joined besides it by name
+func (s *ChatServer) Channels() []ChannelInfo {
+	sessions := s.channelSessions()
+	channels := make([]ChannelInfo, 0, len(sessions)+1)
+	if channel := s.Config().Channel; channel != "" {
+		channels = append(channels, s.defaultChannelInfo())
+	}
+	for _, session := range sessions {
+		channels = append(channels, session.info())
+	}
+	return channels
+}
+
+// Channel returns the channel called name, or false if cylog isn't in it
+func (s *ChatServer) Channel(name string) (ChannelInfo, bool) {
+	if name != "" && name == s.Config().Channel {
+		return s.defaultChannelInfo(), true
+	}
+	s.sessionsMux.Lock()
+	session := s.sessions[name]
+	s.sessionsMux.Unlock()
+	if session == nil {
+		return ChannelInfo{}, false
+	}
+	return session.info(), true
+}
+
+// defaultChannelInfo describes the default channel
+func (s *ChatServer) defaultChannelInfo() ChannelInfo {
+	return ChannelInfo{
+		Name:     s.Config().Channel,
+		Default:  true,
+		Upstream: s.UpstreamStatus(),
+		Users:    s.userlist.Count(),
+	}
+}
+
+// requireChannel rejects requests for a channel other than the default
+// one; the data endpoints serve only its chat
+func requireChannel(chatServer *ChatServer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("channel")
+		if !validChannelName(name) {
+			apiError(c, http.StatusBadRequest, "invalid channel name")
+			return
+		}
+		if name != chatServer.Config().Channel {
+			apiError(c, http.StatusNotFound, "unknown channel")
+			return
+		}
+		c.Next()
+	}
+}
+
+// channelPath returns where the joined channel is recorded
+func channelPath() string {
+	return filepath.Join(logsDir, channelFileName)
+}
+
+// loadChannelRecord reads the channel recorded by the admin API, or nil
+// when there is none
+func loadChannelRecord() (*channelRecord, error) {
+	data, err := os.ReadFile(channelPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read channel file: %w", err)
+	}
+	// Earlier versions wrote it readable by everyone
+	if info, err := os.Stat(channelPath()); err == nil && info.Mode().Perm()&0077 != 0 && writable() {
+		if err := os.Chmod(channelPath(), 0600); err != nil {
+			log.Printf("Error restricting the channel file to its owner: %v", err)
+		}
+	}
+
+	var record channelRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse channel file: %w", err)
+	}
+	if record.Name != "" && !validChannelName(record.Name) {
+		return nil, fmt.Errorf("invalid channel %q in channel file", record.Name)
+	}
+	for _, extra := range record.Extra {
+		if !validChannelName(extra.Name) {
+			return nil, fmt.Errorf("invalid channel %q in channel file", extra.Name)
+		}
+	}
+	return &record, nil
+}
+
+// JoinChannel joins a channel, reporting false if cylog is already in it.
+// With no default channel it becomes the default one; any other channel
+// is logged over its own connection to logs/channels/<name>.
+func (s *ChatServer) JoinChannel(name, password string) (bool, error) {
+	if !validChannelName(name) {
+		return false, fmt.Errorf("invalid channel name %q", name)
+	}
+
+	s.config.reload.Lock()
+	defer s.config.reload.Unlock()
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	select {
+	case <-s.quit:
+		return false, errShuttingDown
+	default:
+	}
+
+	switch channel := s.Config().Channel; {
+	case channel == name || s.sessions[name] != nil:
+		return false, nil
+	case channel == "":
+		if err := s.setChannel(name, password); err != nil {
+			return false, err
+		}
+		log.Printf("Joining channel %s", name)
+		return true, nil
+	}
+
+	session, err := s.startChannelSession(name, password)
+	if err != nil {
+		return false, err
+	}
+	s.sessions[name] = session
+	if err := s.saveChannels(s.Config().Channel, s.Config().ChannelPassword); err != nil {
+		delete(s.sessions, name)
+		session.stop()
+		return false, err
+	}
+	log.Printf("Joining channel %s over its own connection", name)
+	return true, nil
+}
+
+// LeaveChannel leaves a channel, disconnecting and closing its log files
+func (s *ChatServer) LeaveChannel(name string) error {
+	s.config.reload.Lock()
+	defer s.config.reload.Unlock()
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	if session := s.sessions[name]; session != nil {
+		delete(s.sessions, name)
+		session.stop()
+		if err := s.saveChannels(s.Config().Channel, s.Config().ChannelPassword); err != nil {
+			return err
+		}
+		log.Printf("Left channel %s", name)
+		return nil
+	}
+
+	if name == "" || s.Config().Channel != name {
+		return errUnknownChannel
+	}
+	if err := s.setChannel("", ""); err != nil {
+		return err
+	}
+	s.userlist.Replace(nil)
+	s.publishUserlist("snapshot", nil)
+	s.writer.Flush(s.quit)
+	if _, _, err := s.logger.Rotate(); err != nil {
+		log.Printf("Error closing chat log of %s: %v", name, err)
+	}
+	log.Printf("Left channel %s", name)
+	return nil
+}
+
+// setChannel records and switches the default channel, or to none; the
+// caller must hold the config reload and sessions locks. The upstream
+// connection is dropped and joins the new channel when it reconnects.
+func (s *ChatServer) setChannel(name, password string) error {
+	if err := s.saveChannels(name, password); err != nil {
+		return err
+	}
+
+	next := *s.Config()
+	next.Channel = name
+	next.ChannelPassword = password
+	s.config.current.Store(&next)
+
+	if conn, _ := s.upstream.session(); conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+// saveChannels records the default channel and the sessions of the others;
+// the caller must hold the sessions lock
+func (s *ChatServer) saveChannels(name, password string) error {
+	record := channelRecord{Name: name, Password: password}
+	for _, session := range s.sessions {
+		record.Extra = append(record.Extra, channelRecord{Name: session.name, Password: session.password})
+	}
+	sort.Slice(record.Extra, func(i, j int) bool { return record.Extra[i].Name < record.Extra[j].Name })
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// The file holds the channel passwords
+	if err := writePrivateFileAtomic(channelPath(), data); err != nil {
+		return fmt.Errorf("failed to write channel file: %w", err)
+	}
+	return nil
+}
+
+// sendChannelPassword answers Cytube's request for the channel password
+func (s *ChatServer) sendChannelPassword() {
+	cfg := s.Config()
+	if cfg.ChannelPassword == "" {
+		log.Printf("Channel %s needs a password; set channel_password", cfg.Channel)
+		return
+	}
+	conn, _ := s.upstream.session()
+	if conn == nil {
+		return
+	}
+	if err := s.emitUpstream(conn, "channelPassword", cfg.ChannelPassword); err != nil {
+		log.Printf("Error sending channel password: %v", err)
+	}
+}
+
+// scopeOperations returns the channel-scoped copies of the operations on
+// channelScopedPaths
+func scopeOperations(ops []apiOperation) []apiOperation {
+	scoped := make([]apiOperation, 0, len(channelScopedPaths))
+	for _, op := range ops {
+		if (op.Method != http.MethodGet && op.Method != http.MethodHead) || !channelScopedPaths[op.Path] {
+			continue
+		}
+		op.Path = "/channels/:channel" + op.Path
+		op.Params = append([]apiParam{pathParam("channel", "Channel name")}, op.Params...)
+		scoped = append(scoped, op)
+	}
+	return scoped
+}
+
+// registerChannelRoutes registers the channel list and the channel-scoped
+// data endpoints
+func registerChannelRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/channels", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.Channels())
+	})
+
+	scoped := api.Group("/channels/:channel", requireChannel(chatServer))
+	registerMessageRoutes(scoped, chatServer)
+	registerLogRoutes(scoped, chatServer)
+	registerSearchRoutes(scoped, chatServer)
+	registerStatsRoutes(scoped, chatServer)
+	registerTermRoutes(scoped, chatServer)
+}
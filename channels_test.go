@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"cylog/internal/testsupport"
+)
+
+func TestChannelFileIsPrivate(t *testing.T) {
+	chatServer, _ := newTestServer(t, defaultConfig())
+
+	if _, err := chatServer.JoinChannel("secretroom", "hunter2"); err != nil {
+		t.Fatalf("joining: %v", err)
+	}
+	info, err := os.Stat(channelPath())
+	if err != nil {
+		t.Fatalf("channel file not written: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("channel file mode = %o, want 600", perm)
+	}
+
+	files, err := chatServer.logger.backupFiles()
+	if err != nil {
+		t.Fatalf("listing backup files: %v", err)
+	}
+	for _, file := range files {
+		if file.name == channelFileName {
+			t.Errorf("backups include %s", channelFileName)
+		}
+	}
+}
+
+func TestChannelFileOfEarlierVersionsMadePrivate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir(logsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(channelPath(), []byte(`{"name":"room","password":"hunter2"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := loadChannelRecord()
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if record.Password != "hunter2" {
+		t.Errorf("password = %q, want hunter2", record.Password)
+	}
+	info, err := os.Stat(channelPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("channel file mode = %o, want 600", perm)
+	}
+}
+
+func TestLeaveChannelReleasesResources(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	chatServer, _ := runTestServer(t.Context(), t, defaultConfig(), upstream)
+	upstream.WaitConnected(e2eTimeout)
+	upstream.WaitEvent("joinChannel", e2eTimeout)
+	baseline := runtime.NumGoroutine()
+
+	connected := func() bool { return chatServer.UpstreamStatus().Connected }
+	for i := 0; i < 10; i++ {
+		// Leaving drops the connection, which comes back without joining
+		if err := chatServer.LeaveChannel("test"); err != nil {
+			t.Fatalf("leaving: %v", err)
+		}
+		upstream.WaitConnected(e2eTimeout)
+		testsupport.Eventually(t, e2eTimeout, "not reconnected after leaving", connected)
+
+		if _, err := chatServer.JoinChannel("test", ""); err != nil {
+			t.Fatalf("joining: %v", err)
+		}
+		upstream.WaitConnected(e2eTimeout)
+		upstream.WaitEvent("joinChannel", e2eTimeout)
+	}
+
+	waitGoroutines(t, baseline)
+}
+
+func TestJoinAdditionalChannel(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	chatServer, _ := runTestServer(t.Context(), t, defaultConfig(), upstream)
+	upstream.WaitConnected(e2eTimeout)
+	upstream.WaitEvent("joinChannel", e2eTimeout)
+	baseline := runtime.NumGoroutine()
+
+	extra := func() []channelRecord {
+		record, err := loadChannelRecord()
+		if err != nil || record == nil {
+			t.Fatalf("loading the channel file: %v", err)
+		}
+		return record.Extra
+	}
+	for i := 0; i < 5; i++ {
+		joined, err := chatServer.JoinChannel("other", "hunter2")
+		if err != nil || !joined {
+			t.Fatalf("joining: joined %v, %v", joined, err)
+		}
+		upstream.WaitConnected(e2eTimeout)
+		var channel struct{ Name string }
+		if err := json.Unmarshal(upstream.WaitEvent("joinChannel", e2eTimeout).Data, &channel); err != nil || channel.Name != "other" {
+			t.Fatalf("joined %q over the new connection, want other", channel.Name)
+		}
+		if joined, err := chatServer.JoinChannel("other", ""); err != nil || joined {
+			t.Errorf("joining again: joined %v, %v", joined, err)
+		}
+		if info, ok := chatServer.Channel("other"); !ok || info.Default {
+			t.Errorf("channel info = %+v, %v", info, ok)
+		}
+		if got := extra(); len(got) != 1 || got[0].Name != "other" || got[0].Password != "hunter2" {
+			t.Errorf("recorded channels = %+v", got)
+		}
+
+		// Its chat goes to its own logs; the default channel keeps its own
+		content := fmt.Sprintf("hello %d", i)
+		upstream.ChatMsg("alice", content)
+		testsupport.Eventually(t, e2eTimeout, "message not logged for the channel", func() bool {
+			files, _ := filepath.Glob(filepath.Join(channelLogDir("other"), "chat-*.log"))
+			for _, file := range files {
+				if data, err := os.ReadFile(file); err == nil && strings.Contains(string(data), content) {
+					return true
+				}
+			}
+			return false
+		})
+
+		if err := chatServer.LeaveChannel("other"); err != nil {
+			t.Fatalf("leaving: %v", err)
+		}
+		if _, ok := chatServer.Channel("other"); ok {
+			t.Error("still in the channel after leaving")
+		}
+		if got := extra(); len(got) != 0 {
+			t.Errorf("recorded channels after leaving = %+v", got)
+		}
+	}
+	if channels := chatServer.Channels(); len(channels) != 1 || channels[0].Name != "test" {
+		t.Errorf("channels = %+v, want only the default", channels)
+	}
+
+	waitGoroutines(t, baseline)
+}
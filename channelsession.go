@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cylog/internal/clock"
+
+	"github.com/gorilla/websocket"
+)
+
+// channelsDirName is the subdirectory of the logs directory holding the
+// logs of the channels joined besides the default one, one directory each
+const channelsDirName = "channels"
+
+// channelSession logs a channel joined besides the default one over its
+// own Cytube connection. Its chat is written to its own logs only: it is
+// not broadcast, and the data endpoints serve the default channel.
+type channelSession struct {
+	server   *ChatServer
+	name     string
+	password string
+	logger   *Logger
+	upstream upstreamState
+	seq      uint64
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// channelLogDir returns where the logs of an additional channel are kept
+func channelLogDir(name string) string {
+	return filepath.Join(logsDir, channelsDirName, name)
+}
+
+// startChannelSession opens the logs of a channel and starts connecting
+// to it; stop releases both
+func (s *ChatServer) startChannelSession(name, password string) (*channelSession, error) {
+	logger, err := NewLoggerIn(channelLogDir(name), clock.System())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the logs of %s: %w", name, err)
+	}
+	if err := configureLogger(logger, s.Config()); err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &channelSession{
+		server:   s,
+		name:     name,
+		password: password,
+		logger:   logger,
+		seq:      logger.LastSeq(),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go logger.runRotation(ctx)
+	go session.run(ctx)
+	return session, nil
+}
+
+// stop disconnects the session and flushes and closes its logs
+func (c *channelSession) stop() {
+	c.cancel()
+	<-c.done
+	if err := c.logger.Close(); err != nil {
+		log.Printf("Error closing the logs of %s: %v", c.name, err)
+	}
+}
+
+// info describes the session for the channel list
+func (c *channelSession) info() ChannelInfo {
+	return ChannelInfo{
+		Name:     c.name,
+		Upstream: c.upstream.status(c.server.Config().Upstream),
+	}
+}
+
+// run maintains the session's connection, reconnecting after a delay
+// until ctx is canceled
+func (c *channelSession) run(ctx context.Context) {
+	defer close(c.done)
+	defer recoverPanic("channel " + c.name)
+
+	for {
+		conn, url, err := c.server.dialCandidates(ctx, c.upstream.candidates(c.server.Config().Upstream))
+		if err != nil {
+			log.Printf("Failed to connect to Cytube for %s: %v", c.name, err)
+			c.upstream.setDisconnected(err)
+		} else {
+			log.Printf("Connected to Cytube at %s for %s", url, c.name)
+			c.upstream.setConnected(url, conn)
+			c.upstream.setDisconnected(c.read(ctx, conn))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.server.retryDelay):
+		}
+	}
+}
+
+// read handles frames from the connection until it fails or ctx is
+// canceled, returning the read error
+func (c *channelSession) read(ctx context.Context, conn *websocket.Conn) error {
+	defer conn.Close()
+
+	readDone := make(chan struct{})
+	defer close(readDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-readDone:
+		}
+	}()
+	go c.ping(conn, readDone)
+
+	for {
+		stallTimeout := c.server.Config().Upstream.StallTimeout()
+		conn.SetReadDeadline(time.Now().Add(stallTimeout))
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = fmt.Errorf("upstream stalled: no frames for %s", stallTimeout)
+			}
+			log.Printf("Error reading from Cytube for %s: %v", c.name, err)
+			return err
+		}
+
+		c.upstream.frameReceived(time.Now())
+		c.handleFrame(conn, data)
+	}
+}
+
+// handleFrame answers pings, joins the channel once connected and logs
+// its chat
+func (c *channelSession) handleFrame(conn *websocket.Conn, data []byte) {
+	defer recoverPanic("channel " + c.name + " frame handler")
+
+	frame := string(data)
+	switch {
+	case frame == engineIOPing:
+		if err := c.write(conn, []byte(engineIOPong)); err != nil {
+			log.Printf("Error sending pong to Cytube for %s: %v", c.name, err)
+		}
+		return
+	case frame == socketIOConnect:
+		if err := c.emit(conn, "joinChannel", map[string]string{"name": c.name}); err != nil {
+			log.Printf("Error joining channel %s: %v", c.name, err)
+		}
+		return
+	case !strings.HasPrefix(frame, socketIOEventPrefix):
+		return
+	}
+
+	event, ok := parseCytubeEvent(data)
+	if !ok {
+		return
+	}
+	switch event.Name {
+	case "chatMsg":
+		var payload cytubeChatMsg
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			log.Printf("Error decoding chatMsg in %s: %v", c.name, err)
+			return
+		}
+		rank, meta := payloadSenderState(payload)
+		c.logMessage(newChatMessage(payload, time.Now(), rank, meta))
+
+	case "needPassword":
+		if c.password == "" {
+			log.Printf("Channel %s needs a password; join it again with one", c.name)
+			return
+		}
+		if err := c.emit(conn, "channelPassword", c.password); err != nil {
+			log.Printf("Error sending the password of %s: %v", c.name, err)
+		}
+	}
+}
+
+// logMessage runs a message through the content filters and limits of
+// the default channel and writes it to the session's logs
+func (c *channelSession) logMessage(msg Message) {
+	cfg := c.server.Config()
+	msg = normalizeMessage(msg, cfg)
+	msg, keep := c.server.filters.Apply(msg)
+	if !keep {
+		return
+	}
+	msg = cfg.MessageLimits.Apply(msg)
+	msg.HTML = sanitizeHTML(msg.HTML)
+	msg.Links = extractLinks(msg.Content)
+	msg.Color = cfg.UsernameColor(msg.Username)
+	msg.Seq = atomic.AddUint64(&c.seq, 1)
+
+	if err := c.logger.LogMessages([]Message{msg}); err != nil {
+		log.Printf("Error logging message in %s: %v", c.name, err)
+	}
+}
+
+// write sends a text frame to the session's connection
+func (c *channelSession) write(conn *websocket.Conn, data []byte) error {
+	c.upstream.writeMutex.Lock()
+	defer c.upstream.writeMutex.Unlock()
+
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// emit sends a Socket.IO event to the session's connection
+func (c *channelSession) emit(conn *websocket.Conn, name string, data interface{}) error {
+	frame, err := socketIOEvent(name, data)
+	if err != nil {
+		return err
+	}
+	return c.write(conn, frame)
+}
+
+// ping sends Socket.IO pings at the configured interval until done is closed
+func (c *channelSession) ping(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(c.server.Config().Upstream.PingInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.write(conn, []byte(engineIOPing)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// channelSessions returns the sessions of the additional channels, by name
+func (s *ChatServer) channelSessions() []*channelSession {
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	sessions := make([]*channelSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].name < sessions[j].name })
+	return sessions
+}
+
+// resumeChannels rejoins the additional channels recorded by the admin API
+func (s *ChatServer) resumeChannels() {
+	record, err := loadChannelRecord()
+	if err != nil {
+		log.Printf("Error loading the joined channels: %v", err)
+		return
+	}
+	if record == nil {
+		return
+	}
+
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	for _, extra := range record.Extra {
+		if s.sessions[extra.Name] != nil {
+			continue
+		}
+		session, err := s.startChannelSession(extra.Name, extra.Password)
+		if err != nil {
+			log.Printf("Error rejoining channel %s: %v", extra.Name, err)
+			continue
+		}
+		s.sessions[extra.Name] = session
+		log.Printf("Rejoining channel %s", extra.Name)
+	}
+}
+
+// stopChannelSessions stops every additional channel on shutdown; they
+// stay recorded, so they are rejoined on the next start
+func (s *ChatServer) stopChannelSessions() {
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	for name, session := range s.sessions {
+		session.stop()
+		delete(s.sessions, name)
+	}
+}
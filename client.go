@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// clientSendQueueSize is the number of frames buffered for a client before
+// it is considered too slow and disconnected
+const clientSendQueueSize = 256
+
+// clientWriteTimeout is the deadline for writing a single frame to a client
+const clientWriteTimeout = 10 * time.Second
+
+// Client protocol metrics
+var (
+	clientViolations    = metrics.Counter("cylog_client_violations_total", "Invalid frames received from WebSocket clients")
+	clientViolationKick = metrics.Counter("cylog_client_violation_disconnects_total", "WebSocket clients disconnected for repeated violations")
+)
+
+// ErrorFrame is sent to a client whose frame was rejected; Code is one of
+// the errorCode constants
+type ErrorFrame struct {
+	Type      string `json:"type"`
+	Code      string `json:"code"`
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// newErrorFrame builds an error frame
+func newErrorFrame(code string, err error) ErrorFrame {
+	return ErrorFrame{Type: frameTypeError, Code: code, Error: err.Error()}
+}
+
+// Client is a WebSocket connection from a local viewer. Its send queue is
+// owned by its fan-out shard, which closes it on unregister; writes happen
+// only in writePump.
+type Client struct {
+	id          uint64
+	conn        *websocket.Conn
+	send        chan interface{}
+	remoteAddr  string
+	connectedAt time.Time
+	violations  int
+	encoding    string
+	shard       *fanoutShard
+
+	// connID is the request ID of the WebSocket upgrade, identifying the
+	// connection in logs and error frames for its lifetime
+	connID string
+
+	// after is the seq the client resumes from; older buffered messages
+	// aren't replayed
+	after uint64
+
+	// history is how many buffered messages the client asked for with
+	// ?history=N, or -1 for the whole buffer sent one frame per message
+	history int
+
+	// token is what the client authenticated with, if anything; its scopes
+	// are looked up in the current config for each message
+	token authToken
+
+	// bot is set when the client says it is a bot or bridge in its hello
+	// frame; counted while it is included in the viewer count
+	bot     bool
+	counted bool
+
+	// bridge is the bridge script version declared in the hello frame,
+	// zero when none was
+	bridge int
+
+	// sendClosed is set once the client's shard closes send; the reader
+	// may still reply until it notices, and those frames are dropped
+	sendClosed bool
+
+	// Subscription options, changed by configure frames
+	filters      map[string]string
+	types        map[string]bool
+	mentionsOnly bool
+	mutex        sync.Mutex
+
+	// Frame counters, updated by the pumps and read by the hub
+	sent     int64
+	received int64
+}
+
+// ClientInfo describes a connected client for the admin API
+type ClientInfo struct {
+	ID          uint64            `json:"id"`
+	ConnID      string            `json:"conn_id"`
+	RemoteAddr  string            `json:"remote_addr"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	Sent        int64             `json:"messages_sent"`
+	Received    int64             `json:"messages_received"`
+	QueueDepth  int               `json:"queue_depth"`
+	Filters     map[string]string `json:"filters"`
+	Encoding    string            `json:"encoding"`
+	Bot         bool              `json:"bot"`
+	Token       string            `json:"token,omitempty"`
+}
+
+// newClient wraps a WebSocket connection in a client with its own send
+// queue; encoding is encodingJSON or encodingMsgpack
+func newClient(conn *websocket.Conn, remoteAddr string, encoding string, connID string) *Client {
+	return &Client{
+		conn:        conn,
+		connID:      connID,
+		encoding:    encoding,
+		send:        make(chan interface{}, clientSendQueueSize),
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
+		history:     -1,
+		filters:     make(map[string]string),
+	}
+}
+
+// errorFrame builds an error frame for the client, with its connection ID
+func (c *Client) errorFrame(code string, err error) ErrorFrame {
+	frame := newErrorFrame(code, err)
+	frame.RequestID = c.connID
+	return frame
+}
+
+// context returns a context carrying the connection ID, so code handling
+// the client's frames, in its pumps or the hub, can tag its logs with logf
+func (c *Client) context() context.Context {
+	return withLogID(context.Background(), c.connID)
+}
+
+// wants reports whether the client subscribed to the message's type, and
+// to mentions only if it asked for that
+func (c *Client) wants(msg Message) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.mentionsOnly && len(msg.Mentions) == 0 {
+		return false
+	}
+	// PMs only go to clients that connected with the admin scope
+	if msg.Type == messageTypePM && !c.token.allows(scopeAdmin) {
+		return false
+	}
+	return c.types == nil || c.types[msg.Kind()]
+}
+
+// info returns a snapshot of the client's state
+func (c *Client) info() ClientInfo {
+	c.mutex.Lock()
+	filters := make(map[string]string, len(c.filters))
+	for key, value := range c.filters {
+		filters[key] = value
+	}
+	bot := c.bot
+	c.mutex.Unlock()
+
+	return ClientInfo{
+		ID:          c.id,
+		ConnID:      c.connID,
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.connectedAt,
+		Sent:        atomic.LoadInt64(&c.sent),
+		Received:    atomic.LoadInt64(&c.received),
+		QueueDepth:  len(c.send),
+		Filters:     filters,
+		Encoding:    c.encoding,
+		Bot:         bot,
+		Token:       c.token.name,
+	}
+}
+
+// frameBuffers are reused for encoding broadcast frames
+var frameBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// prepareFrame encodes a frame once in the given encoding so it can be sent
+// to many clients without being re-encoded for each
+func prepareFrame(frame interface{}, encoding string) (*websocket.PreparedMessage, error) {
+	if encoding == encodingMsgpack {
+		data, err := encodeMsgpack(frame)
+		if err != nil {
+			return nil, err
+		}
+		return websocket.NewPreparedMessage(websocket.BinaryMessage, data)
+	}
+
+	buf := frameBuffers.Get().(*bytes.Buffer)
+	defer frameBuffers.Put(buf)
+	buf.Reset()
+
+	if err := json.NewEncoder(buf).Encode(frame); err != nil {
+		return nil, err
+	}
+
+	// The prepared message keeps its data, so it can't share the pooled buffer
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+	return websocket.NewPreparedMessage(websocket.TextMessage, data)
+}
+
+// writeFrame writes a queued frame in the client's encoding
+func (c *Client) writeFrame(frame interface{}) error {
+	if prepared, ok := frame.(*websocket.PreparedMessage); ok {
+		return c.conn.WritePreparedMessage(prepared)
+	}
+	if c.encoding == encodingMsgpack {
+		data, err := encodeMsgpack(frame)
+		if err != nil {
+			return err
+		}
+		return c.conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return c.conn.WriteJSON(frame)
+}
+
+// enqueue queues a frame for the client, reporting false if the queue is
+// full or was closed when the client was removed
+func (c *Client) enqueue(frame interface{}) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.sendClosed {
+		return false
+	}
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend closes the send queue, ending the writer; frames enqueued
+// afterwards are dropped
+func (c *Client) closeSend() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.send)
+	}
+}
+
+// writePump writes queued frames to the connection until its shard closes the
+// send queue or a write fails, pinging the client to keep its read deadline fresh
+func (s *ChatServer) writePump(client *Client) {
+	defer recoverPanic("client writer")
+
+	pingPeriod := s.Config().WebSocket.ReadTimeout() * 9 / 10
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+	}()
+
+	for {
+		select {
+		case frame, ok := <-client.send:
+			if !ok {
+				return
+			}
+			client.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			if err := client.writeFrame(frame); err != nil {
+				logf(client.context(), "Error writing to client: %v", err)
+				s.requestUnregister(client)
+				// Keep draining until the hub closes the queue
+				for range client.send {
+				}
+				return
+			}
+			atomic.AddInt64(&client.sent, 1)
+		case <-ticker.C:
+			if err := client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(clientWriteTimeout)); err != nil {
+				s.requestUnregister(client)
+				for range client.send {
+				}
+				return
+			}
+		}
+	}
+}
+
+// readPump reads frames from the client, enforcing the frame size limit and
+// read deadline, until the connection fails or the client is disconnected
+func (s *ChatServer) readPump(client *Client) {
+	defer recoverPanic("client reader")
+
+	defer func() {
+		select {
+		case s.unregister <- client:
+		case <-s.quit:
+		}
+		s.connections.Release(client.remoteAddr)
+		if s.access != nil {
+			s.access.logWebSocket("disconnect", client)
+		}
+	}()
+
+	limits := s.Config().WebSocket
+	conn := client.conn
+	conn.SetReadLimit(limits.MaxFrameBytes)
+	conn.SetReadDeadline(time.Now().Add(limits.ReadTimeout()))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(limits.ReadTimeout()))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				clientViolations.Inc()
+				logf(client.context(), "WebSocket client exceeded frame limit of %d bytes", limits.MaxFrameBytes)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logf(client.context(), "WebSocket error: %v", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(limits.ReadTimeout()))
+		atomic.AddInt64(&client.received, 1)
+
+		// Rejected frames count as violations, and too many disconnect the client
+		reject := func(code string, err error) bool {
+			clientViolations.Inc()
+			client.violations++
+			client.enqueue(client.errorFrame(code, err))
+
+			if limits.MaxViolations > 0 && client.violations >= limits.MaxViolations {
+				clientViolationKick.Inc()
+				closeFrame := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many invalid messages")
+				conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(clientCloseTimeout))
+				return false
+			}
+			return true
+		}
+
+		frameType, err := clientFrameType(data)
+		if err != nil {
+			if !reject(errorCodeInvalidFrame, err) {
+				return
+			}
+			continue
+		}
+		switch frameType {
+		case "", messageTypeChat, frameTypeMessage, frameTypeBatch:
+			// Messages predate frame types, so an untyped frame is a message
+		case frameTypeConfigure:
+			ack, code, err := configureClient(client, data)
+			if err != nil {
+				if !reject(code, err) {
+					return
+				}
+				continue
+			}
+			client.enqueue(ack)
+			continue
+		case frameTypeHello:
+			if err := s.identifyClient(client, data); err != nil {
+				if !reject(errorCodeInvalidFrame, err) {
+					return
+				}
+			}
+			continue
+		default:
+			if !reject(errorCodeUnknownFrame, fmt.Errorf("unknown frame type %q", frameType)) {
+				return
+			}
+			continue
+		}
+
+		cfg := s.Config()
+		if cfg.WebSocket.ReadOnly {
+			if !reject(errorCodeForbidden, errors.New("this server does not accept messages")) {
+				return
+			}
+			continue
+		}
+
+		// Batches report messages already seen in the channel, so they are
+		// never forwarded to Cytube
+		if frameType == frameTypeBatch {
+			if !clientMayIngest(cfg, client) {
+				if !reject(errorCodeForbidden, errors.New("sending messages needs a token with the ingest scope")) {
+					return
+				}
+				continue
+			}
+			ack, err := s.ingestBatch(client, data, time.Now())
+			if ack.Type != "" {
+				client.enqueue(ack)
+			}
+			// An outdated bridge isn't misbehaving; it is told to update
+			if errors.Is(err, errBridgeOutdated) {
+				client.enqueue(client.errorFrame(errorCodeBridgeOutdated, err))
+				continue
+			}
+			if err != nil && !reject(errorCodeInvalidMessage, err) {
+				return
+			}
+			continue
+		}
+
+		msg, err := s.validateClientMessage(client, data)
+		if err != nil {
+			if !reject(errorCodeInvalidMessage, err) {
+				return
+			}
+			continue
+		}
+
+		if !clientMayIngest(cfg, client) {
+			if !reject(errorCodeForbidden, errors.New("sending messages needs a token with the ingest scope")) {
+				return
+			}
+			continue
+		}
+
+		// An outdated bridge isn't misbehaving; it is told to update
+		if err := checkBridgeVersion(cfg, client.bridgeVersion()); err != nil {
+			client.enqueue(client.errorFrame(errorCodeBridgeOutdated, err))
+			continue
+		}
+
+		// Forward the message to Cytube when sending is enabled; otherwise
+		// just broadcast it locally
+		if !cfg.Send.Enabled {
+			s.ingestMessage(msg)
+			continue
+		}
+		if err := s.sendChat(msg); err != nil {
+			client.enqueue(client.errorFrame(errorCodeSendFailed, err))
+		}
+	}
+}
+
+// bridgeVersion returns the bridge script version the client declared
+func (c *Client) bridgeVersion() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.bridge
+}
+
+// clientMayIngest reports whether a client may send messages: anyone may
+// unless tokens are required, then only with the ingest scope
+func clientMayIngest(cfg *Config, client *Client) bool {
+	if !cfg.authRequired() {
+		return true
+	}
+	token, ok := cfg.lookupToken(client.token.hash)
+	return ok && token.allows(scopeIngest)
+}
+
+// validateClientMessage decodes and checks a message frame sent by a client
+func (s *ChatServer) validateClientMessage(client *Client, data []byte) (Message, error) {
+	var frame Message
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return frame, fmt.Errorf("invalid message: %w", err)
+	}
+	return s.checkClientMessage(client, frame)
+}
+
+// checkClientMessage checks a message sent by a client. Only the username,
+// content and HTML are taken from it; the rest is set by the server so
+// clients can't forge IDs, times or metadata. Long content isn't refused
+// here: ingestMessage cuts it to the message limits like any other.
+func (s *ChatServer) checkClientMessage(client *Client, frame Message) (Message, error) {
+	// Ranks and types come from Cytube; clients can't claim them
+	msg := Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Username:  frame.Username,
+		Rank:      rankGuest,
+		Timestamp: time.Now(),
+		Content:   frame.Content,
+		HTML:      sanitizeHTML(frame.HTML),
+		Source:    messageSourceLocal,
+	}
+	if msg.HTML == "" {
+		msg.HTML = html.EscapeString(msg.Content)
+	}
+
+	// Anyone can claim any username; it is only verified when it is the
+	// name of the client's token or login
+	if client.token.name == "" || !strings.EqualFold(client.token.name, msg.Username) {
+		msg.Meta = map[string]interface{}{"unverified": true}
+	}
+
+	if strings.TrimSpace(msg.Username) == "" {
+		return msg, fmt.Errorf("invalid message: missing username")
+	}
+	if strings.TrimSpace(msg.Content) == "" {
+		return msg, fmt.Errorf("invalid message: missing content")
+	}
+	return msg, nil
+}
+
+// requestUnregister asks the hub to remove a client; it never blocks the hub
+// goroutine itself, so it is safe to call from the broadcast path
+func (s *ChatServer) requestUnregister(client *Client) {
+	go func() {
+		select {
+		case s.unregister <- client:
+		case <-s.quit:
+		}
+	}()
+}
+
+// kickRequest asks the hub to disconnect the client with the given ID
+type kickRequest struct {
+	id     uint64
+	result chan bool
+}
+
+// Clients returns information about all connected clients
+func (s *ChatServer) Clients() []ClientInfo {
+	reply := make(chan []ClientInfo, 1)
+	select {
+	case s.clientInfo <- reply:
+		return <-reply
+	case <-s.quit:
+		return []ClientInfo{}
+	}
+}
+
+// DisconnectClient force-closes the client with the given ID, reporting
+// whether it was connected
+func (s *ChatServer) DisconnectClient(id uint64) bool {
+	result := make(chan bool, 1)
+	select {
+	case s.kick <- kickRequest{id: id, result: result}:
+		return <-result
+	case <-s.quit:
+		return false
+	}
+}
+
+// listClients returns client info sorted by ID; it must run on the hub goroutine
+func (s *ChatServer) listClients() []ClientInfo {
+	infos := make([]ClientInfo, 0, len(s.clients))
+	for client := range s.clients {
+		infos = append(infos, client.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// kickClient closes and removes a client; it must run on the hub goroutine
+func (s *ChatServer) kickClient(id uint64) bool {
+	for client := range s.clients {
+		if client.id != id {
+			continue
+		}
+		closeFrame := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "disconnected by administrator")
+		client.conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(clientCloseTimeout))
+		return s.removeClient(client)
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"cylog/internal/testsupport"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEnqueueAfterRemoval(t *testing.T) {
+	client := newClient(nil, "127.0.0.1", encodingJSON, "test")
+	client.closeSend()
+
+	if client.enqueue(ErrorFrame{Type: frameTypeError}) {
+		t.Fatal("enqueue after the send queue closed reported success")
+	}
+	// Removing a client twice must not close the queue twice
+	client.closeSend()
+}
+
+func TestEnqueueRacingRemoval(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		client := newClient(nil, "127.0.0.1", encodingJSON, "test")
+
+		// The writer drains the queue until the shard closes it
+		drained := make(chan struct{})
+		go func() {
+			for range client.send {
+			}
+			close(drained)
+		}()
+
+		// The reader keeps replying, as to frames read before the removal
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				client.enqueue(ErrorFrame{Type: frameTypeError})
+			}
+		}()
+
+		client.closeSend()
+		wg.Wait()
+		<-drained
+	}
+}
+
+func TestConnectDisconnectChurnDuringBroadcast(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	cfg := defaultConfig()
+	cfg.WebSocket.MaxClientsPerIP = 0
+	chatServer, baseURL := runTestServer(t.Context(), t, cfg, upstream)
+	upstream.WaitConnected(e2eTimeout)
+	wsURL := "ws" + strings.TrimPrefix(baseURL, "http") + "/ws"
+
+	// Clients come and go, some after reading a few frames, while the hub
+	// broadcasts as fast as upstream sends
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(reads int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+				if err != nil {
+					t.Errorf("connecting: %v", err)
+					return
+				}
+				for k := 0; k < reads; k++ {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						break
+					}
+				}
+				conn.Close()
+			}
+		}(i % 4)
+	}
+	for i := 0; i < 200; i++ {
+		upstream.ChatMsg("alice", "broadcast")
+	}
+	wg.Wait()
+
+	testsupport.Eventually(t, e2eTimeout, "disconnected clients still registered", func() bool {
+		return len(chatServer.Clients()) == 0
+	})
+	client := testsupport.Dial(t, baseURL, "/ws")
+	upstream.ChatMsg("bob", "after the churn")
+	client.WaitFor(e2eTimeout, frameContaining("after the churn"))
+}
+
+func TestClientMessageCannotForgeFields(t *testing.T) {
+	chatServer, _ := newTestServer(t, defaultConfig())
+	client := newClient(nil, "127.0.0.1", encodingJSON, "test")
+	forgedAt := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		frame    string
+		wantHTML string
+	}{
+		{
+			name:     "forged fields",
+			frame:    `{"id":"forged-1","seq":99,"type":"chat","username":"alice","rank":255,"timestamp":"2001-01-01T00:00:00Z","content":"hi","html":"hi","tags":["admin"],"meta":{"unverified":false},"source":"cytube","color":"#000","late":true}`,
+			wantHTML: "hi",
+		},
+		{
+			name:     "script in the content",
+			frame:    `{"username":"alice","content":"<script>alert(1)</script>"}`,
+			wantHTML: "&lt;script&gt;alert(1)&lt;/script&gt;",
+		},
+		{
+			name:     "script in the HTML",
+			frame:    `{"username":"alice","content":"x","html":"<script>alert(1)</script><b onclick=\"alert(1)\">x</b>"}`,
+			wantHTML: "<b>x</b>",
+		},
+		{
+			name:     "script URL in the HTML",
+			frame:    `{"username":"alice","content":"x","html":"<a href=\"javascript:alert(1)\">x</a><img src=x onerror=alert(1)>"}`,
+			wantHTML: `<a rel="noopener noreferrer nofollow" target="_blank">x</a>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now()
+			msg, err := chatServer.validateClientMessage(client, []byte(tt.frame))
+			if err != nil {
+				t.Fatalf("validating: %v", err)
+			}
+			if msg.ID == "forged-1" || msg.ID == "" {
+				t.Errorf("ID = %q, want one assigned by the server", msg.ID)
+			}
+			if msg.Timestamp.Before(before) || msg.Timestamp.Equal(forgedAt) {
+				t.Errorf("timestamp = %s, want the time it was received", msg.Timestamp)
+			}
+			if msg.Seq != 0 || msg.Type != "" || msg.Rank != rankGuest || msg.Tags != nil || msg.Color != "" || msg.Late {
+				t.Errorf("forged fields kept: %+v", msg)
+			}
+			if msg.Source != messageSourceLocal {
+				t.Errorf("source = %q, want %q", msg.Source, messageSourceLocal)
+			}
+			if msg.Meta["unverified"] != true {
+				t.Errorf("meta = %v, want the username marked unverified", msg.Meta)
+			}
+			if msg.HTML != tt.wantHTML {
+				t.Errorf("HTML = %q, want %q", msg.HTML, tt.wantHTML)
+			}
+		})
+	}
+}
+
+func TestClientScriptPayloadNeutralized(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	cfg := defaultConfig()
+	cfg.Send.Enabled = false
+	_, baseURL := runTestServer(t.Context(), t, cfg, upstream)
+	upstream.WaitConnected(e2eTimeout)
+
+	watcher := testsupport.Dial(t, baseURL, "/ws")
+	sender := testsupport.Dial(t, baseURL, "/ws")
+	sender.Send(map[string]interface{}{
+		"id":       "forged-2",
+		"username": "mallory",
+		"content":  "<script>alert(document.cookie)</script>",
+		"html":     "<script>alert(document.cookie)</script>",
+	})
+
+	var broadcast Message
+	if err := json.Unmarshal(watcher.WaitFor(e2eTimeout, frameContaining("mallory")), &broadcast); err != nil {
+		t.Fatalf("decoding the broadcast: %v", err)
+	}
+	stored := recentMessages(t, baseURL)
+	for _, msg := range append(stored, broadcast) {
+		if msg.Username != "mallory" {
+			continue
+		}
+		if msg.ID == "forged-2" {
+			t.Errorf("the forged ID was kept")
+		}
+		if strings.Contains(msg.HTML, "<script") {
+			t.Errorf("HTML %q still has the script", msg.HTML)
+		}
+		if msg.HTML != "&lt;script&gt;alert(document.cookie)&lt;/script&gt;" {
+			t.Errorf("HTML = %q, want the content escaped", msg.HTML)
+		}
+	}
+	if !hasMessage(stored, "mallory", "<script>alert(document.cookie)</script>") {
+		t.Errorf("the message wasn't stored as sent text: %+v", stored)
+	}
+}
+
+func TestClientLongMessageTruncated(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	cfg := defaultConfig()
+	cfg.Send.Enabled = false
+	cfg.MessageLimits.MaxContentLength = 100
+	cfg.WebSocket.MaxViolations = 1
+	_, baseURL := runTestServer(t.Context(), t, cfg, upstream)
+	upstream.WaitConnected(e2eTimeout)
+
+	watcher := testsupport.Dial(t, baseURL, "/ws")
+	sender := testsupport.Dial(t, baseURL, "/ws")
+	for i := 0; i < 3; i++ {
+		sender.Send(map[string]interface{}{"username": "mallory", "content": fmt.Sprintf("paste %d %s", i, strings.Repeat("é", 3000))})
+	}
+
+	// Every paste is kept, cut to the limit, rather than counted as a violation
+	for i := 0; i < 3; i++ {
+		var broadcast Message
+		if err := json.Unmarshal(watcher.WaitFor(e2eTimeout, frameContaining(fmt.Sprintf("paste %d", i))), &broadcast); err != nil {
+			t.Fatalf("decoding the broadcast: %v", err)
+		}
+		if !broadcast.Truncated || utf8.RuneCountInString(broadcast.Content) != 101 || !strings.HasSuffix(broadcast.Content, truncationMarker) {
+			t.Errorf("broadcast content of %d characters, truncated %v, want 100 and the marker", utf8.RuneCountInString(broadcast.Content), broadcast.Truncated)
+		}
+	}
+}
+
+// serverConns opens n WebSocket connections to a local server and returns
+// the server's ends; the clients discard everything sent to them
+func serverConns(b *testing.B, n int) []*websocket.Conn {
+	b.Helper()
+
+	accepted := make(chan *websocket.Conn)
+	upgrader := websocket.Upgrader{}
+	baseURL := testsupport.Serve(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}))
+
+	conns := make([]*websocket.Conn, n)
+	for i := range conns {
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(baseURL, "http"), nil)
+		if err != nil {
+			b.Fatalf("connecting: %v", err)
+		}
+		// Reading the raw stream keeps the clients' allocations out of
+		// the numbers
+		go io.Copy(io.Discard, client.UnderlyingConn())
+		conns[i] = <-accepted
+		b.Cleanup(func() {
+			conns[i].Close()
+			client.Close()
+		})
+	}
+	return conns
+}
+
+// BenchmarkBroadcast delivers a message through the hub's fan-out, the
+// shards and each client's writer to 100 and 500 connected clients. The
+// frame is encoded once per broadcast, so allocations per broadcast should
+// stay flat as clients are added.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, clients := range []int{100, 500} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			chatServer, _ := newTestServer(b, defaultConfig())
+			chatServer.startFanout()
+			var registered []*Client
+			for i, conn := range serverConns(b, clients) {
+				client := newClient(conn, "127.0.0.1", encodingJSON, fmt.Sprint(i))
+				client.bot = true
+				chatServer.addClient(client, nil)
+				go chatServer.writePump(client)
+				registered = append(registered, client)
+			}
+			b.Cleanup(func() {
+				for client := range chatServer.clients {
+					chatServer.removeClient(client)
+				}
+				chatServer.stopFanout()
+			})
+
+			// sent returns how many frames the writers have written
+			sent := func() int64 {
+				var total int64
+				for _, client := range registered {
+					total += atomic.LoadInt64(&client.sent)
+				}
+				return total
+			}
+
+			msg := Message{ID: "bench", Type: messageTypeChat, Username: "alice", Timestamp: time.Now(), Content: "hello everyone", HTML: "hello <b>everyone</b>"}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				chatServer.fanoutMessage(msg)
+				for want := int64(i+1) * int64(clients); sent() < want; {
+					runtime.Gosched()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// Username palette settings
+const (
+	usernamePaletteSize = 24
+	usernameSaturation  = 0.7
+	minUsernameContrast = 3.0
+)
+
+// Backgrounds username colors must stay readable on: white, the default of
+// most clients, and the dark background of the bundled UI and transcripts
+var (
+	lightBackground = rgbColor{0xff, 0xff, 0xff}
+	darkBackground  = rgbColor{0x1b, 0x1d, 0x21}
+)
+
+// usernameColorPattern matches the colors accepted in username_colors
+var usernameColorPattern = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// usernamePalette is the palette usernames are hashed into
+var usernamePalette = newUsernamePalette(usernamePaletteSize)
+
+// rgbColor is an sRGB color
+type rgbColor struct {
+	r, g, b uint8
+}
+
+// String returns the color as #rrggbb
+func (c rgbColor) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.r, c.g, c.b)
+}
+
+// luminance returns the WCAG relative luminance of the color
+func (c rgbColor) luminance() float64 {
+	linear := func(v uint8) float64 {
+		s := float64(v) / 255
+		if s <= 0.03928 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	return 0.2126*linear(c.r) + 0.7152*linear(c.g) + 0.0722*linear(c.b)
+}
+
+// contrastRatio returns the WCAG contrast ratio of two colors, from 1 to 21
+func contrastRatio(a, b rgbColor) float64 {
+	lighter, darker := a.luminance()+0.05, b.luminance()+0.05
+	if lighter < darker {
+		lighter, darker = darker, lighter
+	}
+	return lighter / darker
+}
+
+// hslColor converts a hue in degrees and a saturation and lightness from 0
+// to 1 to sRGB
+func hslColor(hue, saturation, lightness float64) rgbColor {
+	chroma := (1 - math.Abs(2*lightness-1)) * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = chroma, x, 0
+	case hue < 120:
+		r, g, b = x, chroma, 0
+	case hue < 180:
+		r, g, b = 0, chroma, x
+	case hue < 240:
+		r, g, b = 0, x, chroma
+	case hue < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	m := lightness - chroma/2
+	channel := func(v float64) uint8 {
+		return uint8(math.Round((v + m) * 255))
+	}
+	return rgbColor{channel(r), channel(g), channel(b)}
+}
+
+// newUsernamePalette returns up to n colors with evenly spaced hues. Each
+// has the luminance giving equal contrast against the light and dark
+// backgrounds, so no hue stands out or fades on either; colors still below
+// minUsernameContrast on one of them are left out.
+func newUsernamePalette(n int) []string {
+	target := math.Sqrt((lightBackground.luminance()+0.05)*(darkBackground.luminance()+0.05)) - 0.05
+
+	palette := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		hue := float64(i) * 360 / float64(n)
+		low, high := 0.0, 1.0
+		var color rgbColor
+		for step := 0; step < 20; step++ {
+			lightness := (low + high) / 2
+			color = hslColor(hue, usernameSaturation, lightness)
+			if color.luminance() < target {
+				low = lightness
+			} else {
+				high = lightness
+			}
+		}
+		if contrastRatio(color, lightBackground) < minUsernameContrast || contrastRatio(color, darkBackground) < minUsernameContrast {
+			continue
+		}
+		palette = append(palette, color.String())
+	}
+	return palette
+}
+
+// validateUsernameColors checks the username color overrides, returning
+// them keyed by lowercased username
+func validateUsernameColors(colors map[string]string) (map[string]string, error) {
+	validated := make(map[string]string, len(colors))
+	for username, color := range colors {
+		if !usernameColorPattern.MatchString(color) {
+			return nil, fmt.Errorf("invalid username_colors entry %q: color %q must be #rgb or #rrggbb", username, color)
+		}
+		validated[strings.ToLower(username)] = strings.ToLower(color)
+	}
+	return validated, nil
+}
+
+// UsernameColor returns the color of a username: its override, or else a
+// palette color picked by a hash of the name, so every client and export
+// shows the same one
+func (c *Config) UsernameColor(username string) string {
+	if color, ok := c.UsernameColors[strings.ToLower(username)]; ok {
+		return color
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(username)))
+	return usernamePalette[hash.Sum32()%uint32(len(usernamePalette))]
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestHSLColor(t *testing.T) {
+	tests := []struct {
+		hue, saturation, lightness float64
+		want                       string
+	}{
+		{0, 1, 0.5, "#ff0000"},
+		{120, 1, 0.5, "#00ff00"},
+		{240, 1, 0.5, "#0000ff"},
+		{60, 1, 0.5, "#ffff00"},
+		{300, 1, 0.25, "#800080"},
+		{200, 0, 0.5, "#808080"},
+		{90, 0.7, 0, "#000000"},
+		{90, 0.7, 1, "#ffffff"},
+	}
+	for _, tt := range tests {
+		if got := hslColor(tt.hue, tt.saturation, tt.lightness).String(); got != tt.want {
+			t.Errorf("hslColor(%v, %v, %v) = %s, want %s", tt.hue, tt.saturation, tt.lightness, got, tt.want)
+		}
+	}
+}
+
+func TestContrastRatio(t *testing.T) {
+	black, white := rgbColor{0, 0, 0}, rgbColor{0xff, 0xff, 0xff}
+	tests := []struct {
+		name string
+		a, b rgbColor
+		want float64
+	}{
+		{"black on white", black, white, 21},
+		{"white on black", white, black, 21},
+		{"same color", darkBackground, darkBackground, 1},
+		{"gray on white", rgbColor{0x77, 0x77, 0x77}, white, 4.48},
+	}
+	for _, tt := range tests {
+		if got := contrastRatio(tt.a, tt.b); math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("%s: contrastRatio = %.2f, want %.2f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUsernamePalette(t *testing.T) {
+	for _, n := range []int{1, 6, usernamePaletteSize, 64} {
+		palette := newUsernamePalette(n)
+		if len(palette) == 0 || len(palette) > n {
+			t.Fatalf("newUsernamePalette(%d) has %d colors", n, len(palette))
+		}
+		if !slices.Equal(palette, newUsernamePalette(n)) {
+			t.Errorf("newUsernamePalette(%d) differs between calls", n)
+		}
+		for _, color := range palette {
+			if !usernameColorPattern.MatchString(color) {
+				t.Fatalf("palette color %q is not #rrggbb", color)
+			}
+			rgb := parseTestColor(t, color)
+			for _, background := range []rgbColor{lightBackground, darkBackground} {
+				if ratio := contrastRatio(rgb, background); ratio < minUsernameContrast {
+					t.Errorf("%s has contrast %.2f on %s, want at least %v", color, ratio, background, minUsernameContrast)
+				}
+			}
+		}
+	}
+	if len(usernamePalette) < usernamePaletteSize/2 {
+		t.Errorf("the username palette kept %d of %d colors", len(usernamePalette), usernamePaletteSize)
+	}
+}
+
+func TestUsernameColor(t *testing.T) {
+	cfg := defaultConfig()
+	overrides, err := validateUsernameColors(map[string]string{"Alice": "#ABC"})
+	if err != nil {
+		t.Fatalf("validating the overrides: %v", err)
+	}
+	cfg.UsernameColors = overrides
+
+	tests := []struct {
+		name, username string
+		want           string
+	}{
+		{"override", "Alice", "#abc"},
+		{"override in another case", "ALICE", "#abc"},
+		{"hashed", "bob", cfg.UsernameColor("bob")},
+		{"hashed in another case", "BoB", cfg.UsernameColor("bob")},
+	}
+	for _, tt := range tests {
+		got := cfg.UsernameColor(tt.username)
+		if got != tt.want {
+			t.Errorf("%s: UsernameColor(%q) = %s, want %s", tt.name, tt.username, got, tt.want)
+		}
+		if tt.want != "#abc" && !slices.Contains(usernamePalette, got) {
+			t.Errorf("%s: UsernameColor(%q) = %s, not in the palette", tt.name, tt.username, got)
+		}
+	}
+
+	if _, err := validateUsernameColors(map[string]string{"mallory": "red; background: url(x)"}); err == nil {
+		t.Error("a color that is not #rgb or #rrggbb was accepted")
+	}
+}
+
+// parseTestColor parses a #rrggbb color
+func parseTestColor(t *testing.T, color string) rgbColor {
+	t.Helper()
+
+	var c rgbColor
+	if _, err := fmt.Sscanf(color, "#%02x%02x%02x", &c.r, &c.g, &c.b); err != nil {
+		t.Fatalf("parsing %q: %v", color, err)
+	}
+	return c
+}
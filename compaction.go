@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// manifestSuffix names the sidecar of a monthly rollup that lists the log
+// files it holds
+const manifestSuffix = ".manifest"
+
+// compactionDelay is how long after the start of a month the previous one
+// is compacted, leaving its last files time to be closed
+const compactionDelay = time.Hour
+
+// errMonthNotEnded is returned when compacting a month that isn't over
+var errMonthNotEnded = errors.New("month has not ended")
+
+// compactMutex keeps compactions from running concurrently
+var compactMutex sync.Mutex
+
+// CompactionConfig configures rolling up the log files of completed months
+type CompactionConfig struct {
+	// Enabled compacts the daily and hourly files of each month into one
+	// compressed rollup per kind once the month has ended
+	Enabled bool `yaml:"enabled"`
+}
+
+// rollupEntry locates a compacted log file in its rollup
+type rollupEntry struct {
+	Name      string `json:"name"`
+	FirstLine int    `json:"first_line"`
+	Lines     int    `json:"lines"`
+	Size      int64  `json:"size"`
+}
+
+// rollupManifest lists the files a rollup holds, oldest first
+type rollupManifest struct {
+	Rollup string        `json:"rollup"`
+	Files  []rollupEntry `json:"files"`
+}
+
+// Rollup reports the files compacted into a monthly rollup
+type Rollup struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+}
+
+// rollupName returns the monthly rollup a daily or hourly log file is
+// compacted into, like chat-2025-04.log.gz for chat-2025-04-16.log
+func rollupName(name string) (string, bool) {
+	period, start, _, ok := logFilePeriod(name)
+	if !ok || strings.HasSuffix(name, ".gz") || (period != rotationDaily && period != rotationHourly) {
+		return "", false
+	}
+
+	rollup := logFileName(logFileKind(name), start.Format(monthLabelFormat), 0)
+	if isEncryptedLog(name) {
+		rollup += encryptedSuffix
+	}
+	return rollup + ".gz", true
+}
+
+// manifestPath returns where the manifest of a rollup is kept
+func (l *Logger) manifestPath(rollup string) string {
+	return filepath.Join(l.dir, strings.TrimSuffix(rollup, ".gz")+manifestSuffix)
+}
+
+// loadRollupManifest reads the manifest of a rollup
+func (l *Logger) loadRollupManifest(rollup string) (*rollupManifest, error) {
+	data, err := os.ReadFile(l.manifestPath(rollup))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest rollupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s: %w", rollup, err)
+	}
+	return &manifest, nil
+}
+
+// readRolledUp returns the content of a log file that was compacted, from
+// the lines its rollup's manifest records for it
+func (l *Logger) readRolledUp(name string) (string, error) {
+	rollup, ok := rollupName(name)
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	manifest, err := l.loadRollupManifest(rollup)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range manifest.Files {
+		if entry.Name != name {
+			continue
+		}
+		content, err := l.readLogFile(filepath.Join(l.dir, rollup))
+		if err != nil {
+			return "", err
+		}
+		lines := strings.SplitAfter(content, "\n")
+		if entry.FirstLine+entry.Lines > len(lines) {
+			return "", fmt.Errorf("%s is shorter than its manifest", rollup)
+		}
+		return strings.Join(lines[entry.FirstLine:entry.FirstLine+entry.Lines], ""), nil
+	}
+	return "", os.ErrNotExist
+}
+
+// Compact rolls the daily and hourly log files of completed months up
+// into one compressed file per kind and month, or only those of month when
+// it isn't zero. Each rollup is written completely before its files are
+// removed, and a rollup left with files still around, say by a crash, is
+// finished by the next compaction.
+func (l *Logger) Compact(month time.Time) ([]Rollup, error) {
+	if !writable() {
+		return nil, errDryRun
+	}
+	current := periodStart(rotationMonthly, l.clock.Now())
+	if !month.IsZero() {
+		month = periodStart(rotationMonthly, month)
+		if !month.Before(current) {
+			return nil, errMonthNotEnded
+		}
+	}
+
+	compactMutex.Lock()
+	defer compactMutex.Unlock()
+
+	logs, err := l.GetAvailableLogs()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for _, names := range logs {
+		for _, name := range names {
+			rollup, ok := rollupName(name)
+			if !ok || l.isLive(name) {
+				continue
+			}
+			date, _ := logFileDate(name)
+			start := periodStart(rotationMonthly, date)
+			if !start.Before(current) || (!month.IsZero() && !start.Equal(month)) {
+				continue
+			}
+			groups[rollup] = append(groups[rollup], name)
+		}
+	}
+
+	rollups := make([]string, 0, len(groups))
+	for rollup := range groups {
+		rollups = append(rollups, rollup)
+	}
+	sort.Strings(rollups)
+
+	results := make([]Rollup, 0, len(rollups))
+	for _, rollup := range rollups {
+		names := groups[rollup]
+		sortLogFiles(names)
+		compacted, err := l.compactRollup(rollup, names)
+		if err != nil {
+			return results, fmt.Errorf("failed to compact %s: %w", rollup, err)
+		}
+		log.Printf("Compacted %d log files into %s", len(compacted), rollup)
+		results = append(results, Rollup{Name: rollup, Files: compacted})
+	}
+	if err := l.meta.Save(); err != nil {
+		log.Printf("Error saving log metadata: %v", err)
+	}
+	return results, nil
+}
+
+// compactRollup writes a rollup of names and removes them, returning the
+// removed files. If the rollup already exists, only the files its manifest
+// lists are removed.
+func (l *Logger) compactRollup(rollup string, names []string) ([]string, error) {
+	path := filepath.Join(l.dir, rollup)
+	if _, err := os.Stat(path); err == nil {
+		manifest, err := l.loadRollupManifest(rollup)
+		if err != nil {
+			return nil, fmt.Errorf("rollup exists without a manifest: %w", err)
+		}
+		return l.removeRolledUp(manifest, names), nil
+	}
+
+	l.logMutex.Lock()
+	key := l.signingKey
+	l.logMutex.Unlock()
+
+	// A tampered file must not get a valid signature by being rolled up
+	if key != nil {
+		for _, name := range names {
+			result := verifyLogPath(key, filepath.Join(l.dir, name))
+			if result.Method != verifyNone && !result.Valid {
+				return nil, fmt.Errorf("%s fails verification: %s", name, result.Error)
+			}
+		}
+	}
+
+	manifest, err := l.writeRollup(path, names, key)
+	if err != nil {
+		return nil, err
+	}
+	return l.removeRolledUp(manifest, names), nil
+}
+
+// writeRollup concatenates the log files names into a compressed rollup at
+// path, signing its uncompressed content when key is set. The manifest is
+// written before the rollup is moved into place, so a rollup always has one.
+func (l *Logger) writeRollup(path string, names []string, key []byte) (*rollupManifest, error) {
+	encrypted := isEncryptedLog(path)
+	manifest := &rollupManifest{Rollup: filepath.Base(path), Files: make([]rollupEntry, 0, len(names))}
+
+	tmpPath := path + ".tmp"
+	target, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rollup: %w", err)
+	}
+	writer := gzip.NewWriter(target)
+	writer.Name = strings.TrimSuffix(filepath.Base(path), ".gz")
+	var mac hash.Hash
+	var out io.Writer = writer
+	if key != nil {
+		mac = hmac.New(sha256.New, key)
+		out = io.MultiWriter(writer, mac)
+	}
+
+	err = func() error {
+		if encrypted {
+			if _, err := out.Write([]byte(encryptionMagic)); err != nil {
+				return err
+			}
+		}
+		line := 0
+		for _, name := range names {
+			content, err := os.ReadFile(filepath.Join(l.dir, name))
+			if err != nil {
+				return err
+			}
+			data, lines, err := rollupData(content, encrypted)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if _, err := out.Write(data); err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, rollupEntry{Name: name, FirstLine: line, Lines: lines, Size: int64(len(content))})
+			line += lines
+		}
+		return writer.Close()
+	}()
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to write rollup: %w", err)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := writeFileAtomic(l.manifestPath(manifest.Rollup), data); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to store rollup: %w", err)
+	}
+
+	// Compressed files are signed under their uncompressed name
+	if mac != nil {
+		signature := []byte(signaturePrefix + hex.EncodeToString(mac.Sum(nil)) + "\n")
+		if err := writeFileAtomic(strings.TrimSuffix(path, ".gz")+signatureSuffix, signature); err != nil {
+			log.Printf("Error signing %s: %v", manifest.Rollup, err)
+		}
+	}
+	return manifest, nil
+}
+
+// rollupData returns the part of a log file's content that goes into a
+// rollup and its number of lines. A partial last line of a plaintext file
+// is terminated; an incomplete last chunk of an encrypted file is dropped
+// along with its magic header, which the rollup has once.
+func rollupData(content []byte, encrypted bool) ([]byte, int, error) {
+	if !encrypted {
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			content = append(content, '\n')
+		}
+		return content, bytes.Count(content, []byte("\n")), nil
+	}
+
+	if len(content) == 0 {
+		return nil, 0, nil
+	}
+	if !bytes.HasPrefix(content, []byte(encryptionMagic)) {
+		return nil, 0, errors.New("not an encrypted cylog log file")
+	}
+	content = content[len(encryptionMagic):]
+	end, lines := 0, 0
+	for len(content)-end >= chunkLengthSize {
+		size := chunkLengthSize + int(binary.BigEndian.Uint32(content[end:]))
+		if len(content)-end < size {
+			break
+		}
+		end += size
+		lines++
+	}
+	return content[:end], lines, nil
+}
+
+// removeRolledUp deletes the files of names that a rollup's manifest lists,
+// returning those removed
+func (l *Logger) removeRolledUp(manifest *rollupManifest, names []string) []string {
+	rolled := make(map[string]bool, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		rolled[entry.Name] = true
+	}
+
+	removed := make([]string, 0, len(names))
+	for _, name := range names {
+		if !rolled[name] {
+			log.Printf("Not compacting %s: it was written after %s", name, manifest.Rollup)
+			continue
+		}
+		if err := removeFile(filepath.Join(l.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error removing compacted log file %s: %v", name, err)
+			continue
+		}
+		l.usage.Remove(name)
+		l.meta.Remove(name)
+		l.removeLogSidecars(name)
+		removed = append(removed, name)
+	}
+	l.usage.Refresh(manifest.Rollup)
+	return removed
+}
+
+// compactLogs is the compaction job, compacting every completed month
+func (s *ChatServer) compactLogs(ctx context.Context) error {
+	_, err := s.logger.Compact(time.Time{})
+	return err
+}
+
+// parseCompactMonth parses an optional YYYY-MM month to compact; empty
+// means every completed month
+func parseCompactMonth(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	month, err := time.ParseInLocation(monthLabelFormat, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid month %q: expected YYYY-MM", value)
+	}
+	return month, nil
+}
+
+// registerCompactionRoutes registers the admin endpoint compacting log
+// files on demand
+func registerCompactionRoutes(admin *gin.RouterGroup, chatServer *ChatServer) {
+	admin.POST("/compact", func(c *gin.Context) {
+		month, err := parseCompactMonth(c.Query("month"))
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rollups, err := chatServer.logger.Compact(month)
+		if err != nil {
+			auditLog(c, "compact", "failed: "+err.Error())
+			switch {
+			case errors.Is(err, errMonthNotEnded):
+				apiError(c, http.StatusBadRequest, err.Error())
+			case errors.Is(err, errDryRun):
+				apiError(c, http.StatusConflict, err.Error())
+			default:
+				writeAPIError(c, loggedError(c, err), gin.H{"rollups": rollups})
+			}
+			return
+		}
+
+		auditLog(c, "compact", fmt.Sprintf("%d rollups", len(rollups)))
+		c.JSON(http.StatusOK, rollups)
+	})
+}
+
+// runCompactCommand implements "cylog compact [YYYY-MM]", compacting the
+// log files of every completed month, or of one, while the server is
+// stopped
+func runCompactCommand(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: cylog compact [YYYY-MM]")
+		return 2
+	}
+	month := time.Time{}
+	if len(args) == 1 {
+		var err error
+		if month, err = parseCompactMonth(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 2
+	}
+	if err := logUsage.Scan(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	logMeta.Load()
+
+	// Without the server running no log file is open
+	logger := &Logger{streams: make(map[string]*logStream), dir: logsDir, usage: logUsage, meta: logMeta}
+	logger.SetSigningKey(cfg.Signing.Key)
+
+	rollups, err := logger.Compact(month)
+	for _, rollup := range rollups {
+		fmt.Printf("%s: %d files\n", rollup.Name, len(rollup.Files))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compact log files: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFileName is the default configuration file looked up in the working directory
+const configFileName = "cylog.yaml"
+
+// Config holds the user-tunable settings loaded from the configuration file
+type Config struct {
+	// Port is the HTTP server port; changing it requires a restart
+	Port int `yaml:"port"`
+
+	// Channel is the Cytube channel joined after connecting
+	Channel string `yaml:"channel"`
+
+	// ChannelPassword is sent when the channel asks for a password
+	ChannelPassword string `yaml:"channel_password"`
+
+	// Upstream lists the Cytube WebSocket servers to connect to
+	Upstream UpstreamConfig `yaml:"upstream"`
+
+	// AdminToken protects the /api/v1/admin routes; admin routes are disabled when empty
+	AdminToken string `yaml:"admin_token"`
+
+	// Tokens are named API tokens with scopes, configured by their hashes
+	Tokens []APIToken `yaml:"tokens"`
+
+	// RequireTokens makes the read API and WebSocket require a token with
+	// the read scope, and sending messages the ingest scope
+	RequireTokens bool `yaml:"require_tokens"`
+
+	// Login configures the username and password login of the web UI
+	Login LoginConfig `yaml:"login"`
+
+	// Filters are the content filter rules applied to every message before it is stored
+	Filters []FilterRule `yaml:"filters"`
+
+	// Flood configures collapsing of repeated messages
+	Flood FloodConfig `yaml:"flood"`
+
+	// Retention controls which old chat log files are deleted
+	Retention RetentionConfig `yaml:"retention"`
+
+	// Rotation is how often new log files are started: hourly, daily,
+	// weekly or monthly
+	Rotation string `yaml:"rotation"`
+
+	// LogRoutes maps message types to log file kinds such as events or pm;
+	// messages of unlisted types are written to the chat log
+	LogRoutes map[string]string `yaml:"log_routes"`
+
+	// KindRetention overrides the retention policy for non-chat log kinds
+	KindRetention map[string]RetentionConfig `yaml:"kind_retention"`
+
+	// Loki configures forwarding logged messages to Grafana Loki; changing it
+	// requires a restart
+	Loki LokiConfig `yaml:"loki"`
+
+	// AccessLog configures logs/access.log; changing it requires a restart
+	AccessLog AccessLogConfig `yaml:"access_log"`
+
+	// Debug configures the pprof and expvar endpoints; changing it requires a restart
+	Debug DebugConfig `yaml:"debug"`
+
+	// WebSocket configures limits on local client connections
+	WebSocket WebSocketConfig `yaml:"websocket"`
+
+	// Send configures forwarding messages from local clients to Cytube
+	Send SendConfig `yaml:"send"`
+
+	// Sampling logs only a sample of chat messages in busy periods
+	Sampling SamplingConfig `yaml:"sampling"`
+
+	// UsernameColors overrides the palette color of usernames, as #rgb or
+	// #rrggbb
+	UsernameColors map[string]string `yaml:"username_colors"`
+
+	// Previews configures fetching link previews from whitelisted sites
+	Previews PreviewConfig `yaml:"previews"`
+
+	// MessageLimits caps the content and HTML of every message at ingest
+	MessageLimits MessageLimits `yaml:"message_limits"`
+
+	// StripInvisible removes bidi controls and zero-width characters from
+	// message content, on top of the control characters always removed
+	StripInvisible bool `yaml:"strip_invisible"`
+
+	// LogStatusEvents writes upstream connection status messages to the chat
+	// log; they are only broadcast by default
+	LogStatusEvents bool `yaml:"log_status_events"`
+
+	// APIDocs serves a Swagger UI page for the OpenAPI document at /api/docs
+	APIDocs bool `yaml:"api_docs"`
+
+	// Timezone is the IANA zone used to bucket statistics; defaults to local time
+	Timezone string `yaml:"timezone"`
+
+	// Mentions lists the names whose mentions are flagged and indexed
+	Mentions MentionsConfig `yaml:"mentions"`
+
+	// Notify configures desktop notifications for mentions and tagged messages
+	Notify NotifyConfig `yaml:"notify"`
+
+	// Digest configures the daily digest
+	Digest DigestConfig `yaml:"digest"`
+
+	// Feed configures the Atom feed at /feed.atom
+	Feed FeedConfig `yaml:"feed"`
+
+	// Shares configures read-only share links of log excerpts
+	Shares ShareConfig `yaml:"shares"`
+
+	// Tail configures the time-windowed tail endpoint
+	Tail TailConfig `yaml:"tail"`
+
+	// Compaction configures rolling up the log files of completed months
+	Compaction CompactionConfig `yaml:"compaction"`
+
+	// Disk configures free space monitoring of the logs volume
+	Disk DiskConfig `yaml:"disk"`
+
+	// Signing configures HMAC signatures of log files; changing it requires
+	// a restart
+	Signing SigningConfig `yaml:"signing"`
+
+	// Encryption configures encrypting log files at rest; changing it
+	// requires a restart
+	Encryption EncryptionConfig `yaml:"encryption"`
+
+	// Headless runs without opening the desktop app or showing notifications;
+	// changing it requires a restart
+	Headless bool `yaml:"headless"`
+
+	// Desktop configures how the UI is opened when not headless
+	Desktop DesktopConfig `yaml:"desktop"`
+
+	// UpdateCheck checks GitHub daily for a newer release; off unless opted
+	// into, and always off with CYLOG_DISABLE_UPDATE_CHECK set
+	UpdateCheck bool `yaml:"update_check"`
+
+	// TrustedProxies lists the addresses and CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header is believed; requests from anywhere else
+	// use the peer address. Changing it requires a restart.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// PersistLoggingPause keeps logging paused across a restart after an
+	// admin paused it; otherwise a restart resumes logging
+	PersistLoggingPause bool `yaml:"persist_logging_pause"`
+
+	// StateMaxAgeMinutes is how old the message buffer saved at shutdown may
+	// be and still be restored at startup; zero never restores it
+	StateMaxAgeMinutes int `yaml:"state_max_age_minutes"`
+
+	// ErrorReporting sends panics and serious errors to a Sentry-compatible
+	// service; changing it requires a restart
+	ErrorReporting ErrorReportingConfig `yaml:"error_reporting"`
+
+	// Demo replaces the Cytube connection with generated chat traffic;
+	// changing it requires a restart
+	Demo DemoConfig `yaml:"demo"`
+
+	// FanoutWorkers is the number of goroutines that queue broadcasts for
+	// WebSocket clients; zero means one per CPU. Changing it requires a restart.
+	FanoutWorkers int `yaml:"fanout_workers"`
+
+	// BroadcastQueueSize is how many messages wait for delivery to clients
+	// before the oldest are dropped. Changing it requires a restart.
+	BroadcastQueueSize int `yaml:"broadcast_queue_size"`
+
+	// LogWriter configures the goroutine writing messages to the logs
+	LogWriter LogWriterConfig `yaml:"log_writer"`
+
+	location      *time.Location
+	mentions      *mentionMatcher
+	encryptionKey *[32]byte
+}
+
+// RetentionConfig is the policy for deleting old chat log files; a zero
+// value disables the corresponding limit
+type RetentionConfig struct {
+	// MaxFiles is the number of rotation periods to keep, including the live
+	// one; files split by size within a period count once
+	MaxFiles int `yaml:"max_files" json:"max_files"`
+
+	// KeepDays deletes files whose period ended more than this many days ago
+	KeepDays int `yaml:"keep_days" json:"keep_days"`
+
+	// KeepBytes deletes the oldest files while the total size exceeds this
+	KeepBytes int64 `yaml:"keep_bytes" json:"keep_bytes"`
+}
+
+// WebSocketConfig holds limits applied to local client WebSocket connections
+type WebSocketConfig struct {
+	// MaxFrameBytes is the largest frame accepted from a client
+	MaxFrameBytes int64 `yaml:"max_frame_bytes"`
+
+	// ReadTimeoutSeconds is how long a client may stay silent, including pongs
+	ReadTimeoutSeconds int `yaml:"read_timeout_seconds"`
+
+	// MaxViolations is how many invalid frames a client may send before it is disconnected
+	MaxViolations int `yaml:"max_violations"`
+
+	// MaxClients and MaxClientsPerIP cap the streaming connections in total
+	// and per client address; zero means unlimited
+	MaxClients      int `yaml:"max_clients"`
+	MaxClientsPerIP int `yaml:"max_clients_per_ip"`
+
+	// MaxHistory caps how many buffered messages are replayed to a new
+	// client, whatever it asks for with ?history=N; zero means the whole buffer
+	MaxHistory int `yaml:"max_history"`
+
+	// ReadOnly refuses messages from clients, for deployments that only log
+	ReadOnly bool `yaml:"read_only"`
+
+	// MaxBatch is the most messages a client may send in one batch frame
+	MaxBatch int `yaml:"max_batch"`
+
+	// ReorderWindowSeconds is how long before their receipt batched messages
+	// may have been observed and still be placed in order among the recent
+	// messages; older ones are marked late
+	ReorderWindowSeconds int `yaml:"reorder_window_seconds"`
+
+	// MinBridgeVersion refuses messages from Tampermonkey bridges older
+	// than it, telling them to update; zero accepts any
+	MinBridgeVersion int `yaml:"min_bridge_version"`
+}
+
+// DemoConfig configures the generated traffic of demo mode
+type DemoConfig struct {
+	// Enabled generates traffic instead of dialing Cytube; --demo on the
+	// command line also enables it
+	Enabled bool `yaml:"enabled"`
+
+	// MessagesPerMinute is the rate of generated events, chat and otherwise
+	MessagesPerMinute int `yaml:"messages_per_minute"`
+
+	// Users are the fake usernames; a built-in list is used when empty
+	Users []string `yaml:"users"`
+
+	// Seed makes the generated traffic repeatable; zero seeds from the clock
+	Seed int64 `yaml:"seed"`
+}
+
+// Interval returns the delay between generated events, defaulting to two seconds
+func (c DemoConfig) Interval() time.Duration {
+	if c.MessagesPerMinute <= 0 {
+		return 2 * time.Second
+	}
+	return time.Minute / time.Duration(c.MessagesPerMinute)
+}
+
+// ReadTimeout returns the client read timeout as a duration, defaulting to a minute
+func (c WebSocketConfig) ReadTimeout() time.Duration {
+	if c.ReadTimeoutSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.ReadTimeoutSeconds) * time.Second
+}
+
+// ReorderWindow returns the reorder window of batched messages as a duration
+func (c WebSocketConfig) ReorderWindow() time.Duration {
+	return time.Duration(c.ReorderWindowSeconds) * time.Second
+}
+
+// HistoryLimit returns how many buffered messages a client may be sent on
+// connect, defaulting to the whole buffer
+func (c WebSocketConfig) HistoryLimit() int {
+	if c.MaxHistory <= 0 || c.MaxHistory > recentMessageLimit {
+		return recentMessageLimit
+	}
+	return c.MaxHistory
+}
+
+// defaultConfig returns the configuration used when no config file exists
+func defaultConfig() *Config {
+	return &Config{
+		Port: appPort,
+		Upstream: UpstreamConfig{
+			URLs: []string{webSocketURL},
+		},
+		Flood: FloodConfig{
+			Threshold:     defaultFloodThreshold,
+			WindowSeconds: int(defaultFloodWindow / time.Second),
+		},
+		Retention: RetentionConfig{
+			MaxFiles: maxLogFiles,
+		},
+		LogRoutes: map[string]string{
+			messageTypeStatus: logKindEvents,
+			messageTypeMedia:  logKindEvents,
+			messageTypePM:     logKindPM,
+		},
+		WebSocket: WebSocketConfig{
+			MaxFrameBytes:        64 * 1024,
+			ReadTimeoutSeconds:   60,
+			MaxViolations:        5,
+			MaxClients:           defaultMaxClients,
+			MaxClientsPerIP:      defaultMaxClientsPerIP,
+			MaxHistory:           recentMessageLimit,
+			MaxBatch:             defaultMaxBatch,
+			ReorderWindowSeconds: defaultReorderWindowSeconds,
+		},
+		AccessLog: AccessLogConfig{
+			Enabled: true,
+			Format:  "combined",
+		},
+		Disk: DiskConfig{
+			MinFreeBytes:   defaultDiskMinFree,
+			HardFloorBytes: defaultDiskHardFloor,
+		},
+		StateMaxAgeMinutes: defaultStateMaxAge,
+		Previews: PreviewConfig{
+			MaxFetchBytes: defaultPreviewMaxFetchBytes,
+			CacheMaxBytes: defaultPreviewCacheBytes,
+			TTLHours:      defaultPreviewTTLHours,
+			ThumbnailSize: defaultPreviewThumbnailSize,
+		},
+		MessageLimits: MessageLimits{
+			MaxContentLength: defaultMaxMessageContent,
+			MaxHTMLLength:    defaultMaxMessageHTML,
+		},
+		Send: SendConfig{
+			Enabled:        true,
+			Burst:          defaultSendBurst,
+			IntervalMillis: int(defaultSendInterval / time.Millisecond),
+		},
+		Shares: ShareConfig{
+			DefaultExpiryHours: defaultShareExpiryHours,
+			MaxExpiryHours:     defaultShareMaxHours,
+		},
+		Tail: TailConfig{MaxWindowHours: defaultTailMaxWindowHours},
+	}
+}
+
+// configPath returns the config file path, honoring the CYLOG_CONFIG environment variable
+func configPath() string {
+	if path := os.Getenv("CYLOG_CONFIG"); path != "" {
+		return path
+	}
+	return configFileName
+}
+
+// loadConfig reads the configuration file at path, falling back to defaults if it doesn't exist
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// The key may still come from the environment
+			if cfg.encryptionKey, err = parseEncryptionKey(cfg.Encryption); err != nil {
+				return nil, err
+			}
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if !validRotation(cfg.Rotation) {
+		return nil, fmt.Errorf("invalid rotation %q: must be hourly, daily, weekly or monthly", cfg.Rotation)
+	}
+
+	for msgType, kind := range cfg.LogRoutes {
+		if !logKindPattern.MatchString(kind) {
+			return nil, fmt.Errorf("invalid log kind %q for type %q: must be lowercase letters", kind, msgType)
+		}
+	}
+
+	if cfg.Channel != "" && !validChannelName(cfg.Channel) {
+		return nil, fmt.Errorf("invalid channel %q: must be 1-30 letters, digits, - or _", cfg.Channel)
+	}
+
+	if err := validateTokens(cfg.Tokens); err != nil {
+		return nil, err
+	}
+	if err := cfg.Login.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Sampling.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Previews.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.UsernameColors, err = validateUsernameColors(cfg.UsernameColors); err != nil {
+		return nil, err
+	}
+
+	if cfg.MessageLimits.MaxContentLength < 0 || cfg.MessageLimits.MaxHTMLLength < 0 {
+		return nil, fmt.Errorf("invalid message_limits: lengths must not be negative")
+	}
+
+	if cfg.WebSocket.MaxBatch <= 0 {
+		return nil, fmt.Errorf("invalid websocket max_batch %d: must be positive", cfg.WebSocket.MaxBatch)
+	}
+	if cfg.WebSocket.ReorderWindowSeconds < 0 {
+		return nil, fmt.Errorf("invalid websocket reorder_window_seconds %d: must not be negative", cfg.WebSocket.ReorderWindowSeconds)
+	}
+	if cfg.WebSocket.MinBridgeVersion < 0 || cfg.WebSocket.MinBridgeVersion > bridgeVersion {
+		return nil, fmt.Errorf("invalid websocket min_bridge_version %d: must be between 0 and the served bridge version %d", cfg.WebSocket.MinBridgeVersion, bridgeVersion)
+	}
+
+	if cfg.BroadcastQueueSize < 0 {
+		return nil, fmt.Errorf("invalid broadcast_queue_size %d: must not be negative", cfg.BroadcastQueueSize)
+	}
+
+	if err := cfg.Shares.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Tail.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Desktop.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.LogWriter.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.FanoutWorkers < 0 {
+		return nil, fmt.Errorf("invalid fanout_workers %d: must not be negative", cfg.FanoutWorkers)
+	}
+
+	for _, proxy := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: must be an IP address or CIDR range", proxy)
+		}
+	}
+
+	if cfg.Timezone != "" {
+		location, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+		cfg.location = location
+	}
+
+	if cfg.Notify.QuietHours != "" {
+		if _, _, err := parseQuietHours(cfg.Notify.QuietHours); err != nil {
+			return nil, err
+		}
+	}
+
+	mentions, err := compileMentions(cfg.Mentions)
+	if err != nil {
+		return nil, err
+	}
+	cfg.mentions = mentions
+
+	if cfg.encryptionKey, err = parseEncryptionKey(cfg.Encryption); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Location returns the configured timezone, or local time if none is set
+func (c *Config) Location() *time.Location {
+	if c.location == nil {
+		return time.Local
+	}
+	return c.location
+}
+
+// EncryptionKey returns the decoded log encryption key, or nil when log
+// files are written in plaintext
+func (c *Config) EncryptionKey() *[32]byte {
+	return c.encryptionKey
+}
+
+// MentionMatcher returns the compiled mention names and patterns
+func (c *Config) MentionMatcher() *mentionMatcher {
+	return c.mentions
+}
+
+// ConfigStore holds the active configuration and swaps it atomically on reload
+type ConfigStore struct {
+	path    string
+	current atomic.Pointer[Config]
+	reload  sync.Mutex
+}
+
+// NewConfigStore creates a config store for the file at path with cfg active
+func NewConfigStore(path string, cfg *Config) *ConfigStore {
+	store := &ConfigStore{path: path}
+	store.current.Store(cfg)
+	return store
+}
+
+// Get returns the active configuration; callers must not modify it
+func (s *ConfigStore) Get() *Config {
+	return s.current.Load()
+}
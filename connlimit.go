@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Default streaming connection limits
+const (
+	defaultMaxClients      = 1000
+	defaultMaxClientsPerIP = 20
+)
+
+// Connection limit errors
+var (
+	errTooManyClients      = errors.New("too many clients connected")
+	errTooManyClientsForIP = errors.New("too many clients connected from this address")
+)
+
+var (
+	clientLimitRejections = metrics.Counter("cylog_client_limit_rejections_total", "Streaming connections refused because websocket.max_clients was reached")
+	clientIPRejections    = metrics.Counter("cylog_client_ip_limit_rejections_total", "Streaming connections refused because websocket.max_clients_per_ip was reached")
+)
+
+// ConnectionLimiter counts the long-lived streaming connections, in total
+// and per remote address, so every streaming endpoint shares the limits
+type ConnectionLimiter struct {
+	total int
+	perIP map[string]int
+	mutex sync.Mutex
+}
+
+// NewConnectionLimiter creates an empty connection limiter
+func NewConnectionLimiter() *ConnectionLimiter {
+	return &ConnectionLimiter{perIP: make(map[string]int)}
+}
+
+// Acquire reserves a connection slot for ip under the given limits, where
+// zero means unlimited. The limits are passed in on each call, so a reload
+// applies to new connections without touching existing ones.
+func (l *ConnectionLimiter) Acquire(ip string, maxTotal, maxPerIP int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if maxTotal > 0 && l.total >= maxTotal {
+		clientLimitRejections.Inc()
+		return fmt.Errorf("%w (limit %d)", errTooManyClients, maxTotal)
+	}
+	if maxPerIP > 0 && l.perIP[ip] >= maxPerIP {
+		clientIPRejections.Inc()
+		return fmt.Errorf("%w (limit %d)", errTooManyClientsForIP, maxPerIP)
+	}
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+// Release frees a slot reserved by Acquire
+func (l *ConnectionLimiter) Release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.perIP[ip] <= 0 {
+		return
+	}
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] == 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// Count returns the number of connections holding a slot
+func (l *ConnectionLimiter) Count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.total
+}
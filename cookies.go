@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errCookiesExpired marks an upstream handshake rejected while the configured
+// session cookies had expired, so the status endpoint can tell it apart
+var errCookiesExpired = errors.New("session cookies expired")
+
+// fileCookie is a cookie entry read from a Netscape cookies.txt file
+type fileCookie struct {
+	Domain            string
+	IncludeSubdomains bool
+	Path              string
+	Secure            bool
+	Expires           time.Time
+	Name              string
+	Value             string
+}
+
+// parseCookiesFile reads a Netscape-format cookies.txt file as exported by
+// browser extensions and curl
+func parseCookiesFile(path string) ([]fileCookie, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cookies file: %w", err)
+	}
+	defer file.Close()
+
+	var cookies []fileCookie
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		// Cookies marked HttpOnly are prefixed rather than commented out
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("cookies file line %d: expected 7 tab-separated fields, got %d", lineNumber, len(fields))
+		}
+
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cookies file line %d: invalid expiry %q", lineNumber, fields[4])
+		}
+
+		cookie := fileCookie{
+			Domain:            strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			IncludeSubdomains: strings.EqualFold(fields[1], "TRUE"),
+			Path:              fields[2],
+			Secure:            strings.EqualFold(fields[3], "TRUE"),
+			Name:              fields[5],
+			Value:             fields[6],
+		}
+		// An expiry of zero is a session cookie that never expires on its own
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, cookie)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cookies file: %w", err)
+	}
+	return cookies, nil
+}
+
+// matches reports whether the cookie would be sent to u
+func (c fileCookie) matches(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if host != c.Domain && !(c.IncludeSubdomains && strings.HasSuffix(host, "."+c.Domain)) {
+		return false
+	}
+	if c.Secure && u.Scheme != "https" && u.Scheme != "wss" {
+		return false
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return c.Path == "" || strings.HasPrefix(path, c.Path)
+}
+
+// requestHeader builds the handshake headers for dialing target: the
+// configured headers plus cookies from the config and the cookies file. It
+// also reports whether a cookie for target had expired and was left out.
+func (c UpstreamConfig) requestHeader(target string, now time.Time) (http.Header, bool, error) {
+	header := make(http.Header)
+	for name, value := range c.Headers {
+		header.Set(name, value)
+	}
+
+	names := make([]string, 0, len(c.Cookies))
+	for name := range c.Cookies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, name+"="+c.Cookies[name])
+	}
+
+	expired := false
+	if c.CookiesFile != "" {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid upstream URL: %w", err)
+		}
+
+		cookies, err := parseCookiesFile(c.CookiesFile)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, cookie := range cookies {
+			if !cookie.matches(u) {
+				continue
+			}
+			if !cookie.Expires.IsZero() && now.After(cookie.Expires) {
+				expired = true
+				continue
+			}
+			pairs = append(pairs, cookie.Name+"="+cookie.Value)
+		}
+	}
+
+	if len(pairs) > 0 {
+		if existing := header.Get("Cookie"); existing != "" {
+			pairs = append([]string{existing}, pairs...)
+		}
+		header.Set("Cookie", strings.Join(pairs, "; "))
+	}
+	return header, expired, nil
+}
+
+// sensitiveHeaderWords mark header names whose values must not be logged
+var sensitiveHeaderWords = []string{"cookie", "authorization", "token", "secret", "key", "session", "auth"}
+
+// redactHeader returns a loggable copy of header with sensitive values hidden
+func redactHeader(header http.Header) map[string]string {
+	redacted := make(map[string]string, len(header))
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		lower := strings.ToLower(name)
+		for _, word := range sensitiveHeaderWords {
+			if strings.Contains(lower, word) {
+				value = redactedText
+				break
+			}
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Socket.IO (Engine.IO v3) packet prefixes used by Cytube
+const (
+	engineIOOpen        = "0"
+	engineIOPing        = "2"
+	engineIOPong        = "3"
+	socketIOConnect     = "40"
+	socketIOEventPrefix = "42"
+)
+
+// cytubeEvent is a decoded Socket.IO event frame
+type cytubeEvent struct {
+	Name string
+	Data json.RawMessage
+}
+
+// cytubeChatMsg is the payload of a chatMsg or pm event
+type cytubeChatMsg struct {
+	Username string                 `json:"username"`
+	Msg      string                 `json:"msg"`
+	Time     int64                  `json:"time"`
+	Meta     map[string]interface{} `json:"meta"`
+	To       string                 `json:"to,omitempty"`
+}
+
+// cytubeAnnouncement is the payload of a server-wide announcement event
+type cytubeAnnouncement struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	From  string `json:"from"`
+}
+
+// cytubeServerName is the username Cytube sends its own channel notices as
+const cytubeServerName = "[server]"
+
+// cytubeUser is a userlist entry as sent by Cytube
+type cytubeUser struct {
+	Name    string         `json:"name"`
+	Rank    int            `json:"rank"`
+	Profile cytubeProfile  `json:"profile"`
+	Meta    cytubeUserMeta `json:"meta"`
+}
+
+// cytubeUserMeta holds the user flags Cytube sends with a userlist entry
+type cytubeUserMeta struct {
+	AFK bool `json:"afk"`
+}
+
+// cytubeProfile is a user's profile as sent by Cytube
+type cytubeProfile struct {
+	Image string `json:"image"`
+	Text  string `json:"text"`
+}
+
+// cytubeUserChange is the payload of setAFK, setUserRank and setUserProfile events
+type cytubeUserChange struct {
+	Name    string        `json:"name"`
+	AFK     bool          `json:"afk"`
+	Rank    int           `json:"rank"`
+	Profile cytubeProfile `json:"profile"`
+}
+
+// parseCytubeEvent decodes a frame like 42["chatMsg",{...}] into an event
+func parseCytubeEvent(data []byte) (cytubeEvent, bool) {
+	frame := string(data)
+	if !strings.HasPrefix(frame, socketIOEventPrefix) {
+		return cytubeEvent{}, false
+	}
+
+	// Skip the optional ack id between the prefix and the payload
+	payload := strings.TrimLeft(frame[len(socketIOEventPrefix):], "0123456789")
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &parts); err != nil || len(parts) == 0 {
+		return cytubeEvent{}, false
+	}
+
+	var event cytubeEvent
+	if err := json.Unmarshal(parts[0], &event.Name); err != nil {
+		return cytubeEvent{}, false
+	}
+	if len(parts) > 1 {
+		event.Data = parts[1]
+	}
+	return event, true
+}
+
+// htmlTagPattern matches HTML tags for stripping them from chat messages
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// htmlToText converts a Cytube chat message's HTML into plain text
+func htmlToText(s string) string {
+	return html.UnescapeString(htmlTagPattern.ReplaceAllString(s, ""))
+}
+
+// handleCytubeFrame processes a single frame received from the Cytube WebSocket
+func (s *ChatServer) handleCytubeFrame(conn *websocket.Conn, data []byte) {
+	// A malformed frame must not take down the upstream reader
+	defer recoverPanic("Cytube frame handler")
+
+	frame := string(data)
+
+	switch {
+	case frame == engineIOPing:
+		if err := s.writeUpstream(conn, []byte(engineIOPong)); err != nil {
+			log.Printf("Error sending pong to Cytube: %v", err)
+		}
+		return
+	case frame == engineIOPong:
+		return
+	case strings.HasPrefix(frame, engineIOOpen):
+		// The Engine.IO handshake; pings are sent at our own interval
+		return
+	case frame == socketIOConnect:
+		s.joinChannel(conn)
+		s.login(conn)
+		return
+	}
+
+	event, ok := parseCytubeEvent(data)
+	if !ok {
+		// Not a Socket.IO event; pass the frame through as a raw message
+		s.ingestMessage(Message{
+			ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+			Username:  "User",
+			Timestamp: time.Now(),
+			Content:   frame,
+			HTML:      frame,
+		})
+		return
+	}
+
+	s.handleCytubeEvent(event)
+}
+
+// handleCytubeEvent dispatches a decoded Cytube event
+func (s *ChatServer) handleCytubeEvent(event cytubeEvent) {
+	now := time.Now()
+
+	switch event.Name {
+	case "chatMsg":
+		var payload cytubeChatMsg
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			log.Printf("Error decoding chatMsg: %v", err)
+			return
+		}
+
+		msg := s.chatMessage(payload, now)
+		if msg.Type != messageTypeSystem {
+			s.presence.Seen(payload.Username, msg.Timestamp)
+		}
+		s.ingestMessage(msg)
+
+	case "pm":
+		var payload cytubeChatMsg
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			log.Printf("Error decoding pm: %v", err)
+			return
+		}
+
+		msg := s.chatMessage(payload, now)
+		msg.Type = messageTypePM
+		if msg.Meta == nil {
+			msg.Meta = make(map[string]interface{})
+		}
+		msg.Meta["to"] = payload.To
+		s.ingestMessage(msg)
+
+	case "announcement":
+		var payload cytubeAnnouncement
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			log.Printf("Error decoding announcement: %v", err)
+			return
+		}
+
+		s.ingestMessage(Message{
+			ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+			Type:      messageTypeAnnouncement,
+			Username:  payload.From,
+			Timestamp: now,
+			Content:   payload.Title + ": " + htmlToText(payload.Text),
+			HTML:      "<strong>" + html.EscapeString(payload.Title) + "</strong> " + payload.Text,
+		})
+
+	case "needPassword":
+		s.sendChannelPassword()
+
+	case "login":
+		var result cytubeLogin
+		if err := json.Unmarshal(event.Data, &result); err != nil {
+			log.Printf("Error decoding login: %v", err)
+			return
+		}
+		s.handleLogin(result)
+
+	case "userlist":
+		var users []cytubeUser
+		if err := json.Unmarshal(event.Data, &users); err != nil {
+			log.Printf("Error decoding userlist: %v", err)
+			return
+		}
+
+		names := make([]string, 0, len(users))
+		channelUsers := make([]ChannelUser, 0, len(users))
+		for _, user := range users {
+			names = append(names, user.Name)
+			channelUsers = append(channelUsers, newChannelUser(user))
+		}
+		s.presence.Snapshot(names, now)
+		s.userlist.Replace(channelUsers)
+		s.publishUserlist("snapshot", nil)
+
+	case "addUser":
+		var user cytubeUser
+		if err := json.Unmarshal(event.Data, &user); err != nil {
+			log.Printf("Error decoding addUser: %v", err)
+			return
+		}
+		s.presence.Join(user.Name, now)
+
+		channelUser := newChannelUser(user)
+		s.userlist.Add(channelUser)
+		s.publishUserlist("join", &channelUser)
+
+	case "userLeave":
+		var user cytubeUser
+		if err := json.Unmarshal(event.Data, &user); err != nil {
+			log.Printf("Error decoding userLeave: %v", err)
+			return
+		}
+		s.presence.Leave(user.Name, now)
+
+		if s.userlist.Remove(user.Name) {
+			s.publishUserlist("leave", &ChannelUser{Name: user.Name})
+		}
+
+	case "setAFK", "setUserRank", "setUserProfile":
+		var change cytubeUserChange
+		if err := json.Unmarshal(event.Data, &change); err != nil {
+			log.Printf("Error decoding %s: %v", event.Name, err)
+			return
+		}
+
+		user, ok := s.userlist.Update(change.Name, func(user *ChannelUser) {
+			switch event.Name {
+			case "setAFK":
+				user.AFK = change.AFK
+			case "setUserRank":
+				user.Rank = change.Rank
+			case "setUserProfile":
+				user.ProfileImage = change.Profile.Image
+			}
+		})
+		if ok {
+			s.publishUserlist("update", &user)
+		}
+
+	case "playlist", "queue", "delete", "setCurrent", "changeMedia":
+		s.handleMediaEvent(event, now)
+
+	case "setMOTD":
+		s.handleMOTD(event.Data, now)
+
+	case "emoteList":
+		var emotes []cytubeEmote
+		if err := json.Unmarshal(event.Data, &emotes); err != nil {
+			log.Printf("Error decoding emoteList: %v", err)
+			return
+		}
+		s.emotes.SetEmotes(emotes)
+	}
+}
+
+// chatMessage converts a chatMsg payload, classifying it by the formatting
+// Cytube applied: /me actions, /m and /say moderator messages, and notices
+// from the server. Actions are rendered as "* user does a thing" in HTML.
+func (s *ChatServer) chatMessage(payload cytubeChatMsg, now time.Time) Message {
+	rank, meta := s.senderState(payload)
+	return newChatMessage(payload, now, rank, meta)
+}
+
+// newChatMessage builds the message for a chatMsg payload from a sender of
+// the given rank, typed by the payload's flags
+func newChatMessage(payload cytubeChatMsg, now time.Time, rank int, meta map[string]interface{}) Message {
+	timestamp := now
+	if payload.Time > 0 {
+		timestamp = time.UnixMilli(payload.Time)
+	}
+
+	msg := Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Username:  payload.Username,
+		Rank:      rank,
+		Timestamp: timestamp,
+		Content:   htmlToText(payload.Msg),
+		HTML:      payload.Msg,
+		Meta:      meta,
+	}
+
+	addClass, _ := payload.Meta["addClass"].(string)
+	_, modflair := payload.Meta["modflair"]
+	switch {
+	case payload.Username == cytubeServerName:
+		msg.Type = messageTypeSystem
+	case addClass == "action":
+		msg.Type = messageTypeAction
+		msg.HTML = "* " + html.EscapeString(payload.Username) + " " + payload.Msg
+	case addClass == "shout" || modflair:
+		msg.Type = messageTypeMod
+	}
+	return msg
+}
+
+// senderState returns the rank of a chat message's sender and the meta to
+// store with the message: afk from the tracked userlist and shadowmuted
+// from the payload. The userlist rank is used when the sender is listed,
+// otherwise the mod flair Cytube attaches to the message.
+func (s *ChatServer) senderState(payload cytubeChatMsg) (int, map[string]interface{}) {
+	rank, meta := payloadSenderState(payload)
+	if user, ok := s.userlist.Get(payload.Username); ok {
+		rank = user.Rank
+		if user.AFK {
+			if meta == nil {
+				meta = make(map[string]interface{})
+			}
+			meta["afk"] = true
+		}
+	}
+	return rank, meta
+}
+
+// payloadSenderState returns what a chat message's payload alone says of
+// its sender: the rank of its mod flair and whether it was shadowmuted
+func payloadSenderState(payload cytubeChatMsg) (int, map[string]interface{}) {
+	var meta map[string]interface{}
+	rank := rankGuest
+	if flair, ok := payload.Meta["modflair"].(float64); ok {
+		rank = int(flair)
+	}
+	if shadow, ok := payload.Meta["shadow"].(bool); ok && shadow {
+		meta = map[string]interface{}{"shadowmuted": true}
+	}
+	return rank, meta
+}
+
+// joinChannel asks Cytube to join the configured channel
+func (s *ChatServer) joinChannel(conn *websocket.Conn) {
+	channel := s.Config().Channel
+	if channel == "" {
+		return
+	}
+
+	if err := s.emitUpstream(conn, "joinChannel", map[string]string{"name": channel}); err != nil {
+		log.Printf("Error joining channel %s: %v", channel, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DebugConfig configures the pprof and expvar diagnostics endpoints
+type DebugConfig struct {
+	// Enabled mounts the endpoints under /debug, behind the admin token
+	Enabled bool `yaml:"enabled"`
+
+	// Listen serves the endpoints on a separate port instead of the main
+	// server; only loopback addresses are accepted, and a bare port binds
+	// to 127.0.0.1
+	Listen string `yaml:"listen"`
+
+	// RecordRaw writes every raw upstream frame to logs/raw-<date>.bin for
+	// replaying with cylog replay-raw; the last frames are kept in memory
+	// for /api/v1/admin/raw whenever debugging is on
+	RecordRaw bool `yaml:"record_raw"`
+
+	// RawMaxBytes caps the size of a day's recording, default 64 MiB
+	RawMaxBytes int64 `yaml:"raw_max_bytes"`
+
+	// KeepRawContent keeps the content of messages changed by normalization
+	// as received, in their raw_content field
+	KeepRawContent bool `yaml:"keep_raw_content"`
+}
+
+// publishExpvarsOnce guards expvar registration, which panics on duplicates
+var publishExpvarsOnce sync.Once
+
+// publishExpvars exposes basic server state through expvar
+func publishExpvars(chatServer *ChatServer) {
+	publishExpvarsOnce.Do(func() {
+		expvar.Publish("buffer_length", expvar.Func(func() interface{} {
+			chatServer.messagesMux.RLock()
+			defer chatServer.messagesMux.RUnlock()
+			return len(chatServer.messages)
+		}))
+		expvar.Publish("clients", expvar.Func(func() interface{} {
+			return len(chatServer.Clients())
+		}))
+		expvar.Publish("goroutines", expvar.Func(func() interface{} {
+			return runtime.NumGoroutine()
+		}))
+	})
+}
+
+// registerDebugRoutes mounts the pprof and expvar handlers on group
+func registerDebugRoutes(group *gin.RouterGroup, chatServer *ChatServer) {
+	publishExpvars(chatServer)
+
+	group.GET("/vars", gin.WrapH(expvar.Handler()))
+	group.GET("/pprof/*profile", func(c *gin.Context) {
+		switch strings.TrimPrefix(c.Param("profile"), "/") {
+		case "cmdline":
+			pprof.Cmdline(c.Writer, c.Request)
+		case "profile":
+			pprof.Profile(c.Writer, c.Request)
+		case "symbol":
+			pprof.Symbol(c.Writer, c.Request)
+		case "trace":
+			pprof.Trace(c.Writer, c.Request)
+		default:
+			// Index also serves named profiles such as heap and goroutine
+			pprof.Index(c.Writer, c.Request)
+		}
+	})
+	group.POST("/pprof/symbol", gin.WrapF(pprof.Symbol))
+}
+
+// debugListenAddr validates the separate debug listen address
+func debugListenAddr(listen string) (string, error) {
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", fmt.Errorf("invalid debug listen address: %w", err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("debug listen address must be a loopback address, got %s", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// startDebugServer serves the debug endpoints on the configured separate
+// port until ctx is canceled
+func startDebugServer(ctx context.Context, chatServer *ChatServer) error {
+	addr, err := debugListenAddr(chatServer.Config().Debug.Listen)
+	if err != nil {
+		return err
+	}
+
+	router := gin.New()
+	router.Use(recoveryMiddleware(), apiMiddleware())
+	registerDebugRoutes(router.Group("/debug", requireAdmin(chatServer.config)), chatServer)
+
+	server := &http.Server{Addr: addr, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Debug server error: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Debug endpoints listening on %s", addr)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugRoutesNotFoundWhenDisabled(t *testing.T) {
+	paths := []string{"/debug/vars", "/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline"}
+	tests := []struct {
+		name  string
+		debug DebugConfig
+		want  int
+	}{
+		{name: "disabled", want: http.StatusNotFound},
+		{name: "on a separate port", debug: DebugConfig{Enabled: true, Listen: "127.0.0.1:6060"}, want: http.StatusNotFound},
+		{name: "enabled", debug: DebugConfig{Enabled: true}, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.AdminToken = "admin-secret"
+			cfg.Debug = tt.debug
+			_, router := newTestServer(t, cfg)
+
+			for _, path := range paths {
+				// The variables include the client count, which needs the hub running
+				if path == "/debug/vars" && tt.want == http.StatusOK {
+					continue
+				}
+				for _, token := range []string{"", "admin-secret"} {
+					req := httptest.NewRequest(http.MethodGet, path, nil)
+					if token != "" {
+						req.Header.Set("Authorization", "Bearer "+token)
+					}
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, req)
+
+					want := tt.want
+					if want == http.StatusOK && token == "" {
+						want = http.StatusUnauthorized
+					}
+					if w.Code != want {
+						t.Errorf("GET %s with token %q: status %d, want %d", path, token, w.Code, want)
+					}
+				}
+			}
+		})
+	}
+}
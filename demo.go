@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cylog/internal/demo"
+)
+
+// demoUpstreamURL is reported as the active upstream in demo mode
+const demoUpstreamURL = "demo"
+
+// runDemoUpstream feeds generated Cytube frames through the same frame
+// handler as a live connection until ctx is canceled. Nothing can be sent
+// upstream, so local clients' messages are refused as when disconnected.
+func (s *ChatServer) runDemoUpstream(ctx context.Context) {
+	defer recoverPanic("demo upstream")
+
+	cfg := s.Config().Demo
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	generator := demo.NewGenerator(seed, cfg.Users)
+	log.Printf("Demo mode: generating traffic every %s with seed %d", cfg.Interval(), seed)
+
+	s.upstream.setConnected(demoUpstreamURL, nil)
+	s.publishStatus("connected", "Connected to demo traffic generator", map[string]interface{}{"url": demoUpstreamURL})
+	for _, frame := range generator.Initial() {
+		s.handleCytubeFrame(nil, frame)
+	}
+
+	ticker := time.NewTicker(cfg.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.upstream.setDisconnected(nil)
+			return
+		case now := <-ticker.C:
+			s.upstream.frameReceived(now)
+			s.handleCytubeFrame(nil, generator.Next(now))
+		}
+	}
+}
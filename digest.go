@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Digest limits and timing
+const (
+	digestTopUsers       = 10
+	digestTopLinks       = 10
+	digestCheckInterval  = 10 * time.Minute
+	digestWebhookTimeout = 10 * time.Second
+)
+
+// DigestConfig configures the daily digest
+type DigestConfig struct {
+	// Enabled generates the previous day's digest automatically after midnight
+	Enabled bool `yaml:"enabled"`
+
+	// WebhookURL receives each generated digest as a JSON POST
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// Digest summarizes a day of chat
+type Digest struct {
+	Date         string          `json:"date"`
+	GeneratedAt  time.Time       `json:"generated_at"`
+	MessageCount int             `json:"message_count"`
+	UniqueUsers  int             `json:"unique_users"`
+	TopUsers     []*UserStats    `json:"top_users"`
+	TopLinks     []*SharedLink   `json:"top_links"`
+	Media        []MediaItem     `json:"media"`
+	BusiestHour  *ActivityBucket `json:"busiest_hour,omitempty"`
+}
+
+// digestPath returns where the digest of a date is stored
+func digestPath(date string) string {
+	return filepath.Join(logsDir, "digest-"+date+".json")
+}
+
+// GenerateDigest builds the digest of a day from the statistics, link and
+// media indexes and writes it to digest-<date>.json
+func (s *ChatServer) GenerateDigest(date time.Time) (*Digest, error) {
+	date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.Local)
+	day := date.Format(logDateFormat)
+	digest := &Digest{Date: day, GeneratedAt: time.Now()}
+
+	files, err := s.logger.GetLogsInRange(date, date)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*UserStats, 0)
+	merged := make(map[string]*UserStats)
+	err = s.stats.Collect(files, func(stats *fileStats) {
+		for username, user := range stats.users {
+			total, ok := merged[username]
+			if !ok {
+				total = &UserStats{Username: username}
+				merged[username] = total
+				users = append(users, total)
+			}
+			total.merge(user)
+			digest.MessageCount += user.MessageCount
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].MessageCount != users[j].MessageCount {
+			return users[i].MessageCount > users[j].MessageCount
+		}
+		return users[i].Username < users[j].Username
+	})
+	digest.UniqueUsers = len(users)
+	if len(users) > digestTopUsers {
+		users = users[:digestTopUsers]
+	}
+	digest.TopUsers = users
+
+	links, err := s.SharedLinks(date, date, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(links, func(i, j int) bool { return links[i].Count > links[j].Count })
+	if len(links) > digestTopLinks {
+		links = links[:digestTopLinks]
+	}
+	digest.TopLinks = links
+
+	if digest.Media, err = s.media.History(date, date); err != nil {
+		return nil, err
+	}
+
+	buckets, err := activityHistogram(s, "hour", date, date)
+	if err != nil {
+		return nil, err
+	}
+	for i := range buckets {
+		if buckets[i].Count > 0 && (digest.BusiestHour == nil || buckets[i].Count > digest.BusiestHour.Count) {
+			digest.BusiestHour = &buckets[i]
+		}
+	}
+
+	data, err := json.MarshalIndent(digest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode digest: %w", err)
+	}
+	if err := writeFileAtomic(digestPath(day), data); err != nil {
+		return nil, fmt.Errorf("failed to write digest: %w", err)
+	}
+
+	if url := s.Config().Digest.WebhookURL; url != "" && writable() {
+		go s.postDigest(url, data)
+	}
+	return digest, nil
+}
+
+// postDigest sends a generated digest to the configured webhook
+func (s *ChatServer) postDigest(url string, data []byte) {
+	defer recoverPanic("digest webhook")
+
+	client := &http.Client{Timeout: digestWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Error posting digest: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Error posting digest: webhook returned %s", resp.Status)
+	}
+}
+
+// generateMissedDigest is the digest job: it writes yesterday's digest
+// once the day has ended, if it is missing and there was chat that day
+func (s *ChatServer) generateMissedDigest(ctx context.Context) error {
+	now := time.Now()
+	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.Local)
+	if _, err := os.Stat(digestPath(yesterday.Format(logDateFormat))); !errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	files, err := s.logger.GetLogsInRange(yesterday, yesterday)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	if _, err := s.GenerateDigest(yesterday); err != nil {
+		return fmt.Errorf("failed to generate digest for %s: %w", yesterday.Format(logDateFormat), err)
+	}
+	log.Printf("Generated digest for %s", yesterday.Format(logDateFormat))
+	return nil
+}
+
+// registerDigestRoutes registers the endpoint serving generated digests
+func registerDigestRoutes(api *gin.RouterGroup) {
+	api.GET("/digests/:date", func(c *gin.Context) {
+		date, err := time.ParseInLocation(logDateFormat, c.Param("date"), time.Local)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, "invalid date")
+			return
+		}
+
+		data, err := os.ReadFile(digestPath(date.Format(logDateFormat)))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				apiError(c, http.StatusNotFound, "no digest for this date")
+				return
+			}
+			respondError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+	})
+}
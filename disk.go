@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"sync"
+	"time"
+)
+
+// Disk monitoring defaults
+const (
+	defaultDiskMinFree       = 512 * 1024 * 1024
+	defaultDiskHardFloor     = 64 * 1024 * 1024
+	defaultDiskCheckInterval = 30 * time.Second
+)
+
+// Logging modes reported by the status endpoint
+const (
+	loggingModeNormal   = "normal"
+	loggingModeLowSpace = "low_space"
+	loggingModeDegraded = "degraded"
+	loggingModeFailing  = "failing"
+	loggingModePaused   = "paused"
+	loggingModeDryRun   = "dry_run"
+)
+
+var (
+	diskLowEvents      = metrics.Counter("cylog_disk_low_events_total", "Times free space on the logs volume dropped below disk.min_free_bytes")
+	diskDegradedEvents = metrics.Counter("cylog_logging_degraded_events_total", "Times file logging was paused because the logs volume was nearly full")
+)
+
+// DiskConfig configures free space monitoring of the logs volume; a zero
+// threshold disables the corresponding behavior
+type DiskConfig struct {
+	// MinFreeBytes triggers an emergency retention pass and a warning when
+	// free space drops below it; logging resumes once free space is back above it
+	MinFreeBytes int64 `yaml:"min_free_bytes"`
+
+	// HardFloorBytes pauses writing log files while free space stays below
+	// it; messages are still broadcast
+	HardFloorBytes int64 `yaml:"hard_floor_bytes"`
+
+	// CheckIntervalSeconds is how often free space is checked
+	CheckIntervalSeconds int `yaml:"check_interval_seconds"`
+
+	// MaxLogBytes caps the total size of the log files, app.log and
+	// access.log included; the least recently written closed files are
+	// deleted first
+	MaxLogBytes int64 `yaml:"max_log_bytes"`
+
+	// EmergencyRetention is applied to every log kind, on top of the normal
+	// policies, while free space is low
+	EmergencyRetention RetentionConfig `yaml:"emergency_retention"`
+}
+
+// CheckInterval returns how often free space is checked
+func (c DiskConfig) CheckInterval() time.Duration {
+	if c.CheckIntervalSeconds <= 0 {
+		return defaultDiskCheckInterval
+	}
+	return time.Duration(c.CheckIntervalSeconds) * time.Second
+}
+
+// LoggingStatus reports whether log files are being written
+type LoggingStatus struct {
+	Mode         string     `json:"mode"`
+	FreeBytes    *uint64    `json:"free_bytes,omitempty"`
+	CheckedAt    *time.Time `json:"checked_at,omitempty"`
+	PausedSince  *time.Time `json:"paused_since,omitempty"`
+	DroppedLines int        `json:"dropped_lines,omitempty"`
+	UsedBytes    int64      `json:"used_bytes"`
+	MaxBytes     int64      `json:"max_bytes,omitempty"`
+	SamplingRate int        `json:"sampling_rate,omitempty"`
+
+	// WriteFailures counts the consecutive failed writes, and LastWriteError
+	// is the latest one, kept after writes recover
+	WriteFailures  int              `json:"write_failures,omitempty"`
+	LastWriteError *LogWriteFailure `json:"last_write_error,omitempty"`
+}
+
+// diskState is the outcome of the latest free space check
+type diskState struct {
+	free      uint64
+	checkedAt time.Time
+	low       bool
+	mutex     sync.Mutex
+}
+
+// LoggingStatus returns the current logging mode and free space
+func (s *ChatServer) LoggingStatus() LoggingStatus {
+	s.disk.mutex.Lock()
+	defer s.disk.mutex.Unlock()
+
+	status := LoggingStatus{Mode: loggingModeNormal, UsedBytes: s.logger.usage.Total(), MaxBytes: s.logger.SizeCap()}
+	if !s.disk.checkedAt.IsZero() {
+		free, checkedAt := s.disk.free, s.disk.checkedAt
+		status.FreeBytes = &free
+		status.CheckedAt = &checkedAt
+	}
+	if s.disk.low {
+		status.Mode = loggingModeLowSpace
+	}
+	status.WriteFailures, status.LastWriteError = s.writeFailures()
+	if status.WriteFailures > 0 {
+		status.Mode = loggingModeFailing
+	}
+	if since, dropped, paused := s.logger.Paused(); paused {
+		status.Mode = loggingModeDegraded
+		status.PausedSince = &since
+		status.DroppedLines = dropped
+	}
+	if since, held := s.logger.Held(); held {
+		status.Mode = loggingModePaused
+		status.PausedSince = &since
+	}
+	if !writable() {
+		status.Mode = loggingModeDryRun
+	}
+	if sampling := s.SamplingStatus(); sampling.Rate > 1 {
+		status.SamplingRate = sampling.Rate
+	}
+	return status
+}
+
+// newDiskCheck registers the logs volume metrics and returns the disk job,
+// which checks free space on the logs volume and enforces the log
+// directory cap
+func (s *ChatServer) newDiskCheck() func(ctx context.Context) error {
+	metrics.Gauge("cylog_logs_free_bytes", "Free bytes on the volume holding the logs directory", func() float64 {
+		s.disk.mutex.Lock()
+		defer s.disk.mutex.Unlock()
+		return float64(s.disk.free)
+	})
+	metrics.Gauge("cylog_logging_degraded", "1 while log files are not written because the logs volume is nearly full", func() float64 {
+		if _, _, paused := s.logger.Paused(); paused {
+			return 1
+		}
+		return 0
+	})
+
+	metrics.Gauge("cylog_log_write_consecutive_failures", "Consecutive batches of messages that failed to be written to the log files", func() float64 {
+		failures, _ := s.writeFailures()
+		return float64(failures)
+	})
+
+	metrics.Gauge("cylog_logging_paused", "1 while an admin has paused logging", func() float64 {
+		if _, held := s.logger.Held(); held {
+			return 1
+		}
+		return 0
+	})
+
+	metrics.Gauge("cylog_logs_used_bytes", "Total size of the log files in the logs directory", func() float64 {
+		return float64(s.logger.usage.Total())
+	})
+
+	supported := true
+	return func(ctx context.Context) error {
+		if _, err := s.logger.EnforceSizeCap(); err != nil {
+			return fmt.Errorf("failed to enforce log directory cap: %w", err)
+		}
+
+		// A dry run has no logs volume to watch
+		if !supported || !writable() {
+			return nil
+		}
+		err := s.checkDisk(s.Config().Disk)
+		if errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("Disk space monitoring is not supported on this platform")
+			supported = false
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check free disk space: %w", err)
+		}
+		return nil
+	}
+}
+
+// checkDisk measures free space and moves between the normal, low space
+// and degraded modes
+func (s *ChatServer) checkDisk(cfg DiskConfig) error {
+	free, err := freeDiskBytes(s.logger.dir)
+	if err != nil {
+		return err
+	}
+
+	low := cfg.MinFreeBytes > 0 && free < uint64(cfg.MinFreeBytes)
+	s.disk.mutex.Lock()
+	wasLow := s.disk.low
+	s.disk.mutex.Unlock()
+
+	if low {
+		if !wasLow {
+			diskLowEvents.Inc()
+			log.Printf("Low disk space: %d bytes free in %s, pruning log files", free, s.logger.dir)
+			s.publishDiskEvent(loggingModeLowSpace, fmt.Sprintf("Low disk space: %d MB free for logs", free/(1024*1024)), free)
+		}
+		s.emergencyPrune(cfg.EmergencyRetention)
+		if free, err = freeDiskBytes(s.logger.dir); err != nil {
+			return err
+		}
+		low = free < uint64(cfg.MinFreeBytes)
+	}
+
+	s.disk.mutex.Lock()
+	s.disk.free = free
+	s.disk.checkedAt = time.Now()
+	s.disk.low = low
+	s.disk.mutex.Unlock()
+
+	// Resume only once free space is back above the warning threshold so a
+	// volume hovering at the floor doesn't flap
+	_, _, paused := s.logger.Paused()
+	switch {
+	case !paused && cfg.HardFloorBytes > 0 && free < uint64(cfg.HardFloorBytes):
+		diskDegradedEvents.Inc()
+		s.logger.Pause(time.Now())
+		log.Printf("Disk nearly full: %d bytes free, pausing log files", free)
+		s.publishDiskEvent(loggingModeDegraded, "Disk nearly full: log files are paused, messages are still shown", free)
+	case paused && !low && (cfg.HardFloorBytes <= 0 || free >= uint64(cfg.HardFloorBytes)):
+		dropped, err := s.logger.Resume(time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to resume log files: %w", err)
+		}
+		log.Printf("Disk space recovered: %d bytes free, resuming log files after %d unwritten lines", free, dropped)
+		s.publishDiskEvent(loggingModeNormal, "Disk space recovered: log files resumed", free)
+	}
+	return nil
+}
+
+// emergencyPrune applies the normal retention policy of every log kind,
+// and the emergency policy when one is configured
+func (s *ChatServer) emergencyPrune(emergency RetentionConfig) {
+	logs, err := s.logger.GetAvailableLogs()
+	if err != nil {
+		log.Printf("Error listing log files: %v", err)
+		return
+	}
+	for kind := range logs {
+		s.logger.logMutex.Lock()
+		retention := s.logger.retentionFor(kind)
+		s.logger.logMutex.Unlock()
+
+		for _, policy := range []RetentionConfig{retention, emergency} {
+			if policy == (RetentionConfig{}) {
+				continue
+			}
+			if _, err := s.logger.PruneKind(kind, policy); err != nil {
+				log.Printf("Error pruning %s log files: %v", kind, err)
+			}
+		}
+	}
+}
+
+// publishDiskEvent announces a logging mode change as a system message
+func (s *ChatServer) publishDiskEvent(mode, content string, free uint64) {
+	s.publishMessage(Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Type:      messageTypeSystem,
+		Username:  "System",
+		Timestamp: time.Now(),
+		Content:   content,
+		HTML:      html.EscapeString(content),
+		Meta:      map[string]interface{}{"event": "disk", "mode": mode, "free_bytes": free},
+	})
+}
+
+// Pause stops writing log files; lines logged meanwhile are counted and
+// dropped instead of failing
+func (l *Logger) Pause(now time.Time) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	l.pause(now)
+}
+
+// pause enters degraded mode; the caller must hold logMutex
+func (l *Logger) pause(now time.Time) {
+	if l.pausedSince.IsZero() {
+		l.pausedSince = now
+		l.droppedLines = 0
+	}
+}
+
+// Paused reports whether log files are paused, since when and how many
+// lines have been dropped
+func (l *Logger) Paused() (time.Time, int, bool) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	return l.pausedSince, l.droppedLines, !l.pausedSince.IsZero()
+}
+
+// Resume restarts writing log files, marking the gap in the chat log, and
+// returns the number of lines that were not written
+func (l *Logger) Resume(now time.Time) (int, error) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if l.pausedSince.IsZero() {
+		return 0, nil
+	}
+	since, dropped := l.pausedSince, l.droppedLines
+	l.pausedSince = time.Time{}
+	l.droppedLines = 0
+
+	content := fmt.Sprintf("Logging gap: %d lines were not written between %s and %s because the disk was full",
+		dropped, since.Format(logTimeFormat), now.Format(logTimeFormat))
+	if err := l.writeLine(logKindChat, gapMarker(content, now)); err != nil {
+		return dropped, err
+	}
+	return dropped, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+// freeDiskBytes isn't implemented on this platform, so disk monitoring is off
+func freeDiskBytes(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
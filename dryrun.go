@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+// dryRun is set by --dry-run: cylog then writes nothing to disk and pushes
+// nothing to other services, while the live API and WebSocket keep working
+var dryRun atomic.Bool
+
+// errDryRun is returned by operations that would change files on disk
+var errDryRun = errors.New("dry run: nothing is written to disk")
+
+// writable reports whether cylog may write to disk and cause side effects
+// elsewhere. It is the one check for dry runs: write paths go through the
+// helpers below, and the few that can't consult it directly.
+func writable() bool {
+	return !dryRun.Load()
+}
+
+// makeDir creates a directory and its parents; in a dry run it does nothing
+func makeDir(path string) error {
+	if !writable() {
+		return nil
+	}
+	return os.MkdirAll(path, 0755)
+}
+
+// openFile opens a file for writing with the given flags; in a dry run the
+// file is the null device, so writes are discarded
+func openFile(path string, flag int) (*os.File, error) {
+	if !writable() {
+		return os.OpenFile(os.DevNull, flag&^os.O_CREATE, 0)
+	}
+	return os.OpenFile(path, flag, 0644)
+}
+
+// writeFileAtomic replaces a file through a temporary file and a rename, so
+// a crash never leaves it truncated; in a dry run the data is discarded
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicMode(path, data, 0644)
+}
+
+// writePrivateFileAtomic is writeFileAtomic for files only the owner may
+// read, such as those holding passwords
+func writePrivateFileAtomic(path string, data []byte) error {
+	return writeFileAtomicMode(path, data, 0600)
+}
+
+// writeFileAtomicMode is writeFileAtomic with the permissions of the file
+func writeFileAtomicMode(path string, data []byte, perm os.FileMode) error {
+	if !writable() {
+		return nil
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, perm); err != nil {
+		return err
+	}
+	// A temporary file left by a crash keeps its permissions
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// removeFile deletes a file; a dry run refuses with errDryRun
+func removeFile(path string) error {
+	if !writable() {
+		return errDryRun
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cylog/internal/testsupport"
+)
+
+// e2eTimeout bounds each step of the end-to-end tests
+const e2eTimeout = 5 * time.Second
+
+// frameContaining matches WebSocket frames that mention text
+func frameContaining(text string) func([]byte) bool {
+	return func(frame []byte) bool { return bytes.Contains(frame, []byte(text)) }
+}
+
+// chatLogContains reports whether a chat log file in the working
+// directory's logs holds text
+func chatLogContains(t *testing.T, text string) bool {
+	t.Helper()
+
+	names, err := filepath.Glob(filepath.Join(logsDir, "chat-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		content, err := os.ReadFile(name)
+		if err == nil && strings.Contains(string(content), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// recentMessages fetches /api/v1/messages
+func recentMessages(t *testing.T, baseURL string) []Message {
+	t.Helper()
+
+	resp, err := http.Get(baseURL + "/api/v1/messages")
+	if err != nil {
+		t.Fatalf("fetching messages: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("messages: status %d: %s", resp.StatusCode, body)
+	}
+	var msgs []Message
+	if err := json.Unmarshal(body, &msgs); err != nil {
+		t.Fatalf("decoding messages: %v", err)
+	}
+	return msgs
+}
+
+// hasMessage reports whether msgs has one from username with content
+func hasMessage(msgs []Message, username, content string) bool {
+	for _, msg := range msgs {
+		if msg.Username == username && msg.Content == content {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEndToEnd(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	_, baseURL := runTestServer(t.Context(), t, defaultConfig(), upstream)
+
+	upstream.WaitConnected(e2eTimeout)
+	upstream.WaitEvent("joinChannel", e2eTimeout)
+	client := testsupport.Dial(t, baseURL, "/ws")
+	client.WaitFor(e2eTimeout, frameContaining(`"type":"hello"`))
+
+	upstream.ChatMsg("alice", "hello from upstream")
+	client.WaitFor(e2eTimeout, frameContaining("hello from upstream"))
+	testsupport.Eventually(t, e2eTimeout, "chat message not written to the chat log", func() bool {
+		return chatLogContains(t, "hello from upstream")
+	})
+	if msgs := recentMessages(t, baseURL); !hasMessage(msgs, "alice", "hello from upstream") {
+		t.Errorf("/api/v1/messages = %+v, want alice's message", msgs)
+	}
+
+	// Cytube restarting drops the connection; cylog dials again and
+	// rejoins, and the WebSocket client keeps receiving
+	upstream.Disconnect()
+	upstream.WaitConnected(e2eTimeout)
+	upstream.WaitEvent("joinChannel", e2eTimeout)
+	upstream.ChatMsg("bob", "after the reconnect")
+	client.WaitFor(e2eTimeout, frameContaining("after the reconnect"))
+	testsupport.Eventually(t, e2eTimeout, "message after the reconnect not written to the chat log", func() bool {
+		return chatLogContains(t, "after the reconnect")
+	})
+	if msgs := recentMessages(t, baseURL); !hasMessage(msgs, "bob", "after the reconnect") {
+		t.Errorf("/api/v1/messages = %+v, want bob's message", msgs)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Encrypted log files hold a magic header followed by one chunk per line:
+// a big-endian uint32 length, a random 24 byte nonce and the secretbox of
+// the line
+const (
+	encryptedSuffix   = ".enc"
+	encryptionMagic   = "cylog-enc1\n"
+	encryptionKeyEnv  = "CYLOG_ENCRYPTION_KEY"
+	chunkLengthSize   = 4
+	chunkNonceSize    = 24
+	maxEncryptedChunk = maxLogFileSize + chunkNonceSize + secretbox.Overhead
+)
+
+// Log decryption errors
+var (
+	errNoEncryptionKey    = errors.New("log file is encrypted but no key is configured (set encryption.key or " + encryptionKeyEnv + ")")
+	errWrongEncryptionKey = errors.New("failed to decrypt log file: wrong encryption key or corrupted file")
+)
+
+// EncryptionConfig configures encryption of log files at rest; changing it
+// requires a restart
+type EncryptionConfig struct {
+	// Key is a base64-encoded 32 byte key, e.g. from `openssl rand -base64 32`.
+	// The CYLOG_ENCRYPTION_KEY environment variable takes precedence.
+	Key string `yaml:"key"`
+}
+
+// parseEncryptionKey decodes the configured key, preferring the
+// environment variable; no key means log files are written in plaintext
+func parseEncryptionKey(cfg EncryptionConfig) (*[32]byte, error) {
+	value := cfg.Key
+	if env := os.Getenv(encryptionKeyEnv); env != "" {
+		value = env
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("invalid encryption key: must be 32 bytes encoded as base64")
+	}
+	key := new([32]byte)
+	copy(key[:], decoded)
+	return key, nil
+}
+
+// isEncryptedLog reports whether a log filename is encrypted, ignoring a
+// compression suffix
+func isEncryptedLog(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(name, ".gz"), encryptedSuffix)
+}
+
+// isEmptyLog reports whether a log file of the given size holds no lines
+func isEmptyLog(name string, size int64) bool {
+	return size == 0 || (isEncryptedLog(name) && size <= int64(len(encryptionMagic)))
+}
+
+// sealChunk encrypts a line into a length-prefixed chunk
+func sealChunk(key *[32]byte, line string) []byte {
+	var nonce [chunkNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate nonce: %v", err))
+	}
+
+	chunk := make([]byte, chunkLengthSize, chunkLengthSize+chunkNonceSize+len(line)+secretbox.Overhead)
+	binary.BigEndian.PutUint32(chunk, uint32(chunkNonceSize+len(line)+secretbox.Overhead))
+	chunk = append(chunk, nonce[:]...)
+	return secretbox.Seal(chunk, []byte(line), &nonce, key)
+}
+
+// readChunk decrypts the next chunk, returning the line and the chunk's
+// size; io.EOF means no complete chunk is left
+func readChunk(reader *bufio.Reader, key *[32]byte) (string, int, error) {
+	header, err := reader.Peek(chunkLengthSize)
+	if err != nil {
+		return "", 0, io.EOF
+	}
+	length := int(binary.BigEndian.Uint32(header))
+	if length < chunkNonceSize+secretbox.Overhead || length > maxEncryptedChunk {
+		return "", 0, errWrongEncryptionKey
+	}
+
+	chunk := make([]byte, chunkLengthSize+length)
+	if _, err := io.ReadFull(reader, chunk); err != nil {
+		// A chunk still being written
+		return "", 0, io.EOF
+	}
+	if key == nil {
+		return "", 0, errNoEncryptionKey
+	}
+
+	var nonce [chunkNonceSize]byte
+	copy(nonce[:], chunk[chunkLengthSize:])
+	line, ok := secretbox.Open(nil, chunk[chunkLengthSize+chunkNonceSize:], &nonce, key)
+	if !ok {
+		return "", 0, errWrongEncryptionKey
+	}
+	return string(line), len(chunk), nil
+}
+
+// decryptLogContent decrypts the content of an encrypted log file
+func decryptLogContent(key *[32]byte, content []byte) (string, error) {
+	if !bytes.HasPrefix(content, []byte(encryptionMagic)) {
+		return "", errors.New("not an encrypted cylog log file")
+	}
+	if key == nil {
+		return "", errNoEncryptionKey
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(content[len(encryptionMagic):]))
+	var out strings.Builder
+	for {
+		line, _, err := readChunk(reader, key)
+		if errors.Is(err, io.EOF) {
+			return out.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(line)
+	}
+}
+
+// logLineReader reads the complete lines of a log file from a byte offset,
+// decrypting them if the file is encrypted. Offsets are in file bytes, so
+// a scan can resume where the last one stopped.
+type logLineReader struct {
+	file      *os.File
+	reader    *bufio.Reader
+	key       *[32]byte
+	encrypted bool
+	offset    int64
+}
+
+// openLogLines opens a log file in the logs directory for reading lines
+// starting at offset. Offsets in a compressed rollup are in its
+// decompressed content, which is read up to offset.
+func (l *Logger) openLogLines(name string, offset int64) (*logLineReader, error) {
+	file, err := os.Open(filepath.Join(l.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	var source io.Reader = file
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to decompress log file: %w", err)
+		}
+		if _, err := io.CopyN(io.Discard, gz, offset); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to seek log file: %w", err)
+		}
+		source = gz
+	} else if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek log file: %w", err)
+	}
+
+	l.logMutex.Lock()
+	key := l.encryptionKey
+	l.logMutex.Unlock()
+
+	r := &logLineReader{file: file, reader: bufio.NewReader(source), key: key, encrypted: isEncryptedLog(name), offset: offset}
+	if r.encrypted && offset == 0 {
+		magic := make([]byte, len(encryptionMagic))
+		if _, err := io.ReadFull(r.reader, magic); err != nil {
+			// Nothing written yet
+			return r, nil
+		}
+		if string(magic) != encryptionMagic {
+			file.Close()
+			return nil, fmt.Errorf("%s is not an encrypted cylog log file", name)
+		}
+		r.offset = int64(len(encryptionMagic))
+	}
+	return r, nil
+}
+
+// Next returns the next complete line without its newline; io.EOF means a
+// partially written line or nothing is left
+func (r *logLineReader) Next() (string, error) {
+	if r.encrypted {
+		line, n, err := readChunk(r.reader, r.key)
+		if err != nil {
+			return "", err
+		}
+		r.offset += int64(n)
+		return strings.TrimSuffix(line, "\n"), nil
+	}
+
+	line, err := r.reader.ReadString('\n')
+	if err == io.EOF {
+		return "", io.EOF
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read log file: %w", err)
+	}
+	r.offset += int64(len(line))
+	return line[:len(line)-1], nil
+}
+
+// Offset returns the file offset after the last line returned
+func (r *logLineReader) Offset() int64 {
+	return r.offset
+}
+
+// Close closes the log file
+func (r *logLineReader) Close() error {
+	return r.file.Close()
+}
+
+// SetEncryptionKey enables encrypting new log lines; an empty key writes
+// plaintext. Open files are rotated so that a file is either encrypted or
+// not. It fails if the key can't decrypt the newest encrypted log file.
+func (l *Logger) SetEncryptionKey(key *[32]byte) error {
+	if key != nil {
+		if err := l.checkEncryptionKey(key); err != nil {
+			return err
+		}
+	}
+
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	l.encryptionKey = key
+	for kind, stream := range l.streams {
+		if isEncryptedLog(stream.path) == (key != nil) {
+			continue
+		}
+		if err := l.rotateLogFile(stream, false); err != nil {
+			return fmt.Errorf("failed to reopen %s log file: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+// checkEncryptionKey decrypts the first line of the newest non-empty
+// encrypted log file, so a wrong key is reported at startup
+func (l *Logger) checkEncryptionKey(key *[32]byte) error {
+	paths, err := filepath.Glob(filepath.Join(l.dir, "*-*.log"+encryptedSuffix))
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	sortLogFiles(names)
+
+	for i := len(names) - 1; i >= 0; i-- {
+		content, err := os.ReadFile(filepath.Join(l.dir, names[i]))
+		if err != nil || isEmptyLog(names[i], int64(len(content))) {
+			continue
+		}
+		if !bytes.HasPrefix(content, []byte(encryptionMagic)) {
+			return fmt.Errorf("%s is not an encrypted cylog log file", names[i])
+		}
+		reader := bufio.NewReader(bytes.NewReader(content[len(encryptionMagic):]))
+		if _, _, err := readChunk(reader, key); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("encryption key doesn't match %s: %w", names[i], err)
+		}
+		return nil
+	}
+	return nil
+}
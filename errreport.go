@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error reporting defaults
+const (
+	errorReportTimeout     = 10 * time.Second
+	errorReportBreadcrumbs = 50
+	errorReportDedupWindow = 10 * time.Minute
+
+	// reconnectReportAttempts is how many failed reconnects in a row are
+	// reported as the upstream being unreachable
+	reconnectReportAttempts = 10
+)
+
+// Error reporting metrics
+var (
+	errorReportsSent   = metrics.Counter("cylog_error_reports_sent_total", "Error reports sent to the error reporting DSN")
+	errorReportsFailed = metrics.Counter("cylog_error_reports_failed_total", "Error reports that could not be delivered")
+)
+
+// ErrorReportingConfig configures sending panics and serious errors to a
+// Sentry-compatible service
+type ErrorReportingConfig struct {
+	// DSN is the Sentry DSN, e.g. https://<key>@sentry.example.com/<project>;
+	// reporting is off when it is empty
+	DSN string `yaml:"dsn"`
+
+	// Environment is reported with every event, e.g. production
+	Environment string `yaml:"environment"`
+}
+
+// chatContentPattern matches chat text that could appear in a panic value or
+// log line: Socket.IO event frames, and JSON fields holding message text
+var chatContentPattern = regexp.MustCompile(`42\d*\[.*|"(?:msg|content|html|text|title)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+
+// scrubChatContent replaces chat text in s so reports never carry it
+func scrubChatContent(s string) string {
+	return chatContentPattern.ReplaceAllString(s, "[scrubbed]")
+}
+
+// errorBreadcrumb is a recent app.log line sent along with a report
+type errorBreadcrumb struct {
+	Timestamp float64 `json:"timestamp"`
+	Category  string  `json:"category"`
+	Message   string  `json:"message"`
+}
+
+// ErrorReporter sends events to a Sentry store endpoint. It also collects
+// the last app.log lines as breadcrumbs, so it is installed as a log writer.
+// Without a DSN it only keeps breadcrumbs and sends nothing.
+type ErrorReporter struct {
+	endpoint    string
+	auth        string
+	environment string
+	client      *http.Client
+	breadcrumbs []errorBreadcrumb
+	lastSent    map[string]time.Time
+	mutex       sync.Mutex
+}
+
+// errorReporter is the application-wide error reporter
+var errorReporter = &ErrorReporter{lastSent: make(map[string]time.Time)}
+
+// Configure points the reporter at a DSN; an empty DSN leaves it dormant
+func (r *ErrorReporter) Configure(cfg ErrorReportingConfig) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.endpoint, r.auth = "", ""
+	if cfg.DSN == "" {
+		return nil
+	}
+
+	dsn, err := url.Parse(cfg.DSN)
+	if err != nil {
+		return fmt.Errorf("invalid error reporting DSN: %w", err)
+	}
+	project := strings.Trim(dsn.Path, "/")
+	if dsn.User == nil || dsn.User.Username() == "" || project == "" {
+		return fmt.Errorf("invalid error reporting DSN: must look like https://<key>@host/<project>")
+	}
+
+	// A project under a path prefix keeps the prefix in front of /api
+	prefix := ""
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	r.endpoint = fmt.Sprintf("%s://%s%s/api/%s/store/", dsn.Scheme, dsn.Host, prefix, project)
+	r.auth = fmt.Sprintf("Sentry sentry_version=7, sentry_client=cylog/%s, sentry_key=%s", serverVersion, dsn.User.Username())
+	r.environment = cfg.Environment
+	r.client = &http.Client{Timeout: errorReportTimeout}
+	return nil
+}
+
+// Write records app.log lines as breadcrumbs
+func (r *ErrorReporter) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		r.breadcrumbs = append(r.breadcrumbs, errorBreadcrumb{
+			Timestamp: float64(time.Now().UnixNano()) / 1e9,
+			Category:  "log",
+			Message:   scrubChatContent(line),
+		})
+	}
+	if len(r.breadcrumbs) > errorReportBreadcrumbs {
+		r.breadcrumbs = append([]errorBreadcrumb(nil), r.breadcrumbs[len(r.breadcrumbs)-errorReportBreadcrumbs:]...)
+	}
+	return len(p), nil
+}
+
+// capturePanic reports a recovered panic with its stack trace
+func (r *ErrorReporter) capturePanic(where, id string, value interface{}, stack []byte) {
+	r.capture("fatal", where, "panic", fmt.Sprint(value), map[string]interface{}{
+		"error_id": id,
+		"stack":    scrubChatContent(string(stack)),
+	})
+}
+
+// captureError reports an error that needs attention although the server
+// keeps running
+func captureError(where string, err error) {
+	errorReporter.capture("error", where, fmt.Sprintf("%T", err), err.Error(), nil)
+}
+
+// capture sends an event in the background; repeats of the same error are
+// sent at most once per dedup window
+func (r *ErrorReporter) capture(level, where, kind, value string, extra map[string]interface{}) {
+	r.mutex.Lock()
+	if r.endpoint == "" {
+		r.mutex.Unlock()
+		return
+	}
+
+	value = scrubChatContent(value)
+	key := where + "\x00" + value
+	now := time.Now()
+	if sent, ok := r.lastSent[key]; ok && now.Sub(sent) < errorReportDedupWindow {
+		r.mutex.Unlock()
+		return
+	}
+	r.lastSent[key] = now
+
+	event := map[string]interface{}{
+		"event_id":  newErrorID() + newErrorID(),
+		"timestamp": now.UTC().Format(time.RFC3339),
+		"level":     level,
+		"platform":  "go",
+		"logger":    where,
+		"release":   serverVersion,
+		"tags":      map[string]string{"where": where},
+		"exception": map[string]interface{}{
+			"values": []map[string]string{{"type": kind, "value": value}},
+		},
+		"breadcrumbs": map[string]interface{}{"values": append([]errorBreadcrumb(nil), r.breadcrumbs...)},
+	}
+	if r.environment != "" {
+		event["environment"] = r.environment
+	}
+	if extra != nil {
+		event["extra"] = extra
+	}
+	endpoint, auth, client := r.endpoint, r.auth, r.client
+	r.mutex.Unlock()
+
+	go func() {
+		defer recoverPanic("error reporter")
+		if err := sendErrorReport(client, endpoint, auth, event); err != nil {
+			errorReportsFailed.Inc()
+			log.Printf("Error sending error report: %v", err)
+			return
+		}
+		errorReportsSent.Inc()
+	}()
+}
+
+// sendErrorReport posts an event to a Sentry store endpoint
+func sendErrorReport(client *http.Client, endpoint, auth string, event map[string]interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode error report: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", auth)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error reporting service returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxExportMessages bounds the size of an HTML transcript
+const maxExportMessages = 20000
+
+//go:embed templates/export.html
+var exportTemplateSource string
+
+// exportTemplate renders a standalone HTML transcript
+var exportTemplate = template.Must(template.New("export").Parse(exportTemplateSource))
+
+// exportMessage is a message as rendered into a transcript
+type exportMessage struct {
+	Time     string
+	Type     string
+	Username string
+	Color    template.CSS
+	HTML     template.HTML
+}
+
+// exportPage is the data of a transcript
+type exportPage struct {
+	Title     string
+	From      string
+	To        string
+	Generated string
+	Count     int
+	Messages  []exportMessage
+}
+
+// renderExportHTML renders a message's content with links and emote
+// images; log files only keep the text, so the HTML is rebuilt from it
+func (s *ChatServer) renderExportHTML(msg Message) string {
+	if msg.HTML != "" {
+		return sanitizeHTML(msg.HTML)
+	}
+
+	var out strings.Builder
+	for i, field := range strings.Split(msg.Content, " ") {
+		if i > 0 {
+			out.WriteString(" ")
+		}
+		if image, ok := s.emotes.Image(field); ok && sanitizeURL(image) != "" {
+			fmt.Fprintf(&out, `<img class="emote" src="%s" alt="%s" title="%s">`, html.EscapeString(image), html.EscapeString(field), html.EscapeString(field))
+			continue
+		}
+		if links := extractLinks(field); len(links) == 1 && sanitizeURL(links[0]) != "" {
+			escaped := html.EscapeString(links[0])
+			rest := strings.SplitN(field, links[0], 2)
+			fmt.Fprintf(&out, `%s<a href="%s">%s</a>%s`, html.EscapeString(rest[0]), escaped, escaped, html.EscapeString(rest[len(rest)-1]))
+			continue
+		}
+		out.WriteString(html.EscapeString(field))
+	}
+	return out.String()
+}
+
+// exportMessages reads the logged chat messages on the dates within
+// [from, to], optionally only those sent by user, with the markers of any
+// gaps in the logs, in timestamp order
+func (s *ChatServer) exportMessages(from, to time.Time, user string, match usernameMatch) ([]Message, error) {
+	// Late batched messages are in the files of the day they arrived
+	var end, filesTo time.Time
+	if !to.IsZero() {
+		end = to.AddDate(0, 0, 1)
+		filesTo = to.Add(maxBatchLateness)
+	}
+	files, err := s.logger.GetLogsInRange(from, filesTo)
+	if err != nil {
+		return nil, err
+	}
+
+	query := messageQuery{username: user, usernameMatch: match}
+	msgs := make([]Message, 0)
+	for _, file := range files {
+		content, err := s.logger.GetLogContent(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(content, "\n") {
+			msg, ok := parseLogEntry(line)
+			if !ok || (!isGapEntry(msg) && (isStatusEntry(msg) || !query.matches(msg))) {
+				continue
+			}
+			if msg.Timestamp.Before(from) || (!end.IsZero() && !msg.Timestamp.Before(end)) {
+				continue
+			}
+			if len(msgs) >= maxExportMessages {
+				return nil, fmt.Errorf("range too large: at most %d messages can be exported", maxExportMessages)
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	sortByTimestamp(msgs)
+	return msgs, nil
+}
+
+// buildExportPage returns the transcript of msgs, titled with the channel
+func (s *ChatServer) buildExportPage(title string, msgs []Message) exportPage {
+	page := exportPage{
+		Title:     title,
+		Generated: time.Now().Format(logTimeFormat),
+		Count:     len(msgs),
+		Messages:  make([]exportMessage, 0, len(msgs)),
+	}
+	if channel := s.Config().Channel; channel != "" {
+		page.Title += " - " + channel
+	}
+	if len(msgs) > 0 {
+		page.From = msgs[0].Timestamp.Format(logTimeFormat)
+		page.To = msgs[len(msgs)-1].Timestamp.Format(logTimeFormat)
+	}
+	for _, msg := range msgs {
+		page.Messages = append(page.Messages, exportMessage{
+			Time:     msg.Timestamp.Format(logTimeFormat),
+			Type:     msg.Kind(),
+			Username: msg.Username,
+			Color:    template.CSS(s.Config().UsernameColor(msg.Username)),
+			HTML:     template.HTML(s.renderExportHTML(msg)),
+		})
+	}
+	return page
+}
+
+// registerExportRoutes registers the HTML transcript export endpoint
+func registerExportRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/export.html", func(c *gin.Context) {
+		from, to, err := parseDateRange(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		msgs, err := chatServer.exportMessages(from, to, c.Query("user"), parseUsernameMatch(c, false))
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(msgs) == 0 {
+			apiError(c, http.StatusNotFound, "no messages in range")
+			return
+		}
+
+		page := chatServer.buildExportPage("Chat transcript", msgs)
+
+		filename := fmt.Sprintf("cylog-%s-%s.html", msgs[0].Timestamp.Format(logDateFormat), msgs[len(msgs)-1].Timestamp.Format(logDateFormat))
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := exportTemplate.Execute(c.Writer, page); err != nil {
+			logf(c, "Error rendering transcript: %v", err)
+		}
+	})
+}
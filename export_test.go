@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// updateGolden rewrites the golden files with the current output
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestExportTemplateGolden(t *testing.T) {
+	golden, err := filepath.Abs(filepath.Join("testdata", "export.golden.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.Channel = "test"
+	chatServer, _ := newTestServer(t, cfg)
+
+	at := time.Date(2025, 4, 16, 20, 15, 0, 0, time.UTC)
+	msgs := []Message{
+		{Type: messageTypeChat, Username: "alice", Timestamp: at, Content: "hello, see https://example.com/a?b=1&c=2."},
+		{Type: messageTypeChat, Username: "bob", Timestamp: at.Add(time.Second), Content: "<script>alert(1)</script> & friends"},
+		{Type: messageTypeChat, Username: "carol", Timestamp: at.Add(2 * time.Second), HTML: `<strong>bold</strong> <img src=x onerror=alert(1)> <a href="javascript:alert(1)">link</a>`},
+		{Type: messageTypeAction, Username: "alice", Timestamp: at.Add(3 * time.Second), Content: "waves"},
+		{Type: messageTypeChat, Username: `"><b>mallory`, Timestamp: at.Add(4 * time.Second), Content: "javascript:alert(1) is not a link"},
+		{Type: messageTypeSystem, Username: "System", Timestamp: at.Add(5 * time.Second), Content: "Connected to test"},
+	}
+	page := chatServer.buildExportPage("Chat transcript", msgs)
+	page.Generated = at.Add(time.Hour).Format(logTimeFormat)
+
+	var out bytes.Buffer
+	if err := exportTemplate.Execute(&out, page); err != nil {
+		t.Fatalf("rendering the transcript: %v", err)
+	}
+	if *updateGolden {
+		if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+			t.Fatalf("updating the golden file: %v", err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading the golden file, run with -update to create it: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("transcript differs from %s, run with -update if intended:\n%s", golden, out.Bytes())
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"runtime"
+)
+
+// fanoutQueueSize is the number of jobs buffered for each fan-out shard
+const fanoutQueueSize = 256
+
+// fanoutJob is work for a fan-out shard: adding a client with the frames it
+// starts with, removing one, or delivering a message with a frame prepared
+// for each encoding in use
+type fanoutJob struct {
+	add     *Client
+	initial []interface{}
+	remove  *Client
+	message *Message
+	frames  map[string]interface{}
+}
+
+// fanoutShard owns the send queues of a subset of the clients, so a message
+// is queued for every client by several goroutines instead of just the hub.
+// Only the shard's goroutine touches clients and closes their queues.
+type fanoutShard struct {
+	jobs    chan fanoutJob
+	clients map[*Client]bool
+
+	// size is the number of clients assigned, kept by the hub
+	size int
+}
+
+// newFanoutShards creates n shards, or one per CPU when n is zero
+func newFanoutShards(n int) []*fanoutShard {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	shards := make([]*fanoutShard, n)
+	for i := range shards {
+		shards[i] = &fanoutShard{jobs: make(chan fanoutJob, fanoutQueueSize), clients: make(map[*Client]bool)}
+	}
+	return shards
+}
+
+// runFanout processes a shard's jobs until its queue is closed
+func (s *ChatServer) runFanout(shard *fanoutShard) {
+	defer s.fanout.Done()
+	for job := range shard.jobs {
+		s.runFanoutJob(shard, job)
+	}
+}
+
+// runFanoutJob processes a single job; a panic is logged and the shard
+// keeps running
+func (s *ChatServer) runFanoutJob(shard *fanoutShard, job fanoutJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic("fan-out", r)
+		}
+	}()
+
+	switch {
+	case job.add != nil:
+		shard.clients[job.add] = true
+		for _, frame := range job.initial {
+			if !job.add.enqueue(frame) {
+				logf(job.add.context(), "Error sending recent messages: client send queue full")
+				break
+			}
+		}
+	case job.remove != nil:
+		if shard.clients[job.remove] {
+			delete(shard.clients, job.remove)
+			job.remove.closeSend()
+		}
+	case job.message != nil:
+		for client := range shard.clients {
+			if !client.wants(*job.message) {
+				continue
+			}
+			if !client.enqueue(job.frames[client.encoding]) {
+				logf(client.context(), "Client send queue full, disconnecting")
+				s.requestUnregister(client)
+			}
+		}
+	}
+}
+
+// startFanout starts a goroutine per shard
+func (s *ChatServer) startFanout() {
+	for _, shard := range s.shards {
+		s.fanout.Add(1)
+		go s.runFanout(shard)
+	}
+}
+
+// stopFanout closes the shard queues and waits for the shards to drain
+// them; it must run on the hub goroutine
+func (s *ChatServer) stopFanout() {
+	for _, shard := range s.shards {
+		close(shard.jobs)
+	}
+	s.fanout.Wait()
+}
+
+// addClient assigns a new client to the least loaded shard with the frames
+// it should receive first; it must run on the hub goroutine
+func (s *ChatServer) addClient(client *Client, initial []interface{}) {
+	shard := s.shards[0]
+	for _, candidate := range s.shards[1:] {
+		if candidate.size < shard.size {
+			shard = candidate
+		}
+	}
+	shard.size++
+	client.shard = shard
+	s.clients[client] = true
+	s.encodings[client.encoding]++
+	s.viewers.Join(client)
+	shard.jobs <- fanoutJob{add: client, initial: initial}
+}
+
+// removeClient removes a client, reporting whether it was connected; its
+// shard closes the send queue. It must run on the hub goroutine.
+func (s *ChatServer) removeClient(client *Client) bool {
+	if !s.clients[client] {
+		return false
+	}
+	delete(s.clients, client)
+	if s.encodings[client.encoding]--; s.encodings[client.encoding] == 0 {
+		delete(s.encodings, client.encoding)
+	}
+	s.viewers.Leave(client)
+	client.shard.size--
+	client.shard.jobs <- fanoutJob{remove: client}
+	return true
+}
+
+// fanoutMessage prepares a message once per encoding in use and hands it to
+// every shard with clients; it must run on the hub goroutine
+func (s *ChatServer) fanoutMessage(message Message) {
+	frames := make(map[string]interface{}, len(s.encodings))
+	for encoding := range s.encodings {
+		frames[encoding] = message
+		if prepared, err := prepareFrame(message, encoding); err != nil {
+			log.Printf("Error encoding %s broadcast: %v", encoding, err)
+		} else {
+			frames[encoding] = prepared
+		}
+	}
+
+	for _, shard := range s.shards {
+		if shard.size > 0 {
+			shard.jobs <- fanoutJob{message: &message, frames: frames}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkFanoutEnqueue measures how long after a broadcast each client
+// finds it in its send queue. One worker is the hub enqueueing serially,
+// as before fan-out was sharded.
+func BenchmarkFanoutEnqueue(b *testing.B) {
+	for _, clients := range []int{1000, 5000} {
+		for _, workers := range []int{1, 8} {
+			b.Run(fmt.Sprintf("clients=%d/workers=%d", clients, workers), func(b *testing.B) {
+				benchmarkFanoutEnqueue(b, clients, workers)
+			})
+		}
+	}
+}
+
+func benchmarkFanoutEnqueue(b *testing.B, clients, workers int) {
+	cfg := defaultConfig()
+	cfg.FanoutWorkers = workers
+	chatServer, _ := newTestServer(b, cfg)
+	chatServer.startFanout()
+
+	// Each client's writer notes when the broadcast reached its queue
+	var start time.Time
+	var received sync.WaitGroup
+	latencies := make([][]time.Duration, clients)
+	var drained sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		client := newClient(nil, "127.0.0.1", encodingJSON, fmt.Sprint(i))
+		client.bot = true
+		chatServer.addClient(client, nil)
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			for range client.send {
+				latencies[i] = append(latencies[i], time.Since(start))
+				received.Done()
+			}
+		}()
+	}
+	b.Cleanup(func() {
+		chatServer.stopFanout()
+		for client := range chatServer.clients {
+			client.closeSend()
+		}
+		drained.Wait()
+	})
+
+	msg := Message{ID: "bench", Type: messageTypeChat, Username: "alice", Timestamp: time.Now(), Content: "hello everyone"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		received.Add(clients)
+		start = time.Now()
+		chatServer.fanoutMessage(msg)
+		received.Wait()
+	}
+	b.StopTimer()
+
+	all := slices.Concat(latencies...)
+	slices.Sort(all)
+	b.ReportMetric(float64(all[len(all)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(all[len(all)*99/100].Nanoseconds()), "p99-ns")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Feed defaults
+const (
+	defaultFeedEntries = 50
+	maxFeedDigests     = 14
+	feedTitleLength    = 80
+)
+
+// FeedConfig configures the Atom feed at /feed.atom
+type FeedConfig struct {
+	// MaxEntries is how many recent messages the feed holds
+	MaxEntries int `yaml:"max_entries"`
+
+	// Digests adds an entry for each of the last two weeks of daily digests
+	Digests bool `yaml:"digests"`
+}
+
+// atomFeed is an Atom syndication document
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// atomLink is an Atom link element
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+// atomEntry is one entry of an Atom feed
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Content atomContent `xml:"content"`
+	updated time.Time
+}
+
+// atomAuthor is the author of an Atom entry
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// atomContent is HTML entry content, escaped as Atom requires
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// messageEntry converts a message to a feed entry; its ID is derived from
+// the sequence number so it stays the same across polls and restarts
+func messageEntry(channel string, msg Message) atomEntry {
+	content := msg.HTML
+	if content == "" {
+		content = html.EscapeString(msg.Content)
+	}
+	return atomEntry{
+		ID:      fmt.Sprintf("urn:cylog:%s:message:%d", channel, msg.Seq),
+		Title:   msg.Username + ": " + truncateRunes(msg.Content, feedTitleLength),
+		Updated: msg.Timestamp.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: msg.Username},
+		Content: atomContent{Type: "html", Body: content},
+		updated: msg.Timestamp,
+	}
+}
+
+// digestEntry converts a daily digest to a feed entry
+func digestEntry(channel string, digest Digest) atomEntry {
+	var body strings.Builder
+	fmt.Fprintf(&body, "<p>%d messages from %d users.</p>", digest.MessageCount, digest.UniqueUsers)
+	if len(digest.TopUsers) > 0 {
+		body.WriteString("<p>Most active:")
+		for i, user := range digest.TopUsers {
+			if i > 0 {
+				body.WriteString(",")
+			}
+			fmt.Fprintf(&body, " %s (%d)", html.EscapeString(user.Username), user.MessageCount)
+		}
+		body.WriteString("</p>")
+	}
+	if digest.BusiestHour != nil {
+		fmt.Fprintf(&body, "<p>Busiest hour: %s with %d messages.</p>", digest.BusiestHour.Start.Format("15:04"), digest.BusiestHour.Count)
+	}
+	if len(digest.Media) > 0 {
+		fmt.Fprintf(&body, "<p>%d media items played.</p>", len(digest.Media))
+	}
+
+	return atomEntry{
+		ID:      fmt.Sprintf("urn:cylog:%s:digest:%s", channel, digest.Date),
+		Title:   "Digest for " + digest.Date,
+		Updated: digest.GeneratedAt.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: "cylog"},
+		Content: atomContent{Type: "html", Body: body.String()},
+		updated: digest.GeneratedAt,
+	}
+}
+
+// recentDigests reads the newest generated digests, newest first
+func recentDigests(n int) ([]Digest, error) {
+	paths, err := filepath.Glob(filepath.Join(logsDir, "digest-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+
+	digests := make([]Digest, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read digest: %w", err)
+		}
+		var digest Digest
+		if err := json.Unmarshal(data, &digest); err != nil {
+			continue
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// buildFeed assembles the feed entries, newest first
+func (s *ChatServer) buildFeed(query messageQuery) ([]atomEntry, error) {
+	cfg := s.Config()
+	limit := cfg.Feed.MaxEntries
+	if limit <= 0 {
+		limit = defaultFeedEntries
+	}
+
+	page, err := s.MessagesPage(0, math.MaxUint64, false, limit, query)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]atomEntry, 0, len(page.Messages))
+	for i := len(page.Messages) - 1; i >= 0; i-- {
+		entries = append(entries, messageEntry(cfg.Channel, page.Messages[i]))
+	}
+
+	if cfg.Feed.Digests {
+		digests, err := recentDigests(maxFeedDigests)
+		if err != nil {
+			return nil, err
+		}
+		for _, digest := range digests {
+			entries = append(entries, digestEntry(cfg.Channel, digest))
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].updated.After(entries[j].updated) })
+	return entries, nil
+}
+
+// feedETag derives a validator from the entries, which change whenever a
+// message arrives or a digest is regenerated
+func feedETag(entries []atomEntry) string {
+	hash := sha1.New()
+	for _, entry := range entries {
+		fmt.Fprintf(hash, "%s@%s\n", entry.ID, entry.Updated)
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:10]) + `"`
+}
+
+// notModified reports whether the request's validators match the response;
+// an ETag match takes precedence over the modification time
+func notModified(c *gin.Context, etag string, updated time.Time) bool {
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if since := c.GetHeader("If-Modified-Since"); since != "" && !updated.IsZero() {
+		if t, err := http.ParseTime(since); err == nil && !updated.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerFeedRoutes registers the Atom feed, which needs the read scope
+// with require_tokens
+func registerFeedRoutes(router *gin.Engine, chatServer *ChatServer) {
+	router.GET("/feed.atom", requireScope(chatServer.config, scopeRead), func(c *gin.Context) {
+		query := messageQuery{username: c.Query("user"), usernameMatch: parseUsernameMatch(c, false), keyword: c.Query("q")}
+		entries, err := chatServer.buildFeed(query)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		var updated time.Time
+		if len(entries) > 0 {
+			updated = entries[0].updated
+		}
+		etag := feedETag(entries)
+		c.Header("ETag", etag)
+		if !updated.IsZero() {
+			c.Header("Last-Modified", updated.UTC().Format(http.TimeFormat))
+		}
+		if notModified(c, etag, updated) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		channel := chatServer.Config().Channel
+		feed := atomFeed{
+			ID:      "urn:cylog:" + channel + ":feed",
+			Title:   "cylog " + channel,
+			Updated: updated.UTC().Format(time.RFC3339),
+			Link:    atomLink{Rel: "self", Href: "http://" + c.Request.Host + c.Request.URL.RequestURI()},
+			Entries: entries,
+		}
+		if updated.IsZero() {
+			feed.Updated = time.Now().UTC().Format(time.RFC3339)
+		}
+
+		data, err := xml.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "application/atom+xml; charset=utf-8", append([]byte(xml.Header), data...))
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Filter scopes
+const (
+	FilterScopeContent  = "content"
+	FilterScopeUsername = "username"
+)
+
+// Filter actions
+const (
+	FilterActionDrop   = "drop"
+	FilterActionTag    = "tag"
+	FilterActionRedact = "redact-match"
+)
+
+// redactedText replaces the parts of a message matched by a redact-match rule
+const redactedText = "[redacted]"
+
+// FilterRule describes a single content filter rule
+type FilterRule struct {
+	Pattern string `json:"pattern" yaml:"pattern"`
+	Scope   string `json:"scope" yaml:"scope"`
+	Action  string `json:"action" yaml:"action"`
+	Tag     string `json:"tag,omitempty" yaml:"tag"`
+
+	// Types limits the rule to these message types; empty means all
+	Types []string `json:"types,omitempty" yaml:"types"`
+
+	// Exact makes a username pattern case-sensitive and matched against the
+	// name as sent, zero-width characters included
+	Exact bool `json:"exact,omitempty" yaml:"exact"`
+}
+
+// compiledFilterRule is a FilterRule with its pattern compiled
+type compiledFilterRule struct {
+	FilterRule
+	re    *regexp.Regexp
+	types map[string]bool
+}
+
+// FilterPipeline evaluates content filter rules against incoming messages
+type FilterPipeline struct {
+	rules []compiledFilterRule
+	mutex sync.RWMutex
+}
+
+// NewFilterPipeline creates a filter pipeline from the given rules
+func NewFilterPipeline(rules []FilterRule) (*FilterPipeline, error) {
+	compiled, err := compileFilterRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return &FilterPipeline{rules: compiled}, nil
+}
+
+// compileFilterRules validates and compiles a set of filter rules
+func compileFilterRules(rules []FilterRule) ([]compiledFilterRule, error) {
+	compiled := make([]compiledFilterRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Scope == "" {
+			rule.Scope = FilterScopeContent
+		}
+
+		switch rule.Scope {
+		case FilterScopeContent, FilterScopeUsername:
+		default:
+			return nil, fmt.Errorf("filter %d: invalid scope %q", i, rule.Scope)
+		}
+
+		switch rule.Action {
+		case FilterActionDrop, FilterActionRedact:
+		case FilterActionTag:
+			if rule.Tag == "" {
+				return nil, fmt.Errorf("filter %d: tag action requires a tag", i)
+			}
+		default:
+			return nil, fmt.Errorf("filter %d: invalid action %q", i, rule.Action)
+		}
+
+		// Usernames are matched the way people type them unless asked otherwise
+		pattern := rule.Pattern
+		if rule.Scope == FilterScopeUsername && !rule.Exact {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: invalid pattern: %w", i, err)
+		}
+
+		types, err := parseTypes(strings.Join(rule.Types, ","))
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i, err)
+		}
+
+		compiled = append(compiled, compiledFilterRule{FilterRule: rule, re: re, types: types})
+	}
+	return compiled, nil
+}
+
+// Rules returns a copy of the current filter rules
+func (p *FilterPipeline) Rules() []FilterRule {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	rules := make([]FilterRule, len(p.rules))
+	for i, rule := range p.rules {
+		rules[i] = rule.FilterRule
+	}
+	return rules
+}
+
+// SetRules replaces the filter rules, leaving the current rules in place on error
+func (p *FilterPipeline) SetRules(rules []FilterRule) error {
+	compiled, err := compileFilterRules(rules)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	p.rules = compiled
+	p.mutex.Unlock()
+	return nil
+}
+
+// Apply runs the filter rules against a message, returning the filtered message
+// and whether it should be kept
+func (p *FilterPipeline) Apply(msg Message) (Message, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, rule := range p.rules {
+		if rule.types != nil && !rule.types[msg.Kind()] {
+			continue
+		}
+
+		target := msg.Content
+		if rule.Scope == FilterScopeUsername {
+			target = msg.Username
+			if !rule.Exact {
+				target = zeroWidthReplacer.Replace(target)
+			}
+		}
+
+		if !rule.re.MatchString(target) {
+			continue
+		}
+
+		switch rule.Action {
+		case FilterActionDrop:
+			return msg, false
+		case FilterActionTag:
+			if !hasTag(msg.Tags, rule.Tag) {
+				msg.Tags = append(msg.Tags, rule.Tag)
+			}
+		case FilterActionRedact:
+			if rule.Scope == FilterScopeUsername {
+				msg.Username = rule.re.ReplaceAllLiteralString(msg.Username, redactedText)
+			} else {
+				msg.Content = rule.re.ReplaceAllLiteralString(msg.Content, redactedText)
+				msg.HTML = rule.re.ReplaceAllLiteralString(msg.HTML, redactedText)
+			}
+		}
+	}
+
+	return msg, true
+}
+
+// hasTag reports whether tags contains tag
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
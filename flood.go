@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flood detection defaults
+const (
+	defaultFloodThreshold = 5
+	defaultFloodWindow    = 30 * time.Second
+	maxFloodTrackedUsers  = 1000
+)
+
+// FloodConfig configures the repeated-message flood detector
+type FloodConfig struct {
+	// Threshold is the number of identical messages passed through before
+	// further repeats are collapsed; 0 disables flood detection
+	Threshold int `yaml:"threshold"`
+
+	// WindowSeconds is how long after the last repeat a burst is considered over
+	WindowSeconds int `yaml:"window_seconds"`
+}
+
+// floodState tracks the current run of repeated messages for a single user
+type floodState struct {
+	hash       uint64
+	count      int
+	suppressed int
+	last       Message
+	lastAt     time.Time
+}
+
+// FloodDetector collapses bursts of identical messages from the same user
+type FloodDetector struct {
+	threshold int
+	window    time.Duration
+	users     map[string]*floodState
+	mutex     sync.Mutex
+}
+
+// NewFloodDetector creates a flood detector from the given config
+func NewFloodDetector(cfg FloodConfig) *FloodDetector {
+	window := time.Duration(cfg.WindowSeconds) * time.Second
+	if window <= 0 {
+		window = defaultFloodWindow
+	}
+
+	return &FloodDetector{
+		threshold: cfg.Threshold,
+		window:    window,
+		users:     make(map[string]*floodState),
+	}
+}
+
+// SetConfig updates the detector thresholds; in-progress bursts are kept
+func (d *FloodDetector) SetConfig(cfg FloodConfig) {
+	window := time.Duration(cfg.WindowSeconds) * time.Second
+	if window <= 0 {
+		window = defaultFloodWindow
+	}
+
+	d.mutex.Lock()
+	d.threshold = cfg.Threshold
+	d.window = window
+	d.mutex.Unlock()
+}
+
+// normalizedHash hashes message content ignoring case and whitespace differences
+func normalizedHash(content string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(strings.Join(strings.Fields(content), " "))))
+	return h.Sum64()
+}
+
+// Check records a message and reports whether it should be kept. If the message
+// ends a previous burst from the same user, or the burst of a user evicted to
+// make room, the burst summary is returned too.
+func (d *FloodDetector) Check(msg Message, now time.Time) (bool, *Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.threshold <= 0 {
+		return true, nil
+	}
+
+	hash := normalizedHash(msg.Content)
+	state, ok := d.users[msg.Username]
+	if ok && state.hash == hash && now.Sub(state.lastAt) <= d.window {
+		state.count++
+		state.last = msg
+		state.lastAt = now
+		if state.count > d.threshold {
+			state.suppressed++
+			return false, nil
+		}
+		return true, nil
+	}
+
+	// A new user can only end someone else's burst, by evicting it
+	var summary *Message
+	if ok && state.suppressed > 0 {
+		summary = state.summary()
+	}
+	if !ok && len(d.users) >= maxFloodTrackedUsers {
+		summary = d.evictOldest()
+	}
+
+	d.users[msg.Username] = &floodState{hash: hash, count: 1, last: msg, lastAt: now}
+	return true, summary
+}
+
+// Sweep ends bursts that have been quiet for longer than the window, returning
+// their summaries, and forgets idle users
+func (d *FloodDetector) Sweep(now time.Time) []Message {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var summaries []Message
+	for username, state := range d.users {
+		if now.Sub(state.lastAt) <= d.window {
+			continue
+		}
+		if state.suppressed > 0 {
+			summaries = append(summaries, *state.summary())
+		}
+		delete(d.users, username)
+	}
+	return summaries
+}
+
+// evictOldest removes the least recently active user to keep detector state
+// bounded, returning the summary of its burst if any repeats were collapsed
+func (d *FloodDetector) evictOldest() *Message {
+	var oldest *floodState
+	var oldestName string
+	for username, state := range d.users {
+		if oldest == nil || state.lastAt.Before(oldest.lastAt) {
+			oldest = state
+			oldestName = username
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	delete(d.users, oldestName)
+	if oldest.suppressed > 0 {
+		return oldest.summary()
+	}
+	return nil
+}
+
+// summary builds the synthetic message describing a collapsed burst
+func (s *floodState) summary() *Message {
+	content := fmt.Sprintf("… repeated %d times", s.suppressed)
+	return &Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Username:  s.last.Username,
+		Timestamp: s.lastAt,
+		Content:   content,
+		HTML:      html.EscapeString(content),
+		Tags:      []string{"flood"},
+		Meta: map[string]interface{}{
+			"repeat_count":     s.suppressed,
+			"repeated_content": s.last.Content,
+		},
+	}
+}
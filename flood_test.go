@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// floodMessage is a chat message from username for the flood tests
+func floodMessage(username, content string) Message {
+	return Message{Type: messageTypeChat, Username: username, Content: content}
+}
+
+// checkSummary fails the test unless summary collapses want repeats from username
+func checkSummary(t *testing.T, summary *Message, username string, want int) {
+	t.Helper()
+
+	if summary == nil {
+		t.Fatalf("no summary, want %s's %d repeats", username, want)
+	}
+	if summary.Username != username || summary.Meta["repeat_count"] != want {
+		t.Errorf("summary from %s of %v repeats, want %s and %d", summary.Username, summary.Meta["repeat_count"], username, want)
+	}
+	if summary.Content != fmt.Sprintf("… repeated %d times", want) {
+		t.Errorf("summary content = %q", summary.Content)
+	}
+}
+
+func TestFloodInterleavedUsers(t *testing.T) {
+	detector := NewFloodDetector(FloodConfig{Threshold: 2, WindowSeconds: 30})
+	start := time.Date(2025, 4, 16, 20, 0, 0, 0, time.UTC)
+
+	// Each user's repeats count on their own, whoever speaks in between,
+	// and near-identical content counts as a repeat
+	kept := map[string]int{}
+	for i := 0; i < 5; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		for _, msg := range []Message{floodMessage("alice", "SPAM  spam"), floodMessage("bob", "buy now"), floodMessage("carol", fmt.Sprintf("message %d", i))} {
+			keep, summary := detector.Check(msg, now)
+			if summary != nil {
+				t.Errorf("summary %q in the middle of the bursts", summary.Content)
+			}
+			if keep {
+				kept[msg.Username]++
+			}
+		}
+	}
+	if kept["alice"] != 2 || kept["bob"] != 2 || kept["carol"] != 5 {
+		t.Errorf("kept %v, want 2 from alice and bob and all 5 from carol", kept)
+	}
+
+	// A different message ends only its sender's burst
+	keep, summary := detector.Check(floodMessage("alice", "sorry"), start.Add(10*time.Second))
+	if !keep {
+		t.Error("the message ending the burst was dropped")
+	}
+	checkSummary(t, summary, "alice", 3)
+	if summary.Meta["repeated_content"] != "SPAM  spam" {
+		t.Errorf("repeated content = %v", summary.Meta["repeated_content"])
+	}
+	if keep, _ := detector.Check(floodMessage("bob", "buy now"), start.Add(11*time.Second)); keep {
+		t.Error("bob's burst ended when alice's did")
+	}
+}
+
+func TestFloodBurstFlushedWhenQuiet(t *testing.T) {
+	detector := NewFloodDetector(FloodConfig{Threshold: 1, WindowSeconds: 30})
+	start := time.Date(2025, 4, 16, 20, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		detector.Check(floodMessage("alice", "again"), start.Add(time.Duration(i)*time.Second))
+	}
+	detector.Check(floodMessage("bob", "once"), start)
+
+	if summaries := detector.Sweep(start.Add(33 * time.Second)); len(summaries) != 0 {
+		t.Errorf("summaries %v before the burst went quiet", summaries)
+	}
+	summaries := detector.Sweep(start.Add(34 * time.Second))
+	if len(summaries) != 1 {
+		t.Fatalf("%d summaries once quiet, want alice's alone", len(summaries))
+	}
+	checkSummary(t, &summaries[0], "alice", 3)
+
+	// The flushed burst is forgotten, so a new one starts over
+	if summaries := detector.Sweep(start.Add(time.Hour)); len(summaries) != 0 {
+		t.Errorf("burst flushed twice: %v", summaries)
+	}
+	if keep, summary := detector.Check(floodMessage("alice", "again"), start.Add(time.Hour)); !keep || summary != nil {
+		t.Errorf("first message after the flush: kept %v, summary %v", keep, summary)
+	}
+}
+
+func TestFloodEvictionFlushesBurst(t *testing.T) {
+	detector := NewFloodDetector(FloodConfig{Threshold: 1, WindowSeconds: 30})
+	start := time.Date(2025, 4, 16, 20, 0, 0, 0, time.UTC)
+	detector.Check(floodMessage("alice", "again"), start)
+	detector.Check(floodMessage("alice", "again"), start)
+	for i := 1; i < maxFloodTrackedUsers; i++ {
+		detector.Check(floodMessage(fmt.Sprintf("user%d", i), "hi"), start.Add(time.Second))
+	}
+
+	// Alice is the least recently active, so the next user evicts her burst
+	keep, summary := detector.Check(floodMessage("newcomer", "hi"), start.Add(2*time.Second))
+	if !keep {
+		t.Error("the newcomer's message was dropped")
+	}
+	checkSummary(t, summary, "alice", 1)
+	if len(detector.users) != maxFloodTrackedUsers {
+		t.Errorf("%d users tracked, want %d", len(detector.users), maxFloodTrackedUsers)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes of the cursor-based messages endpoint
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// MessagePage is a page of messages in ascending sequence order
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
+}
+
+// parseCursor parses an optional sequence number query parameter
+func parseCursor(c *gin.Context, name string) (uint64, bool, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, false, nil
+	}
+	cursor, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s cursor", name)
+	}
+	return cursor, true, nil
+}
+
+// isStatusEntry reports whether a logged message is a connection status
+// message, which the recent buffer doesn't hold either
+func isStatusEntry(msg Message) bool {
+	for _, tag := range msg.Tags {
+		if tag == statusTag {
+			return true
+		}
+	}
+	return false
+}
+
+// sortBySeq sorts messages by sequence number and drops duplicates
+func sortBySeq(msgs []Message) []Message {
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+
+	unique := msgs[:0]
+	for i, msg := range msgs {
+		if i > 0 && msg.Seq == msgs[i-1].Seq {
+			continue
+		}
+		unique = append(unique, msg)
+	}
+	return unique
+}
+
+// MessagesPage returns up to limit messages with after < seq < before that
+// match query. With an after cursor the page starts right
+// after it, otherwise it ends right before the before cursor (or at the
+// newest message). Messages that have left the recent buffer are read back
+// from the log files.
+func (s *ChatServer) MessagesPage(after, before uint64, forward bool, limit int, query messageQuery) (MessagePage, error) {
+	s.messagesMux.RLock()
+	buffered := make([]Message, 0, len(s.messages))
+	for _, msg := range s.messages {
+		if msg.Seq > after && msg.Seq < before && query.matches(msg) {
+			buffered = append(buffered, msg)
+		}
+	}
+	evicted := s.evictedSeq
+	s.messagesMux.RUnlock()
+
+	// The buffer holds everything after evicted, so the logs are only needed
+	// when the page reaches back past it
+	msgs := buffered
+	if after < evicted && (forward || len(buffered) <= limit) {
+		upper := before
+		if evicted < upper {
+			upper = evicted + 1
+		}
+		logged, err := s.logger.LoggedMessages(after, upper, forward, limit+1, query)
+		if err != nil {
+			return MessagePage{}, err
+		}
+		msgs = append(logged, buffered...)
+	}
+	msgs = sortBySeq(msgs)
+
+	page := MessagePage{Messages: msgs, HasMore: len(msgs) > limit}
+	if page.HasMore {
+		if forward {
+			page.Messages = msgs[:limit]
+		} else {
+			page.Messages = msgs[len(msgs)-limit:]
+		}
+	}
+	return page, nil
+}
+
+// LoggedMessages reads messages with after < seq < before that match query
+// from the log files, keeping the n lowest when forward is set
+// and the n highest otherwise. Days are read newest first and reading stops
+// once older days can't contribute, since sequence numbers grow over time.
+func (l *Logger) LoggedMessages(after, before uint64, forward bool, n int, query messageQuery) ([]Message, error) {
+	logs, err := l.GetAvailableLogs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the files of every kind by day
+	days := make(map[string][]string)
+	for kind, names := range logs {
+		if recordKinds[kind] {
+			continue
+		}
+		for _, name := range names {
+			date, _, ok := parseLogFileName(name)
+			if !ok {
+				continue
+			}
+			day := date.Format(logDateFormat)
+			days[day] = append(days[day], name)
+		}
+	}
+	order := make([]string, 0, len(days))
+	for day := range days {
+		order = append(order, day)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(order)))
+
+	collected := make([]Message, 0)
+	for _, day := range order {
+		lowest := uint64(math.MaxUint64)
+		parsed := false
+		for _, name := range days[day] {
+			content, err := l.GetLogContent(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range strings.Split(content, "\n") {
+				msg, ok := parseLogEntry(line)
+				if !ok {
+					continue
+				}
+				parsed = true
+				if msg.Seq == 0 {
+					continue
+				}
+				if msg.Seq < lowest {
+					lowest = msg.Seq
+				}
+				if msg.Seq > after && msg.Seq < before && query.matches(msg) && !isStatusEntry(msg) {
+					collected = append(collected, msg)
+				}
+			}
+		}
+
+		// Keep only the messages that can still end up on the page
+		collected = sortBySeq(collected)
+		if len(collected) > n {
+			if forward {
+				collected = collected[:n]
+			} else {
+				collected = collected[len(collected)-n:]
+			}
+		}
+
+		// Days without sequence numbers predate them, as do all older days
+		if parsed && lowest == math.MaxUint64 {
+			break
+		}
+		if lowest <= after+1 || (!forward && len(collected) >= n) {
+			break
+		}
+	}
+	return collected, nil
+}
+
+// registerHistoryRoutes registers the cursor-based messages endpoint
+func registerHistoryRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/messages", func(c *gin.Context) {
+		after, forward, err := parseCursor(c, "after")
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		before, ok, err := parseCursor(c, "before")
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !ok {
+			before = math.MaxUint64
+		}
+
+		limit := defaultPageLimit
+		if value := c.Query("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit <= 0 || limit > maxPageLimit {
+				apiError(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+				return
+			}
+		}
+
+		query, err := parseMessageQuery(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		page, err := chatServer.MessagesPage(after, before, forward, limit, query)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		// Include the media item that was playing at each message on request
+		if c.Query("with_media") == "1" {
+			page.Messages, err = chatServer.media.AttachMedia(page.Messages)
+			if err != nil {
+				respondError(c, err)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, page)
+	})
+}
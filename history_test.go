@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPagingServer logs messages 1 to 10, alternately from alice and bob,
+// and keeps 6 to 10 in the recent buffer, as after the first five were
+// evicted from it
+func newPagingServer(t *testing.T) *ChatServer {
+	t.Helper()
+
+	chatServer, _ := newTestServer(t, defaultConfig())
+	start := time.Now().Add(-time.Hour)
+	var msgs []Message
+	for seq := uint64(1); seq <= 10; seq++ {
+		username := "alice"
+		if seq%2 == 0 {
+			username = "bob"
+		}
+		msgs = append(msgs, Message{ID: strconv.FormatUint(seq, 10), Seq: seq, Type: messageTypeChat, Username: username,
+			Timestamp: start.Add(time.Duration(seq) * time.Second), Content: "message " + strconv.FormatUint(seq, 10)})
+	}
+	if err := chatServer.logger.LogMessages(msgs); err != nil {
+		t.Fatalf("logging messages: %v", err)
+	}
+
+	chatServer.messagesMux.Lock()
+	chatServer.messages = slices.Clone(msgs[5:])
+	chatServer.evictedSeq = 5
+	chatServer.messagesMux.Unlock()
+	return chatServer
+}
+
+// pageThrough follows the cursors of /api/v2/messages from the first page
+// until has_more is unset, returning the sequence numbers of every page.
+// Pages go forward when the first cursor is an after cursor.
+func pageThrough(t *testing.T, chatServer *ChatServer, query, cursor string) [][]uint64 {
+	t.Helper()
+
+	router := setupGinServer(t.Context(), chatServer)
+	forward := strings.HasPrefix(cursor, "after=")
+	var pages [][]uint64
+	for len(pages) <= 10 {
+		req := httptest.NewRequest(http.MethodGet, "/api/v2/messages?"+query+"&"+cursor, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var page MessagePage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("decoding page: %v", err)
+		}
+
+		seqs := make([]uint64, 0, len(page.Messages))
+		for _, msg := range page.Messages {
+			seqs = append(seqs, msg.Seq)
+		}
+		pages = append(pages, seqs)
+		if !page.HasMore || len(seqs) == 0 {
+			return pages
+		}
+		if forward {
+			cursor = "after=" + strconv.FormatUint(seqs[len(seqs)-1], 10)
+		} else {
+			cursor = "before=" + strconv.FormatUint(seqs[0], 10)
+		}
+	}
+	t.Fatal("paging doesn't end")
+	return nil
+}
+
+func TestMessagesPagesAcrossBufferAndLogs(t *testing.T) {
+	chatServer := newPagingServer(t)
+
+	tests := []struct {
+		name   string
+		query  string
+		cursor string
+		want   [][]uint64
+	}{
+		{"forward", "limit=3", "after=0", [][]uint64{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}, {10}}},
+		{"forward from the boundary", "limit=3", "after=5", [][]uint64{{6, 7, 8}, {9, 10}}},
+		{"backward", "limit=3", "", [][]uint64{{8, 9, 10}, {5, 6, 7}, {2, 3, 4}, {1}}},
+		{"backward from the boundary", "limit=4", "before=6", [][]uint64{{2, 3, 4, 5}, {1}}},
+		{"forward filtered", "limit=2&user=alice", "after=0", [][]uint64{{1, 3}, {5, 7}, {9}}},
+		{"backward filtered", "limit=2&user=bob", "", [][]uint64{{8, 10}, {4, 6}, {2}}},
+		{"one page for everything", "limit=100", "after=0", [][]uint64{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pageThrough(t, chatServer, tt.query, tt.cursor)
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("pages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ingestFileName is the file in the logs directory the ingest ledger is persisted to
+const ingestFileName = "ingest.json"
+
+// Ingest ledger limits. UUIDs are remembered as long as batched messages
+// may be late, since older messages are refused anyway.
+const (
+	ingestFlushInterval = 5 * time.Second
+	maxIngestUUIDs      = 20000
+	maxIngestSources    = 1000
+)
+
+// ingestIDPattern matches bridge source identifiers and message UUIDs
+var ingestIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ingestDuplicates counts batched messages dropped as already received
+var ingestDuplicates = metrics.Counter("cylog_ingest_duplicates_total", "Batched messages dropped because their UUID was already received")
+
+// IngestCursor is the last message accepted from a bridge installation
+type IngestCursor struct {
+	Source     string    `json:"source"`
+	LastUUID   string    `json:"last_uuid"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+// ingestEntry is a message UUID received from a source
+type ingestEntry struct {
+	Source string    `json:"source"`
+	UUID   string    `json:"uuid"`
+	SeenAt time.Time `json:"seen_at"`
+}
+
+// ingestFile is the persisted form of the ingest ledger
+type ingestFile struct {
+	Seen    []ingestEntry  `json:"seen"`
+	Cursors []IngestCursor `json:"cursors"`
+}
+
+// IngestLedger remembers the UUIDs of recently batched messages, so a
+// bridge resending its queue after a sleep doesn't log them twice, and the
+// last message accepted from each bridge installation
+type IngestLedger struct {
+	path    string
+	seen    map[string]bool
+	order   []ingestEntry
+	cursors map[string]IngestCursor
+	dirty   bool
+	mutex   sync.Mutex
+}
+
+// NewIngestLedger creates an ingest ledger, loading the persisted one if
+// present; UUIDs too old to be resent are dropped
+func NewIngestLedger(path string) (*IngestLedger, error) {
+	ledger := &IngestLedger{
+		path:    path,
+		seen:    make(map[string]bool),
+		cursors: make(map[string]IngestCursor),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ledger, nil
+		}
+		return nil, fmt.Errorf("failed to read ingest file: %w", err)
+	}
+
+	var file ingestFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse ingest file: %w", err)
+	}
+	for _, entry := range file.Seen {
+		ledger.seen[ingestKey(entry.Source, entry.UUID)] = true
+		ledger.order = append(ledger.order, entry)
+	}
+	for _, cursor := range file.Cursors {
+		ledger.cursors[cursor.Source] = cursor
+	}
+	ledger.prune(time.Now())
+	return ledger, nil
+}
+
+// ingestPath returns the default location of the ingest ledger
+func ingestPath() string {
+	return filepath.Join(logsDir, ingestFileName)
+}
+
+// ingestKey is the key of a message UUID; UUIDs are only compared within
+// the source that generated them
+func ingestKey(source, uuid string) string {
+	return source + "/" + uuid
+}
+
+// newIngestSource returns a random version 4 UUID identifying a bridge
+// installation
+func newIngestSource() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Claim records a message UUID from source, reporting false when it was
+// already received
+func (l *IngestLedger) Claim(source, uuid string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.prune(now)
+	key := ingestKey(source, uuid)
+	if l.seen[key] {
+		return false
+	}
+	l.seen[key] = true
+	l.order = append(l.order, ingestEntry{Source: source, UUID: uuid, SeenAt: now})
+	l.dirty = true
+	return true
+}
+
+// Advance moves the cursor of source to the message uuid
+func (l *IngestLedger) Advance(source, uuid string, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.cursors[source] = IngestCursor{Source: source, LastUUID: uuid, AcceptedAt: now}
+	l.dirty = true
+	l.prune(now)
+}
+
+// prune forgets UUIDs past the lateness limit or over the size limit, and
+// the sources idle the longest over their limit; the caller holds the mutex
+func (l *IngestLedger) prune(now time.Time) {
+	drop := 0
+	for drop < len(l.order) && (len(l.order)-drop > maxIngestUUIDs || now.Sub(l.order[drop].SeenAt) > maxBatchLateness) {
+		delete(l.seen, ingestKey(l.order[drop].Source, l.order[drop].UUID))
+		drop++
+	}
+	if drop > 0 {
+		l.order = append([]ingestEntry(nil), l.order[drop:]...)
+		l.dirty = true
+	}
+
+	if len(l.cursors) > maxIngestSources {
+		cursors := l.sortedCursors()
+		for _, cursor := range cursors[maxIngestSources:] {
+			delete(l.cursors, cursor.Source)
+		}
+		l.dirty = true
+	}
+}
+
+// sortedCursors returns the cursors, most recently accepted first; the
+// caller holds the mutex
+func (l *IngestLedger) sortedCursors() []IngestCursor {
+	cursors := make([]IngestCursor, 0, len(l.cursors))
+	for _, cursor := range l.cursors {
+		cursors = append(cursors, cursor)
+	}
+	sort.Slice(cursors, func(i, j int) bool {
+		return cursors[i].AcceptedAt.After(cursors[j].AcceptedAt)
+	})
+	return cursors
+}
+
+// Cursors returns the cursor of every source, most recently accepted first
+func (l *IngestLedger) Cursors() []IngestCursor {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.sortedCursors()
+}
+
+// Flush writes the ingest ledger to disk if it has changed
+func (l *IngestLedger) Flush() error {
+	l.mutex.Lock()
+	if !l.dirty {
+		l.mutex.Unlock()
+		return nil
+	}
+	file := ingestFile{
+		Seen:    append([]ingestEntry(nil), l.order...),
+		Cursors: l.sortedCursors(),
+	}
+	l.dirty = false
+	l.mutex.Unlock()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("failed to encode ingest ledger: %w", err)
+	}
+	if err := writeFileAtomic(l.path, data); err != nil {
+		return fmt.Errorf("failed to write ingest file: %w", err)
+	}
+	return nil
+}
+
+// run periodically flushes the ingest ledger until ctx is canceled
+func (l *IngestLedger) run(ctx context.Context) {
+	defer recoverPanic("ingest ledger")
+
+	ticker := time.NewTicker(ingestFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := l.Flush(); err != nil {
+				log.Printf("Error saving ingest ledger: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := l.Flush(); err != nil {
+				log.Printf("Error saving ingest ledger: %v", err)
+			}
+		}
+	}
+}
+
+// registerIngestRoutes registers the bridge queue cursor endpoint. Bridges
+// may only have the ingest scope, so it is outside the read scope.
+func registerIngestRoutes(router *gin.Engine, chatServer *ChatServer) {
+	router.GET("/api/v1/ingest/cursor", requireScope(chatServer.config, scopeRead, scopeIngest), func(c *gin.Context) {
+		cursors := chatServer.ingest.Cursors()
+		if source := c.Query("source"); source != "" {
+			selected := make([]IngestCursor, 0, 1)
+			for _, cursor := range cursors {
+				if cursor.Source == source {
+					selected = append(selected, cursor)
+				}
+			}
+			cursors = selected
+		}
+		c.JSON(http.StatusOK, cursors)
+	})
+}
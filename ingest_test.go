@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"cylog/internal/testsupport"
+)
+
+func TestIngestLedgerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ingestFileName)
+	ledger, err := NewIngestLedger(path)
+	if err != nil {
+		t.Fatalf("creating ledger: %v", err)
+	}
+
+	now := time.Now()
+	stale := now.Add(-maxBatchLateness - time.Minute)
+	ledger.Claim("laptop", "old", stale)
+	for _, uuid := range []string{"m1", "m2"} {
+		if !ledger.Claim("laptop", uuid, now) {
+			t.Fatalf("%s taken as a duplicate on first sight", uuid)
+		}
+	}
+	ledger.Advance("laptop", "m2", now)
+	if ledger.Claim("laptop", "m1", now) {
+		t.Error("m1 accepted twice")
+	}
+	if !ledger.Claim("desktop", "m1", now) {
+		t.Error("the same UUID from another source taken as a duplicate")
+	}
+	if err := ledger.Flush(); err != nil {
+		t.Fatalf("flushing: %v", err)
+	}
+
+	reloaded, err := NewIngestLedger(path)
+	if err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	for _, uuid := range []string{"m1", "m2"} {
+		if reloaded.Claim("laptop", uuid, now) {
+			t.Errorf("%s accepted again after the reload", uuid)
+		}
+	}
+	if !reloaded.Claim("laptop", "old", now) {
+		t.Error("a UUID past the lateness limit was kept across the reload")
+	}
+	cursors := reloaded.Cursors()
+	if len(cursors) != 1 || cursors[0].Source != "laptop" || cursors[0].LastUUID != "m2" {
+		t.Errorf("cursors after the reload = %+v, want laptop at m2", cursors)
+	}
+}
+
+// sendBatch sends a batch frame and returns its acknowledgement
+func sendBatch(t *testing.T, client *testsupport.Client, source string, uuids ...string) BatchedFrame {
+	t.Helper()
+
+	frame := BatchFrame{Type: frameTypeBatch, Source: source}
+	for _, uuid := range uuids {
+		frame.Messages = append(frame.Messages, BatchMessage{UUID: uuid, Username: "alice", Content: "message " + uuid, Timestamp: time.Now()})
+	}
+	client.Send(frame)
+
+	var ack BatchedFrame
+	if err := json.Unmarshal(client.WaitFor(e2eTimeout, frameContaining(`"type":"batched"`)), &ack); err != nil {
+		t.Fatalf("decoding the acknowledgement: %v", err)
+	}
+	return ack
+}
+
+// itemStatuses lists the status of each message of an acknowledgement
+func itemStatuses(ack BatchedFrame) []string {
+	statuses := make([]string, 0, len(ack.Items))
+	for _, item := range ack.Items {
+		statuses = append(statuses, item.Status)
+	}
+	return statuses
+}
+
+func TestBatchDuplicatesAndCursor(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	_, baseURL := runTestServer(t.Context(), t, defaultConfig(), upstream)
+	client := testsupport.Dial(t, baseURL, "/ws")
+	client.WaitFor(e2eTimeout, frameContaining(`"type":"hello"`))
+	client.Send(map[string]interface{}{"type": "hello", "bot": true})
+
+	// The first batch is assigned a source for the bridge to keep
+	first := sendBatch(t, client, "", "m1", "m2")
+	if !ingestIDPattern.MatchString(first.Source) {
+		t.Fatalf("assigned source = %q", first.Source)
+	}
+	if want := []string{batchAccepted, batchAccepted}; !slices.Equal(itemStatuses(first), want) {
+		t.Errorf("first batch = %v, want %v", itemStatuses(first), want)
+	}
+
+	// Resending after a sleep only delivers what wasn't acknowledged
+	resent := sendBatch(t, client, first.Source, "m1", "m2", "m3")
+	if want := []string{batchDuplicate, batchDuplicate, batchAccepted}; !slices.Equal(itemStatuses(resent), want) {
+		t.Errorf("resent batch = %v, want %v", itemStatuses(resent), want)
+	}
+	if resent.Accepted != 1 || resent.Duplicate != 2 {
+		t.Errorf("resent batch accepted %d and skipped %d, want 1 and 2", resent.Accepted, resent.Duplicate)
+	}
+
+	resp, err := http.Get(baseURL + "/api/v1/ingest/cursor?source=" + first.Source)
+	if err != nil {
+		t.Fatalf("fetching the cursor: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var cursors []IngestCursor
+	if err := json.Unmarshal(body, &cursors); err != nil {
+		t.Fatalf("decoding cursors %s: %v", body, err)
+	}
+	if len(cursors) != 1 || cursors[0].LastUUID != "m3" {
+		t.Errorf("cursors = %+v, want the source at m3", cursors)
+	}
+}
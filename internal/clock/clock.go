@@ -0,0 +1,158 @@
+// Package clock abstracts the time source, so code that rotates or expires
+// things by date can be driven across day boundaries by a fake clock in
+// tests instead of waiting for midnight.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-shot timer created by a Clock
+type Timer interface {
+	// C delivers the time once the timer fires
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing, reporting whether it was pending
+	Stop() bool
+}
+
+// System returns the real clock
+func System() Clock {
+	return systemClock{}
+}
+
+// systemClock is the real clock
+type systemClock struct{}
+
+// Now returns the current time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer starts a real timer
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+// systemTimer wraps a time.Timer
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// C returns the timer's channel
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+// Stop stops the timer
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// Fake is a clock that only moves when told to; its timers fire as Advance
+// or Set passes their deadline
+type Fake struct {
+	now    time.Time
+	timers []*fakeTimer
+	mutex  sync.Mutex
+}
+
+// NewFake creates a fake clock reading now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.now
+}
+
+// NewTimer creates a timer firing once the fake time reaches d from now
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	timer := &fakeTimer{clock: f, deadline: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- f.now
+		return timer
+	}
+	f.timers = append(f.timers, timer)
+	return timer
+}
+
+// Advance moves the fake time forward by d
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the fake time to now, firing the timers it passes in deadline
+// order; it never moves the time backwards
+func (f *Fake) Set(now time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if now.Before(f.now) {
+		return
+	}
+	f.now = now
+
+	sort.Slice(f.timers, func(i, j int) bool {
+		return f.timers[i].deadline.Before(f.timers[j].deadline)
+	})
+	pending := f.timers[:0]
+	for _, timer := range f.timers {
+		if timer.deadline.After(now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- now
+	}
+	f.timers = pending
+}
+
+// Timers returns how many timers are waiting to fire, so tests can wait
+// for code to start one before advancing past it
+func (f *Fake) Timers() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.timers)
+}
+
+// fakeTimer is a timer of a Fake clock
+type fakeTimer struct {
+	clock    *Fake
+	deadline time.Time
+	c        chan time.Time
+}
+
+// C returns the timer's channel
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop removes the timer from its clock
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
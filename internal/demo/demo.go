@@ -0,0 +1,147 @@
+// Package demo generates synthetic Cytube traffic as raw Socket.IO frames,
+// for running without a live connection and for tests that need known input.
+// A generator with the same seed and users produces the same frames.
+package demo
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+//go:embed corpus.txt
+var corpusText string
+
+// corpus is the chat lines messages are picked from
+var corpus = strings.Split(strings.TrimSpace(corpusText), "\n")
+
+// DefaultUsers are the fake usernames used when none are given
+var DefaultUsers = []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"}
+
+// media are the fake playlist items changeMedia events pick from
+var media = []struct {
+	id      string
+	title   string
+	seconds int
+}{
+	{"dQw4w9WgXcQ", "Demo Song", 212},
+	{"9bZkp7q5f2A", "Demo Music Video", 253},
+	{"jNQXAC9IVRw", "Demo Clip", 19},
+	{"kJQP7kiw5Fk", "Demo Feature", 282},
+}
+
+// Event odds: one frame in joinOdds is a join or leave and one in
+// mediaOdds a media change; the rest are chat, some of them actions
+const (
+	joinOdds   = 12
+	mediaOdds  = 40
+	actionOdds = 15
+)
+
+// Generator produces Cytube frames from the embedded corpus
+type Generator struct {
+	rand    *rand.Rand
+	users   []string
+	present map[string]bool
+}
+
+// NewGenerator creates a generator; users defaults to DefaultUsers
+func NewGenerator(seed int64, users []string) *Generator {
+	if len(users) == 0 {
+		users = DefaultUsers
+	}
+	g := &Generator{
+		rand:    rand.New(rand.NewSource(seed)),
+		users:   users,
+		present: make(map[string]bool, len(users)),
+	}
+	for _, user := range users {
+		g.present[user] = true
+	}
+	return g
+}
+
+// Initial returns the frames Cytube sends after joining a channel: the
+// userlist and the media playing
+func (g *Generator) Initial() [][]byte {
+	users := make([]map[string]interface{}, 0, len(g.users))
+	for i, name := range g.users {
+		users = append(users, user(name, i%3))
+	}
+	return [][]byte{frame("userlist", users), g.changeMedia()}
+}
+
+// Next returns the next frame, stamped with now
+func (g *Generator) Next(now time.Time) []byte {
+	switch {
+	case g.rand.Intn(joinOdds) == 0:
+		name := g.users[g.rand.Intn(len(g.users))]
+		g.present[name] = !g.present[name]
+		if g.present[name] {
+			return frame("addUser", user(name, 1))
+		}
+		return frame("userLeave", map[string]string{"name": name})
+	case g.rand.Intn(mediaOdds) == 0:
+		return g.changeMedia()
+	}
+
+	name := g.speaker()
+	msg := map[string]interface{}{
+		"username": name,
+		"msg":      corpus[g.rand.Intn(len(corpus))],
+		"time":     now.UnixMilli(),
+		"meta":     map[string]interface{}{},
+	}
+	if g.rand.Intn(actionOdds) == 0 {
+		msg["meta"] = map[string]interface{}{"addClass": "action"}
+	}
+	return frame("chatMsg", msg)
+}
+
+// speaker picks a user who is in the channel, or anyone if nobody is
+func (g *Generator) speaker() string {
+	present := make([]string, 0, len(g.users))
+	for _, name := range g.users {
+		if g.present[name] {
+			present = append(present, name)
+		}
+	}
+	if len(present) == 0 {
+		return g.users[g.rand.Intn(len(g.users))]
+	}
+	return present[g.rand.Intn(len(present))]
+}
+
+// changeMedia returns a changeMedia frame for a random playlist item
+func (g *Generator) changeMedia() []byte {
+	item := media[g.rand.Intn(len(media))]
+	return frame("changeMedia", map[string]interface{}{
+		"id":          item.id,
+		"title":       item.title,
+		"seconds":     item.seconds,
+		"type":        "yt",
+		"currentTime": 0,
+	})
+}
+
+// user returns a userlist entry
+func user(name string, rank int) map[string]interface{} {
+	return map[string]interface{}{
+		"name":    name,
+		"rank":    rank,
+		"profile": map[string]string{"image": "", "text": ""},
+		"meta":    map[string]bool{"afk": false},
+	}
+}
+
+// frame encodes a Socket.IO event frame like 42["chatMsg",{...}]
+func frame(name string, data interface{}) []byte {
+	payload, err := json.Marshal([]interface{}{name, data})
+	if err != nil {
+		panic(fmt.Sprintf("demo: encoding %s: %v", name, err))
+	}
+	return append([]byte("42"), payload...)
+}
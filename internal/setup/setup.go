@@ -0,0 +1,201 @@
+// Package setup runs the first-run wizard: a few questions on a terminal
+// whose answers become the starting cylog.yaml. It reads and writes only
+// the streams it is given, so it can be driven by scripted input.
+package setup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// channelPattern matches Cytube channel names
+var channelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,30}$`)
+
+// ErrAborted is returned when the input ends before the wizard finished
+var ErrAborted = errors.New("setup aborted")
+
+// Answers are the settings the wizard asks for
+type Answers struct {
+	Channel string
+
+	// URL is a ws:// or wss:// upstream URL, or an http:// or https://
+	// Cytube site whose socketconfig names the channel's server
+	URL string
+
+	Port     int
+	Headless bool
+}
+
+// Wizard asks the setup questions
+type Wizard struct {
+	in  *bufio.Scanner
+	out io.Writer
+
+	// probe tries a set of answers, such as by joining the channel; nil
+	// skips the check
+	probe func(Answers) error
+}
+
+// New creates a wizard reading answers from in and writing prompts to out;
+// probe, when set, checks the answers before they are accepted
+func New(in io.Reader, out io.Writer, probe func(Answers) error) *Wizard {
+	return &Wizard{in: bufio.NewScanner(in), out: out, probe: probe}
+}
+
+// Run asks the questions, offering defaults, until the answers pass the
+// probe or the user skips it
+func (w *Wizard) Run(defaults Answers) (Answers, error) {
+	fmt.Fprintln(w.out, "No config file found; answer a few questions to create one.")
+	fmt.Fprintln(w.out, "Press Enter to keep the value in brackets.")
+
+	answers := defaults
+	for {
+		var err error
+		if answers, err = w.ask(answers); err != nil {
+			return Answers{}, err
+		}
+		if w.probe == nil {
+			return answers, nil
+		}
+
+		retry := true
+		for retry {
+			fmt.Fprintf(w.out, "Joining %s...\n", answers.Channel)
+			probeErr := w.probe(answers)
+			if probeErr == nil {
+				fmt.Fprintln(w.out, "Joined the channel.")
+				return answers, nil
+			}
+
+			fmt.Fprintf(w.out, "Could not join the channel: %v\n", probeErr)
+			choice, err := w.prompt("Retry, edit the answers or skip the check and save? (r/e/s)", "e", func(value string) error {
+				switch strings.ToLower(value) {
+				case "r", "e", "s":
+					return nil
+				}
+				return errors.New("enter r, e or s")
+			})
+			if err != nil {
+				return Answers{}, err
+			}
+			switch strings.ToLower(choice) {
+			case "s":
+				return answers, nil
+			case "e":
+				retry = false
+			}
+		}
+	}
+}
+
+// ask asks every question once, starting from defaults
+func (w *Wizard) ask(defaults Answers) (Answers, error) {
+	var answers Answers
+	var err error
+
+	if answers.Channel, err = w.prompt("Cytube channel", defaults.Channel, validateChannel); err != nil {
+		return Answers{}, err
+	}
+	if answers.URL, err = w.prompt("Cytube server (wss:// URL, or https:// site to look up)", defaults.URL, validateURL); err != nil {
+		return Answers{}, err
+	}
+
+	port, err := w.prompt("Web UI port", strconv.Itoa(defaults.Port), validatePort)
+	if err != nil {
+		return Answers{}, err
+	}
+	answers.Port, _ = strconv.Atoi(port)
+
+	headless, err := w.prompt("Run headless, without the desktop window? (y/n)", yesNo(defaults.Headless), validateYesNo)
+	if err != nil {
+		return Answers{}, err
+	}
+	answers.Headless = strings.HasPrefix(strings.ToLower(headless), "y")
+	return answers, nil
+}
+
+// prompt asks a question until the answer, or the default for an empty
+// one, passes validate
+func (w *Wizard) prompt(question, value string, validate func(string) error) (string, error) {
+	for {
+		if value != "" {
+			fmt.Fprintf(w.out, "%s [%s]: ", question, value)
+		} else {
+			fmt.Fprintf(w.out, "%s: ", question)
+		}
+		if !w.in.Scan() {
+			fmt.Fprintln(w.out)
+			if err := w.in.Err(); err != nil {
+				return "", err
+			}
+			return "", ErrAborted
+		}
+
+		answer := strings.TrimSpace(w.in.Text())
+		if answer == "" {
+			answer = value
+		}
+		if err := validate(answer); err != nil {
+			fmt.Fprintf(w.out, "  %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// validateChannel checks a channel name
+func validateChannel(value string) error {
+	if !channelPattern.MatchString(value) {
+		return errors.New("a channel name is 1 to 30 letters, digits, _ or -")
+	}
+	return nil
+}
+
+// validateURL checks an upstream or site URL
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return errors.New("enter a URL like wss://cytube.example/socket.io/ or https://cytu.be")
+	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https":
+		return nil
+	}
+	return errors.New("the URL must start with ws://, wss://, http:// or https://")
+}
+
+// validatePort checks a port number
+func validatePort(value string) error {
+	if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+		return errors.New("a port is a number from 1 to 65535")
+	}
+	return nil
+}
+
+// validateYesNo checks a yes or no answer
+func validateYesNo(value string) error {
+	switch strings.ToLower(value) {
+	case "y", "yes", "n", "no":
+		return nil
+	}
+	return errors.New("enter y or n")
+}
+
+// yesNo formats a boolean default
+func yesNo(value bool) string {
+	if value {
+		return "y"
+	}
+	return "n"
+}
+
+// IsSite reports whether a URL names a Cytube site rather than a WebSocket
+func (a Answers) IsSite() bool {
+	return strings.HasPrefix(a.URL, "http://") || strings.HasPrefix(a.URL, "https://")
+}
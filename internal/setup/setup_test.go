@@ -0,0 +1,146 @@
+package setup
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// defaults are the answers the wizard offers in the tests
+var defaults = Answers{Channel: "mychannel", URL: "https://cytu.be", Port: 8080}
+
+func TestWizardScriptedInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   Answers
+		err    error
+		output string
+	}{
+		{
+			name:   "defaults",
+			script: "\n\n\n\n",
+			want:   defaults,
+		},
+		{
+			name:   "every answer",
+			script: "anime\nwss://cytube.example/socket.io/\n3000\ny\n",
+			want:   Answers{Channel: "anime", URL: "wss://cytube.example/socket.io/", Port: 3000, Headless: true},
+		},
+		{
+			name:   "answers with surrounding space",
+			script: "  anime \n\n 3000\nYES\n",
+			want:   Answers{Channel: "anime", URL: defaults.URL, Port: 3000, Headless: true},
+		},
+		{
+			name:   "invalid answers asked again",
+			script: "no spaces allowed\nanime\nftp://cytu.be\ncytu.be\nhttps://om3tcw.com\n0\n70000\nhttp\n8081\nmaybe\nn\n",
+			want:   Answers{Channel: "anime", URL: "https://om3tcw.com", Port: 8081},
+			output: "a channel name is 1 to 30 letters",
+		},
+		{
+			name:   "input ends",
+			script: "anime\nwss://cytube.example/socket.io/\n",
+			err:    ErrAborted,
+		},
+		{
+			name: "no input",
+			err:  ErrAborted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			got, err := New(strings.NewReader(tt.script), &out, nil).Run(defaults)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("answers = %+v, want %+v", got, tt.want)
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("output %q doesn't contain %q", out.String(), tt.output)
+			}
+		})
+	}
+}
+
+func TestWizardProbeFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		fails  int
+		want   Answers
+		probes int
+	}{
+		{
+			name:   "retry until joined",
+			script: "\n\n\n\nr\nr\n",
+			fails:  2,
+			want:   defaults,
+			probes: 3,
+		},
+		{
+			name:   "edit the answers",
+			script: "typo\n\n\n\ne\nanime\n\n\n\n",
+			fails:  1,
+			want:   Answers{Channel: "anime", URL: defaults.URL, Port: defaults.Port},
+			probes: 2,
+		},
+		{
+			name:   "edit by default",
+			script: "typo\n\n\n\n\nanime\n\n\n\n",
+			fails:  1,
+			want:   Answers{Channel: "anime", URL: defaults.URL, Port: defaults.Port},
+			probes: 2,
+		},
+		{
+			name:   "skip the check",
+			script: "offline\n\n\n\nx\nS\n",
+			fails:  1,
+			want:   Answers{Channel: "offline", URL: defaults.URL, Port: defaults.Port},
+			probes: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probes := 0
+			probe := func(Answers) error {
+				probes++
+				if probes <= tt.fails {
+					return errors.New("channel not found")
+				}
+				return nil
+			}
+
+			var out strings.Builder
+			got, err := New(strings.NewReader(tt.script), &out, probe).Run(defaults)
+			if err != nil {
+				t.Fatalf("running the wizard: %v\n%s", err, out.String())
+			}
+			if got != tt.want {
+				t.Errorf("answers = %+v, want %+v", got, tt.want)
+			}
+			if probes != tt.probes {
+				t.Errorf("probed %d times, want %d", probes, tt.probes)
+			}
+			if !strings.Contains(out.String(), "Could not join the channel: channel not found") {
+				t.Errorf("output %q doesn't report the failed join", out.String())
+			}
+		})
+	}
+}
+
+func TestAnswersIsSite(t *testing.T) {
+	tests := map[string]bool{
+		"https://cytu.be":                 true,
+		"http://localhost:8080":           true,
+		"wss://cytube.example/socket.io/": false,
+		"ws://localhost:1337/socket.io/":  false,
+	}
+	for url, want := range tests {
+		if got := (Answers{URL: url}).IsSite(); got != want {
+			t.Errorf("IsSite(%q) = %v, want %v", url, got, want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Package testsupport runs cylog end to end in-process for tests: a fake
+// Cytube server for the upstream connection, and helpers to serve the HTTP
+// router on a random port and connect WebSocket clients to it.
+package testsupport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Socket.IO (Engine.IO v3) frames the fake server sends and answers
+const (
+	openPacket    = `0{"sid":"fake","upgrades":[],"pingInterval":25000,"pingTimeout":60000}`
+	connectPacket = "40"
+	pingPacket    = "2"
+	pongPacket    = "3"
+	eventPrefix   = "42"
+)
+
+// eventBuffer is how many client events are kept for WaitEvent; later ones
+// are dropped until they are read
+const eventBuffer = 256
+
+// Event is a Socket.IO event the client sent, such as joinChannel
+type Event struct {
+	Name string
+	Data json.RawMessage
+}
+
+// fakeConn is a client connection; writes are serialized since the read
+// loop answers pings while tests emit events
+type fakeConn struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+}
+
+// write sends a text frame
+func (c *fakeConn) write(frame string) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(frame))
+}
+
+// FakeCytube is a Cytube WebSocket server speaking enough of the protocol
+// to drive cylog: the Engine.IO handshake and pings, events in both
+// directions, and dropping connections on command
+type FakeCytube struct {
+	tb        testing.TB
+	server    *httptest.Server
+	upgrader  websocket.Upgrader
+	conns     map[*fakeConn]bool
+	connected chan struct{}
+	events    chan Event
+	mutex     sync.Mutex
+}
+
+// NewFakeCytube starts a fake Cytube server, closed when the test ends
+func NewFakeCytube(tb testing.TB) *FakeCytube {
+	tb.Helper()
+
+	f := &FakeCytube{
+		tb:        tb,
+		conns:     make(map[*fakeConn]bool),
+		connected: make(chan struct{}, eventBuffer),
+		events:    make(chan Event, eventBuffer),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	tb.Cleanup(f.Close)
+	return f
+}
+
+// URL returns the Socket.IO WebSocket URL to put in upstream.urls
+func (f *FakeCytube) URL() string {
+	return "ws" + strings.TrimPrefix(f.server.URL, "http") + "/socket.io/?EIO=3&transport=websocket"
+}
+
+// serve handshakes with a client and reads its frames until it disconnects
+func (f *FakeCytube) serve(w http.ResponseWriter, r *http.Request) {
+	ws, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &fakeConn{conn: ws}
+	defer f.drop(conn)
+
+	if conn.write(openPacket) != nil || conn.write(connectPacket) != nil {
+		return
+	}
+	f.mutex.Lock()
+	f.conns[conn] = true
+	f.mutex.Unlock()
+	select {
+	case f.connected <- struct{}{}:
+	default:
+	}
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		frame := string(data)
+		switch {
+		case frame == pingPacket:
+			conn.write(pongPacket)
+		case strings.HasPrefix(frame, eventPrefix):
+			event, ok := parseEvent(frame)
+			if !ok {
+				continue
+			}
+			select {
+			case f.events <- event:
+			default:
+			}
+		}
+	}
+}
+
+// drop forgets and closes a connection
+func (f *FakeCytube) drop(conn *fakeConn) {
+	f.mutex.Lock()
+	delete(f.conns, conn)
+	f.mutex.Unlock()
+	conn.conn.Close()
+}
+
+// parseEvent decodes a frame like 42["joinChannel",{...}]
+func parseEvent(frame string) (Event, bool) {
+	var parts []json.RawMessage
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frame, eventPrefix)), &parts); err != nil || len(parts) == 0 {
+		return Event{}, false
+	}
+
+	var event Event
+	if err := json.Unmarshal(parts[0], &event.Name); err != nil {
+		return Event{}, false
+	}
+	if len(parts) > 1 {
+		event.Data = parts[1]
+	}
+	return event, true
+}
+
+// WaitConnected waits for a client to complete the handshake, failing the
+// test after timeout; call it from the test goroutine
+func (f *FakeCytube) WaitConnected(timeout time.Duration) {
+	f.tb.Helper()
+
+	select {
+	case <-f.connected:
+	case <-time.After(timeout):
+		f.tb.Fatalf("no upstream connection to the fake Cytube server within %s", timeout)
+	}
+}
+
+// WaitEvent waits for the client to send the named event, skipping others,
+// and fails the test after timeout; call it from the test goroutine
+func (f *FakeCytube) WaitEvent(name string, timeout time.Duration) Event {
+	f.tb.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-f.events:
+			if event.Name == name {
+				return event
+			}
+		case <-deadline:
+			f.tb.Fatalf("no %s event sent to the fake Cytube server within %s", name, timeout)
+			return Event{}
+		}
+	}
+}
+
+// Emit sends an event to every connected client
+func (f *FakeCytube) Emit(name string, data interface{}) {
+	f.tb.Helper()
+
+	payload, err := json.Marshal([]interface{}{name, data})
+	if err != nil {
+		f.tb.Fatalf("encoding %s event: %v", name, err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for conn := range f.conns {
+		if err := conn.write(eventPrefix + string(payload)); err != nil {
+			f.tb.Logf("sending %s event: %v", name, err)
+		}
+	}
+}
+
+// ChatMsg sends a chat message said by username now
+func (f *FakeCytube) ChatMsg(username, msg string) {
+	f.tb.Helper()
+
+	f.Emit("chatMsg", map[string]interface{}{
+		"username": username,
+		"msg":      msg,
+		"time":     time.Now().UnixMilli(),
+		"meta":     map[string]interface{}{},
+	})
+}
+
+// Userlist sends the channel's userlist, every user at rank 1
+func (f *FakeCytube) Userlist(names ...string) {
+	f.tb.Helper()
+
+	users := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		users = append(users, map[string]interface{}{
+			"name":    name,
+			"rank":    1,
+			"profile": map[string]string{"image": "", "text": ""},
+			"meta":    map[string]bool{"afk": false},
+		})
+	}
+	f.Emit("userlist", users)
+}
+
+// Disconnect closes every client connection, as when Cytube restarts;
+// clients may reconnect
+func (f *FakeCytube) Disconnect() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for conn := range f.conns {
+		conn.conn.Close()
+	}
+}
+
+// Close disconnects every client and stops the server
+func (f *FakeCytube) Close() {
+	f.Disconnect()
+	f.server.Close()
+}
@@ -0,0 +1,168 @@
+package testsupport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pollInterval is how often Eventually checks its condition
+const pollInterval = 10 * time.Millisecond
+
+// Workdir changes into a fresh temporary directory for the rest of the
+// test, since cylog keeps its logs and state relative to the working
+// directory, and links in the static files it serves from repoRoot
+func Workdir(tb testing.TB, repoRoot string) string {
+	tb.Helper()
+
+	root, err := filepath.Abs(repoRoot)
+	if err != nil {
+		tb.Fatalf("resolving %s: %v", repoRoot, err)
+	}
+	dir := tb.TempDir()
+	for _, name := range []string{"static", "scripts"} {
+		if err := os.Symlink(filepath.Join(root, name), filepath.Join(dir, name)); err != nil {
+			tb.Fatalf("linking %s: %v", name, err)
+		}
+	}
+	tb.Chdir(dir)
+	return dir
+}
+
+// Serve serves handler, such as the Gin router, on a random local port
+// until the test ends and returns its base URL
+func Serve(tb testing.TB, handler http.Handler) string {
+	tb.Helper()
+
+	server := httptest.NewServer(handler)
+	tb.Cleanup(server.Close)
+	return server.URL
+}
+
+// Eventually polls check until it returns true, failing the test with
+// message after timeout; call it from the test goroutine
+func Eventually(tb testing.TB, timeout time.Duration, message string, check func() bool) {
+	tb.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("%s within %s", message, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Client is a WebSocket client connected to cylog
+type Client struct {
+	tb     testing.TB
+	conn   *websocket.Conn
+	frames chan []byte
+	done   chan struct{}
+	closed sync.Once
+
+	// err ended the connection; it is set before frames is closed
+	err error
+}
+
+// Dial connects a WebSocket client to path on the server at baseURL, such
+// as one returned by Serve; it is closed when the test ends
+func Dial(tb testing.TB, baseURL, path string) *Client {
+	tb.Helper()
+
+	url := "ws" + strings.TrimPrefix(baseURL, "http") + path
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		tb.Fatalf("connecting to %s: %v", url, err)
+	}
+
+	c := &Client{tb: tb, conn: conn, frames: make(chan []byte, eventBuffer), done: make(chan struct{})}
+	go c.read()
+	tb.Cleanup(c.Close)
+	return c
+}
+
+// read queues frames for WaitFor until the connection closes
+func (c *Client) read() {
+	defer close(c.frames)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		select {
+		case c.frames <- data:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// WaitFor returns the first frame match accepts, skipping others, and fails
+// the test after timeout or when the connection closes; call it from the
+// test goroutine
+func (c *Client) WaitFor(timeout time.Duration, match func(frame []byte) bool) []byte {
+	c.tb.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				c.tb.Fatalf("WebSocket closed while waiting for a frame")
+				return nil
+			}
+			if match(frame) {
+				return frame
+			}
+		case <-deadline:
+			c.tb.Fatalf("no matching WebSocket frame within %s", timeout)
+			return nil
+		}
+	}
+}
+
+// WaitClosed skips frames until the connection closes and returns the
+// error that closed it, a *websocket.CloseError when cylog sent a close
+// frame, and fails the test after timeout; call it from the test goroutine
+func (c *Client) WaitClosed(timeout time.Duration) error {
+	c.tb.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-c.frames:
+			if !ok {
+				return c.err
+			}
+		case <-deadline:
+			c.tb.Fatalf("WebSocket still open after %s", timeout)
+			return nil
+		}
+	}
+}
+
+// Send writes a frame to cylog as JSON, failing the test on error
+func (c *Client) Send(frame interface{}) {
+	c.tb.Helper()
+
+	if err := c.conn.WriteJSON(frame); err != nil {
+		c.tb.Fatalf("sending a WebSocket frame: %v", err)
+	}
+}
+
+// Close closes the connection
+func (c *Client) Close() {
+	c.closed.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
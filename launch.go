@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// How the UI is opened on startup
+const (
+	openModeAuto    = "auto"
+	openModeNone    = "none"
+	openModeBrowser = "browser"
+	openModeWebView = "webview"
+)
+
+// urlPlaceholder is replaced by the UI URL in desktop.browser_command
+const urlPlaceholder = "{url}"
+
+// DesktopConfig configures how the UI is opened on startup when not
+// headless; --open and --browser-cmd override it
+type DesktopConfig struct {
+	// Open is "auto" (default: the WebView app, else the browser),
+	// "webview", "browser" or "none" to only print the URL
+	Open string `yaml:"open"`
+
+	// BrowserCommand is a command opening the URL, such as
+	// "firefox --new-window {url}"; without {url} the URL is appended
+	BrowserCommand string `yaml:"browser_command"`
+}
+
+// validate checks the desktop settings
+func (c DesktopConfig) validate() error {
+	switch c.Open {
+	case "", openModeAuto, openModeNone, openModeBrowser, openModeWebView:
+	default:
+		return fmt.Errorf("invalid desktop open %q: must be auto, webview, browser or none", c.Open)
+	}
+	if _, err := splitCommand(c.BrowserCommand); err != nil {
+		return fmt.Errorf("invalid desktop browser_command: %w", err)
+	}
+	return nil
+}
+
+// launchEnv describes the system a browser is launched on
+type launchEnv struct {
+	goos string
+
+	// wsl is set for Linux running under the Windows Subsystem for Linux,
+	// where the Windows browser is the one to open
+	wsl bool
+
+	// browser is the BROWSER environment variable
+	browser string
+}
+
+// currentLaunchEnv returns the launch environment of this process
+func currentLaunchEnv() launchEnv {
+	return launchEnv{goos: runtime.GOOS, wsl: isWSL(), browser: os.Getenv("BROWSER")}
+}
+
+// isWSL reports whether Linux runs under the Windows Subsystem for Linux
+func isWSL() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	if os.Getenv("WSL_DISTRO_NAME") != "" {
+		return true
+	}
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	return err == nil && strings.Contains(strings.ToLower(string(release)), "microsoft")
+}
+
+// browserCommands returns the commands to try in order to open url: the
+// configured command alone, or else the usual openers of the system
+func browserCommands(env launchEnv, template, url string) ([][]string, error) {
+	if template != "" {
+		args, err := splitCommand(template)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{substituteURL(args, url)}, nil
+	}
+
+	var commands [][]string
+	if env.browser != "" {
+		// BROWSER may list several commands, separated like PATH
+		for _, browser := range strings.Split(env.browser, string(os.PathListSeparator)) {
+			if args, err := splitCommand(browser); err == nil && len(args) > 0 {
+				commands = append(commands, substituteURL(args, url))
+			}
+		}
+	}
+
+	switch env.goos {
+	case "windows":
+		commands = append(commands,
+			[]string{"rundll32", "url.dll,FileProtocolHandler", url},
+			[]string{"cmd", "/c", "start", "", url},
+		)
+	case "darwin":
+		commands = append(commands, []string{"open", url})
+	default: // "linux", "freebsd", "openbsd", "netbsd"
+		if env.wsl {
+			commands = append(commands,
+				[]string{"wslview", url},
+				[]string{"cmd.exe", "/c", "start", "", url},
+			)
+		}
+		commands = append(commands,
+			[]string{"xdg-open", url},
+			[]string{"gio", "open", url},
+			[]string{"kde-open5", url},
+			[]string{"kde-open", url},
+			[]string{"gnome-open", url},
+			[]string{"sensible-browser", url},
+			[]string{"x-www-browser", url},
+		)
+	}
+	return commands, nil
+}
+
+// substituteURL replaces {url} in a command's arguments, or appends the
+// URL when no argument has it
+func substituteURL(args []string, url string) []string {
+	command := make([]string, 0, len(args)+1)
+	found := false
+	for _, arg := range args {
+		if strings.Contains(arg, urlPlaceholder) {
+			arg = strings.ReplaceAll(arg, urlPlaceholder, url)
+			found = true
+		}
+		command = append(command, arg)
+	}
+	if !found {
+		command = append(command, url)
+	}
+	return command
+}
+
+// splitCommand splits a command line into arguments on spaces, keeping
+// single- or double-quoted text together, so paths with spaces work
+func splitCommand(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// openInBrowser opens the URL with the first browser command that starts
+func openInBrowser(template, url string) error {
+	commands, err := browserCommands(currentLaunchEnv(), template, url)
+	if err != nil {
+		return err
+	}
+
+	lastErr := fmt.Errorf("no browser opener found")
+	for _, command := range commands {
+		path, err := exec.LookPath(command[0])
+		if err != nil {
+			if template != "" {
+				lastErr = err
+			}
+			continue
+		}
+		if err := exec.Command(path, command[1:]...).Start(); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// printURL tells the user where the UI is when nothing was opened
+func printURL(url string) {
+	fmt.Printf("Open %s in your browser\n", url)
+}
+
+// launchDesktopApp opens the UI as configured: the WebView app, the system
+// browser or neither. Whatever fails, the URL is printed to open by hand.
+func launchDesktopApp(cfg DesktopConfig, url string) {
+	browser := func() {
+		if err := openInBrowser(cfg.BrowserCommand, url); err != nil {
+			log.Printf("Could not open a browser: %v", err)
+			printURL(url)
+		}
+	}
+
+	switch cfg.Open {
+	case openModeNone:
+		printURL(url)
+		return
+	case openModeBrowser:
+		browser()
+		return
+	}
+
+	if !webviewAvailable() {
+		if cfg.Open == openModeWebView {
+			log.Println("WebView not available")
+			printURL(url)
+			return
+		}
+		log.Println("WebView not available, opening in system browser")
+		browser()
+		return
+	}
+
+	go func() {
+		// Wait a moment for the server to start
+		time.Sleep(500 * time.Millisecond)
+
+		if err := startWebViewApp(url); err != nil {
+			if cfg.Open == openModeWebView {
+				log.Printf("Failed to start WebView app: %v", err)
+				printURL(url)
+				return
+			}
+			log.Printf("Failed to start WebView app: %v, falling back to browser", err)
+			browser()
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBrowserCommands(t *testing.T) {
+	const url = "http://localhost:8080"
+	linux := [][]string{
+		{"xdg-open", url},
+		{"gio", "open", url},
+		{"kde-open5", url},
+		{"kde-open", url},
+		{"gnome-open", url},
+		{"sensible-browser", url},
+		{"x-www-browser", url},
+	}
+
+	tests := []struct {
+		name     string
+		env      launchEnv
+		template string
+		want     [][]string
+	}{
+		{
+			name: "windows",
+			env:  launchEnv{goos: "windows"},
+			want: [][]string{{"rundll32", "url.dll,FileProtocolHandler", url}, {"cmd", "/c", "start", "", url}},
+		},
+		{
+			name: "darwin",
+			env:  launchEnv{goos: "darwin"},
+			want: [][]string{{"open", url}},
+		},
+		{
+			name: "linux",
+			env:  launchEnv{goos: "linux"},
+			want: linux,
+		},
+		{
+			name: "freebsd",
+			env:  launchEnv{goos: "freebsd"},
+			want: linux,
+		},
+		{
+			name: "wsl",
+			env:  launchEnv{goos: "linux", wsl: true},
+			want: append([][]string{{"wslview", url}, {"cmd.exe", "/c", "start", "", url}}, linux...),
+		},
+		{
+			name: "BROWSER first",
+			env:  launchEnv{goos: "darwin", browser: "firefox" + string(os.PathListSeparator) + "chromium --incognito {url}"},
+			want: [][]string{{"firefox", url}, {"chromium", "--incognito", url}, {"open", url}},
+		},
+		{
+			name:     "configured command alone",
+			env:      launchEnv{goos: "linux", browser: "firefox"},
+			template: `"/opt/My Browser/browser" --new-window {url}`,
+			want:     [][]string{{"/opt/My Browser/browser", "--new-window", url}},
+		},
+		{
+			name:     "configured command without placeholder",
+			env:      launchEnv{goos: "windows"},
+			template: "msedge",
+			want:     [][]string{{"msedge", url}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := browserCommands(tt.env, tt.template, url)
+			if err != nil {
+				t.Fatalf("browserCommands: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("browserCommands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := browserCommands(launchEnv{goos: "linux"}, `firefox "{url}`, url); err == nil {
+		t.Error("a command with an unterminated quote was accepted")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// linkPattern finds candidate URLs; trailing punctuation and wrapping are
+// trimmed afterwards by trimLink
+var linkPattern = regexp.MustCompile(`(?i)https?://[^\s<>"']+`)
+
+// linkTrailing are characters that end a sentence or close markdown-style
+// wrapping rather than belong to the URL
+const linkTrailing = ".,;:!?*_~`"
+
+// linkClosers maps closing brackets to their opening counterparts; a closer
+// is only kept when the URL contains a matching opener, as in
+// https://en.wikipedia.org/wiki/Go_(programming_language)
+var linkClosers = map[byte]byte{')': '(', ']': '[', '}': '{'}
+
+// extractLinks returns the distinct URLs in text, in order of appearance
+func extractLinks(text string) []string {
+	if !strings.Contains(text, "://") {
+		return nil
+	}
+
+	var links []string
+	seen := make(map[string]bool)
+	for _, candidate := range linkPattern.FindAllString(text, -1) {
+		link := trimLink(candidate)
+		parsed, err := url.Parse(link)
+		if err != nil || parsed.Host == "" || seen[link] {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+	}
+	return links
+}
+
+// trimLink strips trailing punctuation and unbalanced closing brackets
+func trimLink(link string) string {
+	for len(link) > 0 {
+		last := link[len(link)-1]
+		if strings.IndexByte(linkTrailing, last) >= 0 {
+			link = link[:len(link)-1]
+			continue
+		}
+		if opener, ok := linkClosers[last]; ok && strings.Count(link, string(opener)) < strings.Count(link, string(last)) {
+			link = link[:len(link)-1]
+			continue
+		}
+		break
+	}
+	return link
+}
+
+// linkKey normalizes a URL for deduplication: scheme and host are case
+// insensitive and a lone trailing slash doesn't matter
+func linkKey(link string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	if parsed.Path == "/" {
+		parsed.Path = ""
+	}
+	return parsed.String()
+}
+
+// linkDomain returns the host of a URL without a www. prefix
+func linkDomain(link string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+}
+
+// linkRecord is a line of the link index: one URL shared in one message
+type linkRecord struct {
+	URL       string    `json:"url"`
+	Username  string    `json:"username"`
+	Timestamp time.Time `json:"timestamp"`
+	MessageID string    `json:"message_id"`
+	Seq       uint64    `json:"seq,omitempty"`
+}
+
+// SharedLink is a URL with when it was first shared and how often
+type SharedLink struct {
+	URL            string    `json:"url"`
+	Domain         string    `json:"domain"`
+	FirstSharedBy  string    `json:"first_shared_by"`
+	FirstSharedAt  time.Time `json:"first_shared_at"`
+	FirstMessageID string    `json:"first_message_id"`
+	LastSharedAt   time.Time `json:"last_shared_at"`
+	Count          int       `json:"count"`
+}
+
+// indexLinks appends the URLs of a message to links-<date>.log
+func (s *ChatServer) indexLinks(msg Message) {
+	for _, link := range msg.Links {
+		data, err := json.Marshal(linkRecord{
+			URL:       link,
+			Username:  msg.Username,
+			Timestamp: msg.Timestamp,
+			MessageID: msg.ID,
+			Seq:       msg.Seq,
+		})
+		if err != nil {
+			log.Printf("Error encoding link record: %v", err)
+			continue
+		}
+		if err := s.logger.WriteLine(logKindLinks, string(data)+"\n"); err != nil {
+			log.Printf("Error indexing link: %v", err)
+		}
+	}
+}
+
+// SharedLinks returns the URLs shared on the dates within [from, to],
+// deduplicated, in the order they were first shared. A non-empty domain
+// keeps links on that domain and its subdomains.
+func (s *ChatServer) SharedLinks(from, to time.Time, domain string) ([]*SharedLink, error) {
+	files, err := s.logger.logsInRange(logKindLinks, from, to)
+	if err != nil {
+		return nil, err
+	}
+	domain = strings.TrimPrefix(strings.ToLower(domain), "www.")
+
+	links := make(map[string]*SharedLink)
+	for _, file := range files {
+		content, err := s.logger.GetLogContent(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(content, "\n") {
+			var record linkRecord
+			if line == "" || json.Unmarshal([]byte(line), &record) != nil {
+				continue
+			}
+
+			host := linkDomain(record.URL)
+			if domain != "" && host != domain && !strings.HasSuffix(host, "."+domain) {
+				continue
+			}
+
+			key := linkKey(record.URL)
+			link, ok := links[key]
+			if !ok {
+				link = &SharedLink{
+					URL:            record.URL,
+					Domain:         host,
+					FirstSharedBy:  record.Username,
+					FirstSharedAt:  record.Timestamp,
+					FirstMessageID: record.MessageID,
+				}
+				links[key] = link
+			}
+			link.Count++
+			if record.Timestamp.After(link.LastSharedAt) {
+				link.LastSharedAt = record.Timestamp
+			}
+		}
+	}
+
+	list := make([]*SharedLink, 0, len(links))
+	for _, link := range links {
+		list = append(list, link)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].FirstSharedAt.Equal(list[j].FirstSharedAt) {
+			return list[i].FirstSharedAt.Before(list[j].FirstSharedAt)
+		}
+		return list[i].URL < list[j].URL
+	})
+	return list, nil
+}
+
+// registerLinkRoutes registers the shared links endpoint
+func registerLinkRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/links", func(c *gin.Context) {
+		from, to, err := parseDateRange(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		links, err := chatServer.SharedLinks(from, to, c.Query("domain"))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, links)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExtractLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"no links", "just chatting", nil},
+		{"bare scheme", "http:// nothing here", nil},
+		{"plain", "see https://example.com/page", []string{"https://example.com/page"}},
+		{"end of sentence", "look at https://example.com/a.", []string{"https://example.com/a"}},
+		{"question", "did you see https://example.com?", []string{"https://example.com"}},
+		{"query kept", "https://youtu.be/x?t=42&list=y!", []string{"https://youtu.be/x?t=42&list=y"}},
+		{"fragment kept", "https://example.com/doc#part-2,", []string{"https://example.com/doc#part-2"}},
+		{"in parentheses", "(https://example.com/a)", []string{"https://example.com/a"}},
+		{"balanced parentheses", "https://en.wikipedia.org/wiki/Go_(programming_language)", []string{"https://en.wikipedia.org/wiki/Go_(programming_language)"}},
+		{"balanced in parentheses", "(see https://en.wikipedia.org/wiki/Go_(lang))", []string{"https://en.wikipedia.org/wiki/Go_(lang)"}},
+		{"markdown link", "[docs](https://example.com/docs)", []string{"https://example.com/docs"}},
+		{"markdown emphasis", "*https://example.com/bold*", []string{"https://example.com/bold"}},
+		{"in quotes", `"https://example.com/q" and 'https://example.com/s'`, []string{"https://example.com/q", "https://example.com/s"}},
+		{"in angle brackets", "<https://example.com/a>", []string{"https://example.com/a"}},
+		{"in HTML", `<a href="https://example.com/h">x</a>`, []string{"https://example.com/h"}},
+		{"upper case scheme", "HTTPS://Example.COM/Path", []string{"HTTPS://Example.COM/Path"}},
+		{"several", "https://a.test, http://b.test; https://c.test", []string{"https://a.test", "http://b.test", "https://c.test"}},
+		{"repeated", "https://a.test https://a.test", []string{"https://a.test"}},
+		{"no host", "https:///path", nil},
+		{"glued to text", "linkhttps://example.com/x", []string{"https://example.com/x"}},
+		{"unicode path", "https://example.com/ñandú!", []string{"https://example.com/ñandú"}},
+		{"other scheme", "ftp://example.com/file javascript:alert(1)", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractLinks(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("extractLinks(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinkKeyAndDomain(t *testing.T) {
+	tests := []struct {
+		link, key, domain string
+	}{
+		{"https://example.com", "https://example.com", "example.com"},
+		{"https://example.com/", "https://example.com", "example.com"},
+		{"HTTPS://WWW.Example.COM/Path", "https://www.example.com/Path", "example.com"},
+		{"https://example.com:8080/a?b=1", "https://example.com:8080/a?b=1", "example.com"},
+		{"http://[::1]:3000/", "http://[::1]:3000", "::1"},
+	}
+	for _, tt := range tests {
+		if got := linkKey(tt.link); got != tt.key {
+			t.Errorf("linkKey(%q) = %q, want %q", tt.link, got, tt.key)
+		}
+		if got := linkDomain(tt.link); got != tt.domain {
+			t.Errorf("linkDomain(%q) = %q, want %q", tt.link, got, tt.domain)
+		}
+	}
+}
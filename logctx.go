@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// logIDKey is the context key of the request or connection ID
+type logIDKey struct{}
+
+// withLogID returns a context carrying the ID of the request or WebSocket
+// connection it serves, for logf to tag log lines with
+func withLogID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, logIDKey{}, id)
+}
+
+// logID returns the request or connection ID carried by ctx, or empty
+func logID(ctx context.Context) string {
+	if id, ok := ctx.Value(logIDKey{}).(string); ok {
+		return id
+	}
+	// A gin context keeps it among its keys
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logf logs like log.Printf, tagged with id= and the request or connection
+// ID of ctx as in the access log, so the lines of a request can be found
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := logID(ctx); id != "" {
+		format += " id=%s"
+		args = append(args, id)
+	}
+	log.Printf(format, args...)
+}
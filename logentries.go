@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logEntryFlushInterval is how many entries are written between flushes of a
+// streamed log file response
+const logEntryFlushInterval = 1000
+
+// logEntryQuery selects the parsed entries of a log file to return
+type logEntryQuery struct {
+	messageQuery
+	offset int64
+	limit  int64
+	ndjson bool
+	legacy bool
+}
+
+// parseLogEntryQuery reads the message filters, ?offset and ?limit, and
+// whether format=ndjson was asked for instead of a JSON array
+func parseLogEntryQuery(c *gin.Context) (logEntryQuery, error) {
+	query, err := parseMessageQuery(c)
+	if err != nil {
+		return logEntryQuery{}, err
+	}
+	offset, err := queryNonNegative(c, "offset", 0)
+	if err != nil {
+		return logEntryQuery{}, err
+	}
+	limit, err := queryNonNegative(c, "limit", 0)
+	if err != nil {
+		return logEntryQuery{}, err
+	}
+	return logEntryQuery{
+		messageQuery: query,
+		offset:       offset,
+		limit:        limit,
+		ndjson:       c.Query("format") == "ndjson",
+		legacy:       wantsLegacyTimestamps(c),
+	}, nil
+}
+
+// streamLogEntries parses a log file line by line and writes the matching
+// entries as they are found, either as a JSON array or one object per line,
+// so large files are never held as a slice of messages. The first offset
+// matches are skipped and at most limit are written; zero means no limit.
+func streamLogEntries(c *gin.Context, content string, query logEntryQuery) error {
+	if query.ndjson {
+		c.Header("Content-Type", "application/x-ndjson; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+	}
+	c.Status(http.StatusOK)
+
+	var buf bytes.Buffer
+	if !query.ndjson {
+		buf.WriteByte('[')
+	}
+
+	skipped, written := int64(0), int64(0)
+	for content != "" && (query.limit == 0 || written < query.limit) {
+		var line string
+		line, content, _ = strings.Cut(content, "\n")
+		msg, ok := parseLogEntry(line)
+		if !ok || !query.matches(msg) {
+			continue
+		}
+		if skipped < query.offset {
+			skipped++
+			continue
+		}
+
+		data, err := json.Marshal(renderLogEntry(query.legacy, msg))
+		if err != nil {
+			return err
+		}
+		if written > 0 && !query.ndjson {
+			buf.WriteByte(',')
+		}
+		buf.Write(data)
+		if query.ndjson {
+			buf.WriteByte('\n')
+		}
+		written++
+
+		if written%logEntryFlushInterval == 0 {
+			if _, err := c.Writer.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+			c.Writer.Flush()
+		}
+	}
+
+	if !query.ndjson {
+		buf.WriteByte(']')
+	}
+	_, err := c.Writer.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// discardResponse is a response writer that drops the body, so serving a
+// large file doesn't allocate a buffer for it
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponse) Header() http.Header         { return w.header }
+func (w *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponse) WriteHeader(status int)      { w.status = status }
+func (w *discardResponse) Flush()                      {}
+
+// BenchmarkLogFileFormats serves a 50k-line chat log as text and as parsed
+// entries, whole and a page of it
+func BenchmarkLogFileFormats(b *testing.B) {
+	chatServer, router := newTestServer(b, defaultConfig())
+	now := chatServer.logger.clock.Now()
+	for batch := 0; batch < 50; batch++ {
+		msgs := make([]Message, 1000)
+		for i := range msgs {
+			n := batch*len(msgs) + i
+			msgs[i] = Message{ID: fmt.Sprint(n), Type: messageTypeChat, Username: fmt.Sprintf("user%d", n%40), Timestamp: now.Add(time.Duration(n) * time.Millisecond), Content: fmt.Sprintf("message number %d with some chat text", n)}
+		}
+		if err := chatServer.logger.LogMessages(msgs); err != nil {
+			b.Fatalf("logging messages: %v", err)
+		}
+	}
+	path := "/api/v1/logs/" + logFileName(logKindChat, now.Format("2006-01-02"), 0)
+
+	formats := []struct {
+		name, query string
+	}{
+		{"text", ""},
+		{"json", "?format=json"},
+		{"ndjson", "?format=ndjson"},
+		{"json page", "?format=json&offset=25000&limit=100"},
+	}
+	for _, format := range formats {
+		b.Run(format.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := &discardResponse{header: make(http.Header)}
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path+format.query, nil))
+				if w.status != http.StatusOK {
+					b.Fatalf("status %d", w.status)
+				}
+			}
+		})
+	}
+}
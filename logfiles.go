@@ -0,0 +1,413 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveDirName is the subdirectory of the logs directory archived files
+// are moved to; retention only looks at the logs directory itself
+const archiveDirName = "archive"
+
+// Log file operation errors
+var (
+	errInvalidLogFilename = errors.New("invalid log filename")
+	errLiveLogFile        = errors.New("log file is being written")
+)
+
+// LogFileInfo describes a log file for the detailed logs listing
+type LogFileInfo struct {
+	Name       string     `json:"name"`
+	Kind       string     `json:"kind"`
+	Date       string     `json:"date"`
+	Period     string     `json:"period"`
+	Size       int64      `json:"size"`
+	Lines      int        `json:"lines"`
+	Messages   int        `json:"messages"`
+	Users      int        `json:"users"`
+	FirstAt    *time.Time `json:"first_timestamp,omitempty"`
+	LastAt     *time.Time `json:"last_timestamp,omitempty"`
+	Compressed bool       `json:"compressed"`
+	Encrypted  bool       `json:"encrypted"`
+	Live       bool       `json:"live"`
+}
+
+// logFileScan is the cached result of scanning a log file, valid while
+// its size and modification time are unchanged
+type logFileScan struct {
+	size     int64
+	modTime  time.Time
+	lines    int
+	messages int
+	users    int
+	first    time.Time
+	last     time.Time
+
+	// offset is how far the live file has been scanned, and usernames the
+	// users seen so far, so it is scanned incrementally as it grows
+	offset    int64
+	usernames map[string]bool
+}
+
+// LogInfoCache caches line, message and user counts of log files; closed
+// files are scanned once, with the result kept in logMeta across restarts,
+// and the live files from where the last scan stopped whenever they grow
+type LogInfoCache struct {
+	logger *Logger
+	scans  map[string]*logFileScan
+	mutex  sync.Mutex
+}
+
+// NewLogInfoCache creates a log file metadata cache for the logger's files
+func NewLogInfoCache(logger *Logger) *LogInfoCache {
+	metrics.Gauge("cylog_log_meta_cache_hit_ratio", "Fraction of log file metadata lookups answered from the cache", func() float64 {
+		hits, misses := logMetaHits.Value(), logMetaMisses.Value()
+		if hits+misses == 0 {
+			return 0
+		}
+		return float64(hits) / float64(hits+misses)
+	})
+	return &LogInfoCache{logger: logger, scans: make(map[string]*logFileScan)}
+}
+
+// Info returns the metadata of a log file
+func (c *LogInfoCache) Info(name string) (LogFileInfo, error) {
+	stat, err := os.Stat(filepath.Join(c.logger.dir, name))
+	if err != nil {
+		return LogFileInfo{}, fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	live := c.logger.isLive(name)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	scan, ok := c.scans[name]
+	if !ok && !live {
+		scan, ok = c.logger.meta.Get(name, stat.Size(), stat.ModTime())
+	}
+	if ok && scan.size == stat.Size() && scan.modTime.Equal(stat.ModTime()) {
+		logMetaHits.Inc()
+		if !live {
+			scan.usernames = nil
+		}
+	} else {
+		logMetaMisses.Inc()
+		// A live file that grew is scanned from where the last scan stopped
+		if !ok || !live || scan.usernames == nil || stat.Size() < scan.size {
+			scan = &logFileScan{usernames: make(map[string]bool)}
+		}
+		err = c.logger.scanLogFile(name, recordKinds[logFileKind(name)], scan)
+		switch {
+		case errors.Is(err, errNoEncryptionKey):
+			// Listed without counts until a key is configured
+			scan = &logFileScan{}
+		case err != nil:
+			delete(c.scans, name)
+			return LogFileInfo{}, err
+		default:
+			scan.size = stat.Size()
+			scan.modTime = stat.ModTime()
+			if !live {
+				scan.usernames = nil
+				c.logger.meta.Put(name, scan)
+			}
+			c.scans[name] = scan
+		}
+	}
+
+	period, date, _, _ := logFilePeriod(name)
+	info := LogFileInfo{
+		Name:       name,
+		Kind:       logFileKind(name),
+		Date:       date.Format(logDateFormat),
+		Period:     period,
+		Size:       stat.Size(),
+		Lines:      scan.lines,
+		Messages:   scan.messages,
+		Users:      scan.users,
+		Compressed: strings.HasSuffix(name, ".gz"),
+		Encrypted:  isEncryptedLog(name),
+		Live:       live,
+	}
+	if !scan.first.IsZero() {
+		first, last := scan.first, scan.last
+		info.FirstAt = &first
+		info.LastAt = &last
+	}
+	return info, nil
+}
+
+// List returns the metadata of the log files of kind (every kind when
+// empty) covering the days within [from, to], newest first
+func (c *LogInfoCache) List(kind string, from, to time.Time) ([]LogFileInfo, error) {
+	logs, err := c.logger.GetAvailableLogs()
+	if err != nil {
+		return nil, err
+	}
+
+	names := flattenLogs(logs, kind)
+	if kind == "" {
+		c.forgetMissing(names)
+	}
+	infos := make([]LogFileInfo, 0, len(names))
+	for _, name := range names {
+		if !logFileInRange(name, from, to) {
+			continue
+		}
+		info, err := c.Info(name)
+		if err != nil {
+			// The file may have been pruned since it was listed
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	if err := c.logger.meta.Save(); err != nil {
+		log.Printf("Error saving log metadata: %v", err)
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		dateI, seqI, _ := parseLogFileName(infos[i].Name)
+		dateJ, seqJ, _ := parseLogFileName(infos[j].Name)
+		if !dateI.Equal(dateJ) {
+			return dateI.After(dateJ)
+		}
+		if seqI != seqJ {
+			return seqI > seqJ
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// forgetMissing drops cached scans of files that no longer exist
+func (c *LogInfoCache) forgetMissing(names []string) {
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[name] = true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for name := range c.scans {
+		if !existing[name] {
+			delete(c.scans, name)
+			c.logger.meta.Remove(name)
+		}
+	}
+}
+
+// scanLogFile adds the complete lines of a log file from scan.offset to
+// scan: the lines and, for message logs, the parsed messages, the users who
+// chatted and the first and last timestamps
+func (l *Logger) scanLogFile(name string, records bool, scan *logFileScan) error {
+	reader, err := l.openLogLines(name, scan.offset)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		line, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			// Leave partially written lines for the next scan
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		scan.offset = reader.Offset()
+		scan.lines++
+		if records {
+			scan.messages++
+			continue
+		}
+		msg, ok := parseLogEntry(line)
+		if !ok {
+			continue
+		}
+		scan.messages++
+		if scan.first.IsZero() || msg.Timestamp.Before(scan.first) {
+			scan.first = msg.Timestamp
+		}
+		if msg.Timestamp.After(scan.last) {
+			scan.last = msg.Timestamp
+		}
+		if isChatEntry(msg) && msg.Username != "" && !scan.usernames[msg.Username] {
+			scan.usernames[msg.Username] = true
+			scan.users++
+		}
+	}
+}
+
+// StatLog returns the file info of a log file
+func (l *Logger) StatLog(filename string) (os.FileInfo, error) {
+	filename, err := validateLogName(filename)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filepath.Join(l.dir, filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat log file: %w", err)
+	}
+	return stat, nil
+}
+
+// isLive reports whether name is the file currently written for its kind
+func (l *Logger) isLive(name string) bool {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	stream, ok := l.streams[logFileKind(name)]
+	return ok && filepath.Base(stream.path) == name
+}
+
+// logNamePattern is the strict form of a log file name: a kind, a period
+// label, an optional sequence number, .enc for encrypted and .gz for
+// compressed files
+var logNamePattern = regexp.MustCompile(`^([a-z]+)-(` + strings.ToLower(logPeriodPattern) + `)((?:\.\d+)?\.log(?:\.enc)?(?:\.gz)?)$`)
+
+// validateLogName checks that a client-supplied name refers to a log file
+// directly in the logs directory and returns its canonical form, lowercase
+// except for the T and W of hourly and weekly labels. Every path built from
+// a log name goes through here first.
+func validateLogName(name string) (string, error) {
+	if strings.ContainsAny(name, "/\\\x00") || strings.Contains(name, "..") {
+		return "", errInvalidLogFilename
+	}
+	matches := logNamePattern.FindStringSubmatch(strings.ToLower(name))
+	if matches == nil {
+		return "", errInvalidLogFilename
+	}
+	return matches[1] + "-" + strings.ToUpper(matches[2]) + matches[3], nil
+}
+
+// DeleteLog deletes a closed log file
+func (l *Logger) DeleteLog(filename string) error {
+	filename, err := validateLogName(filename)
+	if err != nil {
+		return err
+	}
+
+	// Hold the lock so the file can't become live through a rotation meanwhile
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if stream, ok := l.streams[logFileKind(filename)]; ok && filepath.Base(stream.path) == filename {
+		return errLiveLogFile
+	}
+	if err := removeFile(filepath.Join(l.dir, filename)); err != nil {
+		return fmt.Errorf("failed to delete log file: %w", err)
+	}
+	l.usage.Remove(filename)
+	l.meta.Remove(filename)
+	l.removeLogSidecars(filename)
+	return nil
+}
+
+// ArchiveLog compresses a closed log file into the archive directory and
+// removes the original, returning the archive path relative to the logs
+// directory
+func (l *Logger) ArchiveLog(filename string) (string, error) {
+	filename, err := validateLogName(filename)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(filename, ".gz") {
+		return "", fmt.Errorf("%w: already compressed", errInvalidLogFilename)
+	}
+
+	// Compressing a large file takes a while, so it is done without the
+	// lock; the file is only replaced if it didn't become live or change
+	// meanwhile
+	if l.isLive(filename) {
+		return "", errLiveLogFile
+	}
+	if !writable() {
+		return "", errDryRun
+	}
+
+	path := filepath.Join(l.dir, filename)
+	source, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer source.Close()
+	before, err := source.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	if err := makeDir(filepath.Join(l.dir, archiveDirName)); err != nil {
+		return "", fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	archived := filepath.Join(archiveDirName, filename+".gz")
+	target, err := os.CreateTemp(filepath.Join(l.dir, archiveDirName), filename+".gz.*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive: %w", err)
+	}
+	tmpPath := target.Name()
+
+	writer := gzip.NewWriter(target)
+	writer.Name = filename
+	_, err = io.Copy(writer, source)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to compress log file: %w", err)
+	}
+
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if stream, ok := l.streams[logFileKind(filename)]; ok && filepath.Base(stream.path) == filename {
+		os.Remove(tmpPath)
+		return "", errLiveLogFile
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to archive log file: %w", err)
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("%w: it was written to while being archived", errLiveLogFile)
+	}
+
+	// Only remove the original once the archive is complete
+	if err := os.Rename(tmpPath, filepath.Join(l.dir, archived)); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to store archive: %w", err)
+	}
+	if err := removeFile(filepath.Join(l.dir, filename)); err != nil {
+		return archived, fmt.Errorf("archived but failed to remove log file: %w", err)
+	}
+	l.usage.Remove(filename)
+	l.meta.Remove(filename)
+
+	// The signature covers the uncompressed content, so it stays valid
+	signature := filepath.Join(l.dir, filename+signatureSuffix)
+	if err := os.Rename(signature, filepath.Join(l.dir, archiveDirName, filename+signatureSuffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error archiving signature of %s: %v", filename, err)
+	}
+	l.removeLogSidecars(filename)
+	return archived, nil
+}
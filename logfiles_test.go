@@ -0,0 +1,178 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cylog/internal/clock"
+)
+
+// closedLog writes a chat log file for yesterday and rotates to today's,
+// returning the closed file's name
+func closedLog(t *testing.T, logger *Logger, clk *clock.Fake, content string) string {
+	t.Helper()
+
+	logChat(t, logger, content)
+	clk.Advance(24 * time.Hour)
+	logChat(t, logger, "today")
+	return logFileName(logKindChat, clk.Now().AddDate(0, 0, -1).Format("2006-01-02"), 0)
+}
+
+func TestArchiveLog(t *testing.T) {
+	t.Parallel()
+
+	clk := clock.NewFake(time.Date(2025, 4, 16, 12, 0, 0, 0, time.Local))
+	logger := newTestLogger(t, clk)
+	name := closedLog(t, logger, clk, "archive me")
+
+	archived, err := logger.ArchiveLog(name)
+	if err != nil {
+		t.Fatalf("archiving: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(logger.dir, name)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("original still there: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(logger.dir, archived))
+	if err != nil {
+		t.Fatalf("opening archive: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "archive me") {
+		t.Errorf("archive content = %q", content)
+	}
+
+	temps, _ := filepath.Glob(filepath.Join(logger.dir, archiveDirName, "*.tmp"))
+	if len(temps) > 0 {
+		t.Errorf("temporary files left: %v", temps)
+	}
+}
+
+func TestArchiveLiveLogRefused(t *testing.T) {
+	t.Parallel()
+
+	clk := clock.NewFake(time.Date(2025, 4, 16, 12, 0, 0, 0, time.Local))
+	logger := newTestLogger(t, clk)
+	logChat(t, logger, "live")
+
+	if _, err := logger.ArchiveLog("chat-2025-04-16.log"); !errors.Is(err, errLiveLogFile) {
+		t.Fatalf("archiving the live file: %v, want errLiveLogFile", err)
+	}
+}
+
+func TestArchiveLogConcurrently(t *testing.T) {
+	t.Parallel()
+
+	clk := clock.NewFake(time.Date(2025, 4, 16, 12, 0, 0, 0, time.Local))
+	logger := newTestLogger(t, clk)
+	name := closedLog(t, logger, clk, strings.Repeat("line\n", 10000))
+
+	// Writers keep going while the file is compressed
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := logger.ArchiveLog(name)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		logChat(t, logger, "meanwhile")
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d archives succeeded, want 1", succeeded)
+	}
+	temps, _ := filepath.Glob(filepath.Join(logger.dir, archiveDirName, "*.tmp"))
+	if len(temps) > 0 {
+		t.Errorf("temporary files left: %v", temps)
+	}
+}
+
+func TestLogRoutesRejectTraversal(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminToken = "admin-secret"
+	cfg.Signing.Key = "signing-secret"
+	_, router := newTestServer(t, cfg)
+
+	// A file outside the logs directory that a traversal would reach
+	const secret = "top secret"
+	if err := os.WriteFile("secret.log", []byte(secret), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{
+		"chat-..%2Fsecret.log",
+		"chat-..%2F..%2Fsecret.log",
+		"..%2Fsecret.log",
+		"%2e%2e%2fsecret.log",
+		"chat-..%5Csecret.log",
+		"..%5Csecret.log",
+		"chat-2025-04-16..log",
+		"..",
+		"%2e%2e",
+		"chat-2025-04-16.log%00.txt",
+	}
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/api/v1/logs/%s"},
+		{http.MethodHead, "/api/v1/logs/%s"},
+		{http.MethodGet, "/api/v1/logs/%s/meta"},
+		{http.MethodGet, "/api/v1/logs/%s/verify"},
+		{http.MethodDelete, "/api/v1/logs/%s"},
+		{http.MethodPost, "/api/v1/logs/%s/archive"},
+	}
+	for _, route := range routes {
+		for _, name := range names {
+			path := strings.Replace(route.path, "%s", name, 1)
+			t.Run(route.method+" "+path, func(t *testing.T) {
+				req := httptest.NewRequest(route.method, path, nil)
+				req.Header.Set("Authorization", "Bearer admin-secret")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest && w.Code != http.StatusNotFound {
+					t.Errorf("status %d, want 400 or 404: %s", w.Code, w.Body.String())
+				}
+				if strings.Contains(w.Body.String(), secret) {
+					t.Errorf("response has the file outside the logs directory: %s", w.Body.String())
+				}
+			})
+		}
+	}
+
+	if content, err := os.ReadFile("secret.log"); err != nil || string(content) != secret {
+		t.Errorf("file outside the logs directory changed: %q, %v", content, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(logsDir, archiveDirName)); len(entries) != 0 {
+		t.Errorf("files archived: %v", entries)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// loggingPauseFileName is the file in the logs directory recording that an
+// admin paused logging, so a restart either keeps it paused or closes the gap
+const loggingPauseFileName = ".logging-paused.json"
+
+// Marker lines written to the chat log around a pause
+const (
+	loggingPausedMarker  = "[logging paused]"
+	loggingResumedMarker = "[logging resumed]"
+)
+
+// gapTag marks log lines bounding a period that wasn't logged, so search and
+// export can show the gap
+const gapTag = "gap"
+
+// loggingPause is the content of the pause file
+type loggingPause struct {
+	Since time.Time `json:"since"`
+}
+
+// loggingPausePath returns where the pause state is persisted
+func loggingPausePath() string {
+	return filepath.Join(logsDir, loggingPauseFileName)
+}
+
+// gapMarker formats a log line marking the start or end of a gap
+func gapMarker(content string, now time.Time) string {
+	return formatLogEntry(Message{
+		Type:      messageTypeStatus,
+		Username:  "System",
+		Timestamp: now,
+		Content:   content,
+		Tags:      []string{statusTag, gapTag},
+	})
+}
+
+// isGapEntry reports whether a logged message marks the start or end of a
+// period that wasn't logged
+func isGapEntry(msg Message) bool {
+	for _, tag := range msg.Tags {
+		if tag == gapTag {
+			return true
+		}
+	}
+	return false
+}
+
+// Hold stops writing log files at an admin's request, after writing a
+// marker to the chat log; lines logged meanwhile are discarded. It reports
+// whether logging was running.
+func (l *Logger) Hold(now time.Time) (bool, error) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if !l.heldSince.IsZero() {
+		return false, nil
+	}
+	err := l.writeLine(logKindChat, gapMarker(loggingPausedMarker, now))
+	l.heldSince = now
+	return true, err
+}
+
+// Unhold restarts writing log files after Hold, writing a marker to the
+// chat log first; it reports whether logging was paused
+func (l *Logger) Unhold(now time.Time) (bool, error) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if l.heldSince.IsZero() {
+		return false, nil
+	}
+	l.heldSince = time.Time{}
+	return true, l.writeLine(logKindChat, gapMarker(loggingResumedMarker, now))
+}
+
+// Held reports whether an admin paused logging, and since when
+func (l *Logger) Held() (time.Time, bool) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	return l.heldSince, !l.heldSince.IsZero()
+}
+
+// PauseLogging stops writing log files and forwarding messages to Loki
+// while they are still broadcast, reporting whether logging was running
+func (s *ChatServer) PauseLogging() bool {
+	// Messages published before the pause are still logged
+	s.writer.Flush(s.quit)
+	now := time.Now()
+	paused, err := s.logger.Hold(now)
+	if !paused {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error writing logging paused marker: %v", err)
+	}
+	if err := saveLoggingPause(now); err != nil {
+		log.Printf("Error saving logging pause: %v", err)
+	}
+
+	log.Printf("Logging paused")
+	s.publishLoggingEvent(true, now)
+	return true
+}
+
+// ResumeLogging restarts logging after PauseLogging, reporting whether it
+// was paused
+func (s *ChatServer) ResumeLogging() bool {
+	// Messages published during the pause are not logged
+	s.writer.Flush(s.quit)
+	now := time.Now()
+	resumed, err := s.logger.Unhold(now)
+	if !resumed {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error writing logging resumed marker: %v", err)
+	}
+	if err := removeFile(loggingPausePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error removing logging pause file: %v", err)
+	}
+
+	log.Printf("Logging resumed")
+	s.publishLoggingEvent(false, now)
+	return true
+}
+
+// RestoreLoggingPause handles a pause left over from the last run: with
+// persist set logging stays paused, otherwise it resumes with a marker
+// closing the gap
+func (s *ChatServer) RestoreLoggingPause(persist bool) error {
+	data, err := os.ReadFile(loggingPausePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read logging pause file: %w", err)
+	}
+
+	var pause loggingPause
+	if err := json.Unmarshal(data, &pause); err != nil {
+		return fmt.Errorf("failed to parse logging pause file: %w", err)
+	}
+	if !persist {
+		if err := s.logger.WriteLine(logKindChat, gapMarker(loggingResumedMarker, time.Now())); err != nil {
+			return err
+		}
+		log.Printf("Logging resumed after a pause since %s", pause.Since.Format(logTimeFormat))
+		return removeFile(loggingPausePath())
+	}
+
+	s.logger.logMutex.Lock()
+	s.logger.heldSince = pause.Since
+	s.logger.logMutex.Unlock()
+	log.Printf("Logging is still paused since %s", pause.Since.Format(logTimeFormat))
+	return nil
+}
+
+// saveLoggingPause records that logging is paused so it stays paused after
+// a restart
+func saveLoggingPause(since time.Time) error {
+	data, err := json.Marshal(loggingPause{Since: since})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(loggingPausePath(), data)
+}
+
+// publishLoggingEvent tells clients that logging was paused or resumed, so
+// they can show a banner. It is broadcast without being logged.
+func (s *ChatServer) publishLoggingEvent(paused bool, now time.Time) {
+	content := "Logging resumed"
+	meta := map[string]interface{}{"event": "logging", "paused": paused}
+	if paused {
+		content = "Logging paused: messages are shown but not recorded"
+		meta["since"] = now
+	}
+
+	s.broadcastMessage(Message{
+		ID:        fmt.Sprintf("%d", now.UnixNano()),
+		Seq:       atomic.AddUint64(&s.seq, 1),
+		Type:      messageTypeSystem,
+		Username:  "System",
+		Timestamp: now,
+		Content:   content,
+		HTML:      html.EscapeString(content),
+		Meta:      meta,
+	})
+}
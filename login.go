@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cookies of the web UI login
+const (
+	sessionCookieName = "cylog_session"
+	csrfCookieName    = "cylog_csrf"
+)
+
+// csrfFieldName and csrfHeaderName carry the CSRF token of form posts and
+// script requests
+const (
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// sessionKeyFileName holds the key signing session cookies, in the logs
+// directory so sessions survive restarts
+const sessionKeyFileName = ".session.key"
+
+// defaultSessionHours is how long a session lasts without requests
+const defaultSessionHours = 12
+
+// sessionPrefix starts the hash of a login session, which never collides
+// with a token hash
+const sessionPrefix = "session:"
+
+// LoginConfig configures the username and password login of the web UI
+type LoginConfig struct {
+	// Username and PasswordHash enable the login; the hash is a bcrypt hash
+	// from "cylog password hash". The UI stays open without them.
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"`
+
+	// SessionHours is how long a session lasts without requests (default
+	// 12); every request made in its second half renews it
+	SessionHours int `yaml:"session_hours"`
+
+	// Scopes are what a session may do (default read and ingest)
+	Scopes []string `yaml:"scopes"`
+}
+
+// enabled reports whether the login is configured
+func (l LoginConfig) enabled() bool {
+	return l.Username != "" && l.PasswordHash != ""
+}
+
+// sessionLifetime returns how long a session lasts without requests
+func (l LoginConfig) sessionLifetime() time.Duration {
+	if l.SessionHours <= 0 {
+		return defaultSessionHours * time.Hour
+	}
+	return time.Duration(l.SessionHours) * time.Hour
+}
+
+// sessionScopes returns what a session may do
+func (l LoginConfig) sessionScopes() []string {
+	if len(l.Scopes) == 0 {
+		return []string{scopeRead, scopeIngest}
+	}
+	return l.Scopes
+}
+
+// sessionHash identifies the sessions of the configured login. It covers
+// the password hash, so changing the password ends every session.
+func (l LoginConfig) sessionHash() string {
+	return sessionPrefix + hashToken(l.Username+"\x00"+l.PasswordHash)
+}
+
+// validate checks the login settings
+func (l LoginConfig) validate() error {
+	if (l.Username == "") != (l.PasswordHash == "") {
+		return fmt.Errorf("invalid login: username and password_hash must be set together")
+	}
+	if l.PasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(l.PasswordHash)); err != nil {
+			return fmt.Errorf("invalid login: password_hash must be the output of cylog password hash")
+		}
+	}
+	if l.SessionHours < 0 {
+		return fmt.Errorf("invalid login: session_hours must not be negative")
+	}
+	for _, scope := range l.Scopes {
+		if scope != scopeRead && scope != scopeIngest && scope != scopeAdmin {
+			return fmt.Errorf("invalid login: unknown scope %q (must be read, ingest or admin)", scope)
+		}
+	}
+	return nil
+}
+
+// authRequired reports whether the read API and WebSocket need a token or
+// a session
+func (c *Config) authRequired() bool {
+	return c.RequireTokens || c.Login.enabled()
+}
+
+// Sessions signs and checks session cookies
+type Sessions struct {
+	once sync.Once
+	key  []byte
+}
+
+// sessions is the application-wide session signer
+var sessions = &Sessions{}
+
+// signingKey returns the key signing session cookies, created on first use
+// and kept in the logs directory. If it can't be stored, sessions last
+// until the server restarts.
+func (s *Sessions) signingKey() []byte {
+	s.once.Do(func() {
+		key, err := loadSessionKey(filepath.Join(logsDir, sessionKeyFileName))
+		if err != nil {
+			captureError("session key", err)
+			key = make([]byte, 32)
+			rand.Read(key)
+		}
+		s.key = key
+	})
+	return s.key
+}
+
+// loadSessionKey reads the session key, creating it if it doesn't exist
+func loadSessionKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) < 32 {
+			return nil, fmt.Errorf("invalid session key in %s", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if writable() {
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to save session key: %w", err)
+		}
+	}
+	return key, nil
+}
+
+// sign returns the MAC of a session cookie payload for the login
+func (s *Sessions) sign(payload string, login LoginConfig) []byte {
+	mac := hmac.New(sha256.New, s.signingKey())
+	mac.Write([]byte(payload + "|" + login.sessionHash()))
+	return mac.Sum(nil)
+}
+
+// Issue sets a session cookie for the configured login
+func (s *Sessions) Issue(c *gin.Context, login LoginConfig) {
+	expires := time.Now().Add(login.sessionLifetime())
+	payload := strconv.FormatInt(expires.Unix(), 10) + "|" + login.Username
+	value := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload, login))
+	setCookie(c, &http.Cookie{Name: sessionCookieName, Value: value, Expires: expires})
+}
+
+// Verify returns the session token of a request's session cookie, renewing
+// the cookie once half its lifetime has passed
+func (s *Sessions) Verify(c *gin.Context, cfg *Config) (authToken, bool) {
+	if !cfg.Login.enabled() {
+		return authToken{}, false
+	}
+	cookie, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		return authToken{}, false
+	}
+
+	encoded, encodedMAC, ok := strings.Cut(cookie, ".")
+	if !ok {
+		return authToken{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return authToken{}, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, s.sign(string(payload), cfg.Login)) {
+		return authToken{}, false
+	}
+	unix, username, ok := strings.Cut(string(payload), "|")
+	expiry, err := strconv.ParseInt(unix, 10, 64)
+	if !ok || err != nil || username != cfg.Login.Username {
+		return authToken{}, false
+	}
+	remaining := time.Until(time.Unix(expiry, 0))
+	if remaining <= 0 {
+		return authToken{}, false
+	}
+
+	if remaining < cfg.Login.sessionLifetime()/2 && c.GetHeader("Upgrade") == "" {
+		s.Issue(c, cfg.Login)
+	}
+	return cfg.lookupToken(cfg.Login.sessionHash())
+}
+
+// setCookie sets an HttpOnly cookie for the whole site, marked Secure when
+// the request came over HTTPS
+func setCookie(c *gin.Context, cookie *http.Cookie) {
+	cookie.Path = "/"
+	cookie.HttpOnly = true
+	cookie.SameSite = http.SameSiteLaxMode
+	cookie.Secure = isHTTPS(c)
+	http.SetCookie(c.Writer, cookie)
+}
+
+// httpsKey marks requests that came over HTTPS
+const httpsKey = "https"
+
+// httpsMiddleware records whether a request came over HTTPS, either
+// directly or through one of the trusted proxies; X-Forwarded-Proto from
+// any other peer is ignored, as X-Forwarded-For is
+func httpsMiddleware(trustedProxies []string) gin.HandlerFunc {
+	proxies := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			proxies = append(proxies, network)
+		} else if ip := net.ParseIP(proxy); ip != nil {
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		}
+	}
+
+	return func(c *gin.Context) {
+		https := c.Request.TLS != nil
+		if !https && c.GetHeader("X-Forwarded-Proto") == "https" {
+			if peer := net.ParseIP(c.RemoteIP()); peer != nil {
+				for _, proxy := range proxies {
+					if proxy.Contains(peer) {
+						https = true
+						break
+					}
+				}
+			}
+		}
+		c.Set(httpsKey, https)
+		c.Next()
+	}
+}
+
+// isHTTPS reports whether a request came over HTTPS, as httpsMiddleware
+// found
+func isHTTPS(c *gin.Context) bool {
+	return c.GetBool(httpsKey)
+}
+
+// sameOrigin reports whether a browser request was made by a page of this
+// server; requests without an Origin header aren't from another page
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// csrfToken returns the CSRF token of a browser, setting a new one when it
+// has none. Forms send it back as csrf_token and scripts as X-CSRF-Token.
+func csrfToken(c *gin.Context) string {
+	if token, err := c.Cookie(csrfCookieName); err == nil && token != "" {
+		return token
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+	setCookie(c, &http.Cookie{Name: csrfCookieName, Value: token})
+	return token
+}
+
+// validCSRF reports whether a request sent back its browser's CSRF token
+func validCSRF(c *gin.Context) bool {
+	cookie, err := c.Cookie(csrfCookieName)
+	if err != nil || cookie == "" {
+		return false
+	}
+	sent := c.GetHeader(csrfHeaderName)
+	if sent == "" {
+		sent = c.PostForm(csrfFieldName)
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(cookie)) == 1
+}
+
+// requireCSRF returns middleware refusing form posts without the CSRF
+// token
+func requireCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !validCSRF(c) {
+			apiError(c, http.StatusForbidden, "missing or invalid CSRF token")
+			return
+		}
+		c.Next()
+	}
+}
+
+// requirePage returns middleware sending browsers without a session or
+// token to the login page, when the login is configured
+func requirePage(store *ConfigStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := store.Get()
+		token, ok := authenticate(c, cfg)
+		if ok {
+			c.Set(tokenKey, token)
+		}
+		if cfg.Login.enabled() && !(ok && token.allows(scopeRead)) {
+			c.Redirect(http.StatusSeeOther, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// loginRedirect returns where to go after logging in; only paths on this
+// site are followed
+func loginRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// registerLoginRoutes registers the login page and logout
+func registerLoginRoutes(router *gin.Engine, chatServer *ChatServer) {
+	router.GET("/login", func(c *gin.Context) {
+		if !chatServer.Config().Login.enabled() {
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+		c.HTML(http.StatusOK, "login.html", gin.H{
+			"CSRF": csrfToken(c),
+			"Next": loginRedirect(c.Query("next")),
+		})
+	})
+
+	router.POST("/login", requireCSRF(), func(c *gin.Context) {
+		login := chatServer.Config().Login
+		if !login.enabled() {
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+
+		// The password is checked even for a wrong username, so both take
+		// as long
+		username := c.PostForm("username")
+		passwordErr := bcrypt.CompareHashAndPassword([]byte(login.PasswordHash), []byte(c.PostForm("password")))
+		if subtle.ConstantTimeCompare([]byte(username), []byte(login.Username)) != 1 || passwordErr != nil {
+			logf(c, "Failed login as %q from %s", username, c.ClientIP())
+			c.HTML(http.StatusUnauthorized, "login.html", gin.H{
+				"CSRF":  csrfToken(c),
+				"Next":  loginRedirect(c.PostForm("next")),
+				"Error": "Wrong username or password",
+			})
+			return
+		}
+
+		sessions.Issue(c, login)
+		logf(c, "Login as %s from %s", username, c.ClientIP())
+		c.Redirect(http.StatusSeeOther, loginRedirect(c.PostForm("next")))
+	})
+
+	router.POST("/logout", requireCSRF(), func(c *gin.Context) {
+		setCookie(c, &http.Cookie{Name: sessionCookieName, MaxAge: -1})
+		c.Redirect(http.StatusSeeOther, "/login")
+	})
+}
+
+// runPasswordCommand implements "cylog password hash [password]", which
+// prints the bcrypt hash of a password for login.password_hash
+func runPasswordCommand(args []string) int {
+	if len(args) == 0 || args[0] != "hash" || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: cylog password hash [password]")
+		return 2
+	}
+
+	password, err := secretArg(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read password: %v\n", err)
+		return 1
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to hash password: %v\n", err)
+		return 1
+	}
+
+	fmt.Println(string(hash))
+	return 0
+}
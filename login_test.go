@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionCookie issues a session cookie for the login
+func sessionCookie(t *testing.T, login LoginConfig) *http.Cookie {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	sessions.Issue(c, login)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie
+		}
+	}
+	t.Fatal("no session cookie issued")
+	return nil
+}
+
+func TestSessionWebSocketUpgradeNeedsSameOrigin(t *testing.T) {
+	// The session key would otherwise be kept in the repository's logs/
+	t.Chdir(t.TempDir())
+	gin.SetMode(gin.TestMode)
+
+	cfg := defaultConfig()
+	cfg.Login = LoginConfig{Username: "admin", PasswordHash: "$2a$10$unused"}
+	cookie := sessionCookie(t, cfg.Login)
+
+	r := gin.New()
+	r.GET("/ws", requireScope(NewConfigStore("", cfg), scopeRead, scopeIngest), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		upgrade bool
+		origin  string
+		want    int
+	}{
+		{"upgrade without origin", true, "", http.StatusOK},
+		{"upgrade from the same origin", true, "http://cylog.test", http.StatusOK},
+		{"upgrade from the same origin in another case", true, "http://CYLOG.test", http.StatusOK},
+		{"upgrade from another port", true, "http://cylog.test:3000", http.StatusUnauthorized},
+		{"upgrade from another site", true, "https://evil.test", http.StatusUnauthorized},
+		{"upgrade from an opaque origin", true, "null", http.StatusUnauthorized},
+		{"plain request from another site", false, "https://evil.test", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://cylog.test/ws", nil)
+			req.AddCookie(cookie)
+			if tt.upgrade {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedProtoOnlyFromTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(httpsMiddleware([]string{"10.0.0.0/24", "::1"}))
+	r.GET("/", func(c *gin.Context) {
+		csrfToken(c)
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		proto      string
+		secure     bool
+	}{
+		{"trusted proxy range", "10.0.0.7:4000", "https", true},
+		{"trusted proxy address", "[::1]:4000", "https", true},
+		{"trusted proxy over http", "10.0.0.7:4000", "http", false},
+		{"untrusted peer", "192.0.2.1:4000", "https", false},
+		{"no header", "10.0.0.7:4000", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies, want the CSRF cookie", len(cookies))
+			}
+			if cookies[0].Secure != tt.secure {
+				t.Errorf("Secure = %v, want %v", cookies[0].Secure, tt.secure)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// logMetaFileName is the file in the logs directory the scans of closed log
+// files are persisted to
+const logMetaFileName = ".meta.json"
+
+// Log metadata cache metrics
+var (
+	logMetaHits   = metrics.Counter("cylog_log_meta_cache_hits_total", "Log file metadata lookups answered from the cache")
+	logMetaMisses = metrics.Counter("cylog_log_meta_cache_misses_total", "Log file metadata lookups that scanned the file")
+)
+
+// logMetaEntry is the persisted scan of a closed log file
+type logMetaEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Lines    int       `json:"lines"`
+	Messages int       `json:"messages"`
+	Users    int       `json:"users"`
+	First    time.Time `json:"first_timestamp"`
+	Last     time.Time `json:"last_timestamp"`
+}
+
+// valid reports whether the entry could have come from a scan; anything
+// else is treated as corrupted and the file is scanned again
+func (e logMetaEntry) valid() bool {
+	return e.Size >= 0 && e.Lines >= 0 && e.Messages >= 0 && e.Users >= 0 && !e.Last.Before(e.First)
+}
+
+// countsUsers reports whether the entry of a message log has its user
+// count; entries stored before users were counted are scanned again
+func (e logMetaEntry) countsUsers(name string) bool {
+	return recordKinds[logFileKind(name)] || e.Messages == 0 || e.Users > 0
+}
+
+// LogMetaStore persists the scans of closed log files, which never change,
+// so their counts survive restarts. Entries are dropped when their file is
+// deleted or archived.
+type LogMetaStore struct {
+	path    string
+	entries map[string]logMetaEntry
+	dirty   bool
+	mutex   sync.Mutex
+}
+
+// logMeta is the application-wide closed log file metadata store
+var logMeta = newLogMetaStore(logsDir)
+
+// newLogMetaStore creates a store of the scans of the log files in dir,
+// persisted in that directory
+func newLogMetaStore(dir string) *LogMetaStore {
+	return &LogMetaStore{path: filepath.Join(dir, logMetaFileName), entries: make(map[string]logMetaEntry)}
+}
+
+// Load reads the persisted entries; a missing or unreadable file, or
+// invalid entries, just leave those files to be scanned again
+func (m *LogMetaStore) Load() {
+	entries := make(map[string]logMetaEntry)
+	if data, err := os.ReadFile(m.path); err == nil {
+		var stored map[string]logMetaEntry
+		if json.Unmarshal(data, &stored) == nil {
+			for name, entry := range stored {
+				if logFileKind(name) != "" && entry.valid() && entry.countsUsers(name) {
+					entries[name] = entry
+				}
+			}
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.entries = entries
+	m.dirty = false
+}
+
+// Get returns the stored scan of a closed log file if its size and
+// modification time are unchanged
+func (m *LogMetaStore) Get(name string, size int64, modTime time.Time) (*logFileScan, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.entries[name]
+	if !ok || entry.Size != size || !entry.ModTime.Equal(modTime) {
+		return nil, false
+	}
+	return &logFileScan{
+		size:     entry.Size,
+		modTime:  entry.ModTime,
+		lines:    entry.Lines,
+		messages: entry.Messages,
+		users:    entry.Users,
+		first:    entry.First,
+		last:     entry.Last,
+	}, true
+}
+
+// Put records the scan of a closed log file; it is written on the next Save
+func (m *LogMetaStore) Put(name string, scan *logFileScan) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entries[name] = logMetaEntry{
+		Size:     scan.size,
+		ModTime:  scan.modTime,
+		Lines:    scan.lines,
+		Messages: scan.messages,
+		Users:    scan.users,
+		First:    scan.first,
+		Last:     scan.last,
+	}
+	m.dirty = true
+}
+
+// Remove drops the entry of a deleted or archived log file and writes the
+// store, so a file later created under the same name is never mistaken for it
+func (m *LogMetaStore) Remove(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.entries[name]; !ok {
+		return
+	}
+	delete(m.entries, name)
+	m.dirty = true
+	if err := m.save(); err != nil {
+		log.Printf("Error saving log metadata: %v", err)
+	}
+}
+
+// Save writes the entries to disk if they have changed
+func (m *LogMetaStore) Save() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.save()
+}
+
+// save writes the entries to disk if they have changed; the caller must
+// hold the lock
+func (m *LogMetaStore) save() error {
+	if !m.dirty {
+		return nil
+	}
+	data, err := json.Marshal(m.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode log metadata: %w", err)
+	}
+
+	if err := writeFileAtomic(m.path, data); err != nil {
+		return fmt.Errorf("failed to write log metadata: %w", err)
+	}
+	m.dirty = false
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatedLogPattern matches app.log and access.log and their numbered backups
+var rotatedLogPattern = regexp.MustCompile(`^(?:app|access)\.log(?:\.\d+)?$`)
+
+// isCappedLogFile reports whether a file in the logs directory counts
+// against disk.max_log_bytes
+func isCappedLogFile(name string) bool {
+	return logFileKind(name) != "" || rotatedLogPattern.MatchString(name)
+}
+
+// logUsageEntry is the tracked size and last write time of a log file
+type logUsageEntry struct {
+	size    int64
+	modTime time.Time
+}
+
+// LogUsage tracks the total size of the log files in the logs directory.
+// It is updated as files are written, rotated and deleted, so checking the
+// size cap never has to stat every file.
+type LogUsage struct {
+	dir   string
+	files map[string]*logUsageEntry
+	total int64
+	mutex sync.Mutex
+}
+
+// logUsage is the application-wide log directory usage tracker
+var logUsage = newLogUsage(logsDir)
+
+// newLogUsage creates a tracker of the log files in dir
+func newLogUsage(dir string) *LogUsage {
+	return &LogUsage{dir: dir, files: make(map[string]*logUsageEntry)}
+}
+
+// Scan replaces the tracked files with the log files currently on disk; a
+// missing logs directory, as in a dry run, has none
+func (u *LogUsage) Scan() error {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read logs directory: %w", err)
+	}
+
+	files := make(map[string]*logUsageEntry)
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !isCappedLogFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files[entry.Name()] = &logUsageEntry{size: info.Size(), modTime: info.ModTime()}
+		total += info.Size()
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.files = files
+	u.total = total
+	return nil
+}
+
+// Add records n bytes appended to a log file
+func (u *LogUsage) Add(name string, n int64) {
+	if !isCappedLogFile(name) {
+		return
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	entry, ok := u.files[name]
+	if !ok {
+		entry = &logUsageEntry{}
+		u.files[name] = entry
+	}
+	entry.size += n
+	entry.modTime = time.Now()
+	u.total += n
+}
+
+// Refresh re-stats the given log files, dropping those that no longer exist
+func (u *LogUsage) Refresh(names ...string) {
+	for _, name := range names {
+		if !isCappedLogFile(name) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(u.dir, name))
+
+		u.mutex.Lock()
+		if entry, ok := u.files[name]; ok {
+			u.total -= entry.size
+			delete(u.files, name)
+		}
+		if err == nil {
+			u.files[name] = &logUsageEntry{size: info.Size(), modTime: info.ModTime()}
+			u.total += info.Size()
+		}
+		u.mutex.Unlock()
+	}
+}
+
+// Remove stops tracking a deleted log file
+func (u *LogUsage) Remove(name string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if entry, ok := u.files[name]; ok {
+		u.total -= entry.size
+		delete(u.files, name)
+	}
+}
+
+// Total returns the tracked size of all log files
+func (u *LogUsage) Total() int64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.total
+}
+
+// oldest returns the tracked files, least recently written first
+func (u *LogUsage) oldest() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	names := make([]string, 0, len(u.files))
+	for name := range u.files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := u.files[names[i]], u.files[names[j]]
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.Before(b.modTime)
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// SetSizeCap sets the total size the log files may take; zero disables it
+func (l *Logger) SetSizeCap(maxBytes int64) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	l.maxBytes = maxBytes
+}
+
+// SizeCap returns the configured total size cap of the log files
+func (l *Logger) SizeCap() int64 {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	return l.maxBytes
+}
+
+// EnforceSizeCap deletes the least recently written closed log files of
+// every kind until their total size is under the cap, returning the deleted
+// filenames. Live files, including app.log and access.log, are never deleted.
+func (l *Logger) EnforceSizeCap() ([]string, error) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if l.maxBytes <= 0 || l.usage.Total() <= l.maxBytes {
+		return nil, nil
+	}
+
+	live := map[string]bool{appLogFileName: true, accessLogFileName: true}
+	for _, stream := range l.streams {
+		live[filepath.Base(stream.path)] = true
+	}
+
+	deleted := make([]string, 0)
+	for _, name := range l.usage.oldest() {
+		if l.usage.Total() <= l.maxBytes {
+			break
+		}
+		if live[name] {
+			continue
+		}
+		if err := removeFile(filepath.Join(l.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error deleting log file %s: %v", name, err)
+			continue
+		}
+		l.usage.Remove(name)
+		l.meta.Remove(name)
+		l.removeLogSidecars(name)
+		deleted = append(deleted, name)
+		log.Printf("Deleted log file %s to stay under the %d byte log directory cap", name, l.maxBytes)
+	}
+
+	if total := l.usage.Total(); total > l.maxBytes {
+		return deleted, fmt.Errorf("log files take %d bytes, over the %d byte cap, with only live files left", total, l.maxBytes)
+	}
+	return deleted, nil
+}
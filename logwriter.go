@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Log writer defaults
+const (
+	defaultLogQueueSize    = 4096
+	defaultLogDrainTimeout = 10 * time.Second
+	logWriterBatchSize     = 256
+)
+
+// What ingestion does when the log writer queue is full
+const (
+	logQueueBlock = "block"
+	logQueueDrop  = "drop"
+)
+
+// logQueueDropped counts messages that were never written to the logs
+var logQueueDropped = metrics.Counter("cylog_log_queue_dropped_total", "Messages not logged because the log writer queue was full or shutdown timed out")
+
+// LogWriterConfig configures the goroutine writing messages to the logs;
+// changing it requires a restart
+type LogWriterConfig struct {
+	// QueueSize is how many messages wait to be written
+	QueueSize int `yaml:"queue_size"`
+
+	// WhenFull is "block" (default), making ingestion wait for the disk,
+	// or "drop", skipping messages until the queue has room again
+	WhenFull string `yaml:"when_full"`
+
+	// DrainTimeoutSeconds bounds how long shutdown waits for queued messages
+	DrainTimeoutSeconds int `yaml:"drain_timeout_seconds"`
+}
+
+// validate checks the log writer settings
+func (c LogWriterConfig) validate() error {
+	if c.QueueSize < 0 || c.DrainTimeoutSeconds < 0 {
+		return fmt.Errorf("invalid log_writer: queue_size and drain_timeout_seconds must not be negative")
+	}
+	if c.WhenFull != "" && c.WhenFull != logQueueBlock && c.WhenFull != logQueueDrop {
+		return fmt.Errorf("invalid log_writer when_full %q: must be block or drop", c.WhenFull)
+	}
+	return nil
+}
+
+// logJob is a message to write, or a flush request closed once everything
+// queued before it is written
+type logJob struct {
+	msg     Message
+	flushed chan struct{}
+}
+
+// LogWriter writes messages to the logs from a single goroutine, so a slow
+// disk delays neither the Cytube reader nor client read loops
+type LogWriter struct {
+	queue        chan logJob
+	dropWhenFull bool
+	drainTimeout time.Duration
+	dropping     atomic.Bool
+	done         chan struct{}
+}
+
+// NewLogWriter creates a log writer; runLogWriter starts it
+func NewLogWriter(cfg LogWriterConfig) *LogWriter {
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = defaultLogQueueSize
+	}
+	drainTimeout := time.Duration(cfg.DrainTimeoutSeconds) * time.Second
+	if drainTimeout <= 0 {
+		drainTimeout = defaultLogDrainTimeout
+	}
+	return &LogWriter{
+		queue:        make(chan logJob, size),
+		dropWhenFull: cfg.WhenFull == logQueueDrop,
+		drainTimeout: drainTimeout,
+		done:         make(chan struct{}),
+	}
+}
+
+// Enqueue queues a message for writing. With a full queue it waits, or
+// drops the message with when_full: drop; after quit it drops it.
+func (w *LogWriter) Enqueue(msg Message, quit <-chan struct{}) {
+	job := logJob{msg: msg}
+	if w.dropWhenFull {
+		select {
+		case w.queue <- job:
+			w.dropping.Store(false)
+		default:
+			logQueueDropped.Inc()
+			if !w.dropping.Swap(true) {
+				log.Printf("Log writer queue full, dropping messages until it has room")
+			}
+		}
+		return
+	}
+
+	select {
+	case w.queue <- job:
+	case <-quit:
+		logQueueDropped.Inc()
+	}
+}
+
+// Flush waits until every message queued so far is written
+func (w *LogWriter) Flush(quit <-chan struct{}) {
+	flushed := make(chan struct{})
+	select {
+	case w.queue <- logJob{flushed: flushed}:
+	case <-quit:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-w.done:
+	}
+}
+
+// runLogWriter writes queued messages in batches until the server shuts
+// down, then writes what is still queued, within the drain timeout
+func (s *ChatServer) runLogWriter() {
+	defer close(s.writer.done)
+	defer recoverPanic("log writer")
+
+	for {
+		select {
+		case job := <-s.writer.queue:
+			s.writeLogJobs(s.nextLogJobs(job))
+		case <-s.quit:
+			s.drainLogWriter()
+			return
+		}
+	}
+}
+
+// nextLogJobs returns a batch starting with job and whatever else is
+// already queued
+func (s *ChatServer) nextLogJobs(job logJob) []logJob {
+	jobs := []logJob{job}
+	for len(jobs) < logWriterBatchSize {
+		select {
+		case job := <-s.writer.queue:
+			jobs = append(jobs, job)
+		default:
+			return jobs
+		}
+	}
+	return jobs
+}
+
+// drainLogWriter writes the messages queued at shutdown, giving up on the
+// rest when the drain timeout passes
+func (s *ChatServer) drainLogWriter() {
+	deadline := time.Now().Add(s.writer.drainTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case job := <-s.writer.queue:
+			s.writeLogJobs(s.nextLogJobs(job))
+		default:
+			return
+		}
+	}
+
+	if left := len(s.writer.queue); left > 0 {
+		logQueueDropped.Add(int64(left))
+		log.Printf("Log writer drain timed out with %d messages unwritten", left)
+	}
+}
+
+// writeLogJobs writes a batch of messages, answering flush requests once
+// the messages before them are written
+func (s *ChatServer) writeLogJobs(jobs []logJob) {
+	msgs := make([]Message, 0, len(jobs))
+	for _, job := range jobs {
+		if job.flushed == nil {
+			msgs = append(msgs, job.msg)
+			continue
+		}
+		s.persistMessages(msgs)
+		msgs = msgs[:0]
+		close(job.flushed)
+	}
+	s.persistMessages(msgs)
+}
+
+// persistMessages writes messages to the logs and indexes and forwards them
+// to Loki; status messages only when configured, and only a sample of chat
+// while sampling. The sampling rate is read once per batch, so its marker
+// precedes the messages it applies to.
+func (s *ChatServer) persistMessages(msgs []Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	cfg := s.Config()
+	rate := s.SamplingStatus().Rate
+	s.updateSampling(rate, time.Now())
+
+	logged := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if (msg.Type != messageTypeStatus || cfg.LogStatusEvents) && s.sampleMessage(msg, rate) {
+			logged = append(logged, msg)
+		}
+	}
+	err := s.logger.LogMessages(logged)
+
+	// Paused and held logs write nothing, so they neither fail nor recover
+	_, held := s.logger.Held()
+	if _, _, paused := s.logger.Paused(); err != nil || (len(logged) > 0 && !held && !paused && writable()) {
+		s.recordLogWrite(err, time.Now())
+	}
+	for _, msg := range logged {
+		if len(msg.Links) > 0 {
+			s.indexLinks(msg)
+		}
+		if len(msg.Mentions) > 0 {
+			s.indexMention(msg)
+		}
+		if s.loki != nil && !held {
+			s.loki.Enqueue(msg)
+		}
+	}
+}
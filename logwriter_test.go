@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"cylog/internal/testsupport"
+)
+
+// BenchmarkMessageLatencySlowDisk measures how long a chat message takes
+// from upstream to a WebSocket client while every log write is delayed.
+// The queue drops rather than blocks when full, so the numbers show the
+// hot path alone however far the disk falls behind.
+func BenchmarkMessageLatencySlowDisk(b *testing.B) {
+	for _, delay := range []time.Duration{0, time.Millisecond, 10 * time.Millisecond} {
+		b.Run(fmt.Sprintf("write delay=%s", delay), func(b *testing.B) {
+			upstream := testsupport.NewFakeCytube(b)
+			cfg := defaultConfig()
+			cfg.Channel = "test"
+			cfg.Upstream.URLs = []string{upstream.URL()}
+			cfg.Upstream.Proxy = "direct"
+			cfg.LogWriter.WhenFull = logQueueDrop
+			cfg.LogWriter.DrainTimeoutSeconds = 1
+			chatServer, router := newTestServer(b, cfg)
+			chatServer.logger.writeFile = func(file *os.File, data string) (int, error) {
+				time.Sleep(delay)
+				return file.WriteString(data)
+			}
+			baseURL := testsupport.Serve(b, router)
+			chatServer.Run(b.Context())
+			b.Cleanup(func() { <-chatServer.Done() })
+			upstream.WaitConnected(e2eTimeout)
+
+			client := testsupport.Dial(b, baseURL, "/ws")
+			client.Send(map[string]interface{}{"type": "hello", "bot": true})
+
+			latencies := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				content := fmt.Sprintf("latency probe %d", i)
+				start := time.Now()
+				upstream.ChatMsg("alice", content)
+				client.WaitFor(e2eTimeout, frameContaining(content))
+				latencies = append(latencies, time.Since(start))
+			}
+			b.StopTimer()
+
+			slices.Sort(latencies)
+			b.ReportMetric(float64(latencies[len(latencies)/2].Nanoseconds()), "p50-ns")
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+		})
+	}
+}
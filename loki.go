@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Loki client defaults
+const (
+	defaultLokiBatchSize   = 500
+	defaultLokiBatchWait   = 5 * time.Second
+	lokiQueueSize          = 10000
+	lokiRequestTimeout     = 10 * time.Second
+	lokiMaxBackoff         = time.Minute
+	lokiShutdownFlushDelay = 5 * time.Second
+)
+
+// Loki forwarding metrics
+var (
+	lokiPushed  = metrics.Counter("cylog_loki_entries_pushed_total", "Log entries pushed to Loki")
+	lokiDropped = metrics.Counter("cylog_loki_entries_dropped_total", "Log entries dropped because the Loki queue was full or Loki rejected them")
+)
+
+// LokiConfig configures forwarding chat messages to Grafana Loki
+type LokiConfig struct {
+	// Enabled turns on Loki forwarding; it is off by default
+	Enabled bool `yaml:"enabled"`
+
+	// URL is the Loki base URL, e.g. http://localhost:3100
+	URL string `yaml:"url"`
+
+	// TenantID is sent as X-Scope-OrgID for multi-tenant Loki setups
+	TenantID string `yaml:"tenant_id"`
+
+	// BatchSize is the most entries sent in one push
+	BatchSize int `yaml:"batch_size"`
+
+	// BatchWaitMillis is the longest an entry waits before being pushed
+	BatchWaitMillis int `yaml:"batch_wait_millis"`
+}
+
+// lokiStreamKey identifies a Loki stream by its labels
+type lokiStreamKey struct {
+	channel string
+	msgType string
+}
+
+// lokiStream is a stream in a Loki push request
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// LokiClient batches messages and pushes them to Loki from a single
+// goroutine, so entries of each stream are sent in order
+type LokiClient struct {
+	cfg       LokiConfig
+	channel   string
+	client    *http.Client
+	queue     chan Message
+	batchSize int
+	batchWait time.Duration
+
+	// lastSent is the latest timestamp pushed per stream; Loki rejects
+	// entries older than that
+	lastSent map[lokiStreamKey]int64
+}
+
+// NewLokiClient creates a Loki client, or returns nil when forwarding is disabled
+func NewLokiClient(cfg LokiConfig, channel string) *LokiClient {
+	if !cfg.Enabled || cfg.URL == "" || !writable() {
+		return nil
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultLokiBatchSize
+	}
+	batchWait := time.Duration(cfg.BatchWaitMillis) * time.Millisecond
+	if batchWait <= 0 {
+		batchWait = defaultLokiBatchWait
+	}
+
+	return &LokiClient{
+		cfg:       cfg,
+		channel:   channel,
+		client:    &http.Client{Timeout: lokiRequestTimeout},
+		queue:     make(chan Message, lokiQueueSize),
+		batchSize: batchSize,
+		batchWait: batchWait,
+		lastSent:  make(map[lokiStreamKey]int64),
+	}
+}
+
+// Enqueue queues a message for pushing; it never blocks and drops the
+// message if the queue is full
+func (l *LokiClient) Enqueue(msg Message) {
+	select {
+	case l.queue <- msg:
+	default:
+		lokiDropped.Inc()
+	}
+}
+
+// run batches queued messages and pushes them until ctx is canceled, then
+// makes a last attempt to push what is left
+func (l *LokiClient) run(ctx context.Context) {
+	defer recoverPanic("Loki client")
+
+	timer := time.NewTimer(l.batchWait)
+	defer timer.Stop()
+
+	batch := make([]Message, 0, l.batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			for drained := false; !drained; {
+				select {
+				case msg := <-l.queue:
+					batch = append(batch, msg)
+				default:
+					drained = true
+				}
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), lokiShutdownFlushDelay)
+			l.push(flushCtx, batch)
+			cancel()
+			return
+		case msg := <-l.queue:
+			batch = append(batch, msg)
+			if len(batch) < l.batchSize {
+				continue
+			}
+		case <-timer.C:
+			timer.Reset(l.batchWait)
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		l.push(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// push sends a batch to Loki, retrying with exponential backoff on 429 and
+// 5xx responses until it succeeds or ctx is canceled
+func (l *LokiClient) push(ctx context.Context, batch []Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"streams": l.streams(batch)})
+	if err != nil {
+		log.Printf("Error encoding Loki push: %v", err)
+		lokiDropped.Add(int64(len(batch)))
+		return
+	}
+
+	backoff := time.Second
+	for {
+		retry, err := l.send(ctx, body)
+		if err == nil {
+			lokiPushed.Add(int64(len(batch)))
+			return
+		}
+		if !retry {
+			log.Printf("Loki rejected %d entries: %v", len(batch), err)
+			lokiDropped.Add(int64(len(batch)))
+			return
+		}
+
+		log.Printf("Loki push failed, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			lokiDropped.Add(int64(len(batch)))
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > lokiMaxBackoff {
+			backoff = lokiMaxBackoff
+		}
+	}
+}
+
+// send makes one push request, reporting whether a failure is worth retrying
+func (l *LokiClient) send(ctx context.Context, body []byte) (bool, error) {
+	url := strings.TrimSuffix(l.cfg.URL, "/") + "/loki/api/v1/push"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("invalid Loki URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.cfg.TenantID)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("push returned %s", resp.Status)
+}
+
+// streams groups a batch into Loki streams. Entries that would be older than
+// the last one sent on their stream are moved just after it, since Loki
+// rejects out-of-order entries.
+func (l *LokiClient) streams(batch []Message) []*lokiStream {
+	streams := make(map[lokiStreamKey]*lokiStream)
+	order := make([]*lokiStream, 0)
+
+	for _, msg := range batch {
+		msgType := msg.Type
+		if msgType == "" {
+			msgType = "chat"
+		}
+		key := lokiStreamKey{channel: l.channel, msgType: msgType}
+
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: map[string]string{
+				"app":     "cylog",
+				"channel": l.channel,
+				"type":    msgType,
+			}}
+			streams[key] = stream
+			order = append(order, stream)
+		}
+
+		timestamp := msg.Timestamp.UnixNano()
+		if last, ok := l.lastSent[key]; ok && timestamp <= last {
+			log.Printf("Warning: adjusting out-of-order Loki entry from %s by %s", msg.Timestamp.Format(time.RFC3339Nano), time.Duration(last-timestamp+1))
+			timestamp = last + 1
+		}
+		l.lastSent[key] = timestamp
+
+		line, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("Error encoding message for Loki: %v", err)
+			continue
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(timestamp, 10), string(line)})
+	}
+	return order
+}
@@ -1,22 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"html"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
-	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"cylog/internal/clock"
+
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
@@ -26,367 +37,1740 @@ const (
 	appPort         = 8080
 	appWidth        = 1000
 	appHeight       = 700
-	webSocketURL    = "wss://cytube.net/ws" // Update with actual WebSocket URL
+	webSocketURL    = "wss://cytube.net/ws" // Default upstream, override with upstream.urls
 	logsDir         = "logs"
 	maxLogFileSize  = 10 * 1024 * 1024 // 10 MB
 	maxLogFiles     = 5
 	logDateFormat   = "2006-01-02"
+	logTimeFormat   = "2006-01-02 15:04:05"
 	desktopAppTitle = "Cytube Chat Viewer"
+
+	recentMessageLimit = 100 // Messages kept in memory and replayed to new clients
+
+	reconnectDelay     = 5 * time.Second // Delay between Cytube reconnect attempts
+	clientCloseTimeout = time.Second     // Deadline for sending close frames to clients
+	hubShutdownTimeout = 5 * time.Second // How long main waits for the hub to shut down
+)
+
+// Message types; an empty type is a chat message
+const (
+	messageTypeChat         = "chat"
+	messageTypeAction       = "action"
+	messageTypeAnnouncement = "announcement"
+	messageTypeSystem       = "system"
+	messageTypePM           = "pm"
+	messageTypeMedia        = "media"
+	messageTypeMod          = "mod"
+	messageTypeStatus       = "status"
+	messageTypeUserlist     = "userlist"
+	messageTypeViewers      = "viewers"
+
+	// statusTag marks status messages in log files so statistics skip them
+	statusTag = "status"
 )
 
 // Message represents a chat message
 type Message struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Timestamp time.Time `json:"timestamp"`
-	Content   string    `json:"content"`
-	HTML      string    `json:"html"`
+	ID        string                 `json:"id"`
+	Seq       uint64                 `json:"seq,omitempty"`
+	Type      string                 `json:"type,omitempty"`
+	Username  string                 `json:"username"`
+	Rank      int                    `json:"rank,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+	Content   string                 `json:"content"`
+	HTML      string                 `json:"html"`
+	Tags      []string               `json:"tags,omitempty"`
+	Links     []string               `json:"links,omitempty"`
+	Mentions  []string               `json:"mentions,omitempty"`
+	Meta      map[string]interface{} `json:"meta,omitempty"`
+
+	// Color is the username's color, the same in every client
+	Color string `json:"color,omitempty"`
+
+	// Previews are the links with a preview at /api/v1/preview?url=
+	Previews []string `json:"previews,omitempty"`
+
+	// Source is "local" for messages from local WebSocket clients, and
+	// empty for those from Cytube
+	Source string `json:"source,omitempty"`
+
+	// Truncated is set when the content or HTML was cut to the message limits
+	Truncated bool `json:"truncated,omitempty"`
+
+	// RawContent is the content before normalization, kept only with
+	// debug.keep_raw_content and when normalization changed it
+	RawContent string `json:"raw_content,omitempty"`
+
+	// Late is set on batched messages received too long after they were
+	// observed to be placed in order; Timestamp is still when they were
+	// observed
+	Late bool `json:"late,omitempty"`
+
+	// reorder places a batched message among the recent messages by its
+	// timestamp instead of appending it
+	reorder bool
+}
+
+// messageSourceLocal marks messages sent by local WebSocket clients
+const messageSourceLocal = "local"
+
+// Log file kinds; messages of types without a route go to the chat log
+const (
+	logKindChat     = "chat"
+	logKindEvents   = "events"
+	logKindPM       = "pm"
+	logKindMedia    = "media"
+	logKindLinks    = "links"
+	logKindMentions = "mentions"
+)
+
+// recordKinds are log kinds that hold JSON records rather than messages
+var recordKinds = map[string]bool{
+	logKindMedia:    true,
+	logKindLinks:    true,
+	logKindMentions: true,
+}
+
+// logStream is the live log file of a single kind
+type logStream struct {
+	kind  string
+	file  *os.File
+	path  string
+	label string
+
+	// The hash chain of the live file when log signing is on
+	chain       *os.File
+	chainHash   []byte
+	chainOffset int64
 }
 
-// Logger handles logging to files
+// Logger handles logging to files. Messages are routed by type to a log kind,
+// and each kind has its own files, rotation and retention.
 type Logger struct {
-	currentLogFile *os.File
-	logMutex       sync.Mutex
-	logFilePath    string
+	streams         map[string]*logStream
+	logMutex        sync.Mutex
+	closed          bool
+	retention       RetentionConfig
+	kindRetention   map[string]RetentionConfig
+	routes          map[string]string
+	pausedSince     time.Time
+	droppedLines    int
+	heldSince       time.Time
+	samplingRate    int
+	maxBytes        int64
+	rotation        string
+	rotationChanged chan struct{}
+	signingKey      []byte
+	encryptionKey   *[32]byte
+
+	// dir holds the log files and their sidecars; usage and meta track
+	// the files in it
+	dir   string
+	usage *LogUsage
+	meta  *LogMetaStore
+
+	// clock dates log files and drives rotation and retention
+	clock clock.Clock
+
+	// writeFile appends to a log file; tests may replace it to make writes
+	// fail
+	writeFile func(file *os.File, data string) (int, error)
 }
 
 // NewLogger creates a new logger instance
 func NewLogger() (*Logger, error) {
+	return NewLoggerWithClock(clock.System())
+}
+
+// NewLoggerWithClock creates a logger dating its files by the given clock
+func NewLoggerWithClock(clock clock.Clock) (*Logger, error) {
+	return newLogger(logsDir, clock, logUsage, logMeta)
+}
+
+// NewLoggerIn creates a logger keeping its files in dir instead of the
+// logs directory, with its own usage and metadata tracking, so that tests
+// don't depend on the working directory
+func NewLoggerIn(dir string, clock clock.Clock) (*Logger, error) {
+	return newLogger(dir, clock, newLogUsage(dir), newLogMetaStore(dir))
+}
+
+// newLogger creates a logger for the files in dir, tracked by usage and meta
+func newLogger(dir string, clock clock.Clock, usage *LogUsage, meta *LogMetaStore) (*Logger, error) {
 	// Create logs directory if it doesn't exist
-	if err := os.MkdirAll(logsDir, 0755); err != nil {
+	if err := makeDir(dir); err != nil {
 		return nil, fmt.Errorf("failed to create logs directory: %w", err)
 	}
 
-	logger := &Logger{}
-	if err := logger.rotateLogFile(); err != nil {
+	logger := &Logger{
+		streams:         make(map[string]*logStream),
+		retention:       RetentionConfig{MaxFiles: maxLogFiles},
+		rotation:        rotationDaily,
+		rotationChanged: make(chan struct{}, 1),
+		dir:             dir,
+		usage:           usage,
+		meta:            meta,
+		clock:           clock,
+		writeFile:       (*os.File).WriteString,
+	}
+	if err := usage.Scan(); err != nil {
+		return nil, err
+	}
+	meta.Load()
+
+	// A dry run never opens a log file
+	if !writable() {
+		return logger, nil
+	}
+	logger.logMutex.Lock()
+	defer logger.logMutex.Unlock()
+	if _, err := logger.stream(logKindChat); err != nil {
 		return nil, err
 	}
 
 	return logger, nil
 }
 
-// rotateLogFile creates a new log file with the current date
-func (l *Logger) rotateLogFile() error {
+// SetRetention sets the retention policy applied after each rotation; kinds
+// without an entry in kindRetention use the chat policy
+func (l *Logger) SetRetention(retention RetentionConfig, kindRetention map[string]RetentionConfig) {
 	l.logMutex.Lock()
 	defer l.logMutex.Unlock()
 
+	l.retention = retention
+	l.kindRetention = kindRetention
+}
+
+// SetRoutes sets the mapping from message type to log kind
+func (l *Logger) SetRoutes(routes map[string]string) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	l.routes = routes
+}
+
+// retentionFor returns the retention policy of a log kind; the caller must
+// hold logMutex
+func (l *Logger) retentionFor(kind string) RetentionConfig {
+	if retention, ok := l.kindRetention[kind]; ok && kind != logKindChat {
+		return retention
+	}
+	return l.retention
+}
+
+// routeKind returns the log kind a message type is written to
+func (l *Logger) routeKind(msgType string) string {
+	if kind, ok := l.routes[msgType]; ok && kind != "" {
+		return kind
+	}
+	return logKindChat
+}
+
+// stream returns the live stream of a log kind, opening it if needed; the
+// caller must hold logMutex
+func (l *Logger) stream(kind string) (*logStream, error) {
+	if stream, ok := l.streams[kind]; ok {
+		return stream, nil
+	}
+
+	stream := &logStream{kind: kind}
+	if err := l.rotateLogFile(stream, false); err != nil {
+		return nil, err
+	}
+	l.streams[kind] = stream
+	return stream, nil
+}
+
+// rotateLogFile opens the stream's log file for the current date; the caller
+// must hold logMutex. Today's latest file is reused unless it is full or
+// force is set, in which case a new file with the next sequence suffix is
+// created.
+func (l *Logger) rotateLogFile(stream *logStream, force bool) error {
+	if !writable() {
+		return errDryRun
+	}
+
 	// Close the current log file if it's open
-	if l.currentLogFile != nil {
-		l.currentLogFile.Close()
+	previous := ""
+	if stream.file != nil {
+		if info, err := stream.file.Stat(); err == nil && isEmptyLog(stream.path, info.Size()) {
+			previous = stream.path
+		}
+		stream.file.Close()
+		stream.file = nil
+		if previous == "" {
+			l.sealLogFile(stream)
+		}
 	}
 
-	// Create a new log file with the current date
-	currentDate := time.Now().Format(logDateFormat)
-	logFileName := fmt.Sprintf("chat-%s.log", currentDate)
-	l.logFilePath = filepath.Join(logsDir, logFileName)
+	// Don't leave an empty file behind, e.g. after the rotation period changed
+	if !force && previous != "" {
+		removeFile(previous)
+		l.usage.Remove(filepath.Base(previous))
+		l.removeLogSidecars(filepath.Base(previous))
+	}
+
+	// Find the latest file for the current period
+	currentDate := l.currentLabel(l.clock.Now())
+	stream.label = currentDate
+	suffix := ""
+	if l.encryptionKey != nil {
+		suffix = encryptedSuffix
+	}
+	seq := 0
+	for l.logFileExists(stream.kind, currentDate, seq+1) {
+		seq++
+	}
+
+	latest := filepath.Join(l.dir, logFileName(stream.kind, currentDate, seq)+suffix)
+	if info, err := os.Stat(latest); err == nil {
+		if force || info.Size() > maxLogFileSize {
+			seq++
+		}
+	} else if l.logFileExists(stream.kind, currentDate, seq) {
+		// The latest file is plaintext and we encrypt, or the other way round
+		seq++
+	}
+	stream.path = filepath.Join(l.dir, logFileName(stream.kind, currentDate, seq)+suffix)
 
-	file, err := os.OpenFile(l.logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	file, err := openFile(stream.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
 	if err != nil {
 		return fmt.Errorf("failed to open log file: %w", err)
 	}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 && suffix != "" {
+		if _, err := file.WriteString(encryptionMagic); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write log file header: %w", err)
+		}
+	}
 
-	l.currentLogFile = file
+	stream.file = file
+	l.usage.Refresh(filepath.Base(stream.path))
+	if err := l.openChain(stream); err != nil {
+		log.Printf("Error opening hash chain of %s: %v", filepath.Base(stream.path), err)
+	}
 
 	// Clean old log files
-	go l.cleanOldLogFiles()
+	kind := stream.kind
+	retention := l.retentionFor(kind)
+	go func() {
+		if _, err := l.PruneKind(kind, retention); err != nil {
+			log.Printf("Error pruning %s log files: %v", kind, err)
+		}
+		if _, err := l.EnforceSizeCap(); err != nil {
+			log.Printf("Error enforcing log directory cap: %v", err)
+		}
+	}()
 
 	return nil
 }
 
-// cleanOldLogFiles removes old log files if there are more than maxLogFiles
-func (l *Logger) cleanOldLogFiles() {
-	files, err := filepath.Glob(filepath.Join(logsDir, "chat-*.log"))
+// Rotate closes the current chat log file and starts a new one with the next
+// sequence suffix, returning the old and new filenames
+func (l *Logger) Rotate() (string, string, error) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if l.closed {
+		return "", "", fmt.Errorf("logger is closed")
+	}
+
+	stream, err := l.stream(logKindChat)
 	if err != nil {
-		log.Printf("Error finding log files: %v", err)
-		return
+		return "", "", err
 	}
 
-	if len(files) <= maxLogFiles {
-		return
+	oldName := filepath.Base(stream.path)
+	if err := l.rotateLogFile(stream, true); err != nil {
+		return oldName, "", err
 	}
+	return oldName, filepath.Base(stream.path), nil
+}
+
+// logFileExists reports whether a log file exists, plaintext or encrypted
+func (l *Logger) logFileExists(kind, date string, seq int) bool {
+	name := filepath.Join(l.dir, logFileName(kind, date, seq))
+	if _, err := os.Stat(name); err == nil {
+		return true
+	}
+	_, err := os.Stat(name + encryptedSuffix)
+	return err == nil
+}
+
+// logFileName returns the name of a log file for a kind, date and sequence
+// number; the first file of a day has no sequence suffix
+func logFileName(kind, date string, seq int) string {
+	if seq == 0 {
+		return fmt.Sprintf("%s-%s.log", kind, date)
+	}
+	return fmt.Sprintf("%s-%s.%d.log", kind, date, seq)
+}
+
+// logPeriodPattern matches the period label of a log filename: an hour,
+// a day, an ISO week or a month
+const logPeriodPattern = `\d{4}-\d{2}-\d{2}T\d{2}|\d{4}-\d{2}-\d{2}|\d{4}-W\d{2}|\d{4}-\d{2}`
+
+// logFileNamePattern matches log filenames like chat-2025-04-16.log,
+// events-2025-04-16.2.log, chat-2025-04-16T14.log, chat-2025-W16.log or
+// chat-2025-04.log; encrypted files end in .log.enc and monthly rollups
+// in .gz
+var logFileNamePattern = regexp.MustCompile(`^([a-z]+)-(` + logPeriodPattern + `)(?:\.(\d+))?\.log(?:\.enc)?(?:\.gz)?$`)
+
+// logKindPattern matches valid log kind names
+var logKindPattern = regexp.MustCompile(`^[a-z]+$`)
+
+// parseLogFileName extracts the start of the period and the sequence number
+// from a log filename
+func parseLogFileName(filename string) (time.Time, int, bool) {
+	matches := logFileNamePattern.FindStringSubmatch(filename)
+	if matches == nil {
+		return time.Time{}, 0, false
+	}
+
+	_, date, ok := parsePeriodLabel(matches[2])
+	if !ok {
+		return time.Time{}, 0, false
+	}
+
+	seq := 0
+	if matches[3] != "" {
+		seq, _ = strconv.Atoi(matches[3])
+	}
+	return date, seq, true
+}
 
-	// Sort files by modification time (oldest first)
-	fileInfos := make(map[string]os.FileInfo, len(files))
+// logFileKind returns the kind of a log filename, or "" if it isn't one
+func logFileKind(filename string) string {
+	matches := logFileNamePattern.FindStringSubmatch(filename)
+	if matches == nil {
+		return ""
+	}
+	return matches[1]
+}
+
+// sortLogFiles sorts log filenames oldest first by date and sequence
+func sortLogFiles(files []string) {
+	sort.Slice(files, func(i, j int) bool {
+		dateI, seqI, _ := parseLogFileName(files[i])
+		dateJ, seqJ, _ := parseLogFileName(files[j])
+		if !dateI.Equal(dateJ) {
+			return dateI.Before(dateJ)
+		}
+		return seqI < seqJ
+	})
+}
+
+// Prune applies a retention policy to the chat log files
+func (l *Logger) Prune(retention RetentionConfig) ([]string, error) {
+	return l.PruneKind(logKindChat, retention)
+}
+
+// PruneKind applies a retention policy, deleting the oldest closed log files
+// of a kind that exceed it, and returns the deleted filenames. The live file
+// is never deleted.
+func (l *Logger) PruneKind(kind string, retention RetentionConfig) ([]string, error) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	files, err := l.logFiles(kind)
+	if err != nil {
+		return nil, err
+	}
+	sortLogFiles(files)
+
+	// MaxFiles counts rotation periods: a period split by size counts once
+	periodFiles := make(map[string]int)
 	for _, file := range files {
-		info, err := os.Stat(file)
+		periodFiles[logFileNamePattern.FindStringSubmatch(file)[2]]++
+	}
+
+	sizes := make(map[string]int64, len(files))
+	var totalBytes int64
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(l.dir, file))
 		if err != nil {
 			log.Printf("Error getting file info for %s: %v", file, err)
 			continue
 		}
-		fileInfos[file] = info
+		sizes[file] = info.Size()
+		totalBytes += info.Size()
 	}
 
-	// Sort files by modification time
-	filesToDelete := len(files) - maxLogFiles
-	for i := 0; i < filesToDelete; i++ {
-		var oldestFile string
-		var oldestTime time.Time
-		first := true
+	current := ""
+	if stream, ok := l.streams[kind]; ok {
+		current = filepath.Base(stream.path)
+	}
+	now := l.clock.Now()
+	cutoff := time.Date(now.Year(), now.Month(), now.Day()-retention.KeepDays, 0, 0, 0, 0, time.Local)
+	remaining := len(periodFiles)
+	deleted := make([]string, 0)
 
-		for file, info := range fileInfos {
-			if first || info.ModTime().Before(oldestTime) {
-				oldestFile = file
-				oldestTime = info.ModTime()
-				first = false
-			}
+	for _, file := range files {
+		if file == current {
+			continue
+		}
+
+		_, _, end, _ := logFilePeriod(file)
+		tooMany := retention.MaxFiles > 0 && remaining > retention.MaxFiles
+		tooOld := retention.KeepDays > 0 && !end.After(cutoff)
+		tooBig := retention.KeepBytes > 0 && totalBytes > retention.KeepBytes
+		if !tooMany && !tooOld && !tooBig {
+			continue
+		}
+
+		if err := removeFile(filepath.Join(l.dir, file)); err != nil {
+			log.Printf("Error deleting old log file %s: %v", file, err)
+			continue
 		}
+		log.Printf("Deleted old log file: %s", file)
+		l.usage.Remove(file)
+		l.meta.Remove(file)
+		l.removeLogSidecars(file)
+
+		deleted = append(deleted, file)
+		label := logFileNamePattern.FindStringSubmatch(file)[2]
+		if periodFiles[label]--; periodFiles[label] == 0 {
+			remaining--
+		}
+		totalBytes -= sizes[file]
+	}
+
+	return deleted, nil
+}
+
+// LogMessages logs messages to the current log files of their kinds,
+// returning the first error
+func (l *Logger) LogMessages(msgs []Message) error {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
 
-		if oldestFile != "" {
-			os.Remove(oldestFile)
-			delete(fileInfos, oldestFile)
-			log.Printf("Deleted old log file: %s", oldestFile)
+	var firstErr error
+	for _, msg := range msgs {
+		if err := l.writeLine(l.routeKind(msg.Type), formatLogEntry(msg)); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
+	return firstErr
 }
 
-// LogMessage logs a message to the current log file
-func (l *Logger) LogMessage(msg Message) error {
+// WriteLine appends a preformatted line to the current log file of a kind
+func (l *Logger) WriteLine(kind, line string) error {
 	l.logMutex.Lock()
 	defer l.logMutex.Unlock()
 
+	return l.writeLine(kind, line)
+}
+
+// writeLine appends a line to the log file of a kind, rotating it first if
+// it is full or from an earlier day; the caller must hold logMutex
+func (l *Logger) writeLine(kind, line string) error {
+	if l.closed {
+		return fmt.Errorf("logger is closed")
+	}
+	if !l.heldSince.IsZero() || !writable() {
+		return nil
+	}
+	if !l.pausedSince.IsZero() {
+		l.droppedLines++
+		return nil
+	}
+
+	stream, err := l.stream(kind)
+	if err != nil {
+		return newLogWriteError(err)
+	}
+
+	// A failed reopen leaves no file; try again
+	rotated := false
+	if stream.file == nil {
+		if err := l.rotateLogFile(stream, false); err != nil {
+			return newLogWriteError(err)
+		}
+		rotated = true
+	}
+
 	// Check if we need to rotate the log file based on size
-	info, err := os.Stat(l.logFilePath)
+	info, err := os.Stat(stream.path)
 	if err == nil && info.Size() > maxLogFileSize {
-		if err := l.rotateLogFile(); err != nil {
-			return err
+		if err := l.rotateLogFile(stream, false); err != nil {
+			return newLogWriteError(err)
 		}
+		rotated = true
 	}
 
-	// Check if we need to rotate based on date
-	currentDate := time.Now().Format(logDateFormat)
-	if !strings.Contains(l.logFilePath, currentDate) {
-		if err := l.rotateLogFile(); err != nil {
-			return err
+	// Check if we need to rotate based on the period
+	if stream.label != l.currentLabel(l.clock.Now()) {
+		if err := l.rotateLogFile(stream, false); err != nil {
+			return newLogWriteError(err)
 		}
+		rotated = true
 	}
 
-	// Format and write the log entry
-	timestamp := msg.Timestamp.Format("2006-01-02 15:04:05")
-	logEntry := fmt.Sprintf("[%s] %s: %s\n", timestamp, msg.Username, msg.Content)
+	// A new chat log starts with the sampling rate, so each file can be
+	// read on its own
+	if rotated && kind == logKindChat && l.samplingRate > 1 {
+		line = samplingMarker(l.samplingRate, l.clock.Now()) + line
+	}
 
-	if _, err := l.currentLogFile.WriteString(logEntry); err != nil {
-		return fmt.Errorf("failed to write to log file: %w", err)
+	data := line
+	if l.encryptionKey != nil {
+		data = string(sealChunk(l.encryptionKey, line))
+	}
+	n, err := l.writeFile(stream.file, data)
+	l.usage.Add(filepath.Base(stream.path), int64(n))
+	if err != nil {
+		// Don't wait for the disk monitor to notice a full disk
+		if errors.Is(err, syscall.ENOSPC) {
+			log.Printf("Disk full, pausing log files")
+			l.pause(l.clock.Now())
+			l.droppedLines++
+		}
+		return newLogWriteError(fmt.Errorf("failed to write to log file: %w", err))
+	}
+	if err := l.extendChain(stream, data); err != nil {
+		log.Printf("Error extending hash chain of %s: %v", filepath.Base(stream.path), err)
 	}
 
 	return nil
 }
 
-// GetAvailableLogs returns a list of available log files
-func (l *Logger) GetAvailableLogs() ([]string, error) {
-	files, err := filepath.Glob(filepath.Join(logsDir, "chat-*.log"))
+// formatLogEntry formats a message as a log file line; the sequence number
+// is written after the timestamp as #N, then the type of non-chat messages
+// as (type), tags, when present, as <tag1,tag2>, and the rank as a symbol
+// before the username
+func formatLogEntry(msg Message) string {
+	prefix := "[" + msg.Timestamp.Format(logTimeFormat) + "] "
+	if msg.Seq > 0 {
+		prefix += fmt.Sprintf("#%d ", msg.Seq)
+	}
+	if kind := msg.Kind(); kind != messageTypeChat {
+		prefix += "(" + kind + ") "
+	}
+	if len(msg.Tags) > 0 {
+		prefix += "<" + strings.Join(msg.Tags, ",") + "> "
+	}
+	return fmt.Sprintf("%s%s%s: %s\n", prefix, rankPrefix(msg.Rank), msg.Username, msg.Content)
+}
+
+// logLinePattern matches a log line like:
+// [2025-04-16 15:04:05] #42 (action) <tag1,tag2> @Username: Message content
+// Lines written before sequence numbers and types were added have no #N or
+// (type), and lines without a type are chat messages.
+var logLinePattern = regexp.MustCompile(`^\[(.*?)\] (?:#(\d+) )?(?:\(([a-z]+)\) )?(?:<([^>]*)> )?(.*?): (.*)$`)
+
+// parseLogEntry parses a log file line written by formatLogEntry
+func parseLogEntry(line string) (Message, bool) {
+	matches := logLinePattern.FindStringSubmatch(line)
+	if len(matches) != 7 {
+		return Message{}, false
+	}
+
+	timestamp, err := time.ParseInLocation(logTimeFormat, matches[1], time.Local)
+	if err != nil {
+		return Message{}, false
+	}
+
+	username, rank := parseRankPrefix(matches[5])
+	msg := Message{
+		Type:      matches[3],
+		Username:  username,
+		Rank:      rank,
+		Timestamp: timestamp,
+		Content:   matches[6],
+	}
+	if matches[2] != "" {
+		msg.Seq, _ = strconv.ParseUint(matches[2], 10, 64)
+	}
+	if matches[4] != "" {
+		msg.Tags = strings.Split(matches[4], ",")
+	}
+	msg.Late = isLateEntry(msg)
+	msg.Links = extractLinks(msg.Content)
+	return msg, true
+}
+
+// Close flushes and closes the current log files; later writes fail
+func (l *Logger) Close() error {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	// Sampling ends with the run; the next one records its own rate
+	if l.samplingRate > 1 {
+		l.writeLine(logKindChat, samplingMarker(1, l.clock.Now()))
+	}
+	l.closed = true
+
+	var firstErr error
+	for _, stream := range l.streams {
+		err := stream.file.Sync()
+		if closeErr := stream.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		stream.file = nil
+		if stream.chain != nil {
+			stream.chain.Close()
+			stream.chain = nil
+		}
+	}
+	return firstErr
+}
+
+// GetAvailableLogs returns the available log files grouped by kind
+func (l *Logger) GetAvailableLogs() (map[string][]string, error) {
+	files, err := filepath.Glob(filepath.Join(l.dir, "*-*.log"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to find log files: %w", err)
 	}
+	for _, pattern := range []string{"*-*.log" + encryptedSuffix, "*-*.log.gz", "*-*.log" + encryptedSuffix + ".gz"} {
+		matches, err := filepath.Glob(filepath.Join(l.dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find log files: %w", err)
+		}
+		files = append(files, matches...)
+	}
 
-	// Extract just the filenames without the path
-	logFiles := make([]string, len(files))
-	for i, file := range files {
-		logFiles[i] = filepath.Base(file)
+	// Group just the filenames without the path
+	logFiles := make(map[string][]string)
+	for _, file := range files {
+		name := filepath.Base(file)
+		kind := logFileKind(name)
+		if kind == "" {
+			continue
+		}
+		logFiles[kind] = append(logFiles[kind], name)
+	}
+	for _, names := range logFiles {
+		sortLogFiles(names)
 	}
 
 	return logFiles, nil
 }
 
-// GetLogContent returns the content of a specified log file
+// logFiles returns the available log files of a single kind
+func (l *Logger) logFiles(kind string) ([]string, error) {
+	logs, err := l.GetAvailableLogs()
+	if err != nil {
+		return nil, err
+	}
+	return logs[kind], nil
+}
+
+// LastSeq returns the highest message sequence number in the newest log
+// file of each kind, or 0 if the logs predate sequence numbers
+func (l *Logger) LastSeq() uint64 {
+	logs, err := l.GetAvailableLogs()
+	if err != nil {
+		log.Printf("Error listing logs for the message sequence: %v", err)
+		return 0
+	}
+
+	var last uint64
+	for kind, names := range logs {
+		if recordKinds[kind] {
+			continue
+		}
+
+		// The newest files may be empty, e.g. just opened at startup
+		for i := len(names) - 1; i >= 0; i-- {
+			content, err := l.GetLogContent(names[i])
+			if err != nil {
+				log.Printf("Error reading %s for the message sequence: %v", names[i], err)
+				break
+			}
+
+			found := false
+			for _, line := range strings.Split(content, "\n") {
+				if msg, ok := parseLogEntry(line); ok {
+					found = true
+					if msg.Seq > last {
+						last = msg.Seq
+					}
+				}
+			}
+			if found {
+				break
+			}
+		}
+	}
+	return last
+}
+
+// CurrentLogFile returns the name of the chat log file currently being written
+func (l *Logger) CurrentLogFile() string {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	stream, ok := l.streams[logKindChat]
+	if !ok {
+		return ""
+	}
+	return filepath.Base(stream.path)
+}
+
+// GetLogsInRange returns the chat log files covering the days within [from, to], oldest first
+func (l *Logger) GetLogsInRange(from, to time.Time) ([]string, error) {
+	return l.logsInRange(logKindChat, from, to)
+}
+
+// logsInRange returns the log files of a kind covering the days within [from, to], oldest first
+func (l *Logger) logsInRange(kind string, from, to time.Time) ([]string, error) {
+	logs, err := l.logFiles(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	inRange := make([]string, 0, len(logs))
+	for _, name := range logs {
+		if logFileInRange(name, from, to) {
+			inRange = append(inRange, name)
+		}
+	}
+	sortLogFiles(inRange)
+
+	return inRange, nil
+}
+
+// flattenLogs lists the log files of kind, or of every kind when kind is
+// empty, sorted by name
+func flattenLogs(logs map[string][]string, kind string) []string {
+	if kind != "" {
+		if names := logs[kind]; names != nil {
+			return names
+		}
+		return []string{}
+	}
+
+	all := make([]string, 0)
+	for _, names := range logs {
+		all = append(all, names...)
+	}
+	sort.Strings(all)
+	return all
+}
+
+// logFileDate extracts the start of the period from a log filename like
+// chat-2025-04-16.log
+func logFileDate(filename string) (time.Time, bool) {
+	date, _, ok := parseLogFileName(filename)
+	return date, ok
+}
+
+// logFilePeriod returns the rotation period of a log filename and the time
+// span it covers
+func logFilePeriod(filename string) (string, time.Time, time.Time, bool) {
+	matches := logFileNamePattern.FindStringSubmatch(filename)
+	if matches == nil {
+		return "", time.Time{}, time.Time{}, false
+	}
+	period, start, ok := parsePeriodLabel(matches[2])
+	if !ok {
+		return "", time.Time{}, time.Time{}, false
+	}
+	return period, start, nextRotation(period, start), true
+}
+
+// logFileInRange reports whether a log file covers any of the days within
+// [from, to]; zero bounds are open
+func logFileInRange(filename string, from, to time.Time) bool {
+	_, start, end, ok := logFilePeriod(filename)
+	if !ok {
+		return false
+	}
+	if !from.IsZero() && !end.After(from) {
+		return false
+	}
+	return to.IsZero() || start.Before(to.AddDate(0, 0, 1))
+}
+
+// GetLogContent returns the content of a specified log file; a file
+// compacted into a monthly rollup is read from the rollup
 func (l *Logger) GetLogContent(filename string) (string, error) {
 	// Validate the filename to ensure it's a log file
-	if !strings.HasPrefix(filename, "chat-") || !strings.HasSuffix(filename, ".log") {
-		return "", fmt.Errorf("invalid log filename")
+	filename, err := validateLogName(filename)
+	if err != nil {
+		return "", err
 	}
 
-	// Construct the full path with directory
-	filePath := filepath.Join(logsDir, filename)
+	content, err := l.readLogFile(filepath.Join(l.dir, filename))
+	if errors.Is(err, os.ErrNotExist) {
+		if rolled, rollErr := l.readRolledUp(filename); rollErr == nil {
+			return rolled, nil
+		}
+	}
+	return content, err
+}
+
+// readLogFile returns the decompressed and decrypted content of the log
+// file at path, which may be in the archive
+func (l *Logger) readLogFile(path string) (string, error) {
+	filename := filepath.Base(path)
 
 	// Read the file content
-	content, err := os.ReadFile(filePath)
+	content, err := os.ReadFile(path)
 	if err != nil {
 		return "", fmt.Errorf("failed to read log file: %w", err)
 	}
 
+	// Compressed logs are served decompressed
+	if strings.HasSuffix(filename, ".gz") {
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress log file: %w", err)
+		}
+		defer reader.Close()
+		if content, err = io.ReadAll(reader); err != nil {
+			return "", fmt.Errorf("failed to decompress log file: %w", err)
+		}
+	}
+
+	if isEncryptedLog(filename) {
+		l.logMutex.Lock()
+		key := l.encryptionKey
+		l.logMutex.Unlock()
+		return decryptLogContent(key, content)
+	}
+
 	return string(content), nil
 }
 
 // ChatServer manages chat state and connections
 type ChatServer struct {
-	clients     map[*websocket.Conn]bool
+	clients     map[*Client]bool
+	encodings   map[string]int
+	shards      []*fanoutShard
+	fanout      sync.WaitGroup
 	messages    []Message
-	broadcast   chan Message
-	register    chan *websocket.Conn
-	unregister  chan *websocket.Conn
-	cytubeConn  *websocket.Conn
+	seq         uint64
+	evictedSeq  uint64
+	bufferSince time.Time
+	lastStatus  *Message
+	backlog     *broadcastQueue
+	writer      *LogWriter
+	register    chan *Client
+	unregister  chan *Client
 	messagesMux sync.RWMutex
 	upgrader    websocket.Upgrader
+	config      *ConfigStore
 	logger      *Logger
+	filters     *FilterPipeline
+	flood       *FloodDetector
+	stats       *StatsCache
+	logInfo     *LogInfoCache
+	disk        diskState
+	writeHealth logWriteHealth
+	connections *ConnectionLimiter
+	emotes      *EmoteSet
+	presence    *PresenceTracker
+	viewers     *ViewerCounter
+	jobs        *Scheduler
+	aliases     *AliasMap
+	shares      *ShareStore
+	ingest      *IngestLedger
+	userlist    *UserList
+	media       *MediaTracker
+	motd        *MOTDHistory
+	notifier    *Notifier
+	upstream    upstreamState
+	sessions    map[string]*channelSession
+	sessionsMux sync.Mutex
+	retryDelay  time.Duration
+	sendLimiter sendLimiter
+	sampler     Sampler
+	loki        *LokiClient
+	previews    *PreviewCache
+	updates     *UpdateChecker
+	access      *AccessLog
+	raw         *RawRecorder
+	replay      rawReplay
+	restart     chan struct{}
+	clientInfo  chan chan []ClientInfo
+	kick        chan kickRequest
+	revoke      chan struct{}
+	nextID      uint64
+	quit        chan struct{}
+	done        chan struct{}
 }
 
 // NewChatServer creates a new chat server
-func NewChatServer(logger *Logger) *ChatServer {
-	return &ChatServer{
-		clients:    make(map[*websocket.Conn]bool),
-		messages:   make([]Message, 0, 100),
-		broadcast:  make(chan Message),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
-		logger:     logger,
+func NewChatServer(config *ConfigStore, logger *Logger, filters *FilterPipeline, presence *PresenceTracker, aliases *AliasMap, shares *ShareStore, ingest *IngestLedger, motd *MOTDHistory, access *AccessLog) *ChatServer {
+	s := &ChatServer{
+		clients:     make(map[*Client]bool),
+		encodings:   make(map[string]int),
+		shards:      newFanoutShards(config.Get().FanoutWorkers),
+		messages:    make([]Message, 0, recentMessageLimit),
+		backlog:     newBroadcastQueue(config.Get().BroadcastQueueSize),
+		writer:      NewLogWriter(config.Get().LogWriter),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		config:      config,
+		logger:      logger,
+		filters:     filters,
+		flood:       NewFloodDetector(config.Get().Flood),
+		stats:       NewStatsCache(logger),
+		logInfo:     NewLogInfoCache(logger),
+		emotes:      NewEmoteSet(),
+		presence:    presence,
+		aliases:     aliases,
+		shares:      shares,
+		ingest:      ingest,
+		userlist:    NewUserList(),
+		media:       NewMediaTracker(logger),
+		motd:        motd,
+		loki:        NewLokiClient(config.Get().Loki, config.Get().Channel),
+		access:      access,
+		previews:    NewPreviewCache(config),
+		updates:     NewUpdateChecker(),
+		raw:         NewRawRecorder(config.Get().Debug),
+		connections: NewConnectionLimiter(),
+		sessions:    make(map[string]*channelSession),
+		retryDelay:  reconnectDelay,
+		jobs:        NewScheduler(),
+		clientInfo:  make(chan chan []ClientInfo),
+		kick:        make(chan kickRequest),
+		revoke:      make(chan struct{}),
+		restart:     make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
+			Subprotocols:    []string{msgpackSubprotocol},
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all connections
 			},
 		},
 	}
+
+	// Continue the sequence from the logs; everything up to it is only on disk
+	s.seq = logger.LastSeq()
+	s.evictedSeq = s.seq
+	s.bufferSince = time.Now()
+
+	// Headless servers have nobody to notify
+	if !config.Get().Headless {
+		s.notifier = NewNotifier()
+	}
+
+	s.viewers = NewViewerCounter(viewerBroadcastInterval, s.publishViewers)
+	metrics.Gauge("cylog_viewers", "Connected WebSocket clients, not counting bots and bridges", func() float64 {
+		return float64(s.viewers.Count())
+	})
+
+	metrics.Gauge("cylog_broadcast_queue_length", "Messages waiting for delivery to WebSocket clients", func() float64 {
+		return float64(s.backlog.Len())
+	})
+
+	metrics.Gauge("cylog_log_queue_length", "Messages waiting to be written to the logs", func() float64 {
+		return float64(len(s.writer.queue))
+	})
+
+	metrics.Gauge("cylog_upstream_seconds_since_last_frame", "Seconds since the last frame from the Cytube connection", func() float64 {
+		return s.upstream.sinceLastFrame().Seconds()
+	})
+	return s
+}
+
+// Config returns the currently active configuration
+func (s *ChatServer) Config() *Config {
+	return s.config.Get()
+}
+
+// Run starts the chat server
+func (s *ChatServer) Run(ctx context.Context) {
+	// Start the server routines
+	go s.handleMessages(ctx)
+	go s.runLogWriter()
+	switch {
+	case s.replay.path != "":
+		go s.runReplayUpstream(ctx, s.replay.path, s.replay.speed)
+	case s.Config().Demo.Enabled:
+		go s.runDemoUpstream(ctx)
+	default:
+		go s.runUpstream(ctx)
+		s.resumeChannels()
+	}
+	go s.sweepFloods(ctx)
+	go s.presence.run(ctx)
+	go s.ingest.run(ctx)
+
+	// Periodic background jobs
+	s.jobs.Add("digest", every(func() time.Duration { return digestCheckInterval }), func() bool { return s.Config().Digest.Enabled }, s.generateMissedDigest)
+	s.jobs.Add("disk", every(func() time.Duration { return s.Config().Disk.CheckInterval() }), nil, s.newDiskCheck())
+	s.jobs.Add("previews", every(func() time.Duration { return previewCleanupInterval }), func() bool { return s.Config().Previews.Enabled && writable() }, s.previews.Cleanup)
+	s.jobs.Add("update_check", every(s.updates.nextCheck), func() bool { return updateCheckEnabled(s.Config()) }, s.updates.Check)
+	s.jobs.Add("compaction", at(rotationMonthly, compactionDelay), func() bool { return s.Config().Compaction.Enabled && writable() }, s.compactLogs)
+	s.jobs.Start(ctx)
+
+	go s.logger.runRotation(ctx)
+	if s.loki != nil {
+		go s.loki.run(ctx)
+	}
+	if s.notifier != nil {
+		go s.notifier.run(ctx)
+	}
+	go s.previews.run(ctx)
+}
+
+// sweepFloods periodically flushes flood bursts that have gone quiet
+func (s *ChatServer) sweepFloods(ctx context.Context) {
+	defer recoverPanic("flood sweeper")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, summary := range s.flood.Sweep(now) {
+				s.publishMessage(summary)
+			}
+		}
+	}
+}
+
+// runUpstream maintains the Cytube WebSocket connection, dialing, reading
+// until the connection fails and reconnecting after a delay until ctx is canceled
+func (s *ChatServer) runUpstream(ctx context.Context) {
+	defer recoverPanic("upstream")
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			s.publishStatus("reconnecting", fmt.Sprintf("Reconnecting to Cytube (attempt %d)", attempt), map[string]interface{}{"attempt": attempt})
+		}
+
+		conn, url, err := s.dialUpstream(ctx)
+		if err != nil {
+			log.Printf("Failed to connect to Cytube: %v", err)
+			s.upstream.setDisconnected(err)
+			if attempt == reconnectReportAttempts {
+				captureError("upstream", fmt.Errorf("%d reconnect attempts failed: %w", attempt, err))
+			}
+			if ctx.Err() == nil {
+				s.publishStatus("disconnected", "Failed to connect to Cytube: "+err.Error(), map[string]interface{}{"reason": err.Error()})
+			}
+		} else {
+			log.Printf("Connected to Cytube at %s", url)
+			s.upstream.setConnected(url, conn)
+			s.publishStatus("connected", "Connected to Cytube", map[string]interface{}{"url": url})
+			attempt = 0
+
+			err = s.readCytubeMessages(ctx, conn)
+			s.upstream.setDisconnected(err)
+			if ctx.Err() == nil {
+				reason := "connection closed"
+				if err != nil {
+					reason = err.Error()
+				}
+				s.publishStatus("disconnected", "Disconnected from Cytube: "+reason, map[string]interface{}{"reason": reason})
+			}
+		}
+
+		// Try to reconnect after a short delay
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.retryDelay):
+		}
+	}
+}
+
+// connectToCytube establishes a connection to a Cytube WebSocket URL
+func (s *ChatServer) connectToCytube(ctx context.Context, url string) (*websocket.Conn, error) {
+	cfg := s.Config().Upstream
+	dialer, err := cfg.dialer()
+	if err != nil {
+		return nil, err
+	}
+
+	header, cookiesExpired, err := cfg.requestHeader(url, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if cookiesExpired {
+		log.Printf("Warning: some cookies for %s have expired", url)
+	}
+	if len(header) > 0 {
+		log.Printf("Dialing %s with headers %v", url, redactHeader(header))
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		if cookiesExpired && resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, fmt.Errorf("%w: handshake rejected with %s", errCookiesExpired, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to Cytube WebSocket: %w", err)
+	}
+	return conn, nil
+}
+
+// readCytubeMessages reads messages from the Cytube WebSocket until the
+// connection fails or ctx is canceled, returning the read error
+func (s *ChatServer) readCytubeMessages(ctx context.Context, conn *websocket.Conn) error {
+	defer conn.Close()
+
+	// Close the connection on cancellation to unblock the pending read
+	readDone := make(chan struct{})
+	defer close(readDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-readDone:
+		}
+	}()
+	go s.pingUpstream(conn, readDone)
+
+	for {
+		// A connection that delivers nothing, not even pongs, is presumed dead
+		stallTimeout := s.Config().Upstream.StallTimeout()
+		conn.SetReadDeadline(time.Now().Add(stallTimeout))
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = fmt.Errorf("upstream stalled: no frames for %s", stallTimeout)
+			}
+			log.Printf("Error reading message from Cytube: %v", err)
+			return err
+		}
+
+		now := time.Now()
+		s.upstream.frameReceived(now)
+		s.raw.Record(rawInbound, data, now)
+		s.handleCytubeFrame(conn, data)
+	}
+}
+
+// ingestMessage runs a message through the filter pipeline and flood
+// detector, then logs and broadcasts it; dropped messages are neither logged
+// nor broadcast
+func (s *ChatServer) ingestMessage(msg Message) {
+	msg = normalizeMessage(msg, s.Config())
+	msg, keep := s.filters.Apply(msg)
+	if !keep {
+		return
+	}
+	msg = s.Config().MessageLimits.Apply(msg)
+	msg.HTML = sanitizeHTML(msg.HTML)
+	msg.Links = extractLinks(msg.Content)
+	msg.Previews = s.previews.Queue(msg.Links)
+	msg.Color = s.Config().UsernameColor(msg.Username)
+	msg.Mentions = s.Config().MentionMatcher().Find(msg)
+
+	keep, summary := s.flood.Check(msg, time.Now())
+	if summary != nil {
+		s.publishMessage(*summary)
+	}
+	if keep {
+		s.publishMessage(msg)
+	}
+}
+
+// publishStatus broadcasts a synthetic message describing an upstream
+// connection state change; it bypasses filters and flood detection
+func (s *ChatServer) publishStatus(state, content string, meta map[string]interface{}) {
+	if meta == nil {
+		meta = make(map[string]interface{})
+	}
+	meta["state"] = state
+
+	s.publishMessage(Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Type:      messageTypeStatus,
+		Username:  "System",
+		Timestamp: time.Now(),
+		Content:   content,
+		HTML:      html.EscapeString(content),
+		Tags:      []string{statusTag},
+		Meta:      meta,
+	})
+}
+
+// publishMessage queues a message for logging and broadcast
+func (s *ChatServer) publishMessage(msg Message) {
+	msg.Seq = atomic.AddUint64(&s.seq, 1)
+	s.writer.Enqueue(msg, s.quit)
+	s.notifier.Check(s.Config(), msg, time.Now())
+
+	s.broadcastMessage(msg)
+}
+
+// broadcastMessage queues a message for delivery to clients
+func (s *ChatServer) broadcastMessage(msg Message) {
+	s.backlog.Push(msg)
+}
+
+// handleMessages processes incoming messages and client registrations
+func (s *ChatServer) handleMessages(ctx context.Context) {
+	s.startFanout()
+	for !s.handleNext(ctx) {
+	}
+}
+
+// handleNext processes a single hub event, reporting whether the hub has shut
+// down. A panic while handling the event is logged and the hub keeps running.
+func (s *ChatServer) handleNext(ctx context.Context) (stopped bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic("hub", r)
+			stopped = ctx.Err() != nil
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		s.shutdown()
+		return true
+	case client := <-s.register:
+		s.nextID++
+		client.id = s.nextID
+		s.addClient(client, s.recentFrames(client))
+	case client := <-s.unregister:
+		s.removeClient(client)
+	case <-s.backlog.ready:
+		s.deliverQueued()
+	case reply := <-s.clientInfo:
+		reply <- s.listClients()
+	case req := <-s.kick:
+		req.result <- s.kickClient(req.id)
+	case <-s.revoke:
+		s.closeRevokedClients()
+	}
+	return false
+}
+
+// deliverMessage stores a message in the recent buffer and sends it to all clients
+func (s *ChatServer) deliverMessage(message Message) {
+	// Store the message; only the latest status is kept so connection churn
+	// doesn't push chat out of the buffer, and userlist and viewers events
+	// aren't kept
+	s.messagesMux.Lock()
+	if message.Type == messageTypeStatus {
+		s.lastStatus = &message
+	} else if message.Type != messageTypeUserlist && message.Type != messageTypeViewers {
+		// Keep only the most recent messages
+		if len(s.messages) >= recentMessageLimit {
+			if evicted := s.messages[0].Seq; evicted > s.evictedSeq {
+				s.evictedSeq = evicted
+			}
+			// The buffer now holds every message after the one dropped
+			if at := s.messages[0].Timestamp; at.After(s.bufferSince) {
+				s.bufferSince = at
+			}
+			s.messages = s.messages[1:]
+		}
+		if message.reorder {
+			s.messages = insertByTimestamp(s.messages, message)
+		} else {
+			s.messages = append(s.messages, message)
+		}
+	}
+	s.messagesMux.Unlock()
+
+	// Broadcast to all clients; clients that can't keep up are removed
+	s.fanoutMessage(message)
+}
+
+// shutdown stops accepting new clients, delivers any pending broadcasts, sends
+// a going-away close frame to every client and closes the chat logger
+func (s *ChatServer) shutdown() {
+	close(s.quit)
+
+	// Deliver messages that were queued before shutdown began
+	for _, message := range s.backlog.Close() {
+		s.deliverMessage(message)
+	}
+
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(clientCloseTimeout)
+	for client := range s.clients {
+		if err := client.conn.WriteControl(websocket.CloseMessage, closeFrame, deadline); err != nil {
+			log.Printf("Error sending close frame: %v", err)
+		}
+		s.removeClient(client)
+	}
+	s.stopFanout()
+
+	// Let the log writer drain its queue before closing the log files
+	<-s.writer.done
+	s.stopChannelSessions()
+	if err := s.logger.Close(); err != nil {
+		log.Printf("Error closing chat logger: %v", err)
+	}
+	if err := s.raw.Close(); err != nil {
+		log.Printf("Error closing raw frame recording: %v", err)
+	}
+
+	close(s.done)
+}
+
+// Done returns a channel that is closed once the server has finished shutting down
+func (s *ChatServer) Done() <-chan struct{} {
+	return s.done
+}
+
+// recentFrames returns the hello frame, recent messages, upstream state and
+// userlist to queue for a newly connected client. Clients that passed
+// ?history=N get the messages in a single backlog frame.
+func (s *ChatServer) recentFrames(client *Client) []interface{} {
+	s.messagesMux.RLock()
+	defer s.messagesMux.RUnlock()
+
+	var backlog []Message
+	for _, msg := range s.messages {
+		if !client.wants(msg) || (client.after > 0 && msg.Seq <= client.after) {
+			continue
+		}
+		backlog = append(backlog, msg)
+	}
+	limit := s.Config().WebSocket.HistoryLimit()
+	if client.history >= 0 && client.history < limit {
+		limit = client.history
+	}
+	if len(backlog) > limit {
+		backlog = backlog[len(backlog)-limit:]
+	}
+
+	hello := s.helloFrame(client)
+	hello.Backlog = len(backlog)
+	frames := []interface{}{hello}
+	if client.history >= 0 {
+		if len(backlog) > 0 {
+			frames = append(frames, BacklogFrame{Type: frameTypeBacklog, Messages: backlog})
+		}
+	} else {
+		for _, msg := range backlog {
+			frames = append(frames, msg)
+		}
+	}
+
+	// Let the client know the current upstream state
+	if s.lastStatus != nil && client.wants(*s.lastStatus) {
+		frames = append(frames, *s.lastStatus)
+	}
+
+	// And who is in the channel
+	if snapshot := s.userlistMessage("snapshot", nil); client.wants(snapshot) {
+		frames = append(frames, snapshot)
+	}
+	return frames
+}
+
+// handleWebSocket handles WebSocket connections from clients
+func (s *ChatServer) handleWebSocket(c *gin.Context) {
+	// Refuse clients over the limits before upgrading, so they cost no more
+	// than the request
+	ip := c.ClientIP()
+	limits := s.Config().WebSocket
+	if err := s.connections.Acquire(ip, limits.MaxClients, limits.MaxClientsPerIP); err != nil {
+		logf(c, "Refused WebSocket client %s: %v", ip, err)
+		c.Header("Retry-After", "30")
+		apiError(c, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.connections.Release(ip)
+		logf(c, "Error upgrading to WebSocket: %v", err)
+		return
+	}
+
+	// Clients ask for MessagePack frames via the subprotocol or ?encoding=msgpack
+	encoding := encodingJSON
+	if conn.Subprotocol() == msgpackSubprotocol || c.Query("encoding") == encodingMsgpack {
+		encoding = encodingMsgpack
+	}
+
+	// Clients may name the channel they want with ?channel=name; it must be
+	// one cylog is in
+	if channel := c.Query("channel"); channel != "" && channel != s.Config().Channel {
+		closeFrame := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unknown channel")
+		conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(clientCloseTimeout))
+		conn.Close()
+		s.connections.Release(ip)
+		return
+	}
+
+	// Clients may subscribe to some message types with ?types=chat,action
+	types, err := parseTypes(c.Query("types"))
+	if err != nil {
+		closeFrame := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+		conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(clientCloseTimeout))
+		conn.Close()
+		s.connections.Release(ip)
+		return
+	}
+
+	// Register the client, turning it away if the server is shutting down;
+	// the upgrade's request ID identifies the connection
+	client := newClient(conn, ip, encoding, requestID(c))
+	if types != nil {
+		client.types = types
+		client.filters["types"] = c.Query("types")
+	}
+	if c.Query("mentions_only") == "1" {
+		client.mentionsOnly = true
+		client.filters["mentions_only"] = "1"
+	}
+
+	// Reconnecting clients pass the last seq they saw with ?after=N
+	if value := c.Query("after"); value != "" {
+		after, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			closeFrame := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid after parameter")
+			conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(clientCloseTimeout))
+			conn.Close()
+			s.connections.Release(ip)
+			return
+		}
+		client.after = after
+	}
+
+	// Clients that want fewer replayed messages pass ?history=N and get them
+	// batched into one frame
+	if value := c.Query("history"); value != "" {
+		history, err := strconv.Atoi(value)
+		if err != nil || history < 0 {
+			closeFrame := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid history parameter")
+			conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(clientCloseTimeout))
+			conn.Close()
+			s.connections.Release(ip)
+			return
+		}
+		client.history = history
+	}
+
+	// Sessions are closed when their token is revoked
+	if token, ok := requestAuthToken(c); ok {
+		client.token = token
+	}
+	select {
+	case s.register <- client:
+	case <-s.quit:
+		closeFrame := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(clientCloseTimeout))
+		conn.Close()
+		s.connections.Release(ip)
+		return
+	}
+
+	if s.access != nil {
+		s.access.logWebSocket("connect", client)
+	}
+
+	go s.writePump(client)
+	go s.readPump(client)
+}
+
+// registerMessageRoutes registers the recent messages endpoint
+func registerMessageRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/messages", func(c *gin.Context) {
+		query, err := parseMessageQuery(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		chatServer.messagesMux.RLock()
+		defer chatServer.messagesMux.RUnlock()
+
+		c.JSON(http.StatusOK, renderMessages(c, query.filter(chatServer.messages)))
+	})
+}
+
+// logFileETag derives a validator from the size and modification time of a
+// log file, which change whenever it is written. Representations other than
+// the plain file get a tag of their own, so one never validates another.
+func logFileETag(stat os.FileInfo, representation string) string {
+	if representation == "" {
+		return fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size())
+	}
+	h := fnv.New64a()
+	h.Write([]byte(representation))
+	return fmt.Sprintf(`"%x-%x-%x"`, stat.ModTime().UnixNano(), stat.Size(), h.Sum64())
 }
 
-// Run starts the chat server
-func (s *ChatServer) Run(ctx context.Context) {
-	// Connect to Cytube WebSocket
-	err := s.connectToCytube()
-	if err != nil {
-		log.Printf("Failed to connect to Cytube: %v", err)
+// logRepresentation identifies what a log file request returns: empty for
+// the plain file, otherwise the query selecting the format and entries,
+// which the auth token doesn't change
+func logRepresentation(c *gin.Context) string {
+	if format := c.Query("format"); format != "json" && format != "ndjson" {
+		return ""
 	}
+	query := c.Request.URL.Query()
+	query.Del("token")
+	return query.Encode()
+}
 
-	// Start the server routines
-	go s.handleMessages(ctx)
+// logFileValidators sets the ETag and Last-Modified of the requested
+// representation of a log file, and reports whether the request's
+// validators match them
+func logFileValidators(c *gin.Context, stat os.FileInfo) bool {
+	etag := logFileETag(stat, logRepresentation(c))
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	return notModified(c, etag, stat.ModTime())
 }
 
-// connectToCytube establishes a connection to the Cytube WebSocket
-func (s *ChatServer) connectToCytube() error {
-	dialer := websocket.DefaultDialer
-	conn, _, err := dialer.Dial(webSocketURL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to connect to Cytube WebSocket: %w", err)
+// visibleLogs drops the PM logs from a listing unless the request may read
+// them
+func visibleLogs(c *gin.Context, logs map[string][]string) map[string][]string {
+	if !mayReadPrivateMessages(c) {
+		delete(logs, logKindPM)
 	}
-
-	s.cytubeConn = conn
-	go s.readCytubeMessages()
-	return nil
+	return logs
 }
 
-// readCytubeMessages reads messages from the Cytube WebSocket
-func (s *ChatServer) readCytubeMessages() {
-	defer s.cytubeConn.Close()
+// refusePrivateLog responds with 403 and returns true if filename is a PM
+// log the request may not read
+func refusePrivateLog(c *gin.Context, filename string) bool {
+	if logFileKind(filename) != logKindPM || mayReadPrivateMessages(c) {
+		return false
+	}
+	apiError(c, http.StatusForbidden, "PM logs need a token with the admin scope")
+	return true
+}
 
-	for {
-		_, data, err := s.cytubeConn.ReadMessage()
+// registerLogRoutes registers the log file listing, metadata and content
+// endpoints; PM logs are only listed and served to admins
+func registerLogRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/logs", func(c *gin.Context) {
+		logs, err := chatServer.logger.GetAvailableLogs()
 		if err != nil {
-			log.Printf("Error reading message from Cytube: %v", err)
-			// Try to reconnect after a short delay
-			time.Sleep(5 * time.Second)
-			err = s.connectToCytube()
+			respondError(c, err)
+			return
+		}
+		logs = visibleLogs(c, logs)
+
+		// Describe each file on request, newest first
+		if c.Query("detail") == "1" {
+			from, to, err := parseDateRange(c)
+			if err != nil {
+				apiError(c, http.StatusBadRequest, err.Error())
+				return
+			}
+			infos, err := chatServer.logInfo.List(c.Query("kind"), from, to)
 			if err != nil {
-				log.Printf("Failed to reconnect to Cytube: %v", err)
+				respondError(c, err)
+				return
+			}
+			if !mayReadPrivateMessages(c) {
+				infos = slices.DeleteFunc(infos, func(info LogFileInfo) bool { return info.Kind == logKindPM })
 			}
+			c.JSON(http.StatusOK, infos)
 			return
 		}
 
-		// Parse and handle the message
-		// Note: The actual parsing would depend on the Cytube message format
-		// This is a simplified example
-		msg := Message{
-			ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
-			Username:  "User", // Extract from message
-			Timestamp: time.Now(),
-			Content:   string(data),
-			HTML:      string(data), // Assuming HTML content is provided
+		// Group by kind on request, otherwise list files of one or all kinds
+		if c.Query("group") == "kind" {
+			c.JSON(http.StatusOK, logs)
+			return
 		}
+		c.JSON(http.StatusOK, flattenLogs(logs, c.Query("kind")))
+	})
 
-		// Log the message to file
-		if err := s.logger.LogMessage(msg); err != nil {
-			log.Printf("Error logging message: %v", err)
+	// Counts and timestamps of a file, without downloading it
+	api.GET("/logs/:filename/meta", func(c *gin.Context) {
+		filename, err := validateLogName(c.Param("filename"))
+		if err != nil {
+			logFileError(c, err)
+			return
 		}
-
-		s.broadcast <- msg
-	}
-}
-
-// handleMessages processes incoming messages and client registrations
-func (s *ChatServer) handleMessages(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
+		if refusePrivateLog(c, filename) {
 			return
-		case client := <-s.register:
-			s.clients[client] = true
-			s.sendRecentMessages(client)
-		case client := <-s.unregister:
-			if _, ok := s.clients[client]; ok {
-				delete(s.clients, client)
-				client.Close()
-			}
-		case message := <-s.broadcast:
-			// Store the message
-			s.messagesMux.Lock()
-			// Keep only the most recent 100 messages
-			if len(s.messages) >= 100 {
-				s.messages = s.messages[1:]
-			}
-			s.messages = append(s.messages, message)
-			s.messagesMux.Unlock()
+		}
+		info, err := chatServer.logInfo.Info(filename)
+		if err != nil {
+			logFileError(c, err)
+			return
+		}
+		if err := chatServer.logger.meta.Save(); err != nil {
+			log.Printf("Error saving log metadata: %v", err)
+		}
+		c.JSON(http.StatusOK, info)
+	})
 
-			// Broadcast to all clients
-			for client := range s.clients {
-				err := client.WriteJSON(message)
-				if err != nil {
-					log.Printf("Error broadcasting message: %v", err)
-					client.Close()
-					delete(s.clients, client)
-				}
+	// The size and validators of a file, for clients to check it changed
+	api.HEAD("/logs/:filename", func(c *gin.Context) {
+		filename := c.Param("filename")
+		if refusePrivateLog(c, filename) {
+			return
+		}
+		stat, err := chatServer.logger.StatLog(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			// A compacted file only lives on in its rollup, without validators
+			content, err := chatServer.logger.GetLogContent(filename)
+			if err != nil {
+				logFileError(c, err)
+				return
 			}
+			c.Header("Content-Length", strconv.Itoa(len(content)))
+			c.Status(http.StatusOK)
+			return
 		}
-	}
-}
-
-// sendRecentMessages sends recent messages to a newly connected client
-func (s *ChatServer) sendRecentMessages(client *websocket.Conn) {
-	s.messagesMux.RLock()
-	defer s.messagesMux.RUnlock()
-
-	for _, msg := range s.messages {
-		err := client.WriteJSON(msg)
 		if err != nil {
-			log.Printf("Error sending recent message: %v", err)
+			logFileError(c, err)
+			return
+		}
+		if logFileValidators(c, stat) {
+			c.Status(http.StatusNotModified)
 			return
 		}
-	}
-}
 
-// handleWebSocket handles WebSocket connections from clients
-func (s *ChatServer) handleWebSocket(c *gin.Context) {
-	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("Error upgrading to WebSocket: %v", err)
-		return
-	}
+		// Compressed and encrypted files are served decoded, so only their
+		// size on disk is known without reading them
+		c.Header("X-Log-Size", strconv.FormatInt(stat.Size(), 10))
+		if !strings.HasSuffix(stat.Name(), ".gz") && !isEncryptedLog(stat.Name()) {
+			c.Header("Content-Length", strconv.FormatInt(stat.Size(), 10))
+		}
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(http.StatusOK)
+	})
 
-	// Register the client
-	s.register <- conn
+	api.GET("/logs/:filename", func(c *gin.Context) {
+		filename := c.Param("filename")
+		if refusePrivateLog(c, filename) {
+			return
+		}
+		if stat, err := chatServer.logger.StatLog(filename); err == nil && logFileValidators(c, stat) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		content, err := chatServer.logger.GetLogContent(filename)
+		if err != nil {
+			logFileError(c, err)
+			return
+		}
 
-	// Read messages from the client
-	go func() {
-		defer func() {
-			s.unregister <- conn
-		}()
-		for {
-			var msg Message
-			err := conn.ReadJSON(&msg)
+		// Check if format=json or format=ndjson is requested
+		if format := c.Query("format"); format == "json" || format == "ndjson" {
+			query, err := parseLogEntryQuery(c)
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("WebSocket error: %v", err)
-				}
-				break
+				apiError(c, http.StatusBadRequest, err.Error())
+				return
 			}
 
-			// Log the message to file
-			if err := s.logger.LogMessage(msg); err != nil {
-				log.Printf("Error logging message: %v", err)
+			// Parsed entries are written as they are found
+			if err := streamLogEntries(c, content, query); err != nil {
+				logf(c, "Error streaming %s: %v", filename, err)
 			}
-
-			// Process the message if needed
-			// For now, we just echo it back
-			s.broadcast <- msg
+		} else {
+			// Return as plain text
+			c.String(http.StatusOK, content)
 		}
-	}()
+	})
 }
 
 // setupGinServer sets up the Gin server for web UI and API
@@ -394,8 +1778,25 @@ func setupGinServer(ctx context.Context, chatServer *ChatServer) *gin.Engine {
 	// Set Gin to release mode in production
 	gin.SetMode(gin.ReleaseMode)
 
-	// Create gin router
-	router := gin.Default()
+	// Create gin router; panics are recovered into JSON errors. Requests
+	// are logged by the access log, which redacts tokens, rather than Gin's
+	// logger printing every query string to stdout
+	router := gin.New()
+	router.Use(recoveryMiddleware())
+
+	// Client IPs come from X-Forwarded-For only when the peer is a trusted
+	// proxy; Gin trusts every peer unless told otherwise
+	if err := router.SetTrustedProxies(chatServer.Config().TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted_proxies: %v", err)
+	}
+	router.Use(httpsMiddleware(chatServer.Config().TrustedProxies))
+	if chatServer.access != nil {
+		router.Use(chatServer.access.middleware())
+	}
+
+	// Request IDs and error responses, inside the access log so it sees both
+	router.Use(apiMiddleware())
+	router.NoRoute(apiNotFound)
 
 	// Load HTML templates
 	router.LoadHTMLGlob("static/*.html")
@@ -406,150 +1807,147 @@ func setupGinServer(ctx context.Context, chatServer *ChatServer) *gin.Engine {
 	// Serve scripts directory
 	router.Static("/scripts", "./scripts")
 
-	// API group for v1
-	api := router.Group("/api/v1")
+	// API group for v1; with require_tokens it needs the read scope
+	readScope := requireScope(chatServer.config, scopeRead)
+	api := router.Group("/api/v1", readScope)
 	{
-		// Messages endpoints
-		api.GET("/messages", func(c *gin.Context) {
-			chatServer.messagesMux.RLock()
-			defer chatServer.messagesMux.RUnlock()
-
-			c.JSON(http.StatusOK, chatServer.messages)
-		})
-
-		// Logs endpoints
-		api.GET("/logs", func(c *gin.Context) {
-			logs, err := chatServer.logger.GetAvailableLogs()
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			c.JSON(http.StatusOK, logs)
-		})
-
-		api.GET("/logs/:filename", func(c *gin.Context) {
-			filename := c.Param("filename")
-			content, err := chatServer.logger.GetLogContent(filename)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-
-			// Check if format=json is requested
-			if c.Query("format") == "json" {
-				// Parse log content into JSON array
-				lines := strings.Split(content, "\n")
-				logs := make([]map[string]string, 0)
-
-				for _, line := range lines {
-					if line == "" {
-						continue
-					}
-
-					// Parse line like: [2025-04-16 15:04:05] Username: Message content
-					re := regexp.MustCompile(`\[(.*?)\] (.*?): (.*)`)
-					matches := re.FindStringSubmatch(line)
-
-					if len(matches) == 4 {
-						logs = append(logs, map[string]string{
-							"timestamp": matches[1],
-							"username":  matches[2],
-							"content":   matches[3],
-						})
-					}
-				}
-
-				c.JSON(http.StatusOK, logs)
-			} else {
-				// Return as plain text
-				c.String(http.StatusOK, content)
-			}
-		})
+		// Messages and logs endpoints, also scoped to a channel
+		registerMessageRoutes(api, chatServer)
+		registerLogRoutes(api, chatServer)
+		registerChannelRoutes(api, chatServer)
+
+		// Log file management, with the admin token
+		registerLogAdminRoutes(api, chatServer)
+		registerVerifyRoutes(api, chatServer)
+
+		// Status endpoint
+		registerStatusRoutes(api, chatServer)
+
+		// Statistics endpoints
+		registerStatsRoutes(api, chatServer)
+		registerTermRoutes(api, chatServer)
+
+		// User presence and alias endpoints
+		registerAliasRoutes(api, chatServer)
+		registerUserExportRoutes(api, chatServer)
+		registerUserRoutes(api, chatServer)
+
+		registerUserlistRoutes(api, chatServer)
+		registerMOTDRoutes(api, chatServer)
+
+		// Media timeline and shared links endpoints
+		registerMediaRoutes(api, chatServer)
+		registerLinkRoutes(api, chatServer)
+		registerPreviewRoutes(api, chatServer)
+		registerMentionRoutes(api, chatServer)
+		registerDigestRoutes(api)
+		registerExportRoutes(api, chatServer)
+		registerSearchRoutes(api, chatServer)
+		registerTailRoutes(api, chatServer)
+
+		// Share links of log excerpts, managed with the admin token
+		registerShareRoutes(api, chatServer)
+
+		// Admin endpoints, outside the read scope so refused tokens are
+		// audited by requireAdmin
+		admin := router.Group("/api/v1/admin", requireAdmin(chatServer.config))
+		registerAdminRoutes(admin, chatServer)
+		registerCompactionRoutes(admin, chatServer)
+		registerJobRoutes(admin, chatServer)
+		registerAuditRoutes(admin)
+
+		// API description and docs page
+		registerOpenAPIRoutes(router, chatServer)
 	}
 
-	// Tampermonkey compatibility endpoints
-	api.GET("/tampermonkey/bridge.user.js", func(c *gin.Context) {
-		// Serve the Tampermonkey bridge script with the correct content type
-		c.File("scripts/cylog-tampermonkey-bridge.js")
-	})
+	// Tampermonkey bridge script and manifest
+	registerBridgeRoutes(router, chatServer)
+
+	// API v2: cursor-based message history
+	registerHistoryRoutes(router.Group("/api/v2", readScope), chatServer)
 
 	// Backwards compatibility for old API
-	router.GET("/api/messages", func(c *gin.Context) {
+	router.GET("/api/messages", readScope, func(c *gin.Context) {
 		chatServer.messagesMux.RLock()
 		defer chatServer.messagesMux.RUnlock()
 
-		c.JSON(http.StatusOK, chatServer.messages)
+		c.JSON(http.StatusOK, renderMessages(c, chatServer.messages))
 	})
 
+	// Prometheus metrics
+	router.GET("/metrics", readScope, metricsHandler)
+
+	// Diagnostics endpoints, unless they are served on their own port
+	if debug := chatServer.Config().Debug; debug.Enabled && debug.Listen == "" {
+		registerDebugRoutes(router.Group("/debug", requireAdmin(chatServer.config)), chatServer)
+	}
+
+	// Login page, and the pages behind it when it is configured
+	registerLoginRoutes(router, chatServer)
+	pageScope := requirePage(chatServer.config)
+
 	// Serve index page
-	router.GET("/", func(c *gin.Context) {
+	router.GET("/", pageScope, func(c *gin.Context) {
 		host := c.Request.Host
-		c.HTML(http.StatusOK, "index.html", gin.H{
+		page := gin.H{
 			"Host":                     host,
+			"History":                  chatServer.Config().WebSocket.HistoryLimit(),
 			"InjectTampermonkeyBridge": true,
-		})
+		}
+		if token, ok := requestAuthToken(c); ok && strings.HasPrefix(token.hash, sessionPrefix) {
+			page["User"] = token.name
+			page["CSRF"] = csrfToken(c)
+		}
+		c.HTML(http.StatusOK, "index.html", page)
 	})
 
-	// WebSocket endpoint
-	router.GET("/ws", chatServer.handleWebSocket)
+	// WebSocket endpoint; sending messages also needs the ingest scope
+	router.GET("/ws", requireScope(chatServer.config, scopeRead, scopeIngest), chatServer.handleWebSocket)
+
+	// Atom feed of recent messages and digests
+	registerFeedRoutes(router, chatServer)
+
+	// Queue cursors of the bridges sending batches
+	registerIngestRoutes(router, chatServer)
+
+	// Shared log excerpts, public to whoever has the link
+	registerSharedExcerptRoutes(router, chatServer)
 
 	// Add a logs page
-	router.GET("/logs", func(c *gin.Context) {
+	router.GET("/logs", pageScope, readScope, func(c *gin.Context) {
 		logs, err := chatServer.logger.GetAvailableLogs()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			respondError(c, err)
 			return
 		}
-		c.HTML(http.StatusOK, "logs.html", gin.H{
-			"Logs": logs,
-		})
+		logs = visibleLogs(c, logs)
+
+		kinds := make([]string, 0, len(logs))
+		for kind := range logs {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+
+		// Management buttons are only rendered for admins
+		role := requestRole(c)
+		page := gin.H{
+			"Logs":  flattenLogs(logs, c.Query("kind")),
+			"Kinds": kinds,
+			"Kind":  c.Query("kind"),
+			"Role":  role,
+		}
+		if updateCheckEnabled(chatServer.Config()) {
+			page["Update"] = chatServer.updates.Status()
+		}
+		if role == roleAdmin {
+			page["CSRF"] = csrfToken(c)
+		}
+		c.HTML(http.StatusOK, "logs.html", page)
 	})
 
 	return router
 }
 
-// openBrowser opens the URL in the default browser
-func openBrowser(url string) error {
-	var cmd string
-	var args []string
-
-	// Detect the OS and set the appropriate command
-	switch runtime.GOOS {
-	case "windows":
-		cmd = "cmd"
-		args = []string{"/c", "start", url}
-	case "darwin":
-		cmd = "open"
-		args = []string{url}
-	default: // "linux", "freebsd", "openbsd", "netbsd"
-		cmd = "xdg-open"
-		args = []string{url}
-	}
-
-	return exec.Command(cmd, args...).Start()
-}
-
-// launchDesktopApp launches the desktop application using either webview or the system browser
-func launchDesktopApp(url string) {
-	// First try to use webview
-	if webviewAvailable() {
-		go func() {
-			// Wait a moment for the server to start
-			time.Sleep(500 * time.Millisecond)
-
-			if err := startWebViewApp(url); err != nil {
-				log.Printf("Failed to start WebView app: %v, falling back to browser", err)
-				openBrowser(url)
-			}
-		}()
-		return
-	}
-
-	// Fall back to system browser
-	log.Println("WebView not available, opening in system browser")
-	openBrowser(url)
-}
-
 // webviewAvailable checks if the WebView library is available
 func webviewAvailable() bool {
 	// Try running a simple command to check if WebView can be initialized
@@ -605,22 +2003,35 @@ func main() {
 	return cmd.Start()
 }
 
-// setupLogger configures the application logging to both file and console
-func setupLogger() (*log.Logger, error) {
-	// Create logs directory if it doesn't exist
-	if err := os.MkdirAll(logsDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create logs directory: %w", err)
-	}
+// setupLogger configures the application logging to both file and console;
+// a dry run logs to the console only and returns a nil file
+func setupLogger(console bool) (*log.Logger, *rotatingWriter, error) {
+	var writers []io.Writer
+	var appLogFile *rotatingWriter
+	if writable() {
+		// Create logs directory if it doesn't exist
+		if err := makeDir(logsDir); err != nil {
+			return nil, nil, fmt.Errorf("failed to create logs directory: %w", err)
+		}
 
-	// Open app log file
-	appLogPath := filepath.Join(logsDir, "app.log")
-	appLogFile, err := os.OpenFile(appLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open app log file: %w", err)
+		// Open app log file, rotated by size like the chat logs
+		var err error
+		appLogFile, err = newRotatingWriter(filepath.Join(logsDir, appLogFileName), maxAppLogSize, maxAppLogFiles)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open app log file: %w", err)
+		}
+		writers = append(writers, appLogFile)
+	} else {
+		console = true
 	}
 
-	// Create a multi-writer to log to both file and console
-	multiWriter := io.MultiWriter(os.Stdout, appLogFile)
+	// Log to both file and console; recent lines are also kept as error
+	// report breadcrumbs
+	writers = append(writers, errorReporter)
+	if console {
+		writers = append(writers, os.Stdout)
+	}
+	multiWriter := io.MultiWriter(writers...)
 
 	// Create and configure the logger
 	logger := log.New(multiWriter, "", log.LstdFlags)
@@ -629,17 +2040,165 @@ func setupLogger() (*log.Logger, error) {
 	log.SetOutput(multiWriter)
 	log.SetFlags(log.LstdFlags)
 
-	return logger, nil
+	return logger, appLogFile, nil
+}
+
+// configureLogger applies the retention, routing, rotation, signing,
+// encryption and size settings of cfg to a chat logger
+func configureLogger(logger *Logger, cfg *Config) error {
+	logger.SetRetention(cfg.Retention, cfg.KindRetention)
+	logger.SetRoutes(cfg.LogRoutes)
+	logger.SetRotation(cfg.Rotation)
+	logger.SetSigningKey(cfg.Signing.Key)
+	if err := logger.SetEncryptionKey(cfg.EncryptionKey()); err != nil {
+		return fmt.Errorf("failed to enable log encryption: %w", err)
+	}
+	logger.SetSizeCap(cfg.Disk.MaxLogBytes)
+	return nil
+}
+
+// openChatServer opens the chat logs and the tables kept next to them and
+// creates the chat server for cfg, loaded from configPath; main and
+// end-to-end tests share it
+func openChatServer(configPath string, cfg *Config) (*ChatServer, error) {
+	chatLogger, err := NewLogger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize chat logger: %w", err)
+	}
+
+	if err := configureLogger(chatLogger, cfg); err != nil {
+		return nil, err
+	}
+
+	// Compile content filters
+	filters, err := NewFilterPipeline(cfg.Filters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile content filters: %w", err)
+	}
+
+	// Load the persisted presence table
+	presence, err := NewPresenceTracker(presencePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load presence table: %w", err)
+	}
+
+	// Load the username alias map
+	aliases, err := NewAliasMap(aliasesPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aliases: %w", err)
+	}
+
+	// Load the share links of log excerpts
+	shares, err := NewShareStore(sharesPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shares: %w", err)
+	}
+
+	// Load the UUIDs of recently batched messages
+	ingest, err := NewIngestLedger(ingestPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ingest ledger: %w", err)
+	}
+
+	// Load the channel MOTD history
+	motd, err := NewMOTDHistory(motdPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load MOTD history: %w", err)
+	}
+
+	// Open the HTTP access log
+	accessLog, err := NewAccessLog(cfg.AccessLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+
+	return NewChatServer(NewConfigStore(configPath, cfg), chatLogger, filters, presence, aliases, shares, ingest, motd, accessLog), nil
 }
 
 func main() {
+	// Subcommands run without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerifyCommand())
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		os.Exit(runCompactCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestoreCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		os.Exit(runTokenCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "password" {
+		os.Exit(runPasswordCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		os.Exit(runServiceCommand(os.Args[2:]))
+	}
+
+	// Services keep their files next to the executable and may have no console
+	service := hasArg("--service")
+	if service {
+		if err := enterServiceDir(); err != nil {
+			log.Fatalf("Failed to enter service directory: %v", err)
+		}
+	}
+
+	// A dry run writes nothing; every write path checks writable()
+	dryRun.Store(hasArg("--dry-run"))
+
 	// Setup application logging
-	appLogger, err := setupLogger()
+	appLogger, appLogFile, err := setupLogger(!service || serviceConsole)
 	if err != nil {
 		log.Fatalf("Failed to setup logger: %v", err)
 	}
 
 	appLogger.Println("Starting Cylog application")
+	if !writable() {
+		appLogger.Println("Dry run: nothing is written to disk or sent to Loki and digest webhooks")
+	}
+
+	// On a first run from a terminal, ask for the basics
+	if shouldRunSetup(configPath()) {
+		if err := runSetup(configPath()); err != nil {
+			appLogger.Printf("Setup skipped, starting with defaults: %v", err)
+		}
+	}
+
+	// Load configuration
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		appLogger.Fatalf("Failed to load config: %v", err)
+	}
+	if hasArg("--demo") {
+		cfg.Demo.Enabled = true
+	}
+	if open, ok := argValue("--open"); ok {
+		cfg.Desktop.Open = open
+	}
+	if command, ok := argValue("--browser-cmd"); ok {
+		cfg.Desktop.BrowserCommand = command
+	}
+	if err := cfg.Desktop.validate(); err != nil {
+		appLogger.Fatalf("Invalid --open or --browser-cmd: %v", err)
+	}
+	// A channel joined or left through the admin API overrides the config file
+	if record, err := loadChannelRecord(); err != nil {
+		appLogger.Printf("Warning: %v", err)
+	} else if record != nil {
+		cfg.Channel = record.Name
+		cfg.ChannelPassword = record.Password
+	}
+	if service {
+		cfg.Headless = true
+	}
+	if err := errorReporter.Configure(cfg.ErrorReporting); err != nil {
+		appLogger.Fatalf("Failed to configure error reporting: %v", err)
+	}
+	replay, err := parseReplayArgs(os.Args[1:])
+	if err != nil {
+		appLogger.Fatalf("Invalid replay-raw arguments: %v", err)
+	}
 
 	// Create context that will be canceled on SIGINT or SIGTERM
 	ctx, cancel := context.WithCancel(context.Background())
@@ -654,41 +2213,108 @@ func main() {
 		cancel()
 	}()
 
-	// Initialize chat logger
-	chatLogger, err := NewLogger()
-	if err != nil {
-		appLogger.Fatalf("Failed to initialize chat logger: %v", err)
+	// Stop requests from the service manager take the same path
+	var status serviceStatus = noService{}
+	if service {
+		if status, err = startService(cancel); err != nil {
+			appLogger.Fatalf("Failed to start service: %v", err)
+		}
 	}
 
-	// Create and start the chat server
-	chatServer := NewChatServer(chatLogger)
+	// Open the logs and tables and create the chat server
+	chatServer, err := openChatServer(configPath(), cfg)
+	if err != nil {
+		appLogger.Fatalf("Failed to start chat server: %v", err)
+	}
+	chatServer.replay = replay
+
+	// Carry the message buffer over from the last shutdown
+	if cfg.StateMaxAgeMinutes > 0 {
+		if state, err := loadState(time.Duration(cfg.StateMaxAgeMinutes) * time.Minute); err != nil {
+			appLogger.Printf("Warning: ignoring state file: %v", err)
+		} else if state != nil {
+			chatServer.RestoreState(state)
+		}
+	}
+	if err := chatServer.RestoreLoggingPause(cfg.PersistLoggingPause); err != nil {
+		appLogger.Printf("Warning: ignoring logging pause file: %v", err)
+	}
 	chatServer.Run(ctx)
 
+	// Restart on SIGUSR2 or an admin request, once the server has stopped
+	var restarting atomic.Bool
+	restartSignals := make(chan os.Signal, 1)
+	notifyRestart(restartSignals)
+	go func() {
+		select {
+		case <-restartSignals:
+		case <-chatServer.RestartRequested():
+		case <-ctx.Done():
+			return
+		}
+		appLogger.Println("Restarting")
+		restarting.Store(true)
+		cancel()
+	}()
+
 	// Setup Gin server
 	router := setupGinServer(ctx, chatServer)
+	if cfg.Debug.Enabled && cfg.Debug.Listen != "" {
+		if err := startDebugServer(ctx, chatServer); err != nil {
+			appLogger.Fatalf("Failed to start debug server: %v", err)
+		}
+	}
 
-	// Create HTTP server
+	// Create HTTP server, on the listener of the process that restarted into
+	// this one if there was one
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", appPort),
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
 		Handler: router,
 	}
+	listener, err := listen(cfg.Port)
+	if err != nil {
+		appLogger.Fatalf("Failed to listen: %v", err)
+	}
 
 	// Start the HTTP server in a goroutine
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			appLogger.Fatalf("HTTP server error: %v", err)
 		}
 	}()
 
-	appLogger.Printf("Server started at http://localhost:%d", appPort)
+	appLogger.Printf("Server started at http://localhost:%d", cfg.Port)
+	status.Ready()
+
+	// Reload the config file on SIGHUP
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range reloadSignals {
+			if _, err := chatServer.ReloadConfig(); err != nil {
+				appLogger.Printf("Config reload failed, keeping current config: %v", err)
+			}
+		}
+	}()
 
 	// Launch the desktop application
-	appURL := fmt.Sprintf("http://localhost:%d", appPort)
-	launchDesktopApp(appURL)
+	if !cfg.Headless {
+		appURL := fmt.Sprintf("http://localhost:%d", cfg.Port)
+		launchDesktopApp(cfg.Desktop, appURL)
+	}
 
 	// Wait for context cancellation
 	<-ctx.Done()
 	appLogger.Println("Shutting down server...")
+	status.Stopping()
+
+	// Keep the listening socket open for the restarted process
+	var inherited *os.File
+	if restarting.Load() {
+		if inherited, err = listenerFile(listener); err != nil {
+			appLogger.Printf("Restarting without handing over the listener: %v", err)
+		}
+	}
 
 	// Gracefully shutdown the HTTP server
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -697,5 +2323,38 @@ func main() {
 		appLogger.Printf("HTTP server shutdown error: %v", err)
 	}
 
+	// Wait for the chat server to close client connections and flush logs
+	select {
+	case <-chatServer.Done():
+	case <-time.After(hubShutdownTimeout):
+		appLogger.Println("Timed out waiting for chat server shutdown")
+	}
+
+	if chatServer.access != nil {
+		if err := chatServer.access.Close(); err != nil {
+			appLogger.Printf("Error closing access log: %v", err)
+		}
+	}
+
+	if err := chatServer.SaveState(); err != nil {
+		appLogger.Printf("Error saving state: %v", err)
+	}
+
 	appLogger.Println("Application shutdown complete")
+
+	// Stop writing to app.log so the final lines are flushed
+	log.SetOutput(os.Stdout)
+	if appLogFile != nil {
+		if err := appLogFile.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing app log: %v\n", err)
+		}
+	}
+	status.Stopped()
+
+	if restarting.Load() {
+		if err := restartProcess(inherited); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to restart: %v\n", err)
+			os.Exit(1)
+		}
+	}
 }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mediaFinishSlack is how early before its duration an item may end and
+// still count as finished rather than skipped
+const mediaFinishSlack = 5 * time.Second
+
+// Reasons a media item stopped playing
+const (
+	mediaFinished = "finished"
+	mediaSkipped  = "skipped"
+)
+
+// cytubeMedia is a media object as sent by Cytube in playlist and changeMedia events
+type cytubeMedia struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Seconds     int     `json:"seconds"`
+	Type        string  `json:"type"`
+	CurrentTime float64 `json:"currentTime"`
+}
+
+// cytubePlaylistItem is a playlist entry as sent by Cytube
+type cytubePlaylistItem struct {
+	Media   cytubeMedia `json:"media"`
+	UID     int         `json:"uid"`
+	QueueBy string      `json:"queueby"`
+}
+
+// cytubeQueue is the payload of a queue event
+type cytubeQueue struct {
+	Item cytubePlaylistItem `json:"item"`
+}
+
+// cytubeDelete is the payload of a delete event
+type cytubeDelete struct {
+	UID int `json:"uid"`
+}
+
+// MediaItem is one play of a media item in the channel's timeline
+type MediaItem struct {
+	UID       int        `json:"uid,omitempty"`
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	Title     string     `json:"title"`
+	Duration  int        `json:"duration"`
+	QueuedBy  string     `json:"queued_by,omitempty"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	EndReason string     `json:"end_reason,omitempty"`
+}
+
+// key identifies a play of an item across its start and end log records
+func (m MediaItem) key() string {
+	return fmt.Sprintf("%d/%s/%d", m.UID, m.ID, m.StartedAt.UnixMilli())
+}
+
+// MediaTracker follows what is playing and writes the media timeline to
+// media-<date>.log, one JSON record when an item starts and one when it ends
+type MediaTracker struct {
+	logger     *Logger
+	queuedBy   map[int]string
+	currentUID int
+	nowPlaying *MediaItem
+	mutex      sync.Mutex
+}
+
+// NewMediaTracker creates a media tracker, restoring what is playing from
+// the latest media log record
+func NewMediaTracker(logger *Logger) *MediaTracker {
+	tracker := &MediaTracker{
+		logger:   logger,
+		queuedBy: make(map[int]string),
+	}
+
+	files, err := logger.logFiles(logKindMedia)
+	if err != nil {
+		log.Printf("Error listing media logs: %v", err)
+		return tracker
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		items, err := tracker.readItems(files[i])
+		if err != nil {
+			log.Printf("Error reading %s: %v", files[i], err)
+			return tracker
+		}
+		if len(items) == 0 {
+			continue
+		}
+
+		if last := items[len(items)-1]; last.EndedAt == nil {
+			tracker.nowPlaying = &last
+			tracker.currentUID = last.UID
+		}
+		break
+	}
+
+	return tracker
+}
+
+// Playlist replaces the known playlist with a full playlist event
+func (m *MediaTracker) Playlist(items []cytubePlaylistItem) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.queuedBy = make(map[int]string, len(items))
+	for _, item := range items {
+		m.queuedBy[item.UID] = item.QueueBy
+	}
+}
+
+// Queue records who queued a newly added playlist item
+func (m *MediaTracker) Queue(item cytubePlaylistItem) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.queuedBy[item.UID] = item.QueueBy
+}
+
+// Delete forgets a removed playlist item
+func (m *MediaTracker) Delete(uid int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.queuedBy, uid)
+}
+
+// SetCurrent records the playlist item that the next changeMedia belongs to
+func (m *MediaTracker) SetCurrent(uid int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.currentUID = uid
+}
+
+// Change ends the playing item and starts a new one, which it returns.
+// Cytube repeats changeMedia for the playing item when we rejoin, which is
+// ignored and returns nil.
+func (m *MediaTracker) Change(media cytubeMedia, now time.Time) *MediaItem {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if current := m.nowPlaying; current != nil {
+		if current.UID == m.currentUID && current.ID == media.ID {
+			return nil
+		}
+
+		ended := now
+		current.EndedAt = &ended
+		current.EndReason = mediaSkipped
+		if current.Duration > 0 && now.Sub(current.StartedAt) >= time.Duration(current.Duration)*time.Second-mediaFinishSlack {
+			current.EndReason = mediaFinished
+		}
+		m.write(*current)
+	}
+
+	m.nowPlaying = &MediaItem{
+		UID:       m.currentUID,
+		ID:        media.ID,
+		Type:      media.Type,
+		Title:     media.Title,
+		Duration:  media.Seconds,
+		QueuedBy:  m.queuedBy[m.currentUID],
+		StartedAt: now.Add(-time.Duration(media.CurrentTime * float64(time.Second))),
+	}
+	m.write(*m.nowPlaying)
+	return m.nowPlaying
+}
+
+// write appends a timeline record to the media log
+func (m *MediaTracker) write(item MediaItem) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		log.Printf("Error encoding media record: %v", err)
+		return
+	}
+	if err := m.logger.WriteLine(logKindMedia, string(data)+"\n"); err != nil {
+		log.Printf("Error logging media record: %v", err)
+	}
+}
+
+// NowPlaying returns the item currently playing, if any
+func (m *MediaTracker) NowPlaying() (MediaItem, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.nowPlaying == nil {
+		return MediaItem{}, false
+	}
+	return *m.nowPlaying, true
+}
+
+// readItems reads the timeline records of a media log file, merging the
+// start and end records of each play
+func (m *MediaTracker) readItems(filename string) ([]MediaItem, error) {
+	content, err := m.logger.GetLogContent(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]MediaItem, 0)
+	index := make(map[string]int)
+	for _, line := range strings.Split(content, "\n") {
+		if line == "" {
+			continue
+		}
+		var item MediaItem
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			continue
+		}
+
+		if i, ok := index[item.key()]; ok {
+			items[i] = item
+			continue
+		}
+		index[item.key()] = len(items)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// History returns the media played on the dates within [from, to] in the
+// order it played
+func (m *MediaTracker) History(from, to time.Time) ([]MediaItem, error) {
+	files, err := m.logger.logsInRange(logKindMedia, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]MediaItem, 0)
+	index := make(map[string]int)
+	for _, file := range files {
+		fileItems, err := m.readItems(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// A play that spans midnight ends in the next day's file
+		for _, item := range fileItems {
+			if i, ok := index[item.key()]; ok {
+				items[i] = item
+				continue
+			}
+			index[item.key()] = len(items)
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// AttachMedia adds the item that was playing when each message was sent to
+// its meta as "media". msgs must be in time order; the two timelines are
+// merged in a single pass.
+func (m *MediaTracker) AttachMedia(msgs []Message) ([]Message, error) {
+	if len(msgs) == 0 {
+		return msgs, nil
+	}
+
+	// Start a day early for the item that was playing at the first message
+	first := msgs[0].Timestamp
+	from := time.Date(first.Year(), first.Month(), first.Day()-1, 0, 0, 0, 0, time.Local)
+	items, err := m.History(from, msgs[len(msgs)-1].Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	j := -1
+	for i, msg := range msgs {
+		for j+1 < len(items) && !items[j+1].StartedAt.After(msg.Timestamp) {
+			j++
+		}
+		if j < 0 {
+			continue
+		}
+		item := items[j]
+		if item.EndedAt != nil && !msg.Timestamp.Before(*item.EndedAt) {
+			continue
+		}
+
+		meta := make(map[string]interface{}, len(msg.Meta)+1)
+		for key, value := range msg.Meta {
+			meta[key] = value
+		}
+		meta["media"] = item
+		msgs[i].Meta = meta
+	}
+	return msgs, nil
+}
+
+// handleMediaEvent updates the media tracker from a Cytube playlist event
+func (s *ChatServer) handleMediaEvent(event cytubeEvent, now time.Time) {
+	switch event.Name {
+	case "playlist":
+		var items []cytubePlaylistItem
+		if err := json.Unmarshal(event.Data, &items); err != nil {
+			log.Printf("Error decoding playlist: %v", err)
+			return
+		}
+		s.media.Playlist(items)
+
+	case "queue":
+		var payload cytubeQueue
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			log.Printf("Error decoding queue: %v", err)
+			return
+		}
+		s.media.Queue(payload.Item)
+
+	case "delete":
+		var payload cytubeDelete
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			log.Printf("Error decoding delete: %v", err)
+			return
+		}
+		s.media.Delete(payload.UID)
+
+	case "setCurrent":
+		var uid int
+		if err := json.Unmarshal(event.Data, &uid); err != nil {
+			log.Printf("Error decoding setCurrent: %v", err)
+			return
+		}
+		s.media.SetCurrent(uid)
+
+	case "changeMedia":
+		var media cytubeMedia
+		if err := json.Unmarshal(event.Data, &media); err != nil {
+			log.Printf("Error decoding changeMedia: %v", err)
+			return
+		}
+		if item := s.media.Change(media, now); item != nil {
+			s.publishMedia(*item)
+		}
+	}
+}
+
+// publishMedia announces a newly playing item as a media message; it
+// bypasses filters and flood detection
+func (s *ChatServer) publishMedia(item MediaItem) {
+	content := "Now playing: " + item.Title
+	s.publishMessage(Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Type:      messageTypeMedia,
+		Username:  "System",
+		Timestamp: item.StartedAt,
+		Content:   content,
+		HTML:      html.EscapeString(content),
+		Meta:      map[string]interface{}{"media": item},
+	})
+}
+
+// registerMediaRoutes registers the media timeline endpoints
+func registerMediaRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/media/history", func(c *gin.Context) {
+		from, to, err := parseDateRange(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		items, err := chatServer.media.History(from, to)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, items)
+	})
+
+	api.GET("/now-playing", func(c *gin.Context) {
+		item, ok := chatServer.media.NowPlaying()
+		if !ok {
+			apiError(c, http.StatusNotFound, "nothing is playing")
+			return
+		}
+		c.JSON(http.StatusOK, item)
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MentionsConfig lists the names that count as mentioning the person running
+// cylog
+type MentionsConfig struct {
+	// Names are matched as whole words, case-insensitively, with or without a leading @
+	Names []string `yaml:"names"`
+
+	// Patterns are case-insensitive regular expressions for other forms of address
+	Patterns []string `yaml:"patterns"`
+}
+
+// mentionRule is a compiled name or pattern; label is what a match is
+// reported as in Message.Mentions
+type mentionRule struct {
+	label   string
+	pattern *regexp.Regexp
+}
+
+// mentionMatcher finds mentions of the configured names in message content
+type mentionMatcher struct {
+	rules []mentionRule
+	names map[string]bool
+}
+
+// compileMentions compiles the mention names and patterns
+func compileMentions(config MentionsConfig) (*mentionMatcher, error) {
+	matcher := &mentionMatcher{names: make(map[string]bool)}
+
+	for _, name := range config.Names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// Word boundaries are spelled out since \b only knows ASCII letters
+		pattern := regexp.MustCompile(`(?i)(?:^|[^\pL\pN_])(@?` + regexp.QuoteMeta(name) + `)(?:[^\pL\pN_]|$)`)
+		matcher.rules = append(matcher.rules, mentionRule{label: name, pattern: pattern})
+		matcher.names[normalizeUsername(name)] = true
+	}
+
+	for _, expr := range config.Patterns {
+		pattern, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mention pattern %q: %w", expr, err)
+		}
+		matcher.rules = append(matcher.rules, mentionRule{label: expr, pattern: pattern})
+	}
+
+	return matcher, nil
+}
+
+// Find returns the names and patterns mentioned in a message. Matches inside
+// URLs don't count, nor do messages sent under one of the names.
+func (m *mentionMatcher) Find(msg Message) []string {
+	if m == nil || len(m.rules) == 0 || m.names[normalizeUsername(msg.Username)] {
+		return nil
+	}
+
+	urls := linkPattern.FindAllStringIndex(msg.Content, -1)
+	var mentions []string
+	for _, rule := range m.rules {
+		for _, match := range rule.pattern.FindAllStringSubmatchIndex(msg.Content, -1) {
+			start, end := match[0], match[1]
+			// Names report the span of the name itself, without the boundaries
+			if len(match) >= 4 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+			if !insideSpans(urls, start, end) {
+				mentions = append(mentions, rule.label)
+				break
+			}
+		}
+	}
+	return mentions
+}
+
+// insideSpans reports whether [start, end) overlaps any of the spans
+func insideSpans(spans [][]int, start, end int) bool {
+	for _, span := range spans {
+		if start < span[1] && end > span[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// indexMention appends a mentioning message to mentions-<date>.log
+func (s *ChatServer) indexMention(msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding mention record: %v", err)
+		return
+	}
+	if err := s.logger.WriteLine(logKindMentions, string(data)+"\n"); err != nil {
+		log.Printf("Error indexing mention: %v", err)
+	}
+}
+
+// Mentions returns the mentioning messages on the dates within [from, to]
+// in the order they were sent
+func (s *ChatServer) Mentions(from, to time.Time) ([]Message, error) {
+	files, err := s.logger.logsInRange(logKindMentions, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]Message, 0)
+	for _, file := range files {
+		content, err := s.logger.GetLogContent(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(content, "\n") {
+			var msg Message
+			if line == "" || json.Unmarshal([]byte(line), &msg) != nil {
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// registerMentionRoutes registers the mentions feed endpoint
+func registerMentionRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/mentions", func(c *gin.Context) {
+		from, to, err := parseDateRange(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		msgs, err := chatServer.Mentions(from, to)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, msgs)
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// messageTimeFormat is the RFC3339 format, with milliseconds and UTC
+// offset, used for timestamps on every JSON surface
+const messageTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// messageJSON is the JSON contract of a Message, shared by the messages API,
+// parsed logs and WebSocket frames
+type messageJSON struct {
+	ID         string                 `json:"id"`
+	Seq        uint64                 `json:"seq,omitempty"`
+	Type       string                 `json:"type"`
+	Username   string                 `json:"username"`
+	Rank       int                    `json:"rank,omitempty"`
+	Timestamp  string                 `json:"timestamp"`
+	UnixMs     int64                  `json:"unix_ms"`
+	Content    string                 `json:"content"`
+	HTML       string                 `json:"html"`
+	Tags       []string               `json:"tags,omitempty"`
+	Links      []string               `json:"links,omitempty"`
+	Mentions   []string               `json:"mentions,omitempty"`
+	Meta       map[string]interface{} `json:"meta,omitempty"`
+	Color      string                 `json:"color,omitempty"`
+	Previews   []string               `json:"previews,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	Truncated  bool                   `json:"truncated,omitempty"`
+	RawContent string                 `json:"raw_content,omitempty"`
+	Late       bool                   `json:"late,omitempty"`
+}
+
+// MarshalJSON encodes the message with an RFC3339 timestamp and a unix_ms
+// field for JavaScript clients
+func (m Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(messageJSON{
+		ID:         m.ID,
+		Seq:        m.Seq,
+		Type:       m.Kind(),
+		Username:   m.Username,
+		Rank:       m.Rank,
+		Timestamp:  m.Timestamp.Format(messageTimeFormat),
+		UnixMs:     m.Timestamp.UnixMilli(),
+		Content:    m.Content,
+		HTML:       m.HTML,
+		Tags:       m.Tags,
+		Links:      m.Links,
+		Mentions:   m.Mentions,
+		Meta:       m.Meta,
+		Color:      m.Color,
+		Previews:   m.Previews,
+		Source:     m.Source,
+		Truncated:  m.Truncated,
+		RawContent: m.RawContent,
+		Late:       m.Late,
+	})
+}
+
+// messageTypes are the message types clients can select; an empty type is chat
+var messageTypes = map[string]bool{
+	messageTypeChat:         true,
+	messageTypeAction:       true,
+	messageTypeAnnouncement: true,
+	messageTypeSystem:       true,
+	messageTypePM:           true,
+	messageTypeMedia:        true,
+	messageTypeMod:          true,
+	messageTypeStatus:       true,
+	messageTypeUserlist:     true,
+	messageTypeViewers:      true,
+}
+
+// Kind returns the message's type, which is chat when none is set
+func (m Message) Kind() string {
+	if m.Type == "" {
+		return messageTypeChat
+	}
+	return m.Type
+}
+
+// parseTypes parses a comma-separated list of message types; an empty list
+// selects every type
+func parseTypes(value string) (map[string]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	types := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !messageTypes[name] {
+			return nil, fmt.Errorf("unknown message type %q", name)
+		}
+		types[name] = true
+	}
+	return types, nil
+}
+
+// messageQuery selects messages by sender rank and type, and optionally by
+// sender name, normalized unless usernameMatch says otherwise, and a
+// case-insensitive keyword in the content. PMs are left out unless
+// privateMessages is set
+type messageQuery struct {
+	minRank         int
+	types           map[string]bool
+	username        string
+	usernameMatch   usernameMatch
+	keyword         string
+	privateMessages bool
+}
+
+// parseMessageQuery parses the optional min_rank, type, user and exact
+// query parameters
+func parseMessageQuery(c *gin.Context) (messageQuery, error) {
+	minRank, err := parseMinRank(c)
+	if err != nil {
+		return messageQuery{}, err
+	}
+	types, err := parseTypes(c.Query("type"))
+	if err != nil {
+		return messageQuery{}, err
+	}
+	return messageQuery{minRank: minRank, types: types, username: c.Query("user"), usernameMatch: parseUsernameMatch(c, false), privateMessages: mayReadPrivateMessages(c)}, nil
+}
+
+// matches reports whether a message is selected by the query
+func (q messageQuery) matches(msg Message) bool {
+	if msg.Rank < q.minRank || (msg.Type == messageTypePM && !q.privateMessages) {
+		return false
+	}
+	if q.username != "" && !matchUsername(q.usernameMatch, q.username, msg.Username) {
+		return false
+	}
+	if q.keyword != "" && !strings.Contains(strings.ToLower(msg.Content), strings.ToLower(q.keyword)) {
+		return false
+	}
+	return q.types == nil || q.types[msg.Kind()]
+}
+
+// filter returns the messages selected by the query
+func (q messageQuery) filter(msgs []Message) []Message {
+	if q.minRank <= rankGuest && q.types == nil && q.username == "" && q.keyword == "" && q.privateMessages {
+		return msgs
+	}
+
+	filtered := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if q.matches(msg) {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
+// legacyMessage encodes like Message did before the timestamp contract was
+// standardized: Go's default time format and no unix_ms field
+type legacyMessage Message
+
+// legacyLogEntry is a parsed log line as the logs API returned it before the
+// timestamp contract was standardized
+type legacyLogEntry map[string]string
+
+// wantsLegacyTimestamps reports whether the request asked for the pre-RFC3339
+// output with ?ts=legacy; this compatibility mode will be removed in a later release
+func wantsLegacyTimestamps(c *gin.Context) bool {
+	return c.Query("ts") == "legacy"
+}
+
+// renderMessages returns msgs in the JSON form the request asked for
+func renderMessages(c *gin.Context, msgs []Message) interface{} {
+	if !wantsLegacyTimestamps(c) {
+		return msgs
+	}
+
+	legacy := make([]legacyMessage, len(msgs))
+	for i, msg := range msgs {
+		legacy[i] = legacyMessage(msg)
+	}
+	return legacy
+}
+
+// renderLogEntry returns a parsed log entry in the JSON form the request asked for
+func renderLogEntry(legacy bool, msg Message) interface{} {
+	if !legacy {
+		return msg
+	}
+
+	entry := legacyLogEntry{
+		"timestamp": msg.Timestamp.Format(logTimeFormat),
+		"username":  msg.Username,
+		"content":   msg.Content,
+	}
+	if len(msg.Tags) > 0 {
+		entry["tags"] = strings.Join(msg.Tags, ",")
+	}
+	return entry
+}
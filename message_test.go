@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contractMessages are a message with every field set, in a zone east of
+// UTC, and one with only the required fields
+var contractMessages = []Message{
+	{
+		ID: "1", Seq: 42, Type: messageTypeAction, Username: "alice", Rank: 2,
+		Timestamp: time.Date(2025, 4, 16, 20, 15, 0, 123000000, time.FixedZone("CEST", 2*60*60)),
+		Content:   "waves at @bob", HTML: "* alice waves at @bob", Tags: []string{"greeting"},
+		Links: []string{"https://example.com"}, Mentions: []string{"bob"}, Meta: map[string]interface{}{"emote": "wave"},
+		Color: "#de4369", Previews: []string{"https://example.com"}, Source: messageSourceLocal,
+		Truncated: true, RawContent: "waves  at @bob", Late: true,
+	},
+	{ID: "2", Username: "bob", Timestamp: time.Date(2025, 4, 16, 18, 15, 0, 0, time.UTC), Content: "hi", HTML: "hi"},
+}
+
+func TestMessageJSONContract(t *testing.T) {
+	tests := []struct {
+		name   string
+		render func(Message) interface{}
+		want   []string
+	}{
+		{
+			name:   "message",
+			render: func(msg Message) interface{} { return msg },
+			want: []string{
+				`{"id":"1","seq":42,"type":"action","username":"alice","rank":2,"timestamp":"2025-04-16T20:15:00.123+02:00","unix_ms":1744827300123,"content":"waves at @bob","html":"* alice waves at @bob","tags":["greeting"],"links":["https://example.com"],"mentions":["bob"],"meta":{"emote":"wave"},"color":"#de4369","previews":["https://example.com"],"source":"local","truncated":true,"raw_content":"waves  at @bob","late":true}`,
+				`{"id":"2","type":"chat","username":"bob","timestamp":"2025-04-16T18:15:00.000Z","unix_ms":1744827300000,"content":"hi","html":"hi"}`,
+			},
+		},
+		{
+			name:   "legacy message",
+			render: func(msg Message) interface{} { return legacyMessage(msg) },
+			want: []string{
+				`{"id":"1","seq":42,"type":"action","username":"alice","rank":2,"timestamp":"2025-04-16T20:15:00.123+02:00","content":"waves at @bob","html":"* alice waves at @bob","tags":["greeting"],"links":["https://example.com"],"mentions":["bob"],"meta":{"emote":"wave"},"color":"#de4369","previews":["https://example.com"],"source":"local","truncated":true,"raw_content":"waves  at @bob","late":true}`,
+				`{"id":"2","username":"bob","timestamp":"2025-04-16T18:15:00Z","content":"hi","html":"hi"}`,
+			},
+		},
+		{
+			name:   "log entry",
+			render: func(msg Message) interface{} { return renderLogEntry(false, msg) },
+			want: []string{
+				`{"id":"1","seq":42,"type":"action","username":"alice","rank":2,"timestamp":"2025-04-16T20:15:00.123+02:00","unix_ms":1744827300123,"content":"waves at @bob","html":"* alice waves at @bob","tags":["greeting"],"links":["https://example.com"],"mentions":["bob"],"meta":{"emote":"wave"},"color":"#de4369","previews":["https://example.com"],"source":"local","truncated":true,"raw_content":"waves  at @bob","late":true}`,
+				`{"id":"2","type":"chat","username":"bob","timestamp":"2025-04-16T18:15:00.000Z","unix_ms":1744827300000,"content":"hi","html":"hi"}`,
+			},
+		},
+		{
+			name:   "legacy log entry",
+			render: func(msg Message) interface{} { return renderLogEntry(true, msg) },
+			want: []string{
+				`{"content":"waves at @bob","tags":"greeting","timestamp":"2025-04-16 20:15:00","username":"alice"}`,
+				`{"content":"hi","timestamp":"2025-04-16 18:15:00","username":"bob"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, msg := range contractMessages {
+				got, err := json.Marshal(tt.render(msg))
+				if err != nil {
+					t.Fatalf("encoding message %s: %v", msg.ID, err)
+				}
+				if string(got) != tt.want[i] {
+					t.Errorf("message %s encodes as\n%s\nwant\n%s", msg.ID, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestMessageJSONCoversEveryField guards against a field added to Message
+// but not to messageJSON, which would silently leave it out of the API
+func TestMessageJSONCoversEveryField(t *testing.T) {
+	contract := make(map[string]bool)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(messageJSON{})) {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		contract[name] = true
+	}
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Message{})) {
+		if !field.IsExported() {
+			continue
+		}
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); !contract[name] {
+			t.Errorf("Message.%s (%q) is missing from messageJSON", field.Name, name)
+		}
+	}
+}
+
+func TestMessagesAPITimestamps(t *testing.T) {
+	chatServer, router := newTestServer(t, defaultConfig())
+	chatServer.messages = contractMessages[1:]
+
+	tests := map[string]string{
+		"/api/v1/messages":           `[{"id":"2","type":"chat","username":"bob","timestamp":"2025-04-16T18:15:00.000Z","unix_ms":1744827300000,"content":"hi","html":"hi"}]`,
+		"/api/v1/messages?ts=legacy": `[{"id":"2","username":"bob","timestamp":"2025-04-16T18:15:00Z","content":"hi","html":"hi"}]`,
+	}
+	for path, want := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s: status %d\n%s\nwant\n%s", path, w.Code, w.Body.String(), want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	value int64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// metric is a registered metric with its Prometheus metadata
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	counter *Counter
+	sample  func() float64
+}
+
+// MetricsRegistry holds the application's metrics
+type MetricsRegistry struct {
+	metrics map[string]*metric
+	mutex   sync.RWMutex
+}
+
+// metrics is the application-wide metrics registry
+var metrics = &MetricsRegistry{metrics: make(map[string]*metric)}
+
+// Counter registers (or returns the already registered) counter with the given name
+func (r *MetricsRegistry) Counter(name, help string) *Counter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if existing, ok := r.metrics[name]; ok && existing.counter != nil {
+		return existing.counter
+	}
+
+	counter := &Counter{}
+	r.metrics[name] = &metric{
+		name:    name,
+		help:    help,
+		kind:    "counter",
+		counter: counter,
+		sample:  func() float64 { return float64(counter.Value()) },
+	}
+	return counter
+}
+
+// Gauge registers a gauge whose value is sampled from fn at scrape time
+func (r *MetricsRegistry) Gauge(name, help string, fn func() float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics[name] = &metric{name: name, help: help, kind: "gauge", sample: fn}
+}
+
+// WritePrometheus renders all metrics in the Prometheus text exposition format
+func (r *MetricsRegistry) WritePrometheus(b *strings.Builder) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m := r.metrics[name]
+		fmt.Fprintf(b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.kind)
+		fmt.Fprintf(b, "%s %g\n", m.name, m.sample())
+	}
+}
+
+// metricsHandler serves the metrics registry in the Prometheus text format
+func metricsHandler(c *gin.Context) {
+	var b strings.Builder
+	metrics.WritePrometheus(&b)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// motdFileName is the file in the logs directory the MOTD history is persisted to
+const motdFileName = "motd.json"
+
+// maxMOTDHistory is how many MOTDs are kept, oldest dropped first
+const maxMOTDHistory = 50
+
+// MOTDEntry is a channel MOTD and when it was first seen
+type MOTDEntry struct {
+	HTML  string    `json:"html"`
+	Text  string    `json:"text"`
+	SetAt time.Time `json:"set_at"`
+}
+
+// MOTDHistory records each distinct MOTD the channel has had
+type MOTDHistory struct {
+	path    string
+	entries []MOTDEntry
+	mutex   sync.RWMutex
+}
+
+// NewMOTDHistory creates a MOTD history, loading the persisted entries if present
+func NewMOTDHistory(path string) (*MOTDHistory, error) {
+	history := &MOTDHistory{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return history, nil
+		}
+		return nil, fmt.Errorf("failed to read MOTD file: %w", err)
+	}
+	if err := json.Unmarshal(data, &history.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse MOTD file: %w", err)
+	}
+	return history, nil
+}
+
+// Set records a MOTD, returning the new entry, or nil when it is the same
+// as the current one; Cytube sends the MOTD again on every join
+func (m *MOTDHistory) Set(motdHTML string, now time.Time) (*MOTDEntry, error) {
+	motdHTML = sanitizeHTML(strings.TrimSpace(motdHTML))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.entries) > 0 && m.entries[len(m.entries)-1].HTML == motdHTML {
+		return nil, nil
+	}
+	if len(m.entries) == 0 && motdHTML == "" {
+		return nil, nil
+	}
+
+	entry := MOTDEntry{HTML: motdHTML, Text: strings.TrimSpace(htmlToText(motdHTML)), SetAt: now}
+	m.entries = append(m.entries, entry)
+	if len(m.entries) > maxMOTDHistory {
+		m.entries = m.entries[len(m.entries)-maxMOTDHistory:]
+	}
+	return &entry, m.save()
+}
+
+// save writes the history to disk; the caller must hold the lock
+func (m *MOTDHistory) save() error {
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode MOTD history: %w", err)
+	}
+
+	if err := writeFileAtomic(m.path, data); err != nil {
+		return fmt.Errorf("failed to write MOTD file: %w", err)
+	}
+	return nil
+}
+
+// Current returns the current MOTD, if any
+func (m *MOTDHistory) Current() (MOTDEntry, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if len(m.entries) == 0 {
+		return MOTDEntry{}, false
+	}
+	return m.entries[len(m.entries)-1], true
+}
+
+// Entries returns the recorded MOTDs, oldest first
+func (m *MOTDHistory) Entries() []MOTDEntry {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	entries := make([]MOTDEntry, len(m.entries))
+	copy(entries, m.entries)
+	return entries
+}
+
+// motdPath returns the location of the persisted MOTD history
+func motdPath() string {
+	return filepath.Join(logsDir, motdFileName)
+}
+
+// decodeMOTD reads a setMOTD payload: a plain HTML string, or an object
+// with motd and html fields from older Cytube versions
+func decodeMOTD(data json.RawMessage) (string, error) {
+	var motd string
+	if err := json.Unmarshal(data, &motd); err == nil {
+		return motd, nil
+	}
+
+	var payload struct {
+		MOTD string `json:"motd"`
+		HTML string `json:"html"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return "", err
+	}
+	if payload.HTML != "" {
+		return payload.HTML, nil
+	}
+	return payload.MOTD, nil
+}
+
+// handleMOTD records a setMOTD event and announces a change as a system message
+func (s *ChatServer) handleMOTD(data json.RawMessage, now time.Time) {
+	motd, err := decodeMOTD(data)
+	if err != nil {
+		log.Printf("Error decoding setMOTD: %v", err)
+		return
+	}
+
+	entry, err := s.motd.Set(motd, now)
+	if err != nil {
+		log.Printf("Error saving MOTD history: %v", err)
+	}
+	if entry == nil {
+		return
+	}
+
+	content := "MOTD changed: " + entry.Text
+	s.publishMessage(Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Type:      messageTypeSystem,
+		Username:  "System",
+		Timestamp: now,
+		Content:   content,
+		HTML:      html.EscapeString("MOTD changed: ") + entry.HTML,
+		Meta:      map[string]interface{}{"event": "motd"},
+	})
+}
+
+// registerMOTDRoutes registers the channel MOTD endpoints
+func registerMOTDRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/motd", func(c *gin.Context) {
+		entry, ok := chatServer.motd.Current()
+		if !ok {
+			apiError(c, http.StatusNotFound, "no MOTD recorded")
+			return
+		}
+		c.JSON(http.StatusOK, entry)
+	})
+
+	api.GET("/motd/history", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.motd.Entries())
+	})
+}
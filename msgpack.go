@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+// msgpackSubprotocol is the WebSocket subprotocol clients request to receive
+// MessagePack frames instead of JSON
+const msgpackSubprotocol = "cylog.msgpack.v1"
+
+// Client frame encodings
+const (
+	encodingJSON    = "json"
+	encodingMsgpack = "msgpack"
+)
+
+// msgpackHandle encodes frames with the current MessagePack spec and sorted
+// map keys so identical frames encode identically
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true, BasicHandle: codec.BasicHandle{EncodeOptions: codec.EncodeOptions{Canonical: true}}}
+
+// encodeMsgpack encodes a frame as MessagePack. The frame goes through its
+// JSON form first so msgpack clients see exactly the JSON field names and
+// value types, with timestamps as the same strings.
+func encodeMsgpack(frame interface{}) ([]byte, error) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	if err := codec.NewEncoderBytes(&out, msgpackHandle).Encode(normalizeJSONNumbers(generic)); err != nil {
+		return nil, fmt.Errorf("failed to encode msgpack: %w", err)
+	}
+	return out, nil
+}
+
+// normalizeJSONNumbers converts decoded JSON numbers to integers where they
+// are whole and to floats otherwise
+func normalizeJSONNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeJSONNumbers(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeJSONNumbers(item)
+		}
+		return v
+	default:
+		return value
+	}
+}
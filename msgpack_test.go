@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// decodeMsgpackHandle decodes MessagePack the way a client library would:
+// strings as strings, integers as int64 and maps keyed by string
+var decodeMsgpackHandle = &codec.MsgpackHandle{
+	BasicHandle: codec.BasicHandle{DecodeOptions: codec.DecodeOptions{
+		RawToString:   true,
+		SignedInteger: true,
+		MapType:       reflect.TypeOf(map[string]interface{}(nil)),
+	}},
+}
+
+func TestMsgpackMatchesJSON(t *testing.T) {
+	at := time.Date(2025, 4, 16, 20, 15, 0, 123000000, time.UTC)
+	frames := map[string]interface{}{
+		"message": Message{
+			ID: "1", Seq: 42, Type: messageTypeChat, Username: "alice", Rank: 2, Timestamp: at,
+			Content: "hi @bob https://example.com", HTML: "hi @bob", RawContent: "hi  @bob",
+			Links: []string{"https://example.com"}, Mentions: []string{"bob"}, Tags: []string{"greeting"},
+			Color: "#de4369", Truncated: true, Late: true, Source: messageSourceLocal,
+			Meta: map[string]interface{}{"to": "bob", "count": 3, "ratio": 0.5, "nested": map[string]interface{}{"ok": true}, "none": nil},
+		},
+		"minimal message": Message{ID: "2", Type: messageTypeSystem, Username: "System", Timestamp: at, Content: "Connected"},
+		"batch ack":       BatchedFrame{Type: frameTypeBatched, Source: "bridge", Accepted: 1, Rejected: 1, Items: []BatchResult{{UUID: "a", Status: batchAccepted}, {UUID: "b", Status: batchRejected, Error: "invalid message"}}},
+	}
+	for name, frame := range frames {
+		t.Run(name, func(t *testing.T) {
+			packed, err := encodeMsgpack(frame)
+			if err != nil {
+				t.Fatalf("encoding msgpack: %v", err)
+			}
+			var got interface{}
+			if err := codec.NewDecoderBytes(packed, decodeMsgpackHandle).Decode(&got); err != nil {
+				t.Fatalf("decoding msgpack: %v", err)
+			}
+
+			data, err := json.Marshal(frame)
+			if err != nil {
+				t.Fatalf("encoding JSON: %v", err)
+			}
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			var want interface{}
+			if err := decoder.Decode(&want); err != nil {
+				t.Fatalf("decoding JSON: %v", err)
+			}
+			want = normalizeJSONNumbers(want)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("msgpack decodes to\n%#v\nJSON to\n%#v", got, want)
+			}
+			if message, ok := frame.(Message); ok {
+				fields := got.(map[string]interface{})
+				if fields["timestamp"] != message.Timestamp.Format(time.RFC3339Nano) {
+					t.Errorf("timestamp = %#v, want the JSON string", fields["timestamp"])
+				}
+				if _, ok := fields["seq"].(int64); !ok && message.Seq != 0 {
+					t.Errorf("seq = %#v, want an integer", fields["seq"])
+				}
+			}
+		})
+	}
+}
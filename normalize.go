@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ansiEscapePattern matches terminal escape sequences: CSI sequences such as
+// colors and cursor moves, OSC sequences such as window titles, and
+// two-character escapes such as a terminal reset. They are removed whole, so
+// no "[31m" is left behind.
+var ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x{9b}[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)?|\x1b[0-~]`)
+
+// invisibleRunes are the bidi controls and zero-width characters removed by
+// strip_invisible; they can reorder or hide text, e.g. to spoof a username
+var invisibleRunes = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x061c, Hi: 0x061c, Stride: 1}, // arabic letter mark
+		{Lo: 0x180e, Hi: 0x180e, Stride: 1}, // mongolian vowel separator
+		{Lo: 0x200b, Hi: 0x200f, Stride: 1}, // zero-width space, joiners, LRM, RLM
+		{Lo: 0x202a, Hi: 0x202e, Stride: 1}, // bidi embeddings and overrides
+		{Lo: 0x2060, Hi: 0x2064, Stride: 1}, // word joiner, invisible operators
+		{Lo: 0x2066, Hi: 0x2069, Stride: 1}, // bidi isolates
+		{Lo: 0xfeff, Hi: 0xfeff, Stride: 1}, // zero-width no-break space
+	},
+}
+
+// normalizeContent makes message content safe to print: it removes terminal
+// escape sequences and control characters other than newline and tab,
+// optionally the invisible characters, and converts the rest to NFC
+func normalizeContent(s string, stripInvisible bool) string {
+	s = ansiEscapePattern.ReplaceAllString(s, "")
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case unicode.IsControl(r):
+			return -1
+		case stripInvisible && unicode.Is(invisibleRunes, r):
+			return -1
+		}
+		return r
+	}, s)
+	return norm.NFC.String(s)
+}
+
+// normalizeMessage normalizes a message's content. Its HTML is left to
+// sanitizeHTML, so it still renders as sent. With debug.keep_raw_content, a
+// changed content's original is kept in RawContent.
+func normalizeMessage(msg Message, cfg *Config) Message {
+	content := normalizeContent(msg.Content, cfg.StripInvisible)
+	if content == msg.Content {
+		return msg
+	}
+	if cfg.Debug.KeepRawContent {
+		msg.RawContent = msg.Content
+	}
+	msg.Content = content
+	return msg
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeContent(t *testing.T) {
+	tests := []struct {
+		name           string
+		in             string
+		stripInvisible bool
+		want           string
+	}{
+		{"plain text", "hello world", false, "hello world"},
+		{"newline and tab kept", "a\tb\nc", false, "a\tb\nc"},
+		{"ANSI color", "\x1b[31mred\x1b[0m text", false, "red text"},
+		{"ANSI cursor move", "a\x1b[2J\x1b[10;20Hb", false, "ab"},
+		{"C1 CSI color", "\u009b31mred", false, "red"},
+		{"OSC title with BEL", "\x1b]0;pwned\x07hi", false, "hi"},
+		{"OSC hyperlink with ST", "\x1b]8;;https://evil.test\x1b\\click\x1b]8;;\x1b\\", false, "click"},
+		{"unterminated OSC", "hi\x1b]0;pwned", false, "hi"},
+		{"terminal reset", "a\x1bcb", false, "ab"},
+		{"save cursor", "a\x1b7b", false, "ab"},
+		{"lone ESC", "a\x1b", false, "a"},
+		{"C0 controls", "a\x00b\x07c\rd\x7f", false, "abcd"},
+		{"C1 controls", "a\u0085b\u009fc", false, "abc"},
+		{"NUL only", "\x00\x00", false, ""},
+		{"RLO kept", "user\u202etxt.exe", false, "user\u202etxt.exe"},
+		{"RLO stripped", "user\u202etxt.exe", true, "usertxt.exe"},
+		{"bidi isolates stripped", "\u2066a\u2069", true, "a"},
+		{"ZWSP stripped", "ad\u200bmin", true, "admin"},
+		{"ZWJ stripped", "a\u200db", true, "ab"},
+		{"BOM stripped", "\ufeffhello", true, "hello"},
+		{"BOM kept", "\ufeffhello", false, "\ufeffhello"},
+		{"NFC composition", "e\u0301", false, "\u00e9"},
+		{"invalid UTF-8", "a\xffb\xc3", false, "a\ufffdb\ufffd"},
+		{"invalid UTF-8 in an escape", "\x1b[31\xffmx", false, "31\ufffdmx"},
+		{"emoji kept", "👍🏽 nice", true, "👍🏽 nice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeContent(tt.in, tt.stripInvisible)
+			if got != tt.want {
+				t.Errorf("normalizeContent(%q, %v) = %q, want %q", tt.in, tt.stripInvisible, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("normalizeContent(%q) = %q, not valid UTF-8", tt.in, got)
+			}
+			if again := normalizeContent(got, tt.stripInvisible); again != got {
+				t.Errorf("normalizing %q again = %q, not idempotent", got, again)
+			}
+		})
+	}
+}
+
+func TestNormalizeMessageKeepsRawContent(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debug.KeepRawContent = true
+
+	msg := normalizeMessage(Message{Content: "\x1b[1mbold"}, cfg)
+	if msg.Content != "bold" || msg.RawContent != "\x1b[1mbold" {
+		t.Errorf("content %q, raw %q; want the normalized content and the original", msg.Content, msg.RawContent)
+	}
+	if msg := normalizeMessage(Message{Content: "clean"}, cfg); msg.RawContent != "" {
+		t.Errorf("unchanged content kept raw %q", msg.RawContent)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification defaults
+const (
+	defaultNotifyInterval = 10 * time.Second
+	notifyBodyLength      = 120
+	notifyQueueSize       = 16
+)
+
+// NotifyConfig configures desktop notifications for mentions and tagged messages
+type NotifyConfig struct {
+	// Enabled shows a desktop notification when a message mentions you
+	Enabled bool `yaml:"enabled"`
+
+	// Tags also notify for messages tagged by these filter rules
+	Tags []string `yaml:"tags"`
+
+	// IntervalSeconds is the minimum gap between notifications; messages in
+	// between are counted into the next one
+	IntervalSeconds int `yaml:"interval_seconds"`
+
+	// QuietHours is a local time window like "23:00-07:00" without notifications
+	QuietHours string `yaml:"quiet_hours"`
+}
+
+// Interval returns the minimum gap between notifications
+func (c NotifyConfig) Interval() time.Duration {
+	if c.IntervalSeconds <= 0 {
+		return defaultNotifyInterval
+	}
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+// parseQuietHours parses a "HH:MM-HH:MM" window into minutes after midnight
+func parseQuietHours(value string) (int, int, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid quiet_hours %q: expected HH:MM-HH:MM", value)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid quiet_hours %q: %w", value, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid quiet_hours %q: %w", value, err)
+	}
+	return start, end, nil
+}
+
+// parseClock parses HH:MM into minutes after midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inQuietHours reports whether now falls in the configured quiet window,
+// which may wrap past midnight
+func inQuietHours(window string, now time.Time) bool {
+	if window == "" {
+		return false
+	}
+	start, end, err := parseQuietHours(window)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// notification is a desktop notification waiting to be shown
+type notification struct {
+	title string
+	body  string
+}
+
+// Notifier shows desktop notifications off the hub goroutine, never more
+// than one per interval
+type Notifier struct {
+	queue   chan notification
+	last    time.Time
+	skipped int
+	failed  bool
+	mutex   sync.Mutex
+}
+
+// NewNotifier creates a notifier; nothing is shown until run is started
+func NewNotifier() *Notifier {
+	return &Notifier{queue: make(chan notification, notifyQueueSize)}
+}
+
+// wantsNotification reports whether a message should notify under cfg
+func wantsNotification(cfg NotifyConfig, msg Message) bool {
+	if len(msg.Mentions) > 0 {
+		return true
+	}
+	for _, tag := range msg.Tags {
+		if containsString(cfg.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check queues a notification for a mentioning or watched message. It is
+// a no-op on a nil notifier, which is what headless mode uses.
+func (n *Notifier) Check(cfg *Config, msg Message, now time.Time) {
+	if n == nil || !cfg.Notify.Enabled || !wantsNotification(cfg.Notify, msg) {
+		return
+	}
+	if inQuietHours(cfg.Notify.QuietHours, now.In(cfg.Location())) {
+		return
+	}
+
+	n.mutex.Lock()
+	if !n.last.IsZero() && now.Sub(n.last) < cfg.Notify.Interval() {
+		n.skipped++
+		n.mutex.Unlock()
+		return
+	}
+	n.last = now
+	skipped := n.skipped
+	n.skipped = 0
+	n.mutex.Unlock()
+
+	body := msg.Username + ": " + truncateRunes(msg.Content, notifyBodyLength)
+	if skipped > 0 {
+		body += fmt.Sprintf(" (+%d more)", skipped)
+	}
+	title := "cylog"
+	if cfg.Channel != "" {
+		title += " - " + cfg.Channel
+	}
+
+	select {
+	case n.queue <- notification{title: title, body: body}:
+	default:
+		log.Printf("Dropping notification: queue full")
+	}
+}
+
+// truncateRunes shortens s to at most max runes, marking the cut with an ellipsis
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// run shows queued notifications until ctx is canceled
+func (n *Notifier) run(ctx context.Context) {
+	defer recoverPanic("notifier")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case note := <-n.queue:
+			if err := showNotification(note.title, note.body); err != nil && !n.failed {
+				// Only report the first failure; the tool is usually just missing
+				n.failed = true
+				log.Printf("Error showing desktop notification: %v", err)
+			}
+		}
+	}
+}
+
+// showNotification shows a native notification using the tools each OS
+// ships with. Title and body are passed as arguments or environment
+// variables, never interpolated into a script.
+func showNotification(title, body string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToastScript)
+		cmd.Env = append(os.Environ(), "CYLOG_NOTIFY_TITLE="+title, "CYLOG_NOTIFY_BODY="+body)
+	case "darwin":
+		cmd = exec.Command("osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title, body)
+	default: // "linux", "freebsd", "openbsd", "netbsd"
+		cmd = exec.Command("notify-send", "--app-name=cylog", "--expire-time=8000", title, body)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w %s", cmd.Path, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// windowsToastScript shows a toast notification through the WinRT API
+const windowsToastScript = `
+$ErrorActionPreference = 'Stop'
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode($env:CYLOG_NOTIFY_TITLE)) > $null
+$text.Item(1).AppendChild($template.CreateTextNode($env:CYLOG_NOTIFY_BODY)) > $null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($template)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('cylog').Show($toast)
+`
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiParam describes a path or query parameter of an API operation
+type apiParam struct {
+	Name        string
+	In          string
+	Description string
+	Type        string
+}
+
+// apiOperation describes an API route for the OpenAPI document. Body and
+// Response are values of the types the handlers bind and return, so the
+// schemas are derived from the same structs; a map[string]interface{} is
+// used as a literal schema for ad-hoc gin.H responses.
+type apiOperation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Params   []apiParam
+	Body     interface{}
+	Response interface{}
+	Text     bool
+	HTML     bool
+	Archive  bool
+	Admin    bool
+}
+
+// queryParam is shorthand for a string query parameter
+func queryParam(name, description string) apiParam {
+	return apiParam{Name: name, In: "query", Description: description, Type: "string"}
+}
+
+// pathParam is shorthand for a string path parameter
+func pathParam(name, description string) apiParam {
+	return apiParam{Name: name, In: "path", Description: description, Type: "string"}
+}
+
+// objectSchema is a literal object schema with the given property schemas
+func objectSchema(properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// stringSchema and friends are literal schemas for ad-hoc responses
+var (
+	stringSchema      = map[string]interface{}{"type": "string"}
+	integerSchema     = map[string]interface{}{"type": "integer"}
+	booleanSchema     = map[string]interface{}{"type": "boolean"}
+	stringArraySchema = map[string]interface{}{"type": "array", "items": stringSchema}
+)
+
+// dateParams are the from/to range parameters shared by the statistics endpoints
+var dateParams = []apiParam{
+	queryParam("from", "First date to include, YYYY-MM-DD"),
+	queryParam("to", "Last date to include, YYYY-MM-DD"),
+}
+
+// legacyParam selects the pre-RFC3339 timestamp output
+var legacyParam = queryParam("ts", "Set to legacy for the old timestamp formats")
+
+// minRankParam filters messages by the sender's Cytube rank
+var minRankParam = queryParam("min_rank", "Only messages from users of at least this rank, e.g. 2 for moderators")
+
+// typeParam filters messages by type
+var typeParam = queryParam("type", "Comma-separated message types, e.g. chat,action")
+
+// userParam and exactParam filter messages by sender, ignoring case and
+// zero-width characters unless exact=1
+var (
+	userParam  = queryParam("user", "Only messages from this user")
+	exactParam = queryParam("exact", "Set to 1 to match the username case-sensitively")
+)
+
+// apiOperations lists every /api/v1 route; TestOpenAPICoversRoutes fails
+// for routes missing from it
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/messages", Summary: "Recent messages", Params: []apiParam{legacyParam, minRankParam, typeParam, userParam, exactParam}, Response: []Message{}},
+	{Method: "GET", Path: "/logs", Summary: "Available log files", Params: []apiParam{
+		queryParam("kind", "Only list files of this kind, e.g. chat or events"),
+		queryParam("group", "Set to kind to group files by kind"),
+		queryParam("detail", "Set to 1 to describe each file, newest first; from and to filter by date"),
+	}, Response: []string{}},
+	{Method: "DELETE", Path: "/logs/:filename", Summary: "Delete a closed log file", Params: []apiParam{pathParam("filename", "Log filename")},
+		Response: objectSchema(map[string]interface{}{"deleted": stringSchema}), Admin: true},
+	{Method: "POST", Path: "/logs/:filename/archive", Summary: "Compress a closed log file into logs/archive", Params: []apiParam{pathParam("filename", "Log filename")},
+		Response: objectSchema(map[string]interface{}{"archived": stringSchema, "path": stringSchema}), Admin: true},
+	{Method: "GET", Path: "/logs/:filename/verify", Summary: "Check a log file against its HMAC signature or hash chain", Params: []apiParam{pathParam("filename", "Log filename")},
+		Response: objectSchema(map[string]interface{}{"file": stringSchema, "valid": booleanSchema, "method": stringSchema, "size": integerSchema, "verified_bytes": integerSchema, "error": stringSchema})},
+	{Method: "GET", Path: "/logs/:filename/meta", Summary: "Size, message and user counts and first and last timestamps of a log file", Params: []apiParam{pathParam("filename", "Log filename")},
+		Response: LogFileInfo{}},
+	{Method: "HEAD", Path: "/logs/:filename", Summary: "Size, ETag and Last-Modified of a log file, without its content", Params: []apiParam{pathParam("filename", "Log filename")}},
+	{Method: "GET", Path: "/logs/:filename", Summary: "Content of a log file", Params: []apiParam{
+		pathParam("filename", "Log filename"),
+		queryParam("format", "Set to json for parsed messages, or ndjson for one message per line"),
+		queryParam("offset", "Skip this many matching messages"),
+		queryParam("limit", "Return at most this many messages"),
+		legacyParam,
+		minRankParam,
+		typeParam,
+		userParam,
+		exactParam,
+	}, Response: []Message{}, Text: true},
+	{Method: "GET", Path: "/status", Summary: "Server status", Response: Status{}},
+	{Method: "GET", Path: "/stats/users", Summary: "Per-user message statistics", Params: append([]apiParam{
+		queryParam("top", "Only return the top N users"),
+		queryParam("sort", "count or username"),
+		queryParam("resolve_aliases", "Set to 1 to merge alias groups"),
+		queryParam("user", "Only this user"),
+		exactParam,
+	}, dateParams...), Response: []UserStats{}},
+	{Method: "GET", Path: "/stats/activity", Summary: "Message counts per hour or day", Params: append([]apiParam{
+		queryParam("granularity", "hour or day"),
+	}, dateParams...), Response: []ActivityBucket{}},
+	{Method: "GET", Path: "/stats/terms", Summary: "Most used words or emotes", Params: append([]apiParam{
+		queryParam("type", "word or emote"),
+		queryParam("top", "Number of terms to return"),
+	}, dateParams...), Response: []TermCount{}},
+	{Method: "GET", Path: "/users", Summary: "Presence table", Response: []PresenceRecord{}},
+	{Method: "GET", Path: "/users/:name", Summary: "Presence record of a user", Params: []apiParam{pathParam("name", "Username")}, Response: PresenceRecord{}},
+	{Method: "GET", Path: "/users/:name/export", Summary: "Every logged message of a user, oldest first; PMs only with an admin token", Params: []apiParam{
+		pathParam("name", "Username, matched case-insensitively"),
+		exactParam,
+		queryParam("format", "jsonl (default), csv or text"),
+		queryParam("resolve_aliases", "Set to 1 to include the user's alias group"),
+	}, Response: []Message{}, Text: true},
+	{Method: "GET", Path: "/users/aliases", Summary: "Alias groups", Response: []AliasGroup{}},
+	{Method: "PUT", Path: "/users/aliases", Summary: "Replace alias groups", Body: []AliasGroup{}, Response: []AliasGroup{}, Admin: true},
+	{Method: "GET", Path: "/userlist", Summary: "Users currently in the channel", Response: []ChannelUser{}},
+	{Method: "GET", Path: "/motd", Summary: "Current channel MOTD", Response: MOTDEntry{}},
+	{Method: "GET", Path: "/motd/history", Summary: "Distinct channel MOTDs, oldest first", Response: []MOTDEntry{}},
+	{Method: "GET", Path: "/media/history", Summary: "Media played on the given dates", Params: dateParams, Response: []MediaItem{}},
+	{Method: "GET", Path: "/now-playing", Summary: "Media item currently playing", Response: MediaItem{}},
+	{Method: "GET", Path: "/links", Summary: "URLs shared in chat, deduplicated", Params: append([]apiParam{
+		queryParam("domain", "Only links on this domain and its subdomains"),
+	}, dateParams...), Response: []SharedLink{}},
+	{Method: "GET", Path: "/preview", Summary: "Cached preview of a link from a message's previews; never fetched on request", Params: []apiParam{
+		queryParam("url", "The link"),
+		queryParam("thumbnail", "Set to 1 for the PNG thumbnail of an image instead"),
+	}, Response: LinkPreview{}},
+	{Method: "GET", Path: "/mentions", Summary: "Messages mentioning the configured names", Params: dateParams, Response: []Message{}},
+	{Method: "GET", Path: "/export.html", Summary: "Standalone HTML transcript of logged messages", Params: append([]apiParam{
+		userParam,
+		exactParam,
+	}, dateParams...), HTML: true},
+	{Method: "POST", Path: "/shares", Summary: "Create a read-only share link of the logged messages in a time range; 404 when there are none",
+		Body: ShareRequest{}, Response: Share{}, Admin: true},
+	{Method: "GET", Path: "/shares", Summary: "Share links that haven't expired, newest first", Response: []Share{}, Admin: true},
+	{Method: "DELETE", Path: "/shares/:slug", Summary: "Revoke a share link", Params: []apiParam{pathParam("slug", "Share slug")},
+		Response: objectSchema(map[string]interface{}{"revoked": stringSchema}), Admin: true},
+	{Method: "GET", Path: "/ingest/cursor", Summary: "The last batched message accepted from each bridge installation, most recent first; needs the read or ingest scope",
+		Params: []apiParam{queryParam("source", "Only the cursor of this source")}, Response: []IngestCursor{}},
+	{Method: "GET", Path: "/search", Summary: "Logged chat messages matching a query, newest first, with match offsets", Params: append([]apiParam{
+		queryParam("q", "Case-insensitive substring, or a regular expression with regex=1"),
+		queryParam("regex", "Set to 1 to treat q as a regular expression"),
+		queryParam("fields", "Comma-separated fields to match: content (default) and username"),
+		userParam,
+		exactParam,
+		queryParam("fuzzy", "Set to 1 to also match usernames within a small edit distance of user"),
+		queryParam("limit", "Maximum number of hits (default 100, at most 1000)"),
+		minRankParam,
+		typeParam,
+	}, dateParams...), Response: []SearchHit{}},
+	{Method: "GET", Path: "/tail", Summary: "Messages in a time window as NDJSON, one per line in timestamp order, ending with a tail_meta line with next_since", Params: []apiParam{
+		queryParam("since", "Start of the window (RFC 3339), inclusive"),
+		queryParam("until", "End of the window (RFC 3339), exclusive; defaults to the reorder window before now"),
+		queryParam("format", "jsonl, the only format"),
+		userParam,
+		exactParam,
+		minRankParam,
+		typeParam,
+	}, Response: Message{}},
+	{Method: "GET", Path: "/digests/:date", Summary: "Daily digest of a date", Params: []apiParam{pathParam("date", "Date (YYYY-MM-DD)")}, Response: Digest{}},
+	{Method: "GET", Path: "/admin/filters", Summary: "Content filter rules", Response: []FilterRule{}, Admin: true},
+	{Method: "PUT", Path: "/admin/filters", Summary: "Replace content filter rules", Body: []FilterRule{}, Response: []FilterRule{}, Admin: true},
+	{Method: "GET", Path: "/admin/clients", Summary: "Connected WebSocket clients", Response: []ClientInfo{}, Admin: true},
+	{Method: "DELETE", Path: "/admin/clients/:id", Summary: "Disconnect a WebSocket client", Params: []apiParam{pathParam("id", "Client ID")},
+		Response: objectSchema(map[string]interface{}{"disconnected": integerSchema}), Admin: true},
+	{Method: "GET", Path: "/admin/raw", Summary: "The last 200 raw upstream frames, with debug enabled", Response: []RawFrame{}, Admin: true},
+	{Method: "POST", Path: "/admin/rotate", Summary: "Start a new chat log file",
+		Response: objectSchema(map[string]interface{}{"closed": stringSchema, "opened": stringSchema}), Admin: true},
+	{Method: "POST", Path: "/admin/prune", Summary: "Apply the retention policy now", Params: []apiParam{
+		queryParam("kind", "Log kind, default chat"),
+		queryParam("max_files", "Override the number of files to keep"),
+		queryParam("keep_days", "Override the number of days to keep"),
+		queryParam("keep_bytes", "Override the total size to keep"),
+	}, Response: objectSchema(map[string]interface{}{"deleted": stringArraySchema, "retention": RetentionConfig{}}), Admin: true},
+	{Method: "POST", Path: "/admin/digest", Summary: "Generate the digest of a date (default today)", Params: []apiParam{queryParam("date", "Date (YYYY-MM-DD)")}, Response: Digest{}, Admin: true},
+	{Method: "POST", Path: "/admin/compact", Summary: "Compact the daily and hourly log files of completed months into monthly rollups",
+		Params: []apiParam{queryParam("month", "Only this month (YYYY-MM)")}, Response: []Rollup{}, Admin: true},
+	{Method: "GET", Path: "/admin/jobs", Summary: "Periodic background jobs and their last run", Response: []JobStatus{}, Admin: true},
+	{Method: "POST", Path: "/admin/jobs/:name/run", Summary: "Run a job now; 409 while it is running", Params: []apiParam{pathParam("name", "Job name")}, Response: JobStatus{}, Admin: true},
+	{Method: "GET", Path: "/admin/audit", Summary: "The audit log of admin requests and failed admin logins, newest first",
+		Params: []apiParam{queryParam("offset", "Entries to skip"), queryParam("limit", "Entries to return (default 100, at most 1000)")}, Response: AuditPage{}, Admin: true},
+	{Method: "GET", Path: "/admin/backup", Summary: "tar.gz of the logs directory for cylog restore; 429 while another backup runs", Archive: true, Admin: true},
+	{Method: "POST", Path: "/admin/logging/pause", Summary: "Stop writing log files while still broadcasting", Response: LoggingStatus{}, Admin: true},
+	{Method: "POST", Path: "/admin/logging/resume", Summary: "Resume writing log files", Response: LoggingStatus{}, Admin: true},
+	{Method: "GET", Path: "/admin/logging/sampling", Summary: "Chat sampling rate in effect and where it comes from", Response: SamplingStatus{}, Admin: true},
+	{Method: "PUT", Path: "/admin/logging/sampling", Summary: "Log one in rate chat messages until the next restart; 1 logs every message", Body: SamplingRequest{}, Response: SamplingStatus{}, Admin: true},
+	{Method: "DELETE", Path: "/admin/logging/sampling", Summary: "Return to the configured sampling rate", Response: SamplingStatus{}, Admin: true},
+	{Method: "POST", Path: "/admin/channels", Summary: "Join a channel, over its own connection unless it becomes the default one; 200 if already in it", Body: JoinRequest{}, Response: ChannelInfo{}, Admin: true},
+	{Method: "DELETE", Path: "/admin/channels/:name", Summary: "Leave a channel, closing its log files", Params: []apiParam{pathParam("name", "Channel name")},
+		Response: objectSchema(map[string]interface{}{"left": stringSchema}), Admin: true},
+	{Method: "POST", Path: "/admin/restart", Summary: "Restart the server, keeping the message buffer and listener",
+		Response: objectSchema(map[string]interface{}{"restarting": booleanSchema}), Admin: true},
+	{Method: "POST", Path: "/admin/reload", Summary: "Reload the config file", Response: ReloadResult{}, Admin: true},
+	{Method: "GET", Path: "/channels", Summary: "Channels cylog is in, with their connection state", Response: []ChannelInfo{}},
+	{Method: "GET", Path: "/tampermonkey/bridge.user.js", Summary: "Tampermonkey bridge script, generated for the requested host", Text: true},
+	{Method: "GET", Path: "/tampermonkey/manifest", Summary: "Bridge script version, minimum accepted version, required endpoints and token requirement", Response: BridgeManifest{}},
+	{Method: "GET", Path: "/openapi.json", Summary: "This document", Response: map[string]interface{}{"type": "object"}},
+}
+
+// channelOperations are the data endpoints scoped to a channel
+var channelOperations = scopeOperations(apiOperations)
+
+// apiV2Operations lists every /api/v2 route, with paths relative to
+// /api/v2; TestOpenAPICoversRoutes fails for routes missing from it
+var apiV2Operations = []apiOperation{
+	{Method: "GET", Path: "/messages", Summary: "A page of messages in sequence order, read back from the log files once they left the recent buffer", Params: []apiParam{
+		queryParam("after", "Return the messages right after this sequence number, oldest first"),
+		queryParam("before", "Return the messages right before this sequence number; without a cursor, the newest messages"),
+		queryParam("limit", "Messages per page (default 100, at most 1000)"),
+		queryParam("with_media", "Set to 1 to include the media item playing at each message"),
+		minRankParam,
+		typeParam,
+		userParam,
+		exactParam,
+	}, Response: MessagePage{}},
+}
+
+// schemaBuilder converts Go types to OpenAPI schemas, collecting named
+// structs as reusable components
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+// jsonContracts maps types with custom JSON encodings to the struct that
+// describes their actual output
+var jsonContracts = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(Message{}): reflect.TypeOf(messageJSON{}),
+}
+
+// schema returns the schema of a value, which may be a literal schema map
+func (b *schemaBuilder) schema(value interface{}) interface{} {
+	if literal, ok := value.(map[string]interface{}); ok {
+		resolved := make(map[string]interface{}, len(literal))
+		for key, item := range literal {
+			if key == "properties" {
+				properties := make(map[string]interface{})
+				for name, property := range item.(map[string]interface{}) {
+					properties[name] = b.schema(property)
+				}
+				item = properties
+			}
+			resolved[key] = item
+		}
+		return resolved
+	}
+	return b.typeSchema(reflect.TypeOf(value))
+}
+
+// typeSchema returns the schema of a Go type
+func (b *schemaBuilder) typeSchema(t reflect.Type) interface{} {
+	if contract, ok := jsonContracts[t]; ok {
+		name := t.Name()
+		if _, done := b.components[name]; !done {
+			b.components[name] = map[string]interface{}{}
+			b.components[name] = b.structSchema(contract)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.typeSchema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		name := t.Name()
+		if name == "" {
+			return b.structSchema(t)
+		}
+		if _, done := b.components[name]; !done {
+			// Reserve the name first so recursive types terminate
+			b.components[name] = map[string]interface{}{}
+			b.components[name] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the object schema of a struct's JSON fields
+func (b *schemaBuilder) structSchema(t reflect.Type) interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		properties[name] = b.typeSchema(field.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// openAPIPath converts a Gin route path like /users/:name to /users/{name}
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// operation renders an API operation, collecting the schemas it uses
+func (b *schemaBuilder) operation(op apiOperation) map[string]interface{} {
+	operation := map[string]interface{}{"summary": op.Summary}
+
+	params := make([]interface{}, 0, len(op.Params))
+	for _, param := range op.Params {
+		params = append(params, map[string]interface{}{
+			"name":        param.Name,
+			"in":          param.In,
+			"description": param.Description,
+			"required":    param.In == "path",
+			"schema":      map[string]interface{}{"type": param.Type},
+		})
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+
+	if op.Body != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schema(op.Body)}},
+		}
+	}
+
+	content := make(map[string]interface{})
+	if op.Response != nil {
+		content["application/json"] = map[string]interface{}{"schema": b.schema(op.Response)}
+	}
+	if op.Text {
+		content["text/plain"] = map[string]interface{}{"schema": stringSchema}
+	}
+	if op.HTML {
+		content["text/html"] = map[string]interface{}{"schema": stringSchema}
+	}
+	if op.Archive {
+		content["application/gzip"] = map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}
+	}
+	// Every error has the same body
+	errorContent := map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schema(APIErrorResponse{})}}
+	responses := map[string]interface{}{
+		"200":     map[string]interface{}{"description": "OK", "content": content},
+		"default": map[string]interface{}{"description": "Error", "content": errorContent},
+	}
+	if op.Admin {
+		operation["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+		responses["401"] = map[string]interface{}{"description": "Invalid admin token", "content": errorContent}
+		responses["403"] = map[string]interface{}{"description": "Admin API disabled, or the token lacks the admin scope", "content": errorContent}
+	}
+	operation["responses"] = responses
+	return operation
+}
+
+// pathItem returns the path item of path, adding it if it is new
+func pathItem(paths map[string]interface{}, path string) map[string]interface{} {
+	item, ok := paths[path].(map[string]interface{})
+	if !ok {
+		item = make(map[string]interface{})
+		paths[path] = item
+	}
+	return item
+}
+
+// buildOpenAPI renders the OpenAPI 3 document for the /api/v1 and /api/v2
+// routes
+func buildOpenAPI() map[string]interface{} {
+	builder := &schemaBuilder{components: make(map[string]interface{})}
+	paths := make(map[string]interface{})
+
+	for _, op := range append(apiOperations, channelOperations...) {
+		pathItem(paths, openAPIPath(op.Path))[strings.ToLower(op.Method)] = builder.operation(op)
+	}
+
+	// The v2 paths would clash with v1's, so they are listed under /v2 with
+	// a server of their own
+	for _, op := range apiV2Operations {
+		item := pathItem(paths, "/v2"+openAPIPath(op.Path))
+		item["servers"] = []interface{}{map[string]interface{}{"url": "/api"}}
+		item[strings.ToLower(op.Method)] = builder.operation(op)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Cylog API",
+			"version": "1",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/api/v1"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": builder.components,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// registerOpenAPIRoutes serves the OpenAPI document and, when enabled, the
+// Swagger UI page. The document is outside the API group so it needs no
+// token.
+func registerOpenAPIRoutes(router *gin.Engine, chatServer *ChatServer) {
+	spec := buildOpenAPI()
+	router.GET("/api/v1/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	})
+
+	router.GET("/api/docs", func(c *gin.Context) {
+		if !chatServer.Config().APIDocs {
+			apiError(c, http.StatusNotFound, "API docs disabled")
+			return
+		}
+		c.HTML(http.StatusOK, "apidocs.html", nil)
+	})
+}
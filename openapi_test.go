@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// undocumentedRoutes are the routes left out of the OpenAPI document: the
+// pages, the WebSocket, static files, feeds, metrics, diagnostics and the
+// unversioned API kept for old clients
+var undocumentedRoutes = map[string]bool{
+	"GET /":                     true,
+	"GET /login":                true,
+	"POST /login":               true,
+	"POST /logout":              true,
+	"GET /logs":                 true,
+	"GET /share/:slug":          true,
+	"GET /api/docs":             true,
+	"GET /ws":                   true,
+	"GET /static/*filepath":     true,
+	"HEAD /static/*filepath":    true,
+	"GET /scripts/*filepath":    true,
+	"HEAD /scripts/*filepath":   true,
+	"GET /feed.atom":            true,
+	"GET /metrics":              true,
+	"GET /debug/vars":           true,
+	"GET /debug/pprof/*profile": true,
+	"POST /debug/pprof/symbol":  true,
+	"GET /api/messages":         true,
+}
+
+// documentedRoutes returns the method and full path of every operation in
+// the OpenAPI document, with path parameters like {name}
+func documentedRoutes(t *testing.T) map[string]bool {
+	t.Helper()
+
+	serverURL := func(servers interface{}) string {
+		list, ok := servers.([]interface{})
+		if !ok || len(list) != 1 {
+			t.Fatalf("servers = %v, want one server", servers)
+		}
+		return list[0].(map[string]interface{})["url"].(string)
+	}
+
+	spec := buildOpenAPI()
+	base := serverURL(spec["servers"])
+	documented := make(map[string]bool)
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		item := item.(map[string]interface{})
+		server := base
+		if servers, ok := item["servers"]; ok {
+			server = serverURL(servers)
+		}
+		for method := range item {
+			if method == "servers" {
+				continue
+			}
+			documented[strings.ToUpper(method)+" "+server+path] = true
+		}
+	}
+	return documented
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debug.Enabled = true
+	_, router := newTestServer(t, cfg)
+
+	documented := documentedRoutes(t)
+	registered := make(map[string]bool)
+	for _, route := range router.Routes() {
+		key := route.Method + " " + route.Path
+		registered[key] = true
+		if undocumentedRoutes[key] {
+			continue
+		}
+		if !documented[route.Method+" "+openAPIPath(route.Path)] {
+			t.Errorf("route %s is missing from the OpenAPI document", key)
+		}
+	}
+
+	// Documented operations must exist, and the exceptions must not go stale
+	for key := range documented {
+		method, path, _ := strings.Cut(key, " ")
+		found := false
+		for _, route := range router.Routes() {
+			if route.Method == method && openAPIPath(route.Path) == path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("documented operation %s is not registered", key)
+		}
+	}
+	for key := range undocumentedRoutes {
+		if !registered[key] {
+			t.Errorf("undocumented route %s is not registered", key)
+		}
+	}
+}
+
+func TestOpenAPIServesV2(t *testing.T) {
+	paths := buildOpenAPI()["paths"].(map[string]interface{})
+
+	item, ok := paths["/v2/messages"].(map[string]interface{})
+	if !ok {
+		t.Fatal("/api/v2/messages is not documented")
+	}
+	want := []interface{}{map[string]interface{}{"url": "/api"}}
+	if !reflect.DeepEqual(item["servers"], want) {
+		t.Errorf("servers of /v2/messages = %v, want %v", item["servers"], want)
+	}
+	if _, ok := item["get"]; !ok {
+		t.Error("GET /api/v2/messages is not documented")
+	}
+
+	// The v1 path of the same name keeps the document's server
+	v1, ok := paths["/messages"].(map[string]interface{})
+	if !ok {
+		t.Fatal("/api/v1/messages is no longer documented")
+	}
+	if _, ok := v1["servers"]; ok {
+		t.Error("/api/v1/messages has a server of its own")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// presenceFileName is the file in the logs directory the presence table is persisted to
+const presenceFileName = "presence.json"
+
+// presenceFlushInterval is how often a changed presence table is written to disk
+const presenceFlushInterval = 30 * time.Second
+
+// PresenceRecord tracks when a user has been seen in the channel
+type PresenceRecord struct {
+	Username  string    `json:"username"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Sessions  int       `json:"sessions"`
+	Present   bool      `json:"present"`
+}
+
+// PresenceTracker maintains a persistent table of user presence
+type PresenceTracker struct {
+	path  string
+	users map[string]*PresenceRecord
+	dirty bool
+	mutex sync.Mutex
+}
+
+// NewPresenceTracker creates a presence tracker, loading the persisted table if present
+func NewPresenceTracker(path string) (*PresenceTracker, error) {
+	tracker := &PresenceTracker{
+		path:  path,
+		users: make(map[string]*PresenceRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return tracker, nil
+		}
+		return nil, fmt.Errorf("failed to read presence file: %w", err)
+	}
+
+	var records []*PresenceRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse presence file: %w", err)
+	}
+
+	// Nobody is known to be present until the first userlist arrives
+	for _, record := range records {
+		record.Present = false
+		tracker.users[record.Username] = record
+	}
+
+	return tracker, nil
+}
+
+// record returns the presence record for a user, creating it if needed
+func (p *PresenceTracker) record(username string, now time.Time) *PresenceRecord {
+	record, ok := p.users[username]
+	if !ok {
+		record = &PresenceRecord{Username: username, FirstSeen: now}
+		p.users[username] = record
+	}
+	return record
+}
+
+// join marks a user as present, starting a new session if they weren't already
+func (p *PresenceTracker) join(username string, now time.Time) {
+	record := p.record(username, now)
+	if !record.Present {
+		record.Present = true
+		record.Sessions++
+	}
+	record.LastSeen = now
+	p.dirty = true
+}
+
+// Join records a user joining the channel
+func (p *PresenceTracker) Join(username string, now time.Time) {
+	if username == "" {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.join(username, now)
+}
+
+// Leave records a user leaving the channel
+func (p *PresenceTracker) Leave(username string, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	record, ok := p.users[username]
+	if !ok {
+		return
+	}
+	record.Present = false
+	record.LastSeen = now
+	p.dirty = true
+}
+
+// Seen records activity from a user, such as a chat message
+func (p *PresenceTracker) Seen(username string, now time.Time) {
+	if username == "" {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.join(username, now)
+}
+
+// Snapshot reconciles the table with a full userlist: listed users are marked
+// present and everyone else, including users whose leave was missed, as gone
+func (p *PresenceTracker) Snapshot(usernames []string, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	listed := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		if username == "" {
+			continue
+		}
+		listed[username] = true
+		p.join(username, now)
+	}
+
+	for username, record := range p.users {
+		if record.Present && !listed[username] {
+			record.Present = false
+			p.dirty = true
+		}
+	}
+}
+
+// List returns all presence records sorted by username
+func (p *PresenceTracker) List() []PresenceRecord {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	records := make([]PresenceRecord, 0, len(p.users))
+	for _, record := range p.users {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Username < records[j].Username
+	})
+	return records
+}
+
+// Get returns the presence record for a user, matching case-insensitively if
+// there is no exact match
+func (p *PresenceTracker) Get(username string) (PresenceRecord, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if record, ok := p.users[username]; ok {
+		return *record, true
+	}
+	for name, record := range p.users {
+		if usernamesEqual(name, username) {
+			return *record, true
+		}
+	}
+	return PresenceRecord{}, false
+}
+
+// Flush writes the presence table to disk if it has changed
+func (p *PresenceTracker) Flush() error {
+	p.mutex.Lock()
+	if !p.dirty {
+		p.mutex.Unlock()
+		return nil
+	}
+	records := make([]*PresenceRecord, 0, len(p.users))
+	for _, record := range p.users {
+		copied := *record
+		records = append(records, &copied)
+	}
+	p.dirty = false
+	p.mutex.Unlock()
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode presence table: %w", err)
+	}
+
+	if err := writeFileAtomic(p.path, data); err != nil {
+		return fmt.Errorf("failed to write presence file: %w", err)
+	}
+	return nil
+}
+
+// run periodically flushes the presence table until ctx is canceled
+func (p *PresenceTracker) run(ctx context.Context) {
+	defer recoverPanic("presence tracker")
+
+	ticker := time.NewTicker(presenceFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := p.Flush(); err != nil {
+				log.Printf("Error saving presence table: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := p.Flush(); err != nil {
+				log.Printf("Error saving presence table: %v", err)
+			}
+		}
+	}
+}
+
+// presencePath returns the default location of the presence table
+func presencePath() string {
+	return filepath.Join(logsDir, presenceFileName)
+}
+
+// registerUserRoutes registers the user presence endpoints
+func registerUserRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/users", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.presence.List())
+	})
+
+	api.GET("/users/:name", func(c *gin.Context) {
+		record, ok := chatServer.presence.Get(c.Param("name"))
+		if !ok {
+			apiError(c, http.StatusNotFound, "user not found")
+			return
+		}
+		c.JSON(http.StatusOK, record)
+	})
+}
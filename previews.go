@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// previewsDirName is the preview cache in the logs directory; it is a cache,
+// so backups leave it out
+const previewsDirName = "previews"
+
+// Preview fetching limits
+const (
+	previewQueueSize       = 100
+	previewFetchTimeout    = 10 * time.Second
+	previewMaxRedirects    = 3
+	previewMaxPixels       = 40 * 1000 * 1000
+	previewCleanupInterval = time.Hour
+)
+
+// Preview defaults
+const (
+	defaultPreviewMaxFetchBytes = 5 * 1024 * 1024
+	defaultPreviewCacheBytes    = 100 * 1024 * 1024
+	defaultPreviewTTLHours      = 7 * 24
+	defaultPreviewThumbnailSize = 320
+)
+
+// previewDeniedNetworks are address ranges previews are never fetched from,
+// on top of the loopback, private, link-local and multicast ones
+var previewDeniedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+)
+
+// Preview metrics
+var (
+	previewFetches       = metrics.Counter("cylog_preview_fetches_total", "Link previews fetched")
+	previewFetchFailures = metrics.Counter("cylog_preview_fetch_failures_total", "Link preview fetches that failed or were refused")
+)
+
+// PreviewConfig configures link previews
+type PreviewConfig struct {
+	// Enabled fetches previews of links to Domains at ingest
+	Enabled bool `yaml:"enabled"`
+
+	// Domains are the sites previews are fetched from, subdomains included;
+	// redirects must stay on them
+	Domains []string `yaml:"domains"`
+
+	// MaxFetchBytes is the largest image downloaded for a thumbnail
+	MaxFetchBytes int64 `yaml:"max_fetch_bytes"`
+
+	// CacheMaxBytes caps the size of logs/previews; the oldest entries go first
+	CacheMaxBytes int64 `yaml:"cache_max_bytes"`
+
+	// TTLHours is how long a preview is kept before it is fetched again
+	TTLHours int `yaml:"ttl_hours"`
+
+	// ThumbnailSize is the longest side of a thumbnail, in pixels
+	ThumbnailSize int `yaml:"thumbnail_size"`
+}
+
+// TTL returns how long a preview is kept
+func (p PreviewConfig) TTL() time.Duration {
+	return time.Duration(p.TTLHours) * time.Hour
+}
+
+// allowed reports whether a preview of link may be fetched: an http or
+// https URL on a default port, without credentials, on one of the domains
+func (p PreviewConfig) allowed(link string) bool {
+	parsed, err := url.Parse(link)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.User != nil {
+		return false
+	}
+	if port := parsed.Port(); port != "" && port != "80" && port != "443" {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	for _, domain := range p.Domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the preview settings
+func (p PreviewConfig) validate() error {
+	if p.MaxFetchBytes <= 0 || p.CacheMaxBytes <= 0 || p.TTLHours <= 0 || p.ThumbnailSize <= 0 {
+		return fmt.Errorf("invalid previews: max_fetch_bytes, cache_max_bytes, ttl_hours and thumbnail_size must be positive")
+	}
+	for _, domain := range p.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/:*") {
+			return fmt.Errorf("invalid previews domain %q: must be a host name", domain)
+		}
+	}
+	return nil
+}
+
+// LinkPreview is the cached metadata of a link
+type LinkPreview struct {
+	URL         string    `json:"url"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Thumbnail   string    `json:"thumbnail,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// PreviewCache fetches link previews in the background and keeps them in
+// logs/previews, one JSON file per link plus a PNG thumbnail for images
+type PreviewCache struct {
+	store   *ConfigStore
+	client  *http.Client
+	queue   chan string
+	pending map[string]bool
+	mutex   sync.Mutex
+}
+
+// NewPreviewCache creates a preview cache. Its HTTP client ignores proxy
+// settings and refuses to connect to non-public addresses, which also
+// covers redirects and host names resolving to internal hosts.
+func NewPreviewCache(store *ConfigStore) *PreviewCache {
+	p := &PreviewCache{
+		store:   store,
+		queue:   make(chan string, previewQueueSize),
+		pending: make(map[string]bool),
+	}
+	dialer := &net.Dialer{Timeout: previewFetchTimeout, Control: dialPublicOnly}
+	p.client = &http.Client{
+		Timeout: previewFetchTimeout,
+		Transport: &http.Transport{
+			DialContext:            dialer.DialContext,
+			TLSHandshakeTimeout:    previewFetchTimeout,
+			ResponseHeaderTimeout:  previewFetchTimeout,
+			MaxResponseHeaderBytes: 64 * 1024,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > previewMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if !p.store.Get().Previews.allowed(req.URL.String()) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+			}
+			return nil
+		},
+	}
+	return p
+}
+
+// dialPublicOnly refuses connections to loopback, private, link-local,
+// multicast and other reserved addresses
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// publicIP reports whether ip is a globally routable unicast address
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range previewDeniedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCIDRs parses constant CIDR ranges
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// previewsDir returns the preview cache directory
+func previewsDir() string {
+	return filepath.Join(logsDir, previewsDirName)
+}
+
+// previewKey names the cache files of a link
+func previewKey(link string) string {
+	sum := sha256.Sum256([]byte(linkKey(link)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// previewPath returns the metadata file of a link
+func previewPath(link string) string {
+	return filepath.Join(previewsDir(), previewKey(link)+".json")
+}
+
+// thumbnailPath returns the thumbnail of a link
+func thumbnailPath(link string) string {
+	return filepath.Join(previewsDir(), previewKey(link)+".png")
+}
+
+// Queue schedules previews of the links that may be previewed and returns
+// them; a link already cached, or still being fetched, isn't fetched again.
+// Previews appear in the cache shortly after the message is broadcast.
+func (p *PreviewCache) Queue(links []string) []string {
+	cfg := p.store.Get().Previews
+	if !cfg.Enabled || !writable() {
+		return nil
+	}
+
+	var previews []string
+	for _, link := range links {
+		if !cfg.allowed(link) {
+			continue
+		}
+		previews = append(previews, link)
+		if info, err := os.Stat(previewPath(link)); err == nil && time.Since(info.ModTime()) < cfg.TTL() {
+			continue
+		}
+
+		key := previewKey(link)
+		p.mutex.Lock()
+		if p.pending[key] {
+			p.mutex.Unlock()
+			continue
+		}
+		select {
+		case p.queue <- link:
+			p.pending[key] = true
+		default:
+			log.Printf("Dropping link preview of %s: queue full", link)
+		}
+		p.mutex.Unlock()
+	}
+	return previews
+}
+
+// run fetches queued previews until ctx is canceled
+func (p *PreviewCache) run(ctx context.Context) {
+	defer recoverPanic("previews")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case link := <-p.queue:
+			if err := p.save(p.fetch(ctx, link)); err != nil {
+				log.Printf("Error caching link preview: %v", err)
+			}
+			p.mutex.Lock()
+			delete(p.pending, previewKey(link))
+			p.mutex.Unlock()
+		}
+	}
+}
+
+// fetch downloads a link's preview. Only images are downloaded whole, to
+// make a thumbnail; anything else is described by its headers. A failed
+// fetch is cached too, so the link isn't retried before the TTL.
+func (p *PreviewCache) fetch(ctx context.Context, link string) LinkPreview {
+	cfg := p.store.Get().Previews
+	preview := LinkPreview{URL: link, FetchedAt: time.Now()}
+	previewFetches.Inc()
+	fail := func(err error) LinkPreview {
+		previewFetchFailures.Inc()
+		preview.Error = err.Error()
+		return preview
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("User-Agent", "cylog/"+serverVersion)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("unexpected status %s", resp.Status))
+	}
+
+	preview.ContentType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.ContentLength > 0 {
+		preview.Size = resp.ContentLength
+	}
+	if !strings.HasPrefix(preview.ContentType, "image/") {
+		return preview
+	}
+	if resp.ContentLength > cfg.MaxFetchBytes {
+		return fail(fmt.Errorf("image larger than %d bytes", cfg.MaxFetchBytes))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, cfg.MaxFetchBytes+1))
+	if err != nil {
+		return fail(err)
+	}
+	if int64(len(data)) > cfg.MaxFetchBytes {
+		return fail(fmt.Errorf("image larger than %d bytes", cfg.MaxFetchBytes))
+	}
+	preview.Size = int64(len(data))
+
+	// The dimensions are checked before decoding, so a small file can't
+	// expand into a huge bitmap
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fail(fmt.Errorf("unsupported image: %w", err))
+	}
+	preview.Width, preview.Height = imageConfig.Width, imageConfig.Height
+	if imageConfig.Width*imageConfig.Height > previewMaxPixels {
+		return preview
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fail(fmt.Errorf("unsupported image: %w", err))
+	}
+
+	var thumbnail bytes.Buffer
+	if err := png.Encode(&thumbnail, scaleImage(img, cfg.ThumbnailSize)); err != nil {
+		return fail(err)
+	}
+	if err := writeFileAtomic(thumbnailPath(link), thumbnail.Bytes()); err != nil {
+		return fail(fmt.Errorf("failed to save thumbnail: %w", err))
+	}
+	preview.Thumbnail = "/api/v1/preview?thumbnail=1&url=" + url.QueryEscape(link)
+	return preview
+}
+
+// scaleImage shrinks an image so its longest side is at most size pixels,
+// by nearest neighbor sampling
+func scaleImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	scaledWidth, scaledHeight := size, height*size/width
+	if height > width {
+		scaledWidth, scaledHeight = width*size/height, size
+	}
+	scaledWidth, scaledHeight = max(scaledWidth, 1), max(scaledHeight, 1)
+
+	scaled := image.NewNRGBA(image.Rect(0, 0, scaledWidth, scaledHeight))
+	for y := 0; y < scaledHeight; y++ {
+		for x := 0; x < scaledWidth; x++ {
+			scaled.Set(x, y, img.At(bounds.Min.X+x*width/scaledWidth, bounds.Min.Y+y*height/scaledHeight))
+		}
+	}
+	return scaled
+}
+
+// save writes a preview's metadata to the cache
+func (p *PreviewCache) save(preview LinkPreview) error {
+	if err := makeDir(previewsDir()); err != nil {
+		return err
+	}
+	data, err := json.Marshal(preview)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(previewPath(preview.URL), data)
+}
+
+// Get returns the cached preview of a link; it never fetches
+func (p *PreviewCache) Get(link string) (LinkPreview, error) {
+	var preview LinkPreview
+	data, err := os.ReadFile(previewPath(link))
+	if err != nil {
+		return preview, err
+	}
+	if err := json.Unmarshal(data, &preview); err != nil {
+		return preview, fmt.Errorf("invalid preview of %s: %w", link, err)
+	}
+	return preview, nil
+}
+
+// Cleanup removes expired previews, then the oldest ones while the cache
+// is over its size cap
+func (p *PreviewCache) Cleanup(ctx context.Context) error {
+	cfg := p.store.Get().Previews
+	entries, err := os.ReadDir(previewsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := make([]cacheFile, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(previewsDir(), entry.Name())
+		if time.Since(info.ModTime()) >= cfg.TTL() {
+			if err := removeFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		files = append(files, cacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, file := range files {
+		if total <= cfg.CacheMaxBytes || ctx.Err() != nil {
+			break
+		}
+		if err := removeFile(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= file.size
+	}
+	return nil
+}
+
+// registerPreviewRoutes registers the endpoint serving cached previews. It
+// only reads the cache, so it can't be used to make requests to other sites.
+func registerPreviewRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/preview", func(c *gin.Context) {
+		link := c.Query("url")
+		if link == "" {
+			apiError(c, http.StatusBadRequest, "missing url parameter")
+			return
+		}
+
+		preview, err := chatServer.previews.Get(link)
+		if errors.Is(err, os.ErrNotExist) {
+			apiError(c, http.StatusNotFound, "no preview of this url")
+			return
+		}
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if c.Query("thumbnail") == "" {
+			c.JSON(http.StatusOK, preview)
+			return
+		}
+
+		if preview.Thumbnail == "" {
+			apiError(c, http.StatusNotFound, "no thumbnail of this url")
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=86400")
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.File(thumbnailPath(link))
+	})
+}
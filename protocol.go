@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// protocolVersion is the version of the WebSocket frame contract. It is
+// bumped on changes that could break existing clients such as the
+// Tampermonkey bridge; new fields and frame types don't bump it.
+const protocolVersion = 1
+
+// serverVersion is the cylog version, set at build time with
+// -ldflags "-X main.serverVersion=v1.2.3"
+var serverVersion = ""
+
+// Control frame types; frames without one of these are messages
+const (
+	frameTypeHello      = "hello"
+	frameTypeConfigure  = "configure"
+	frameTypeConfigured = "configured"
+	frameTypeError      = "error"
+	frameTypeMessage    = "message"
+	frameTypeBacklog    = "backlog"
+	frameTypeBatch      = "batch"
+	frameTypeBatched    = "batched"
+)
+
+// Error frame codes
+const (
+	errorCodeInvalidFrame        = "invalid_frame"
+	errorCodeUnknownFrame        = "unknown_frame"
+	errorCodeInvalidMessage      = "invalid_message"
+	errorCodeSendFailed          = "send_failed"
+	errorCodeUnsupportedProtocol = "unsupported_protocol"
+	errorCodeForbidden           = "forbidden"
+	errorCodeBridgeOutdated      = "bridge_outdated"
+)
+
+// Features advertised in the hello frame
+const (
+	featureResume    = "resume"
+	featureFilters   = "filters"
+	featureMsgpack   = "msgpack"
+	featureConfigure = "configure"
+	featureSend      = "send"
+	featureHistory   = "history"
+	featureViewers   = "viewers"
+	featureBatch     = "batch"
+)
+
+// version returns the cylog version, falling back to the module version
+func version() string {
+	if serverVersion != "" {
+		return serverVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// HelloFrame is the first frame sent to every client, describing the
+// protocol and what the server supports
+type HelloFrame struct {
+	Type     string `json:"type"`
+	Protocol int    `json:"protocol"`
+	Server   string `json:"server"`
+	ClientID uint64 `json:"client_id"`
+	Encoding string `json:"encoding"`
+
+	// BufferSize is how many recent messages are replayed on connect, and
+	// OldestSeq the first of them; a client resuming from an older seq must
+	// fetch the gap from /api/v2/messages
+	BufferSize int    `json:"buffer_size"`
+	OldestSeq  uint64 `json:"oldest_seq,omitempty"`
+
+	// Backlog is how many buffered messages follow the hello frame, so a
+	// client can show a loading state until they arrive
+	Backlog int `json:"backlog"`
+
+	// LoggingPaused is set while an admin has paused logging
+	LoggingPaused bool `json:"logging_paused,omitempty"`
+
+	Features []string `json:"features"`
+	Channels []string `json:"channels"`
+}
+
+// BacklogFrame carries the buffered messages replayed to a client that
+// asked for them with ?history=N, oldest first
+type BacklogFrame struct {
+	Type     string    `json:"type"`
+	Messages []Message `json:"messages"`
+}
+
+// ClientHelloFrame may be sent by a client to introduce itself; bots and
+// bridges set Bot so they aren't counted as viewers, and bridges declare
+// the version of their script in Bridge
+type ClientHelloFrame struct {
+	Type   string `json:"type"`
+	Bot    bool   `json:"bot,omitempty"`
+	Bridge int    `json:"bridge,omitempty"`
+}
+
+// ConfigureFrame is sent by a client to change its options after connecting
+type ConfigureFrame struct {
+	Type string `json:"type"`
+
+	// Protocol is the version the client speaks; zero means the current one
+	Protocol     int      `json:"protocol,omitempty"`
+	Types        []string `json:"types,omitempty"`
+	MentionsOnly *bool    `json:"mentions_only,omitempty"`
+}
+
+// ConfiguredFrame acknowledges a configure frame with the client's options
+type ConfiguredFrame struct {
+	Type         string   `json:"type"`
+	Protocol     int      `json:"protocol"`
+	Types        []string `json:"types"`
+	MentionsOnly bool     `json:"mentions_only"`
+}
+
+// helloFrame builds the hello frame for a client; the caller must hold
+// messagesMux
+func (s *ChatServer) helloFrame(client *Client) HelloFrame {
+	cfg := s.Config()
+	hello := HelloFrame{
+		Type:       frameTypeHello,
+		Protocol:   protocolVersion,
+		Server:     version(),
+		ClientID:   client.id,
+		Encoding:   client.encoding,
+		BufferSize: recentMessageLimit,
+		Features:   []string{featureResume, featureFilters, featureMsgpack, featureConfigure, featureHistory, featureViewers},
+		Channels:   []string{},
+	}
+	if len(s.messages) > 0 {
+		hello.OldestSeq = s.messages[0].Seq
+	}
+	if _, held := s.logger.Held(); held {
+		hello.LoggingPaused = true
+	}
+	if cfg.Send.Enabled && !cfg.WebSocket.ReadOnly {
+		hello.Features = append(hello.Features, featureSend)
+	}
+	if !cfg.WebSocket.ReadOnly {
+		hello.Features = append(hello.Features, featureBatch)
+	}
+	if cfg.Channel != "" {
+		hello.Channels = append(hello.Channels, cfg.Channel)
+	}
+	return hello
+}
+
+// clientFrameType returns the type of a frame sent by a client
+func clientFrameType(data []byte) (string, error) {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return "", fmt.Errorf("invalid frame: %w", err)
+	}
+	return header.Type, nil
+}
+
+// configureClient applies a configure frame, returning the acknowledgement
+func configureClient(client *Client, data []byte) (ConfiguredFrame, string, error) {
+	var frame ConfigureFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return ConfiguredFrame{}, errorCodeInvalidFrame, fmt.Errorf("invalid configure frame: %w", err)
+	}
+	if frame.Protocol > protocolVersion {
+		return ConfiguredFrame{}, errorCodeUnsupportedProtocol, fmt.Errorf("protocol %d is not supported; the server speaks up to %d", frame.Protocol, protocolVersion)
+	}
+
+	list := strings.Join(frame.Types, ",")
+	types, err := parseTypes(list)
+	if err != nil {
+		return ConfiguredFrame{}, errorCodeInvalidFrame, err
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if frame.Types != nil {
+		client.types = types
+		client.filters["types"] = list
+		if types == nil {
+			delete(client.filters, "types")
+		}
+	}
+	if frame.MentionsOnly != nil {
+		client.mentionsOnly = *frame.MentionsOnly
+		client.filters["mentions_only"] = "1"
+		if !client.mentionsOnly {
+			delete(client.filters, "mentions_only")
+		}
+	}
+
+	ack := ConfiguredFrame{Type: frameTypeConfigured, Protocol: protocolVersion, Types: []string{}, MentionsOnly: client.mentionsOnly}
+	for kind := range client.types {
+		ack.Types = append(ack.Types, kind)
+	}
+	sort.Strings(ack.Types)
+	return ack, "", nil
+}
+
+// identifyClient applies a hello frame sent by a client
+func (s *ChatServer) identifyClient(client *Client, data []byte) error {
+	var frame ClientHelloFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return fmt.Errorf("invalid hello frame: %w", err)
+	}
+	if frame.Bridge < 0 {
+		return fmt.Errorf("invalid hello frame: bridge version must not be negative")
+	}
+	client.mutex.Lock()
+	client.bridge = frame.Bridge
+	client.mutex.Unlock()
+	if frame.Bot {
+		client.mutex.Lock()
+		client.bot = true
+		client.mutex.Unlock()
+		s.viewers.Leave(client)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cytube user ranks
+const (
+	rankGuest      = 0
+	rankRegistered = 1
+	rankModerator  = 2
+	rankAdmin      = 3
+	rankOwner      = 4
+	rankSiteAdmin  = 5
+)
+
+// rankPrefixes are the symbols text logs put before a username to record
+// its rank, highest rank first; guests have none. Cytube usernames can't
+// contain these characters.
+var rankPrefixes = []struct {
+	rank   int
+	symbol byte
+}{
+	{rankSiteAdmin, '!'},
+	{rankOwner, '~'},
+	{rankAdmin, '&'},
+	{rankModerator, '@'},
+	{rankRegistered, '+'},
+}
+
+// rankPrefix returns the log prefix symbol for a rank
+func rankPrefix(rank int) string {
+	for _, prefix := range rankPrefixes {
+		if rank >= prefix.rank {
+			return string(prefix.symbol)
+		}
+	}
+	return ""
+}
+
+// parseRankPrefix splits a logged username into the name and its rank
+func parseRankPrefix(username string) (string, int) {
+	if username == "" {
+		return username, rankGuest
+	}
+	for _, prefix := range rankPrefixes {
+		if username[0] == prefix.symbol {
+			return username[1:], prefix.rank
+		}
+	}
+	return username, rankGuest
+}
+
+// parseMinRank parses the optional min_rank query parameter
+func parseMinRank(c *gin.Context) (int, error) {
+	value := c.Query("min_rank")
+	if value == "" {
+		return rankGuest, nil
+	}
+	minRank, err := strconv.Atoi(value)
+	if err != nil || minRank < rankGuest {
+		return 0, fmt.Errorf("invalid min_rank parameter")
+	}
+	return minRank, nil
+}
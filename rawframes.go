@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Raw frame recording defaults
+const (
+	rawRingSize        = 200
+	defaultRawMaxBytes = 64 * 1024 * 1024
+)
+
+// rawFileMagic starts every raw frame recording
+const rawFileMagic = "CYLOGRAW"
+
+// Directions of recorded upstream frames
+const (
+	rawInbound  = "in"
+	rawOutbound = "out"
+)
+
+// RawFrame is an upstream frame as it went over the wire
+type RawFrame struct {
+	Direction string    `json:"direction"`
+	Time      time.Time `json:"time"`
+	Data      string    `json:"data"`
+}
+
+// RawRecorder keeps the last upstream frames in memory and, when enabled,
+// appends every frame to logs/raw-<date>.bin. Each record is a direction
+// byte (0 in, 1 out), the time in Unix nanoseconds as a big-endian int64,
+// the data length as a big-endian uint32 and the data. A day's file stops
+// growing once it reaches maxBytes.
+type RawRecorder struct {
+	ring     []RawFrame
+	next     int
+	record   bool
+	maxBytes int64
+	file     *os.File
+	date     string
+	written  int64
+	mutex    sync.Mutex
+}
+
+// NewRawRecorder creates a recorder from the debug config, or returns nil
+// when debugging is off
+func NewRawRecorder(cfg DebugConfig) *RawRecorder {
+	if !cfg.Enabled {
+		return nil
+	}
+	maxBytes := cfg.RawMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultRawMaxBytes
+	}
+	return &RawRecorder{ring: make([]RawFrame, 0, rawRingSize), record: cfg.RecordRaw, maxBytes: maxBytes}
+}
+
+// rawRecordingPath returns where the frames of a date are recorded
+func rawRecordingPath(date string) string {
+	return filepath.Join(logsDir, "raw-"+date+".bin")
+}
+
+// Record stores a frame; a nil recorder does nothing
+func (r *RawRecorder) Record(direction string, data []byte, now time.Time) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	frame := RawFrame{Direction: direction, Time: now, Data: string(data)}
+	if len(r.ring) < rawRingSize {
+		r.ring = append(r.ring, frame)
+	} else {
+		r.ring[r.next] = frame
+	}
+	r.next = (r.next + 1) % rawRingSize
+
+	if r.record {
+		if err := r.write(frame); err != nil {
+			log.Printf("Error recording raw frame, recording stopped: %v", err)
+			r.record = false
+		}
+	}
+}
+
+// write appends a frame to the recording of its date; the caller must hold the lock
+func (r *RawRecorder) write(frame RawFrame) error {
+	date := frame.Time.Format(logDateFormat)
+	if r.file == nil || date != r.date {
+		if err := r.open(date); err != nil {
+			return err
+		}
+	}
+
+	size := int64(13 + len(frame.Data))
+	if r.written+size > r.maxBytes {
+		return nil
+	}
+
+	record := make([]byte, 13, size)
+	if frame.Direction == rawOutbound {
+		record[0] = 1
+	}
+	binary.BigEndian.PutUint64(record[1:9], uint64(frame.Time.UnixNano()))
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(frame.Data)))
+	record = append(record, frame.Data...)
+	if _, err := r.file.Write(record); err != nil {
+		return fmt.Errorf("failed to write raw recording: %w", err)
+	}
+	r.written += size
+	return nil
+}
+
+// open switches to the recording of date, appending to it if it exists
+func (r *RawRecorder) open(date string) error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	file, err := openFile(rawRecordingPath(date), os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("failed to open raw recording: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat raw recording: %w", err)
+	}
+	if stat.Size() == 0 {
+		if _, err := file.WriteString(rawFileMagic); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write raw recording: %w", err)
+		}
+	}
+
+	r.file = file
+	r.date = date
+	r.written = stat.Size()
+	if r.written < int64(len(rawFileMagic)) {
+		r.written = int64(len(rawFileMagic))
+	}
+	return nil
+}
+
+// Frames returns the frames in the ring buffer, oldest first
+func (r *RawRecorder) Frames() []RawFrame {
+	if r == nil {
+		return []RawFrame{}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	frames := make([]RawFrame, 0, len(r.ring))
+	if len(r.ring) == rawRingSize {
+		frames = append(frames, r.ring[r.next:]...)
+		frames = append(frames, r.ring[:r.next]...)
+	} else {
+		frames = append(frames, r.ring...)
+	}
+	return frames
+}
+
+// Close closes the recording file
+func (r *RawRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// rawReplay selects a raw recording to replay instead of connecting upstream
+type rawReplay struct {
+	path  string
+	speed float64
+}
+
+// parseReplayArgs reads `replay-raw <file> [speed]` from the command line
+// arguments; speed defaults to 1 (as recorded) and 0 replays without waiting
+func parseReplayArgs(args []string) (rawReplay, error) {
+	if len(args) == 0 || args[0] != "replay-raw" {
+		return rawReplay{}, nil
+	}
+	if len(args) < 2 {
+		return rawReplay{}, fmt.Errorf("usage: cylog replay-raw <file> [speed]")
+	}
+
+	replay := rawReplay{path: args[1], speed: 1}
+	if len(args) > 2 {
+		speed, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || speed < 0 {
+			return rawReplay{}, fmt.Errorf("invalid speed %q", args[2])
+		}
+		replay.speed = speed
+	}
+	return replay, nil
+}
+
+// readRawFrame reads the next record of a raw recording
+func readRawFrame(reader io.Reader) (RawFrame, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return RawFrame{}, err
+	}
+
+	frame := RawFrame{Direction: rawInbound, Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9])))}
+	if header[0] == 1 {
+		frame.Direction = rawOutbound
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[9:13]))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return RawFrame{}, fmt.Errorf("truncated record: %w", io.ErrUnexpectedEOF)
+	}
+	frame.Data = string(data)
+	return frame, nil
+}
+
+// runReplayUpstream feeds the inbound event frames of a raw recording
+// through the same frame handler as a live connection, waiting between
+// frames as recorded divided by speed; a speed of zero doesn't wait.
+// Pings and the connect handshake are skipped since nothing is connected.
+func (s *ChatServer) runReplayUpstream(ctx context.Context, path string, speed float64) {
+	defer recoverPanic("raw replay")
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open raw recording: %v", err)
+		return
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(rawFileMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != rawFileMagic {
+		log.Printf("Failed to replay %s: not a raw frame recording", path)
+		return
+	}
+
+	log.Printf("Replaying raw frames from %s at %gx speed", path, speed)
+	s.upstream.setConnected("replay:"+filepath.Base(path), nil)
+	s.publishStatus("connected", "Replaying "+filepath.Base(path), map[string]interface{}{"url": path})
+
+	var previous time.Time
+	count := 0
+	for {
+		frame, err := readRawFrame(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading raw recording: %v", err)
+			break
+		}
+		if frame.Direction != rawInbound || !strings.HasPrefix(frame.Data, socketIOEventPrefix) {
+			continue
+		}
+
+		if speed > 0 && !previous.IsZero() && frame.Time.After(previous) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(float64(frame.Time.Sub(previous)) / speed)):
+			}
+		}
+		previous = frame.Time
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.upstream.frameReceived(time.Now())
+		s.handleCytubeFrame(nil, []byte(frame.Data))
+		count++
+	}
+
+	log.Printf("Replay of %s finished after %d frames", path, count)
+	s.upstream.setDisconnected(nil)
+	s.publishStatus("disconnected", "Replay finished", map[string]interface{}{"reason": "replay finished"})
+}
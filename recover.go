@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// panicsTotal counts panics recovered in handlers and background goroutines
+var panicsTotal = metrics.Counter("cylog_panics_total", "Panics recovered in HTTP handlers and background goroutines")
+
+// newErrorID returns a random ID for correlating an error response with app.log
+func newErrorID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// logPanic records a recovered panic and its stack trace in the application log
+func logPanic(where string, r interface{}) string {
+	id := newErrorID()
+	panicsTotal.Inc()
+	stack := debug.Stack()
+	log.Printf("Panic %s in %s: %v\n%s", id, where, r, stack)
+	errorReporter.capturePanic(where, id, r, stack)
+	return id
+}
+
+// recoverPanic logs a panic in a background goroutine instead of letting it
+// crash the process; use it as defer recoverPanic("name")
+func recoverPanic(where string) {
+	if r := recover(); r != nil {
+		logPanic(where, r)
+	}
+}
+
+// recoveryMiddleware turns handler panics into a JSON 500 response carrying
+// an error ID that matches the logged stack trace
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+
+			id := logPanic(fmt.Sprintf("%s %s", c.Request.Method, c.Request.URL.Path), r)
+
+			// Hijacked WebSocket connections and partly written responses
+			// can't carry an error body
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			writeAPIError(c, newAPIError(http.StatusInternalServerError, "internal error"), gin.H{"id": id})
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+)
+
+// ReloadResult reports which configuration changes a reload applied
+type ReloadResult struct {
+	Applied  []string `json:"applied"`
+	Rejected []string `json:"rejected"`
+}
+
+// configField describes how a top-level config setting is handled on reload
+type configField struct {
+	name  string
+	live  bool
+	value func(*Config) interface{}
+}
+
+// configFields lists the settings compared on reload; live settings are
+// applied to the running server, the rest require a restart
+var configFields = []configField{
+	{"port", false, func(c *Config) interface{} { return c.Port }},
+	{"channel", false, func(c *Config) interface{} { return c.Channel }},
+	{"channel_password", false, func(c *Config) interface{} { return c.ChannelPassword }},
+	{"loki", false, func(c *Config) interface{} { return c.Loki }},
+	{"debug", false, func(c *Config) interface{} { return c.Debug }},
+	{"access_log", false, func(c *Config) interface{} { return c.AccessLog }},
+	{"signing", false, func(c *Config) interface{} { return c.Signing }},
+	{"encryption", false, func(c *Config) interface{} { return c.Encryption }},
+	{"headless", false, func(c *Config) interface{} { return c.Headless }},
+	{"desktop", false, func(c *Config) interface{} { return c.Desktop }},
+	{"update_check", true, func(c *Config) interface{} { return c.UpdateCheck }},
+	{"trusted_proxies", false, func(c *Config) interface{} { return c.TrustedProxies }},
+	{"state_max_age_minutes", false, func(c *Config) interface{} { return c.StateMaxAgeMinutes }},
+	{"error_reporting", false, func(c *Config) interface{} { return c.ErrorReporting }},
+	{"demo", false, func(c *Config) interface{} { return c.Demo }},
+	{"fanout_workers", false, func(c *Config) interface{} { return c.FanoutWorkers }},
+	{"broadcast_queue_size", false, func(c *Config) interface{} { return c.BroadcastQueueSize }},
+	{"log_writer", false, func(c *Config) interface{} { return c.LogWriter }},
+	{"upstream", true, func(c *Config) interface{} { return c.Upstream }},
+	{"admin_token", true, func(c *Config) interface{} { return c.AdminToken }},
+	{"tokens", true, func(c *Config) interface{} { return c.Tokens }},
+	{"require_tokens", true, func(c *Config) interface{} { return c.RequireTokens }},
+	{"login", true, func(c *Config) interface{} { return c.Login }},
+	{"filters", true, func(c *Config) interface{} { return c.Filters }},
+	{"flood", true, func(c *Config) interface{} { return c.Flood }},
+	{"retention", true, func(c *Config) interface{} { return c.Retention }},
+	{"rotation", true, func(c *Config) interface{} { return c.Rotation }},
+	{"log_routes", true, func(c *Config) interface{} { return c.LogRoutes }},
+	{"kind_retention", true, func(c *Config) interface{} { return c.KindRetention }},
+	{"websocket", true, func(c *Config) interface{} { return c.WebSocket }},
+	{"send", true, func(c *Config) interface{} { return c.Send }},
+	{"sampling", true, func(c *Config) interface{} { return c.Sampling }},
+	{"username_colors", true, func(c *Config) interface{} { return c.UsernameColors }},
+	{"previews", true, func(c *Config) interface{} { return c.Previews }},
+	{"message_limits", true, func(c *Config) interface{} { return c.MessageLimits }},
+	{"strip_invisible", true, func(c *Config) interface{} { return c.StripInvisible }},
+	{"log_status_events", true, func(c *Config) interface{} { return c.LogStatusEvents }},
+	{"api_docs", true, func(c *Config) interface{} { return c.APIDocs }},
+	{"timezone", true, func(c *Config) interface{} { return c.Timezone }},
+	{"mentions", true, func(c *Config) interface{} { return c.Mentions }},
+	{"notify", true, func(c *Config) interface{} { return c.Notify }},
+	{"digest", true, func(c *Config) interface{} { return c.Digest }},
+	{"feed", true, func(c *Config) interface{} { return c.Feed }},
+	{"shares", true, func(c *Config) interface{} { return c.Shares }},
+	{"tail", true, func(c *Config) interface{} { return c.Tail }},
+	{"disk", true, func(c *Config) interface{} { return c.Disk }},
+	{"compaction", true, func(c *Config) interface{} { return c.Compaction }},
+	{"persist_logging_pause", true, func(c *Config) interface{} { return c.PersistLoggingPause }},
+}
+
+// ReloadConfig re-reads the config file and applies the settings that can
+// change live. Nothing is applied if the file fails to parse or validate;
+// settings that need a restart keep their running values.
+func (s *ChatServer) ReloadConfig() (ReloadResult, error) {
+	s.config.reload.Lock()
+	defer s.config.reload.Unlock()
+
+	result := ReloadResult{Applied: []string{}, Rejected: []string{}}
+
+	next, err := loadConfig(s.config.path)
+	if err != nil {
+		return result, err
+	}
+	if _, err := compileFilterRules(next.Filters); err != nil {
+		return result, fmt.Errorf("invalid filters: %w", err)
+	}
+
+	current := s.config.Get()
+	for _, field := range configFields {
+		if reflect.DeepEqual(field.value(current), field.value(next)) {
+			continue
+		}
+		if field.live {
+			result.Applied = append(result.Applied, field.name)
+		} else {
+			result.Rejected = append(result.Rejected, field.name)
+		}
+	}
+
+	// Settings that can't change live keep their running values
+	next.Port = current.Port
+	next.Channel = current.Channel
+	next.ChannelPassword = current.ChannelPassword
+	next.Loki = current.Loki
+	next.Debug = current.Debug
+	next.AccessLog = current.AccessLog
+	next.Headless = current.Headless
+	next.Desktop = current.Desktop
+	next.TrustedProxies = current.TrustedProxies
+	next.FanoutWorkers = current.FanoutWorkers
+	next.BroadcastQueueSize = current.BroadcastQueueSize
+	next.LogWriter = current.LogWriter
+	next.Demo = current.Demo
+	next.ErrorReporting = current.ErrorReporting
+	next.Signing = current.Signing
+	next.Encryption = current.Encryption
+	next.encryptionKey = current.encryptionKey
+
+	if err := s.filters.SetRules(next.Filters); err != nil {
+		return result, fmt.Errorf("invalid filters: %w", err)
+	}
+	s.flood.SetConfig(next.Flood)
+	loggers := []*Logger{s.logger}
+	for _, session := range s.channelSessions() {
+		loggers = append(loggers, session.logger)
+	}
+	for _, logger := range loggers {
+		logger.SetRetention(next.Retention, next.KindRetention)
+		logger.SetRoutes(next.LogRoutes)
+		logger.SetRotation(next.Rotation)
+		logger.SetSizeCap(next.Disk.MaxLogBytes)
+	}
+	s.config.current.Store(next)
+
+	// Revoked tokens take effect for requests as soon as the config is
+	// stored; their WebSocket sessions are closed here
+	s.RevokeClients()
+
+	log.Printf("Config reloaded: applied %v, requires restart %v", result.Applied, result.Rejected)
+	return result, nil
+}
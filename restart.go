@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDEnv names the environment variable a restarted process finds its
+// inherited listener's file descriptor in
+const listenFDEnv = "CYLOG_LISTEN_FD"
+
+// RequestRestart asks main to restart the server; repeated requests while
+// one is pending are ignored
+func (s *ChatServer) RequestRestart() {
+	select {
+	case s.restart <- struct{}{}:
+	default:
+	}
+}
+
+// RestartRequested returns a channel that receives restart requests
+func (s *ChatServer) RestartRequested() <-chan struct{} {
+	return s.restart
+}
+
+// listen returns the HTTP listener: the one inherited from the process that
+// restarted into this one, or a new one on port
+func listen(port int) (net.Listener, error) {
+	value := os.Getenv(listenFDEnv)
+	if value == "" {
+		return net.Listen("tcp", fmt.Sprintf(":%d", port))
+	}
+	os.Unsetenv(listenFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", listenFDEnv, value)
+	}
+	return inheritListener(fd)
+}
+
+// restartEnv returns the environment for the restarted process, pointing it
+// at the inherited listener when there is one
+func restartEnv(fd int) []string {
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, entry := range os.Environ() {
+		if strings.HasPrefix(entry, listenFDEnv+"=") {
+			continue
+		}
+		env = append(env, entry)
+	}
+	if fd >= 0 {
+		env = append(env, fmt.Sprintf("%s=%d", listenFDEnv, fd))
+	}
+	return env
+}
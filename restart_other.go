@@ -0,0 +1,39 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// notifyRestart does nothing; restarts are requested through the admin API
+func notifyRestart(c chan<- os.Signal) {}
+
+// inheritListener isn't supported on this platform
+func inheritListener(fd int) (net.Listener, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// listenerFile returns nil; the listener can't be handed over on this
+// platform, so the restarted process listens anew
+func listenerFile(ln net.Listener) (*os.File, error) {
+	return nil, nil
+}
+
+// restartProcess starts a new process of the executable; the buffer still
+// carries over through the state file
+func restartProcess(listener *os.File) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = restartEnv(-1)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Start()
+}
@@ -0,0 +1,58 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// notifyRestart relays SIGUSR2, which restarts the server, to c
+func notifyRestart(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// inheritListener wraps an inherited listener file descriptor
+func inheritListener(fd int) (net.Listener, error) {
+	file := os.NewFile(uintptr(fd), "listener")
+	defer file.Close()
+
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inherit listener: %w", err)
+	}
+	return ln, nil
+}
+
+// listenerFile duplicates the listener so it outlives the HTTP server's
+// shutdown and can be handed to the restarted process
+func listenerFile(ln net.Listener) (*os.File, error) {
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("listener can't be inherited")
+	}
+	return tcp.File()
+}
+
+// restartProcess replaces the process with a fresh start of the executable,
+// keeping its PID and passing the listener on so no connection is refused
+func restartProcess(listener *os.File) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	fd := -1
+	if listener != nil {
+		fd = int(listener.Fd())
+		if _, err := unix.FcntlInt(uintptr(fd), unix.F_SETFD, 0); err != nil {
+			return fmt.Errorf("failed to pass listener: %w", err)
+		}
+	}
+	return syscall.Exec(exe, os.Args, restartEnv(fd))
+}
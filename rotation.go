@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rotation periods; each starts a new log file of every kind
+const (
+	rotationHourly  = "hourly"
+	rotationDaily   = "daily"
+	rotationWeekly  = "weekly"
+	rotationMonthly = "monthly"
+)
+
+// Period labels used in log filenames
+const (
+	hourLabelFormat  = "2006-01-02T15"
+	monthLabelFormat = "2006-01"
+)
+
+// validRotation reports whether period is a supported rotation period; an
+// empty period means daily
+func validRotation(period string) bool {
+	switch period {
+	case "", rotationHourly, rotationDaily, rotationWeekly, rotationMonthly:
+		return true
+	}
+	return false
+}
+
+// periodStart returns the start of the period containing t
+func periodStart(period string, t time.Time) time.Time {
+	switch period {
+	case rotationHourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case rotationWeekly:
+		// ISO weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+	case rotationMonthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+}
+
+// nextRotation returns the start of the period after the one containing t
+func nextRotation(period string, t time.Time) time.Time {
+	start := periodStart(period, t)
+	switch period {
+	case rotationHourly:
+		return time.Date(start.Year(), start.Month(), start.Day(), start.Hour()+1, 0, 0, 0, start.Location())
+	case rotationWeekly:
+		return start.AddDate(0, 0, 7)
+	case rotationMonthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// periodLabel returns the filename label of the period containing t, like
+// 2025-04-16T14, 2025-04-16, 2025-W16 or 2025-04
+func periodLabel(period string, t time.Time) string {
+	switch period {
+	case rotationHourly:
+		return t.Format(hourLabelFormat)
+	case rotationWeekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case rotationMonthly:
+		return t.Format(monthLabelFormat)
+	default:
+		return t.Format(logDateFormat)
+	}
+}
+
+// parsePeriodLabel parses a filename label of any period, so files written
+// before a rotation change are still recognized, returning the period and
+// its start in local time
+func parsePeriodLabel(label string) (string, time.Time, bool) {
+	var period, layout string
+	switch {
+	case strings.Contains(label, "T"):
+		period, layout = rotationHourly, hourLabelFormat
+	case strings.Contains(label, "W"):
+		year, err := strconv.Atoi(label[:4])
+		if err != nil {
+			return "", time.Time{}, false
+		}
+		week, err := strconv.Atoi(label[6:])
+		if err != nil || week < 1 || week > 53 {
+			return "", time.Time{}, false
+		}
+		// January 4th is always in the first ISO week
+		start := periodStart(rotationWeekly, time.Date(year, time.January, 4, 0, 0, 0, 0, time.Local)).AddDate(0, 0, 7*(week-1))
+		if _, w := start.ISOWeek(); w != week {
+			return "", time.Time{}, false
+		}
+		return rotationWeekly, start, true
+	case len(label) == len(monthLabelFormat):
+		period, layout = rotationMonthly, monthLabelFormat
+	default:
+		period, layout = rotationDaily, logDateFormat
+	}
+
+	start, err := time.ParseInLocation(layout, label, time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return period, start, true
+}
+
+// SetRotation sets the rotation period; files already open are rotated on
+// their next write or when the rotation timer fires
+func (l *Logger) SetRotation(period string) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if period == "" {
+		period = rotationDaily
+	}
+	if period == l.rotation {
+		return
+	}
+	l.rotation = period
+	select {
+	case l.rotationChanged <- struct{}{}:
+	default:
+	}
+}
+
+// currentLabel returns the period label files are written under now; the
+// caller must hold logMutex
+func (l *Logger) currentLabel(now time.Time) string {
+	return periodLabel(l.rotation, now)
+}
+
+// runRotation rotates every open log file at each period boundary, so files
+// of quiet kinds are closed on time rather than on their next write
+func (l *Logger) runRotation(ctx context.Context) {
+	defer recoverPanic("log rotation")
+
+	for {
+		l.logMutex.Lock()
+		next := nextRotation(l.rotation, l.clock.Now())
+		l.logMutex.Unlock()
+
+		timer := l.clock.NewTimer(next.Sub(l.clock.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-l.rotationChanged:
+			timer.Stop()
+		case <-timer.C():
+		}
+
+		l.rotateExpired(l.clock.Now())
+	}
+}
+
+// rotateExpired rotates the open log files whose period has ended
+func (l *Logger) rotateExpired(now time.Time) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if l.closed {
+		return
+	}
+	label := l.currentLabel(now)
+	for kind, stream := range l.streams {
+		if stream.label == label {
+			continue
+		}
+		if err := l.rotateLogFile(stream, false); err != nil {
+			log.Printf("Error rotating %s log file: %v", kind, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cylog/internal/clock"
+	"cylog/internal/testsupport"
+)
+
+// newTestLogger creates a logger in a temporary directory, dated by clk and
+// closed when the test ends
+func newTestLogger(t *testing.T, clk clock.Clock) *Logger {
+	t.Helper()
+
+	logger, err := NewLoggerIn(t.TempDir(), clk)
+	if err != nil {
+		t.Fatalf("creating logger: %v", err)
+	}
+	t.Cleanup(func() { logger.Close() })
+	return logger
+}
+
+// logChat logs a chat message said at the clock's time
+func logChat(t *testing.T, logger *Logger, content string) {
+	t.Helper()
+
+	msg := Message{ID: "test", Type: messageTypeChat, Username: "alice", Timestamp: logger.clock.Now(), Content: content}
+	if err := logger.LogMessages([]Message{msg}); err != nil {
+		t.Fatalf("logging a message: %v", err)
+	}
+}
+
+// chatLogs returns the logger's chat log filenames, sorted
+func chatLogs(t *testing.T, logger *Logger) []string {
+	t.Helper()
+
+	logs, err := logger.GetAvailableLogs()
+	if err != nil {
+		t.Fatalf("listing logs: %v", err)
+	}
+	names := slices.Clone(logs[logKindChat])
+	sort.Strings(names)
+	return names
+}
+
+func TestRotationOpensNextDayAtMidnight(t *testing.T) {
+	t.Parallel()
+
+	clk := clock.NewFake(time.Date(2025, 4, 16, 23, 59, 0, 0, time.Local))
+	logger := newTestLogger(t, clk)
+	logChat(t, logger, "before midnight")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go logger.runRotation(ctx)
+	testsupport.Eventually(t, time.Second, "rotation timer not started", func() bool {
+		return clk.Timers() == 1
+	})
+
+	clk.Advance(2 * time.Minute)
+	next := filepath.Join(logger.dir, "chat-2025-04-17.log")
+	testsupport.Eventually(t, time.Second, "next day's log file not opened", func() bool {
+		_, err := os.Stat(next)
+		return err == nil
+	})
+
+	content, err := os.ReadFile(filepath.Join(logger.dir, "chat-2025-04-16.log"))
+	if err != nil {
+		t.Fatalf("reading the previous day's file: %v", err)
+	}
+	if !strings.Contains(string(content), "before midnight") {
+		t.Errorf("previous day's file lost its message: %q", content)
+	}
+}
+
+func TestRotationRollsOverPastMaxSize(t *testing.T) {
+	t.Parallel()
+
+	clk := clock.NewFake(time.Date(2025, 4, 16, 12, 0, 0, 0, time.Local))
+	logger := newTestLogger(t, clk)
+	logChat(t, logger, strings.Repeat("x", maxLogFileSize))
+	logChat(t, logger, "after the limit")
+
+	want := []string{"chat-2025-04-16.1.log", "chat-2025-04-16.log"}
+	if got := chatLogs(t, logger); !slices.Equal(got, want) {
+		t.Fatalf("log files = %v, want %v", got, want)
+	}
+	content, err := os.ReadFile(filepath.Join(logger.dir, "chat-2025-04-16.1.log"))
+	if err != nil {
+		t.Fatalf("reading the rolled over file: %v", err)
+	}
+	if !strings.Contains(string(content), "after the limit") {
+		t.Errorf("rolled over file = %q, want the message written after the limit", content)
+	}
+}
+
+func TestRetentionKeepsMaxFiles(t *testing.T) {
+	t.Parallel()
+
+	clk := clock.NewFake(time.Date(2025, 4, 16, 12, 0, 0, 0, time.Local))
+	logger := newTestLogger(t, clk)
+	logger.SetRetention(RetentionConfig{MaxFiles: 2}, nil)
+
+	for day := 0; day < 5; day++ {
+		if day > 0 {
+			clk.Advance(24 * time.Hour)
+		}
+		logChat(t, logger, "hello")
+	}
+
+	want := []string{"chat-2025-04-19.log", "chat-2025-04-20.log"}
+	testsupport.Eventually(t, time.Second, "the three oldest files not pruned", func() bool {
+		return slices.Equal(chatLogs(t, logger), want)
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// samplingTag marks the log lines recording the sampling rate, so later
+// statistics can scale the counts after them
+const samplingTag = "sampling"
+
+// Sources of the sampling rate reported by the admin API
+const (
+	samplingSourceConfig = "config"
+	samplingSourceWindow = "window"
+	samplingSourceAdmin  = "admin"
+)
+
+// SamplingWindow samples at its own rate during a daily time window
+type SamplingWindow struct {
+	// Hours is the window as HH:MM-HH:MM in the configured timezone; it may
+	// wrap past midnight
+	Hours string `yaml:"hours"`
+	Rate  int    `yaml:"rate"`
+}
+
+// SamplingConfig configures logging only a sample of chat in busy periods.
+// Every message is still broadcast; only log files and Loki are sampled.
+type SamplingConfig struct {
+	// Rate logs one in Rate chat messages; 0 or 1 logs every message
+	Rate int `yaml:"rate"`
+
+	// Windows override Rate during their hours; the first matching one wins
+	Windows []SamplingWindow `yaml:"windows"`
+
+	// KeepUsers and KeepKeywords (case-insensitive substrings) are always
+	// logged, as are mentions and every message that isn't chat
+	KeepUsers    []string `yaml:"keep_users"`
+	KeepKeywords []string `yaml:"keep_keywords"`
+}
+
+// validate checks the sampling settings
+func (c SamplingConfig) validate() error {
+	if c.Rate < 0 {
+		return fmt.Errorf("invalid sampling rate %d: must not be negative", c.Rate)
+	}
+	for _, window := range c.Windows {
+		if _, _, err := parseQuietHours(window.Hours); err != nil {
+			return fmt.Errorf("invalid sampling window: %w", err)
+		}
+		if window.Rate < 0 {
+			return fmt.Errorf("invalid sampling window %s: rate must not be negative", window.Hours)
+		}
+	}
+	return nil
+}
+
+// rateAt returns the configured rate at now, and whether a window set it
+func (c SamplingConfig) rateAt(now time.Time) (int, bool) {
+	for _, window := range c.Windows {
+		if inQuietHours(window.Hours, now) {
+			return max(window.Rate, 1), true
+		}
+	}
+	return max(c.Rate, 1), false
+}
+
+// keeps reports whether a message is logged whatever the rate
+func (c SamplingConfig) keeps(msg Message) bool {
+	if !isChatMessage(msg) {
+		return true
+	}
+	if len(msg.Mentions) > 0 {
+		return true
+	}
+	for _, user := range c.KeepUsers {
+		if strings.EqualFold(user, msg.Username) {
+			return true
+		}
+	}
+	content := strings.ToLower(msg.Content)
+	for _, keyword := range c.KeepKeywords {
+		if keyword != "" && strings.Contains(content, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SamplingStatus describes the sampling rate for the admin API
+type SamplingStatus struct {
+	Rate   int    `json:"rate"`
+	Source string `json:"source"`
+}
+
+// SamplingRequest sets the sampling rate from the admin API
+type SamplingRequest struct {
+	Rate int `json:"rate"`
+}
+
+// Sampler picks the chat messages that are logged while sampling
+type Sampler struct {
+	// override is the rate an admin set at runtime, 0 when the config applies
+	override int
+	count    int
+	mutex    sync.Mutex
+}
+
+// samplingMarker formats the log line recording a sampling rate
+func samplingMarker(rate int, now time.Time) string {
+	content := "[sampling off]"
+	if rate > 1 {
+		content = fmt.Sprintf("[sampling 1 in %d]", rate)
+	}
+	return formatLogEntry(Message{
+		Type:      messageTypeStatus,
+		Username:  "System",
+		Timestamp: now,
+		Content:   content,
+		Tags:      []string{statusTag, samplingTag},
+	})
+}
+
+// SetSampling records the sampling rate in effect, writing a marker to the
+// chat log when it changed; it reports whether it did
+func (l *Logger) SetSampling(rate int, now time.Time) (bool, error) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	rate = max(rate, 1)
+	if rate == max(l.samplingRate, 1) {
+		return false, nil
+	}
+	l.samplingRate = rate
+	return true, l.writeLine(logKindChat, samplingMarker(rate, now))
+}
+
+// SamplingStatus returns the current sampling rate and where it comes from
+func (s *ChatServer) SamplingStatus() SamplingStatus {
+	s.sampler.mutex.Lock()
+	override := s.sampler.override
+	s.sampler.mutex.Unlock()
+
+	if override > 0 {
+		return SamplingStatus{Rate: override, Source: samplingSourceAdmin}
+	}
+	cfg := s.Config()
+	rate, window := cfg.Sampling.rateAt(time.Now().In(cfg.Location()))
+	if window {
+		return SamplingStatus{Rate: rate, Source: samplingSourceWindow}
+	}
+	return SamplingStatus{Rate: rate, Source: samplingSourceConfig}
+}
+
+// SetSampling overrides the configured sampling rate until the next
+// restart, or clears the override with a rate of 0, writing a marker when
+// the rate in effect changes
+func (s *ChatServer) SetSampling(rate int) SamplingStatus {
+	// Messages queued before the change are logged at the old rate
+	s.writer.Flush(s.quit)
+
+	s.sampler.mutex.Lock()
+	s.sampler.override = rate
+	s.sampler.mutex.Unlock()
+
+	status := s.SamplingStatus()
+	s.updateSampling(status.Rate, time.Now())
+	return status
+}
+
+// updateSampling writes a marker when the sampling rate in effect changed
+func (s *ChatServer) updateSampling(rate int, now time.Time) {
+	changed, err := s.logger.SetSampling(rate, now)
+	if err != nil {
+		log.Printf("Error writing sampling marker: %v", err)
+	}
+	if changed && rate > 1 {
+		log.Printf("Logging one in %d chat messages", rate)
+	} else if changed {
+		log.Printf("Logging every message")
+	}
+}
+
+// sampleMessage reports whether a message is logged under a sampling rate
+func (s *ChatServer) sampleMessage(msg Message, rate int) bool {
+	if rate <= 1 || s.Config().Sampling.keeps(msg) {
+		return true
+	}
+
+	s.sampler.mutex.Lock()
+	defer s.sampler.mutex.Unlock()
+
+	s.sampler.count++
+	if s.sampler.count >= rate {
+		s.sampler.count = 0
+		return true
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// sanitizeAllowedTags are the elements kept in sanitized HTML, with the
+// attributes each may carry. Class is kept so Cytube emote and greentext
+// styling survives.
+var sanitizeAllowedTags = map[string][]string{
+	"a":          {"href"},
+	"b":          nil,
+	"blockquote": nil,
+	"br":         nil,
+	"code":       {"class"},
+	"del":        nil,
+	"em":         nil,
+	"i":          nil,
+	"img":        {"src", "alt", "title", "class"},
+	"p":          nil,
+	"pre":        nil,
+	"s":          nil,
+	"span":       {"class"},
+	"strong":     nil,
+	"sub":        nil,
+	"sup":        nil,
+	"u":          nil,
+}
+
+// sanitizeDroppedTags are elements removed together with their content
+var sanitizeDroppedTags = map[string]bool{
+	"iframe":   true,
+	"noscript": true,
+	"object":   true,
+	"script":   true,
+	"style":    true,
+	"template": true,
+	"textarea": true,
+}
+
+// sanitizeLinkSchemes are the URL schemes allowed in href and src
+var sanitizeLinkSchemes = map[string]bool{"http": true, "https": true}
+
+// sanitizeHTML reduces Cytube-provided HTML to an allowlist of formatting
+// tags and attributes. Unknown tags are dropped but their text kept, and
+// links are forced to open without access to the page.
+func sanitizeHTML(s string) string {
+	if !strings.ContainsAny(s, "<>&") {
+		return s
+	}
+
+	var out strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(s))
+	var open []string
+	dropping := ""
+
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if tokenizer.Err() != io.EOF {
+				break
+			}
+			// Close whatever the input left open
+			for i := len(open) - 1; i >= 0; i-- {
+				out.WriteString("</" + open[i] + ">")
+			}
+			return out.String()
+		}
+
+		token := tokenizer.Token()
+		if dropping != "" {
+			if tokenType == html.EndTagToken && token.Data == dropping {
+				dropping = ""
+			}
+			continue
+		}
+
+		switch tokenType {
+		case html.TextToken:
+			out.WriteString(html.EscapeString(token.Data))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if sanitizeDroppedTags[token.Data] {
+				if tokenType == html.StartTagToken {
+					dropping = token.Data
+				}
+				continue
+			}
+			allowed, ok := sanitizeAllowedTags[token.Data]
+			if !ok {
+				continue
+			}
+			if token.Data == "img" && sanitizeURL(attrValue(token, "src")) == "" {
+				continue
+			}
+
+			out.WriteString("<" + token.Data)
+			for _, attr := range token.Attr {
+				if !containsString(allowed, attr.Key) {
+					continue
+				}
+				value := attr.Val
+				if attr.Key == "href" || attr.Key == "src" {
+					if value = sanitizeURL(value); value == "" {
+						continue
+					}
+				}
+				out.WriteString(" " + attr.Key + `="` + html.EscapeString(value) + `"`)
+			}
+			if token.Data == "a" {
+				out.WriteString(` rel="noopener noreferrer nofollow" target="_blank"`)
+			}
+			out.WriteString(">")
+
+			if token.Data != "br" && token.Data != "img" && tokenType == html.StartTagToken {
+				open = append(open, token.Data)
+			}
+
+		case html.EndTagToken:
+			// Only close tags that are open, unwinding any left inside them
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != token.Data {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					out.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+	return html.EscapeString(s)
+}
+
+// sanitizeURL returns the URL if its scheme is allowed, or "" otherwise
+func sanitizeURL(value string) string {
+	parsed, err := url.Parse(strings.TrimSpace(value))
+	if err != nil || !sanitizeLinkSchemes[strings.ToLower(parsed.Scheme)] {
+		return ""
+	}
+	return parsed.String()
+}
+
+// attrValue returns the value of a token attribute, or "" when absent
+func attrValue(token html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// containsString reports whether list contains value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
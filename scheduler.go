@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Errors returned when triggering a job
+var (
+	errUnknownJob = errors.New("unknown job")
+	errJobRunning = errors.New("job is already running")
+)
+
+// jobFailures counts scheduled job runs that returned an error or panicked
+var jobFailures = metrics.Counter("cylog_job_failures_total", "Scheduled job runs that failed or panicked")
+
+// jobSchedule is when a job runs: every interval, or delay after the start
+// of each rotation period (hourly, daily, weekly or monthly)
+type jobSchedule struct {
+	interval func() time.Duration
+	period   string
+	delay    time.Duration
+}
+
+// every schedules a job at an interval, read before each wait so config
+// reloads apply
+func every(interval func() time.Duration) jobSchedule {
+	return jobSchedule{interval: interval}
+}
+
+// at schedules a job delay after the start of each rotation period
+func at(period string, delay time.Duration) jobSchedule {
+	return jobSchedule{period: period, delay: delay}
+}
+
+// next returns when a job last run at now runs next
+func (s jobSchedule) next(now time.Time) time.Time {
+	if s.interval != nil {
+		return now.Add(s.interval())
+	}
+	return nextRotation(s.period, now.Add(-s.delay)).Add(s.delay)
+}
+
+// String describes the schedule, like "every 10m0s" or "monthly +1h0m0s"
+func (s jobSchedule) String() string {
+	if s.interval != nil {
+		return "every " + s.interval().String()
+	}
+	if s.delay == 0 {
+		return s.period
+	}
+	return fmt.Sprintf("%s +%s", s.period, s.delay)
+}
+
+// job is a task run by the scheduler; the fields after trigger are guarded
+// by the scheduler's mutex
+type job struct {
+	name     string
+	schedule jobSchedule
+	enabled  func() bool
+	run      func(ctx context.Context) error
+	trigger  chan struct{}
+
+	running      bool
+	runs         int
+	failures     int
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastErr      string
+	nextRun      time.Time
+}
+
+// JobStatus describes a scheduled job for the admin API
+type JobStatus struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Enabled  bool   `json:"enabled"`
+	Running  bool   `json:"running"`
+	Runs     int    `json:"runs"`
+	Failures int    `json:"failures"`
+
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration float64    `json:"last_duration_seconds"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+}
+
+// Scheduler runs periodic background jobs, each in its own goroutine so a
+// slow job never delays another, and never two runs of one job at once.
+// Every job runs once when the scheduler starts.
+type Scheduler struct {
+	jobs  []*job
+	mutex sync.Mutex
+}
+
+// NewScheduler creates a scheduler without jobs
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// Add registers a job before Start; a nil enabled means always enabled.
+// A disabled job is skipped on its schedule but can still be run manually.
+func (s *Scheduler) Add(name string, schedule jobSchedule, enabled func() bool, run func(ctx context.Context) error) {
+	if enabled == nil {
+		enabled = func() bool { return true }
+	}
+	s.jobs = append(s.jobs, &job{name: name, schedule: schedule, enabled: enabled, run: run, trigger: make(chan struct{}, 1)})
+}
+
+// Start runs the jobs until ctx is canceled
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+}
+
+// loop runs a job on its schedule and when triggered
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	defer recoverPanic("job " + j.name)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		manual := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-j.trigger:
+			manual = true
+		}
+
+		if manual || j.enabled() {
+			s.execute(ctx, j)
+		}
+
+		next := j.schedule.next(time.Now())
+		s.mutex.Lock()
+		j.nextRun = next
+		s.mutex.Unlock()
+		timer.Reset(time.Until(next))
+	}
+}
+
+// execute runs a job once, recording the outcome; a panic fails the run
+// instead of stopping the job
+func (s *Scheduler) execute(ctx context.Context, j *job) {
+	start := time.Now()
+	s.mutex.Lock()
+	j.running = true
+	s.mutex.Unlock()
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic %s: %v", logPanic("job "+j.name, r), r)
+			}
+		}()
+		return j.run(ctx)
+	}()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j.running = false
+	j.runs++
+	j.lastRun = start
+	j.lastDuration = time.Since(start)
+	j.lastErr = ""
+	if err != nil {
+		j.failures++
+		j.lastErr = err.Error()
+		jobFailures.Inc()
+		log.Printf("Job %s failed: %v", j.name, err)
+	}
+}
+
+// Trigger runs a job as soon as possible, outside its schedule
+func (s *Scheduler) Trigger(name string) (JobStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, j := range s.jobs {
+		if j.name != name {
+			continue
+		}
+		if j.running {
+			return s.status(j), errJobRunning
+		}
+		select {
+		case j.trigger <- struct{}{}:
+		default:
+			// Already triggered and about to run
+		}
+		return s.status(j), nil
+	}
+	return JobStatus{}, errUnknownJob
+}
+
+// Jobs returns the status of every job in registration order
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		statuses = append(statuses, s.status(j))
+	}
+	return statuses
+}
+
+// status describes a job; the caller must hold the mutex
+func (s *Scheduler) status(j *job) JobStatus {
+	status := JobStatus{
+		Name:         j.name,
+		Schedule:     j.schedule.String(),
+		Enabled:      j.enabled(),
+		Running:      j.running,
+		Runs:         j.runs,
+		Failures:     j.failures,
+		LastDuration: j.lastDuration.Seconds(),
+		LastError:    j.lastErr,
+	}
+	if !j.lastRun.IsZero() {
+		lastRun := j.lastRun
+		status.LastRun = &lastRun
+	}
+	if !j.nextRun.IsZero() {
+		nextRun := j.nextRun
+		status.NextRun = &nextRun
+	}
+	return status
+}
+
+// registerJobRoutes registers the admin endpoints listing and running jobs
+func registerJobRoutes(admin *gin.RouterGroup, chatServer *ChatServer) {
+	admin.GET("/jobs", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.jobs.Jobs())
+	})
+
+	admin.POST("/jobs/:name/run", func(c *gin.Context) {
+		name := c.Param("name")
+		status, err := chatServer.jobs.Trigger(name)
+		switch {
+		case errors.Is(err, errUnknownJob):
+			apiError(c, http.StatusNotFound, err.Error())
+		case errors.Is(err, errJobRunning):
+			writeAPIError(c, newAPIError(http.StatusConflict, err.Error()), gin.H{"job": status})
+		default:
+			auditLog(c, "run_job", name)
+			c.JSON(http.StatusAccepted, status)
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Search limits
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+
+	// maxMatchesPerField caps the matches reported per field of a message,
+	// so a pattern like "." can't blow up the response
+	maxMatchesPerField = 50
+)
+
+// Fields a search can target
+const (
+	searchFieldContent  = "content"
+	searchFieldUsername = "username"
+)
+
+// MatchSpan is the position of a match as byte offsets, for Go and other
+// UTF-8 clients, and rune offsets, for slicing JavaScript strings of BMP text
+type MatchSpan struct {
+	Start     int `json:"start"`
+	End       int `json:"end"`
+	RuneStart int `json:"rune_start"`
+	RuneEnd   int `json:"rune_end"`
+}
+
+// SearchHit is a logged message matching a search, with the matches the
+// UI should highlight
+type SearchHit struct {
+	Message         Message     `json:"message"`
+	File            string      `json:"file"`
+	ContentMatches  []MatchSpan `json:"content_matches"`
+	UsernameMatches []MatchSpan `json:"username_matches,omitempty"`
+	MatchCount      int         `json:"match_count"`
+
+	// Truncated is set when a field had more than maxMatchesPerField matches
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Gap is set on the markers bounding a period that wasn't logged, which
+	// are returned whether or not they match
+	Gap bool `json:"gap,omitempty"`
+}
+
+// searchQuery is a compiled search; plain queries are matched as
+// case-insensitive substrings through an escaped pattern, so both kinds
+// report offsets the same way
+type searchQuery struct {
+	pattern  *regexp.Regexp
+	content  bool
+	username bool
+	filter   messageQuery
+}
+
+// parseSearchQuery parses the q, regex and fields query parameters along
+// with the usual message filters
+func parseSearchQuery(c *gin.Context) (searchQuery, error) {
+	filter, err := parseMessageQuery(c)
+	if err != nil {
+		return searchQuery{}, err
+	}
+	filter.usernameMatch = parseUsernameMatch(c, true)
+
+	q := c.Query("q")
+	if q == "" {
+		return searchQuery{}, fmt.Errorf("q parameter is required")
+	}
+	expr := "(?i)" + regexp.QuoteMeta(q)
+	if c.Query("regex") == "1" {
+		expr = q
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return searchQuery{}, fmt.Errorf("invalid regex: %w", err)
+	}
+
+	query := searchQuery{pattern: pattern, filter: filter}
+	for _, field := range strings.Split(c.DefaultQuery("fields", searchFieldContent), ",") {
+		switch strings.TrimSpace(field) {
+		case searchFieldContent:
+			query.content = true
+		case searchFieldUsername:
+			query.username = true
+		default:
+			return searchQuery{}, fmt.Errorf("invalid field %q: must be content or username", field)
+		}
+	}
+	return query, nil
+}
+
+// findMatches returns the spans of up to maxMatchesPerField matches in s and
+// whether there were more
+func (q searchQuery) findMatches(s string) ([]MatchSpan, bool) {
+	indexes := q.pattern.FindAllStringIndex(s, maxMatchesPerField+1)
+	truncated := len(indexes) > maxMatchesPerField
+	if truncated {
+		indexes = indexes[:maxMatchesPerField]
+	}
+
+	spans := make([]MatchSpan, 0, len(indexes))
+	runes, last := 0, 0
+	for _, index := range indexes {
+		// Offsets are increasing, so rune counts are carried forward
+		runes += utf8.RuneCountInString(s[last:index[0]])
+		runeStart := runes
+		runes += utf8.RuneCountInString(s[index[0]:index[1]])
+		last = index[1]
+		spans = append(spans, MatchSpan{Start: index[0], End: index[1], RuneStart: runeStart, RuneEnd: runes})
+	}
+	return spans, truncated
+}
+
+// match returns the hit for a message, or false if no targeted field matches
+func (q searchQuery) match(msg Message) (SearchHit, bool) {
+	if !q.filter.matches(msg) {
+		return SearchHit{}, false
+	}
+
+	hit := SearchHit{Message: msg, ContentMatches: []MatchSpan{}}
+	if q.content {
+		spans, truncated := q.findMatches(msg.Content)
+		hit.ContentMatches = spans
+		hit.Truncated = hit.Truncated || truncated
+	}
+	if q.username {
+		spans, truncated := q.findMatches(msg.Username)
+		hit.UsernameMatches = spans
+		hit.Truncated = hit.Truncated || truncated
+	}
+	hit.MatchCount = len(hit.ContentMatches) + len(hit.UsernameMatches)
+	return hit, hit.MatchCount > 0
+}
+
+// searchLogs returns up to limit logged chat messages matching the query on
+// the dates within [from, to], newest first
+func (s *ChatServer) searchLogs(c *gin.Context, query searchQuery, limit int) ([]SearchHit, error) {
+	from, to, err := parseDateRange(c)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.logger.GetLogsInRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]SearchHit, 0)
+	for i := len(files) - 1; i >= 0 && len(hits) < limit; i-- {
+		if err := c.Request.Context().Err(); err != nil {
+			return nil, err
+		}
+		content, err := s.logger.GetLogContent(files[i])
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(content, "\n")
+		for j := len(lines) - 1; j >= 0 && len(hits) < limit; j-- {
+			msg, ok := parseLogEntry(lines[j])
+			if ok && isGapEntry(msg) {
+				hits = append(hits, SearchHit{Message: msg, File: files[i], ContentMatches: []MatchSpan{}, Gap: true})
+				continue
+			}
+			if !ok || isStatusEntry(msg) {
+				continue
+			}
+			if hit, ok := query.match(msg); ok {
+				hit.File = files[i]
+				hits = append(hits, hit)
+			}
+		}
+	}
+	return hits, nil
+}
+
+// registerSearchRoutes registers the log search endpoint
+func registerSearchRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/search", func(c *gin.Context) {
+		query, err := parseSearchQuery(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit, err := queryNonNegative(c, "limit", defaultSearchLimit)
+		if err != nil || limit == 0 || limit > maxSearchLimit {
+			apiError(c, http.StatusBadRequest, fmt.Sprintf("invalid limit parameter: must be between 1 and %d", maxSearchLimit))
+			return
+		}
+
+		hits, err := chatServer.searchLogs(c, query, int(limit))
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, hits)
+	})
+}
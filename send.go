@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Outbound chat defaults, matching Cytube's default chat throttle
+const (
+	defaultSendBurst    = 4
+	defaultSendInterval = time.Second
+)
+
+// Outbound chat metrics
+var (
+	chatSent     = metrics.Counter("cylog_chat_sent_total", "Chat messages forwarded to Cytube from local clients")
+	chatRejected = metrics.Counter("cylog_chat_send_rejected_total", "Chat messages from local clients that could not be sent")
+)
+
+// SendConfig configures forwarding chat messages from local clients to Cytube
+type SendConfig struct {
+	// Enabled forwards client messages upstream; when false, client messages
+	// are only broadcast locally as before
+	Enabled bool `yaml:"enabled"`
+
+	// Username and Password are the Cytube account used to send; a guest
+	// login is used when Password is empty
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Burst and IntervalMillis throttle outbound messages: Burst messages may
+	// be sent at once, then one every IntervalMillis
+	Burst          int `yaml:"burst"`
+	IntervalMillis int `yaml:"interval_millis"`
+}
+
+// cytubeLogin is the payload of a login event reply
+type cytubeLogin struct {
+	Success bool   `json:"success"`
+	Name    string `json:"name"`
+	Error   string `json:"error"`
+}
+
+// sendLimiter is a token bucket throttling outbound chat messages
+type sendLimiter struct {
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// allow takes a token if one is available under cfg at now
+func (l *sendLimiter) allow(cfg SendConfig, now time.Time) bool {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = defaultSendBurst
+	}
+	interval := time.Duration(cfg.IntervalMillis) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultSendInterval
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += float64(now.Sub(l.last)) / float64(interval)
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// emitUpstream sends a Socket.IO event to the Cytube connection
+func (s *ChatServer) emitUpstream(conn *websocket.Conn, name string, data interface{}) error {
+	frame, err := socketIOEvent(name, data)
+	if err != nil {
+		return err
+	}
+	return s.writeUpstream(conn, frame)
+}
+
+// socketIOEvent encodes a Socket.IO event frame like 42["name",data]
+func socketIOEvent(name string, data interface{}) ([]byte, error) {
+	payload, err := json.Marshal([]interface{}{name, data})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	return append([]byte(socketIOEventPrefix), payload...), nil
+}
+
+// login authenticates with the configured Cytube account, if any
+func (s *ChatServer) login(conn *websocket.Conn) {
+	cfg := s.Config().Send
+	if !cfg.Enabled || cfg.Username == "" {
+		return
+	}
+
+	credentials := map[string]string{"name": cfg.Username}
+	if cfg.Password != "" {
+		credentials["pw"] = cfg.Password
+	}
+	if err := s.emitUpstream(conn, "login", credentials); err != nil {
+		log.Printf("Error logging in to Cytube as %s: %v", cfg.Username, err)
+	}
+}
+
+// handleLogin records the result of a login attempt
+func (s *ChatServer) handleLogin(result cytubeLogin) {
+	if !result.Success {
+		log.Printf("Cytube login failed: %s", result.Error)
+		s.upstream.setAccount("")
+		return
+	}
+
+	log.Printf("Logged in to Cytube as %s", result.Name)
+	s.upstream.setAccount(result.Name)
+}
+
+// sendChat forwards a message from a local client to Cytube. The message is
+// not broadcast locally; it appears once Cytube echoes it back as chatMsg.
+func (s *ChatServer) sendChat(msg Message) error {
+	conn, account := s.upstream.session()
+	if conn == nil {
+		chatRejected.Inc()
+		return fmt.Errorf("not connected to Cytube")
+	}
+	if account == "" {
+		chatRejected.Inc()
+		return fmt.Errorf("not logged in to Cytube")
+	}
+	if !s.sendLimiter.allow(s.Config().Send, time.Now()) {
+		chatRejected.Inc()
+		return fmt.Errorf("sending too fast, slow down")
+	}
+
+	if err := s.emitUpstream(conn, "chatMsg", map[string]interface{}{"msg": msg.Content, "meta": map[string]interface{}{}}); err != nil {
+		chatRejected.Inc()
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+
+	chatSent.Inc()
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"cylog/internal/testsupport"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer opens the chat server and builds the router the binary
+// would for cfg, in a fresh working directory. The hub isn't started.
+func newTestServer(tb testing.TB, cfg *Config) (*ChatServer, *gin.Engine) {
+	tb.Helper()
+
+	testsupport.Workdir(tb, ".")
+	chatServer, err := openChatServer("", cfg)
+	if err != nil {
+		tb.Fatalf("opening the chat server: %v", err)
+	}
+	tb.Cleanup(func() { chatServer.logger.Close() })
+	return chatServer, setupGinServer(tb.Context(), chatServer)
+}
+
+func TestLogFileETagPerRepresentation(t *testing.T) {
+	chatServer, router := newTestServer(t, defaultConfig())
+	now := chatServer.logger.clock.Now()
+	var msgs []Message
+	for _, content := range []string{"one", "two", "three"} {
+		msgs = append(msgs, Message{ID: content, Type: messageTypeChat, Username: "alice", Timestamp: now, Content: content})
+	}
+	if err := chatServer.logger.LogMessages(msgs); err != nil {
+		t.Fatalf("logging messages: %v", err)
+	}
+	path := "/api/v1/logs/" + logFileName(logKindChat, now.Format("2006-01-02"), 0)
+
+	get := func(query, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path+query, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	plain := get("", "").Header().Get("ETag")
+	if plain == "" {
+		t.Fatal("no ETag on the plain file")
+	}
+	seen := map[string]string{plain: ""}
+	for _, query := range []string{"?format=json", "?format=ndjson", "?format=json&limit=1", "?format=json&offset=1&limit=1"} {
+		w := get(query, plain)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s with the plain file's ETag: status %d, want 200", query, w.Code)
+		}
+		etag := w.Header().Get("ETag")
+		if other, ok := seen[etag]; ok {
+			t.Errorf("%s has the same ETag as %q", query, other)
+		}
+		seen[etag] = query
+		if w := get(query, etag); w.Code != http.StatusNotModified {
+			t.Errorf("%s with its own ETag: status %d, want 304", query, w.Code)
+		}
+	}
+	if w := get("", plain); w.Code != http.StatusNotModified {
+		t.Errorf("plain file with its own ETag: status %d, want 304", w.Code)
+	}
+}
+
+func TestPMLogsNeedAdmin(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminToken = "admin-secret"
+	cfg.Tokens = []APIToken{{Name: "viewer", Hash: hashToken("viewer-secret"), Scopes: []string{scopeRead}}}
+	chatServer, router := newTestServer(t, cfg)
+	now := chatServer.logger.clock.Now()
+	msgs := []Message{
+		{ID: "1", Type: messageTypeChat, Username: "alice", Timestamp: now, Content: "hello"},
+		{ID: "2", Type: messageTypePM, Username: "alice", Timestamp: now, Content: "a secret", Meta: map[string]interface{}{"to": "bob"}},
+	}
+	if err := chatServer.logger.LogMessages(msgs); err != nil {
+		t.Fatalf("logging messages: %v", err)
+	}
+	chatServer.messages = msgs
+	pmLog := logFileName(logKindPM, now.Format("2006-01-02"), 0)
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, token := range []string{"", "viewer-secret", "admin-secret"} {
+		admin := token == "admin-secret"
+		want := http.StatusForbidden
+		if admin {
+			want = http.StatusOK
+		}
+		for _, path := range []string{"/api/v1/logs/" + pmLog, "/api/v1/logs/" + pmLog + "/meta"} {
+			if w := request(http.MethodGet, path, token); w.Code != want {
+				t.Errorf("GET %s with token %q: status %d, want %d", path, token, w.Code, want)
+			}
+		}
+		if w := request(http.MethodHead, "/api/v1/logs/"+pmLog, token); w.Code != want {
+			t.Errorf("HEAD %s with token %q: status %d, want %d", pmLog, token, w.Code, want)
+		}
+
+		for _, path := range []string{"/api/v1/logs", "/api/v1/logs?group=kind", "/api/v1/logs?detail=1", "/logs"} {
+			w := request(http.MethodGet, path, token)
+			if listed := strings.Contains(w.Body.String(), pmLog); listed != admin {
+				t.Errorf("GET %s with token %q: PM log listed = %v, want %v", path, token, listed, admin)
+			}
+		}
+		w := request(http.MethodGet, "/api/v1/messages", token)
+		if listed := strings.Contains(w.Body.String(), "a secret"); listed != admin {
+			t.Errorf("GET /api/v1/messages with token %q: PM returned = %v, want %v", token, listed, admin)
+		}
+		if !strings.Contains(w.Body.String(), "hello") {
+			t.Errorf("GET /api/v1/messages with token %q left out the chat message: %s", token, w.Body.String())
+		}
+	}
+}
+
+func TestTokensNotLoggedToStdout(t *testing.T) {
+	var out bytes.Buffer
+	defaultWriter := gin.DefaultWriter
+	gin.DefaultWriter = &out
+	log.SetOutput(&out)
+	t.Cleanup(func() {
+		gin.DefaultWriter = defaultWriter
+		log.SetOutput(os.Stderr)
+	})
+
+	cfg := defaultConfig()
+	cfg.Tokens = []APIToken{{Name: "viewer", Hash: hashToken("viewer-secret"), Scopes: []string{scopeRead}}}
+	_, router := newTestServer(t, cfg)
+	for _, path := range []string{"/api/v1/messages?token=viewer-secret", "/api/v1/missing?token=viewer-secret"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if strings.Contains(out.String(), "viewer-secret") {
+		t.Errorf("token written to the process output:\n%s", out.String())
+	}
+}
+
+func TestForwardedForOnlyFromTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		wantIP  string
+	}{
+		{name: "untrusted peer", trusted: []string{"10.0.0.0/8"}, wantIP: "127.0.0.1"},
+		{name: "no trusted proxies", wantIP: "127.0.0.1"},
+		{name: "trusted proxy", trusted: []string{"127.0.0.1"}, wantIP: "203.0.113.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := testsupport.NewFakeCytube(t)
+			cfg := defaultConfig()
+			cfg.AdminToken = "admin-secret"
+			cfg.TrustedProxies = tt.trusted
+			cfg.WebSocket.MaxClientsPerIP = 1
+			chatServer, baseURL := runTestServer(t.Context(), t, cfg, upstream)
+			spoofed := tt.wantIP != "127.0.0.1"
+
+			request := func(path, forwardedFor string) *http.Response {
+				req, err := http.NewRequest(http.MethodGet, baseURL+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Authorization", "Bearer admin-secret")
+				req.Header.Set("X-Forwarded-For", forwardedFor)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("requesting %s: %v", path, err)
+				}
+				t.Cleanup(func() { resp.Body.Close() })
+				return resp
+			}
+
+			// The access log records the address Gin resolved
+			request("/api/v1/status", "203.0.113.1").Body.Close()
+			testsupport.Eventually(t, e2eTimeout, "request not in the access log", func() bool {
+				content, _ := os.ReadFile(filepath.Join(logsDir, accessLogFileName))
+				return strings.Contains(string(content), "/api/v1/status")
+			})
+			content, _ := os.ReadFile(filepath.Join(logsDir, accessLogFileName))
+			if !strings.HasPrefix(string(content), tt.wantIP+" ") {
+				t.Errorf("access log entry %q, want it from %s", content, tt.wantIP)
+			}
+
+			// The per-address connection cap and the client list see the
+			// same address
+			wsURL := "ws" + strings.TrimPrefix(baseURL, "http") + "/ws"
+			first, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-Forwarded-For": {"203.0.113.1"}})
+			if err != nil {
+				t.Fatalf("connecting the first client: %v", err)
+			}
+			t.Cleanup(func() { first.Close() })
+			testsupport.Eventually(t, e2eTimeout, "client not registered", func() bool {
+				return len(chatServer.Clients()) == 1
+			})
+			second, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-Forwarded-For": {"203.0.113.2"}})
+			if err == nil {
+				t.Cleanup(func() { second.Close() })
+			}
+			if refused := resp != nil && resp.StatusCode == http.StatusServiceUnavailable; refused == spoofed {
+				t.Errorf("second client from another forwarded address: refused %v, want %v", refused, !spoofed)
+			}
+
+			var clients []ClientInfo
+			if err := json.NewDecoder(request("/api/v1/admin/clients", "203.0.113.9").Body).Decode(&clients); err != nil {
+				t.Fatalf("decoding the client list: %v", err)
+			}
+			if len(clients) == 0 || clients[0].RemoteAddr != tt.wantIP {
+				t.Errorf("clients = %+v, want the first from %s", clients, tt.wantIP)
+			}
+		})
+	}
+}
+
+// runTestServer starts the chat server for cfg against upstream and serves
+// its router on a random port, returning the base URL. Upstream is dialed
+// directly, whatever the environment says, unless cfg names a proxy. The
+// server shuts down, closing its logs, when ctx is canceled; the test waits
+// for it to.
+func runTestServer(ctx context.Context, t *testing.T, cfg *Config, upstream *testsupport.FakeCytube) (*ChatServer, string) {
+	t.Helper()
+
+	cfg.Channel = "test"
+	cfg.Upstream.URLs = []string{upstream.URL()}
+	if cfg.Upstream.Proxy == "" {
+		cfg.Upstream.Proxy = "direct"
+	}
+	chatServer, router := newTestServer(t, cfg)
+	chatServer.retryDelay = 10 * time.Millisecond
+	baseURL := testsupport.Serve(t, router)
+
+	chatServer.Run(ctx)
+	t.Cleanup(func() { <-chatServer.Done() })
+	return chatServer, baseURL
+}
+
+// waitGoroutines waits for the number of goroutines to fall to at most
+// want, as closed connections wind down
+func waitGoroutines(t *testing.T, want int) {
+	t.Helper()
+
+	testsupport.Eventually(t, 5*time.Second, fmt.Sprintf("goroutines not back to %d", want), func() bool {
+		return runtime.NumGoroutine() <= want
+	})
+}
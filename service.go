@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// serviceName is the name cylog is registered under with the service manager
+const serviceName = "cylog"
+
+// serviceStatus reports the server's lifecycle to the service manager
+type serviceStatus interface {
+	// Ready reports that the server is accepting connections
+	Ready()
+
+	// Stopping reports that a graceful shutdown has begun
+	Stopping()
+
+	// Stopped reports that the shutdown is complete; the process exits next
+	Stopped()
+}
+
+// noService is the status reporter used outside of service mode
+type noService struct{}
+
+func (noService) Ready()    {}
+func (noService) Stopping() {}
+func (noService) Stopped()  {}
+
+// hasArg reports whether a flag such as --demo was given on the command line
+func hasArg(name string) bool {
+	for _, arg := range os.Args[1:] {
+		if arg == name {
+			return true
+		}
+	}
+	return false
+}
+
+// argValue returns the value of a command-line flag given as --name=value
+// or --name value, and whether it was given
+func argValue(name string) (string, bool) {
+	args := os.Args[1:]
+	for i, arg := range args {
+		if value, ok := strings.CutPrefix(arg, name+"="); ok {
+			return value, true
+		}
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// runServiceCommand runs `cylog service install|uninstall|start|stop`
+func runServiceCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cylog service install|uninstall|start|stop")
+		return 2
+	}
+	if err := controlService(args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to %s service: %v\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("Service %s: %s done\n", serviceName, args[0])
+	return 0
+}
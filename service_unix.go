@@ -0,0 +1,106 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// serviceConsole is whether stdout is kept for logging in service mode;
+// under systemd it goes to the journal
+const serviceConsole = true
+
+// enterServiceDir is a no-op; systemd units set WorkingDirectory
+func enterServiceDir() error {
+	return nil
+}
+
+// controlService isn't supported; systemd units are managed with systemctl
+func controlService(command string) error {
+	return fmt.Errorf("not supported on this platform; use a systemd unit with Type=notify and --service")
+}
+
+// systemdService reports to systemd over NOTIFY_SOCKET and sends watchdog
+// pings while the server runs
+type systemdService struct {
+	socket string
+	stop   chan struct{}
+}
+
+// startService returns the systemd status reporter; without NOTIFY_SOCKET
+// nothing is reported. cancel isn't needed: systemd stops services with
+// SIGTERM, which already cancels the server.
+func startService(cancel func()) (serviceStatus, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return noService{}, nil
+	}
+	return &systemdService{socket: socket, stop: make(chan struct{})}, nil
+}
+
+// notify sends a state such as READY=1 to systemd
+func (s *systemdService) notify(state string) {
+	addr := &net.UnixAddr{Name: s.socket, Net: "unixgram"}
+	// Abstract sockets are given with a leading @
+	if addr.Name[0] == '@' {
+		addr.Name = "\x00" + addr.Name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, or
+// zero when the watchdog is off or meant for another process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Ready sends READY=1 and starts the watchdog pings at half the interval
+func (s *systemdService) Ready() {
+	s.notify("READY=1")
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
+
+// Stopping sends STOPPING=1 and stops the watchdog pings
+func (s *systemdService) Stopping() {
+	close(s.stop)
+	s.notify("STOPPING=1")
+}
+
+// Stopped is a no-op; systemd notices the process exit
+func (s *systemdService) Stopped() {}
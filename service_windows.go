@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceConsole is whether stdout is kept for logging in service mode;
+// Windows services have no console, so only app.log is written
+const serviceConsole = false
+
+// serviceStopTimeout is how long stop waits for the service to stop
+const serviceStopTimeout = 30 * time.Second
+
+// enterServiceDir changes to the executable's directory, since services
+// start in the system directory and cylog keeps its files next to itself
+func enterServiceDir() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return os.Chdir(filepath.Dir(exe))
+}
+
+// controlService installs, uninstalls, starts or stops the Windows service
+func controlService(command string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if command == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		service, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: desktopAppTitle,
+			Description: "Logs and serves Cytube channel chat",
+			StartType:   mgr.StartAutomatic,
+		}, "--service")
+		if err != nil {
+			return err
+		}
+		return service.Close()
+	}
+
+	service, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	switch command {
+	case "uninstall":
+		return service.Delete()
+	case "start":
+		return service.Start("--service")
+	case "stop":
+		status, err := service.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		for deadline := time.Now().Add(serviceStopTimeout); status.State != svc.Stopped; {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for the service to stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = service.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// windowsService handles service control requests from the SCM
+type windowsService struct {
+	cancel  func()
+	ready   chan struct{}
+	stopped chan struct{}
+	done    chan struct{}
+}
+
+// startService hands the process to the SCM dispatcher; stop and shutdown
+// requests cancel the server through cancel
+func startService(cancel func()) (serviceStatus, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return nil, err
+	}
+	if !isService {
+		return noService{}, nil
+	}
+
+	service := &windowsService{cancel: cancel, ready: make(chan struct{}), stopped: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(service.done)
+		if err := svc.Run(serviceName, service); err != nil {
+			fmt.Fprintf(os.Stderr, "Service dispatcher error: %v\n", err)
+			cancel()
+		}
+	}()
+	return service, nil
+}
+
+// Execute runs the SCM request loop until the server has stopped
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	select {
+	case <-s.ready:
+	case <-s.stopped:
+		return false, 0
+	}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-s.stopped:
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				s.cancel()
+			}
+		}
+	}
+}
+
+// Ready reports the service as running
+func (s *windowsService) Ready() {
+	close(s.ready)
+}
+
+// Stopping is reported when the stop request arrives
+func (s *windowsService) Stopping() {}
+
+// Stopped lets Execute return and waits for the SCM to be told the
+// service has stopped
+func (s *windowsService) Stopped() {
+	close(s.stopped)
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+	}
+}
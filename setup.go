@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"cylog/internal/setup"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+// setupProbeTimeout bounds the wizard's test connection to the channel
+const setupProbeTimeout = 15 * time.Second
+
+// setupFile is the config file the wizard writes
+type setupFile struct {
+	Channel  string `yaml:"channel"`
+	Port     int    `yaml:"port"`
+	Headless bool   `yaml:"headless"`
+	Upstream struct {
+		URLs         []string `yaml:"urls,omitempty"`
+		DiscoveryURL string   `yaml:"discovery_url,omitempty"`
+	} `yaml:"upstream"`
+}
+
+// shouldRunSetup reports whether to run the first-run wizard: there is no
+// config file yet, nobody opted out with --non-interactive, and stdin is a
+// terminal to answer on
+func shouldRunSetup(path string) bool {
+	if hasArg("--non-interactive") || hasArg("--service") || hasArg("--demo") {
+		return false
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// runSetup runs the first-run wizard on the terminal and writes its answers
+// to the config file at path
+func runSetup(path string) error {
+	wizard := setup.New(os.Stdin, os.Stdout, probeChannel)
+	answers, err := wizard.Run(setup.Answers{URL: webSocketURL, Port: appPort})
+	if err != nil {
+		return err
+	}
+
+	var file setupFile
+	file.Channel = answers.Channel
+	file.Port = answers.Port
+	file.Headless = answers.Headless
+	upstream := setupUpstream(answers)
+	file.Upstream.URLs = upstream.URLs
+	file.Upstream.DiscoveryURL = upstream.DiscoveryURL
+
+	data, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	data = append([]byte("# Written by the cylog setup wizard; see the README for every option\n"), data...)
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	fmt.Printf("Saved %s\n", path)
+	return nil
+}
+
+// setupUpstream returns the upstream settings for the wizard's answers: a
+// WebSocket URL is dialed directly, and for a site the channel's server is
+// looked up from its socketconfig
+func setupUpstream(answers setup.Answers) UpstreamConfig {
+	if answers.IsSite() {
+		site := strings.TrimSuffix(answers.URL, "/")
+		return UpstreamConfig{DiscoveryURL: site + "/socketconfig/" + answers.Channel + ".json"}
+	}
+	return UpstreamConfig{URLs: []string{answers.URL}}
+}
+
+// probeChannel connects to Cytube with the wizard's answers and joins the
+// channel, so a mistyped server or channel shows up before it is saved
+func probeChannel(answers setup.Answers) error {
+	ctx, cancel := context.WithTimeout(context.Background(), setupProbeTimeout)
+	defer cancel()
+
+	cfg := setupUpstream(answers)
+	urls := cfg.URLs
+	if cfg.DiscoveryURL != "" {
+		discovered, err := discoverUpstreams(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		urls = discovered
+	}
+	dialer, err := cfg.dialer()
+	if err != nil {
+		return err
+	}
+
+	var conn *websocket.Conn
+	for _, candidate := range urls {
+		if conn, _, err = dialer.DialContext(ctx, candidate, nil); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	joined := false
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("no answer from the channel: %w", err)
+		}
+
+		frame := string(data)
+		switch {
+		case frame == engineIOPing:
+			conn.WriteMessage(websocket.TextMessage, []byte(engineIOPong))
+			continue
+		case frame == socketIOConnect && !joined:
+			join := fmt.Sprintf(`%s["joinChannel",{"name":%q}]`, socketIOEventPrefix, answers.Channel)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(join)); err != nil {
+				return fmt.Errorf("failed to join: %w", err)
+			}
+			joined = true
+			continue
+		}
+
+		event, ok := parseCytubeEvent(data)
+		if !ok || !joined {
+			continue
+		}
+		switch event.Name {
+		case "kick", "errorMsg", "errorMessage":
+			return fmt.Errorf("the server refused: %s", event.Data)
+		case "userlist", "setMotd", "channelOpts", "rank", "setPermissions":
+			return nil
+		}
+	}
+}
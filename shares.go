@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sharesFileName is the file in the logs directory share links are persisted to
+const sharesFileName = "shares.json"
+
+// shareSlugBytes is the number of random bytes in a share slug
+const shareSlugBytes = 16
+
+// Share link defaults
+const (
+	defaultShareExpiryHours = 7 * 24
+	defaultShareMaxHours    = 30 * 24
+)
+
+// ShareConfig configures read-only share links of log excerpts
+type ShareConfig struct {
+	// DefaultExpiryHours is how long a share link works when its creator
+	// doesn't say
+	DefaultExpiryHours int `yaml:"default_expiry_hours"`
+
+	// MaxExpiryHours caps the expiry a creator may ask for; zero allows any
+	MaxExpiryHours int `yaml:"max_expiry_hours"`
+}
+
+// validate checks the share settings
+func (c ShareConfig) validate() error {
+	if c.DefaultExpiryHours <= 0 {
+		return fmt.Errorf("invalid shares default_expiry_hours %d: must be positive", c.DefaultExpiryHours)
+	}
+	if c.MaxExpiryHours < 0 {
+		return fmt.Errorf("invalid shares max_expiry_hours %d: must not be negative", c.MaxExpiryHours)
+	}
+	if c.MaxExpiryHours > 0 && c.DefaultExpiryHours > c.MaxExpiryHours {
+		return fmt.Errorf("invalid shares default_expiry_hours %d: exceeds max_expiry_hours %d", c.DefaultExpiryHours, c.MaxExpiryHours)
+	}
+	return nil
+}
+
+// ShareRequest is the body of a share link creation request
+type ShareRequest struct {
+	From time.Time `json:"from" binding:"required"`
+	To   time.Time `json:"to" binding:"required"`
+
+	// User, Exact, Types, MinRank and Query filter the excerpt like the
+	// user, exact, type, min_rank and q query parameters
+	User    string   `json:"user,omitempty"`
+	Exact   bool     `json:"exact,omitempty"`
+	Types   []string `json:"types,omitempty"`
+	MinRank int      `json:"min_rank,omitempty"`
+	Query   string   `json:"q,omitempty"`
+
+	// Anonymize replaces usernames with User 1, User 2 and so on, in the
+	// sender and in the text
+	Anonymize bool `json:"anonymize,omitempty"`
+
+	// ExpiresInHours defaults to shares.default_expiry_hours
+	ExpiresInHours int `json:"expires_in_hours,omitempty"`
+}
+
+// Share is a read-only link to a log excerpt: the messages within a time
+// range selected by fixed filters
+type Share struct {
+	Slug      string    `json:"slug"`
+	Path      string    `json:"path"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	User      string    `json:"user,omitempty"`
+	Exact     bool      `json:"exact,omitempty"`
+	Types     []string  `json:"types,omitempty"`
+	MinRank   int       `json:"min_rank,omitempty"`
+	Query     string    `json:"q,omitempty"`
+	Anonymize bool      `json:"anonymize,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// expired reports whether the share no longer works at now
+func (s Share) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// query returns the message filters of the share
+func (s Share) query() messageQuery {
+	query := messageQuery{minRank: s.MinRank, username: s.User, keyword: s.Query}
+	if s.Exact {
+		query.usernameMatch = usernameMatchExact
+	}
+	if len(s.Types) > 0 {
+		query.types = make(map[string]bool, len(s.Types))
+		for _, name := range s.Types {
+			query.types[name] = true
+		}
+	}
+	return query
+}
+
+// SharedExcerpt is the JSON view of a share link
+type SharedExcerpt struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Count     int       `json:"count"`
+	Messages  []Message `json:"messages"`
+}
+
+// ShareStore holds the share links, persisted so they survive a restart
+type ShareStore struct {
+	path   string
+	shares map[string]Share
+	mutex  sync.Mutex
+}
+
+// NewShareStore creates a share store, loading the persisted links if
+// present; expired links are dropped
+func NewShareStore(path string) (*ShareStore, error) {
+	store := &ShareStore{path: path, shares: make(map[string]Share)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read shares file: %w", err)
+	}
+
+	var shares []Share
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, fmt.Errorf("failed to parse shares file: %w", err)
+	}
+	now := time.Now()
+	for _, share := range shares {
+		if !share.expired(now) {
+			store.shares[share.Slug] = share
+		}
+	}
+	return store, nil
+}
+
+// sharesPath returns the default location of the share links
+func sharesPath() string {
+	return filepath.Join(logsDir, sharesFileName)
+}
+
+// newShareSlug returns an unguessable URL-safe slug
+func newShareSlug() (string, error) {
+	b := make([]byte, shareSlugBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Add stores a new share link under a fresh slug
+func (s *ShareStore) Add(share Share) (Share, error) {
+	slug, err := newShareSlug()
+	if err != nil {
+		return Share{}, fmt.Errorf("failed to generate share slug: %w", err)
+	}
+	share.Slug = slug
+	share.Path = "/share/" + slug
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.shares[slug] = share
+	if err := s.save(); err != nil {
+		delete(s.shares, slug)
+		return Share{}, err
+	}
+	return share, nil
+}
+
+// Get returns the share link with slug, unless it has expired
+func (s *ShareStore) Get(slug string) (Share, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	share, ok := s.shares[slug]
+	if !ok || share.expired(time.Now()) {
+		return Share{}, false
+	}
+	return share, true
+}
+
+// List returns the share links that haven't expired, newest first
+func (s *ShareStore) List() []Share {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	shares := make([]Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		if !share.expired(now) {
+			shares = append(shares, share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedAt.After(shares[j].CreatedAt)
+	})
+	return shares
+}
+
+// Revoke deletes a share link, reporting whether it existed
+func (s *ShareStore) Revoke(slug string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	share, ok := s.shares[slug]
+	if !ok {
+		return false, nil
+	}
+	delete(s.shares, slug)
+	if err := s.save(); err != nil {
+		s.shares[slug] = share
+		return false, err
+	}
+	return !share.expired(time.Now()), nil
+}
+
+// save persists the links that haven't expired, dropping the others; the
+// caller holds the mutex
+func (s *ShareStore) save() error {
+	now := time.Now()
+	shares := make([]Share, 0, len(s.shares))
+	for slug, share := range s.shares {
+		if share.expired(now) {
+			delete(s.shares, slug)
+			continue
+		}
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedAt.Before(shares[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode shares: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("failed to write shares file: %w", err)
+	}
+	return nil
+}
+
+// newShare validates a share link request, with now bounding its range
+func newShare(req ShareRequest, cfg ShareConfig, now time.Time) (Share, error) {
+	if last := now.Truncate(time.Second).Add(-time.Second); req.To.After(last) {
+		// Log lines have whole seconds, so the current second could still
+		// gain messages and change the excerpt after it was shared
+		req.To = last
+	}
+	if !req.From.Before(req.To) {
+		return Share{}, errors.New("from must be before to, and in the past")
+	}
+	if _, err := parseTypes(strings.Join(req.Types, ",")); err != nil {
+		return Share{}, err
+	}
+	if req.MinRank < 0 {
+		return Share{}, errors.New("min_rank must not be negative")
+	}
+
+	hours := req.ExpiresInHours
+	switch {
+	case hours < 0:
+		return Share{}, errors.New("expires_in_hours must not be negative")
+	case hours == 0:
+		hours = cfg.DefaultExpiryHours
+	case cfg.MaxExpiryHours > 0 && hours > cfg.MaxExpiryHours:
+		return Share{}, fmt.Errorf("expires_in_hours must be at most %d", cfg.MaxExpiryHours)
+	}
+
+	return Share{
+		From:      req.From,
+		To:        req.To,
+		User:      req.User,
+		Exact:     req.Exact,
+		Types:     req.Types,
+		MinRank:   req.MinRank,
+		Query:     req.Query,
+		Anonymize: req.Anonymize,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(hours) * time.Hour),
+	}, nil
+}
+
+// shareMessages reads the logged messages of a share link: those within
+// its time range that pass its filters, with the markers of any gaps
+func (s *ChatServer) shareMessages(share Share) ([]Message, error) {
+	files, err := s.logger.GetLogsInRange(share.From, share.To.Add(maxBatchLateness))
+	if err != nil {
+		return nil, err
+	}
+
+	query := share.query()
+	msgs := make([]Message, 0)
+	for _, file := range files {
+		content, err := s.logger.GetLogContent(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(content, "\n") {
+			msg, ok := parseLogEntry(line)
+			if !ok || msg.Timestamp.Before(share.From) || msg.Timestamp.After(share.To) {
+				continue
+			}
+			if !isGapEntry(msg) && (isStatusEntry(msg) || !query.matches(msg)) {
+				continue
+			}
+			if len(msgs) >= maxExportMessages {
+				return nil, fmt.Errorf("range too large: at most %d messages can be shared", maxExportMessages)
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	sortByTimestamp(msgs)
+	return msgs, nil
+}
+
+// anonymizeMessages replaces the senders of msgs with User 1, User 2 and so
+// on in order of appearance, and their names in message text likewise.
+// HTML from Cytube can't be rewritten safely, so it is dropped and the
+// message rendered from its text.
+func anonymizeMessages(msgs []Message) []Message {
+	aliases := make(map[string]string)
+	names := make([]string, 0)
+	for _, msg := range msgs {
+		if msg.Username == "" || msg.Kind() == messageTypeSystem {
+			continue
+		}
+		key := strings.ToLower(msg.Username)
+		if _, ok := aliases[key]; !ok {
+			aliases[key] = fmt.Sprintf("User %d", len(aliases)+1)
+			names = append(names, regexp.QuoteMeta(msg.Username))
+		}
+	}
+	if len(names) == 0 {
+		return msgs
+	}
+
+	// Longer names first, so a name containing another is replaced whole
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	mentions := regexp.MustCompile(`(?i)\b(` + strings.Join(names, "|") + `)\b`)
+	replace := func(text string) string {
+		return mentions.ReplaceAllStringFunc(text, func(name string) string {
+			return aliases[strings.ToLower(name)]
+		})
+	}
+
+	anonymized := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		if alias, ok := aliases[strings.ToLower(msg.Username)]; ok && msg.Kind() != messageTypeSystem {
+			msg.Username = alias
+		}
+		msg.Content = replace(msg.Content)
+		msg.HTML = ""
+		msg.Mentions = nil
+		anonymized[i] = msg
+	}
+	return anonymized
+}
+
+// sharedMessage returns the public view of a shared message: its HTML
+// sanitized, without the metadata only the API exposes
+func (s *ChatServer) sharedMessage(msg Message) Message {
+	return Message{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Username:  msg.Username,
+		Rank:      msg.Rank,
+		Timestamp: msg.Timestamp,
+		Content:   msg.Content,
+		HTML:      s.renderExportHTML(msg),
+		Tags:      msg.Tags,
+		Links:     msg.Links,
+	}
+}
+
+// registerShareRoutes registers the admin endpoints managing share links
+func registerShareRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	admin := requireAdmin(chatServer.config)
+
+	api.POST("/shares", admin, func(c *gin.Context) {
+		var req ShareRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		share, err := newShare(req, chatServer.Config().Shares, time.Now())
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Count the messages still queued for the logs
+		chatServer.writer.Flush(chatServer.quit)
+		msgs, err := chatServer.shareMessages(share)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(msgs) == 0 {
+			apiError(c, http.StatusNotFound, "no messages in range")
+			return
+		}
+
+		share.CreatedBy = tokenName(c)
+		share, err = chatServer.shares.Add(share)
+		if err != nil {
+			auditLog(c, "create_share", "failed: "+err.Error())
+			respondError(c, err)
+			return
+		}
+
+		auditLog(c, "create_share", fmt.Sprintf("%s: %d messages from %s to %s, expires %s", share.Slug, len(msgs),
+			share.From.Format(logTimeFormat), share.To.Format(logTimeFormat), share.ExpiresAt.Format(logTimeFormat)))
+		c.JSON(http.StatusCreated, share)
+	})
+
+	api.GET("/shares", admin, func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.shares.List())
+	})
+
+	api.DELETE("/shares/:slug", admin, func(c *gin.Context) {
+		slug := c.Param("slug")
+		revoked, err := chatServer.shares.Revoke(slug)
+		if err != nil {
+			auditLog(c, "revoke_share", slug+" failed: "+err.Error())
+			respondError(c, err)
+			return
+		}
+		if !revoked {
+			apiError(c, http.StatusNotFound, "share not found")
+			return
+		}
+
+		auditLog(c, "revoke_share", slug)
+		c.JSON(http.StatusOK, gin.H{"revoked": slug})
+	})
+}
+
+// registerSharedExcerptRoutes registers the public page of a share link.
+// It needs no token: the slug is the credential, so the page asks not to
+// be indexed or to leak its URL in the Referer header.
+func registerSharedExcerptRoutes(router *gin.Engine, chatServer *ChatServer) {
+	router.GET("/share/:slug", func(c *gin.Context) {
+		c.Header("X-Robots-Tag", "noindex, nofollow")
+		c.Header("Referrer-Policy", "no-referrer")
+		c.Header("Cache-Control", "private, no-store")
+
+		share, ok := chatServer.shares.Get(c.Param("slug"))
+		if !ok {
+			apiError(c, http.StatusNotFound, "share not found or expired")
+			return
+		}
+
+		msgs, err := chatServer.shareMessages(share)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if share.Anonymize {
+			msgs = anonymizeMessages(msgs)
+		}
+
+		if c.Query("format") == "json" {
+			excerpt := SharedExcerpt{
+				From:      share.From,
+				To:        share.To,
+				ExpiresAt: share.ExpiresAt,
+				Count:     len(msgs),
+				Messages:  make([]Message, 0, len(msgs)),
+			}
+			for _, msg := range msgs {
+				excerpt.Messages = append(excerpt.Messages, chatServer.sharedMessage(msg))
+			}
+			c.JSON(http.StatusOK, excerpt)
+			return
+		}
+
+		page := chatServer.buildExportPage("Shared chat excerpt", msgs)
+		page.From = share.From.Format(logTimeFormat)
+		page.To = share.To.Format(logTimeFormat)
+		page.Generated = share.CreatedAt.Format(logTimeFormat)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := exportTemplate.Execute(c.Writer, page); err != nil {
+			logf(c, "Error rendering shared excerpt: %v", err)
+		}
+	})
+}
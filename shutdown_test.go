@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cylog/internal/testsupport"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownClosesClientsAndFlushesLogs(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	chatServer, baseURL := runTestServer(ctx, t, defaultConfig(), upstream)
+
+	client := testsupport.Dial(t, baseURL, "/ws")
+	client.WaitFor(e2eTimeout, frameContaining(`"type":"hello"`))
+	upstream.WaitConnected(e2eTimeout)
+	upstream.ChatMsg("alice", "just before shutdown")
+	client.WaitFor(e2eTimeout, frameContaining("just before shutdown"))
+
+	cancel()
+	err := client.WaitClosed(e2eTimeout)
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("connection ended with %v, want a close frame", err)
+	}
+	if closeErr.Code != websocket.CloseGoingAway {
+		t.Errorf("close code = %d, want %d (going away)", closeErr.Code, websocket.CloseGoingAway)
+	}
+
+	// The log writer drains its queue before the log files are closed
+	<-chatServer.Done()
+	if !chatLogContains(t, "just before shutdown") {
+		t.Error("message broadcast before shutdown is missing from the chat log")
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sidecar files of signed logs
+const (
+	signatureSuffix = ".sig"
+	chainSuffix     = ".chain"
+	signaturePrefix = "hmac-sha256 "
+)
+
+// Verification methods
+const (
+	verifySignature = "signature"
+	verifyChain     = "chain"
+	verifyNone      = "none"
+)
+
+// SigningConfig configures tamper evidence for log files; changing it
+// requires a restart
+type SigningConfig struct {
+	// Key is the HMAC-SHA256 key; signing is off when it is empty
+	Key string `yaml:"key"`
+}
+
+// LogVerification is the result of checking a log file against its
+// signature or hash chain
+type LogVerification struct {
+	File   string `json:"file"`
+	Valid  bool   `json:"valid"`
+	Method string `json:"method"`
+	Size   int64  `json:"size"`
+
+	// VerifiedBytes is how much of the file the chain covers; the rest was
+	// written after the last chain entry
+	VerifiedBytes int64  `json:"verified_bytes"`
+	Error         string `json:"error,omitempty"`
+}
+
+// SetSigningKey enables HMAC signing of log files; an empty key disables it
+func (l *Logger) SetSigningKey(key string) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	l.signingKey = nil
+	if key != "" {
+		l.signingKey = []byte(key)
+	}
+	// The live files start their chains now
+	for _, stream := range l.streams {
+		if err := l.openChain(stream); err != nil {
+			log.Printf("Error opening hash chain of %s: %v", filepath.Base(stream.path), err)
+		}
+	}
+}
+
+// chainHash extends a hash chain by a segment of the log file
+func chainHash(key, prev, segment []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(prev)
+	mac.Write(segment)
+	return mac.Sum(nil)
+}
+
+// openChain opens the hash chain of a stream's live file, continuing from
+// its last entry; the caller must hold logMutex
+func (l *Logger) openChain(stream *logStream) error {
+	if stream.chain != nil {
+		stream.chain.Close()
+		stream.chain = nil
+	}
+	stream.chainHash = nil
+	stream.chainOffset = 0
+	if l.signingKey == nil {
+		return nil
+	}
+
+	file, err := openFile(stream.path+chainSuffix, os.O_CREATE|os.O_RDWR|os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("failed to open hash chain: %w", err)
+	}
+	offset, hash, err := lastChainEntry(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	stream.chain = file
+	stream.chainOffset = offset
+	stream.chainHash = hash
+	return nil
+}
+
+// lastChainEntry reads the final entry of a chain file
+func lastChainEntry(file *os.File) (int64, []byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to stat hash chain: %w", err)
+	}
+	start := info.Size() - 256
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, info.Size()-start)
+	if _, err := file.ReadAt(tail, start); err != nil && !errors.Is(err, io.EOF) {
+		return 0, nil, fmt.Errorf("failed to read hash chain: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	if len(lines) == 0 || lines[len(lines)-1] == "" {
+		return 0, nil, nil
+	}
+	entry, err := parseChainEntry(lines[len(lines)-1])
+	if err != nil {
+		return 0, nil, err
+	}
+	return entry.offset, entry.hash, nil
+}
+
+// chainEntry is a line of a chain file: the end offset of the segment and
+// the chained hash up to it
+type chainEntry struct {
+	offset int64
+	hash   []byte
+}
+
+// parseChainEntry parses a "<offset> <hex hash>" chain line
+func parseChainEntry(line string) (chainEntry, error) {
+	offsetText, hashText, ok := strings.Cut(line, " ")
+	offset, err := strconv.ParseInt(offsetText, 10, 64)
+	if !ok || err != nil {
+		return chainEntry{}, fmt.Errorf("invalid hash chain entry %q", line)
+	}
+	hash, err := hex.DecodeString(hashText)
+	if err != nil {
+		return chainEntry{}, fmt.Errorf("invalid hash chain entry %q", line)
+	}
+	return chainEntry{offset: offset, hash: hash}, nil
+}
+
+// extendChain appends the line just written to the stream's hash chain;
+// the caller must hold logMutex. Bytes written while signing was off are
+// read back from the file so the chain covers them too.
+func (l *Logger) extendChain(stream *logStream, line string) error {
+	if stream.chain == nil {
+		return nil
+	}
+	end, err := stream.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to get log file offset: %w", err)
+	}
+
+	segment := []byte(line)
+	if end-stream.chainOffset != int64(len(line)) {
+		file, err := os.Open(stream.path)
+		if err != nil {
+			return fmt.Errorf("failed to read log file: %w", err)
+		}
+		segment = make([]byte, end-stream.chainOffset)
+		_, err = file.ReadAt(segment, stream.chainOffset)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read log file: %w", err)
+		}
+	}
+
+	hash := chainHash(l.signingKey, stream.chainHash, segment)
+	if _, err := fmt.Fprintf(stream.chain, "%d %x\n", end, hash); err != nil {
+		return fmt.Errorf("failed to write hash chain: %w", err)
+	}
+	stream.chainHash = hash
+	stream.chainOffset = end
+	return nil
+}
+
+// sealLogFile writes the signature of a closed log file and drops its hash
+// chain, which the signature supersedes; the caller must hold logMutex
+func (l *Logger) sealLogFile(stream *logStream) {
+	if stream.chain != nil {
+		stream.chain.Close()
+		stream.chain = nil
+	}
+	if l.signingKey == nil {
+		return
+	}
+
+	content, err := os.ReadFile(stream.path)
+	if err != nil {
+		log.Printf("Error signing %s: %v", filepath.Base(stream.path), err)
+		return
+	}
+	mac := hmac.New(sha256.New, l.signingKey)
+	mac.Write(content)
+
+	if err := writeFileAtomic(stream.path+signatureSuffix, []byte(signaturePrefix+hex.EncodeToString(mac.Sum(nil))+"\n")); err != nil {
+		log.Printf("Error signing %s: %v", filepath.Base(stream.path), err)
+		return
+	}
+	removeFile(stream.path + chainSuffix)
+}
+
+// removeLogSidecars deletes the signature, hash chain and rollup manifest
+// of a deleted log file; those of a compressed file are named after its
+// uncompressed name
+func (l *Logger) removeLogSidecars(name string) {
+	name = strings.TrimSuffix(name, ".gz")
+	removeFile(filepath.Join(l.dir, name+signatureSuffix))
+	removeFile(filepath.Join(l.dir, name+chainSuffix))
+	removeFile(filepath.Join(l.dir, name+manifestSuffix))
+}
+
+// verifyLogPath checks the log file at path against its signature, or its
+// hash chain when it hasn't been signed yet. Compressed files are checked
+// against the signature of their uncompressed content.
+func verifyLogPath(key []byte, path string) LogVerification {
+	result := LogVerification{File: filepath.Base(path), Method: verifyNone}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	sidecar := path
+	if strings.HasSuffix(path, ".gz") {
+		sidecar = strings.TrimSuffix(path, ".gz")
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err == nil {
+			content, err = io.ReadAll(reader)
+		}
+		if err != nil {
+			result.Error = "failed to decompress: " + err.Error()
+			return result
+		}
+	}
+	result.Size = int64(len(content))
+
+	if signature, err := os.ReadFile(sidecar + signatureSuffix); err == nil {
+		result.Method = verifySignature
+		expected, err := hex.DecodeString(strings.TrimSpace(strings.TrimPrefix(string(signature), signaturePrefix)))
+		if err != nil {
+			result.Error = "malformed signature"
+			return result
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(content)
+		result.Valid = hmac.Equal(mac.Sum(nil), expected)
+		if result.Valid {
+			result.VerifiedBytes = result.Size
+		} else {
+			result.Error = "signature mismatch"
+		}
+		return result
+	}
+
+	chain, err := os.ReadFile(sidecar + chainSuffix)
+	if err != nil {
+		result.Error = "not signed"
+		return result
+	}
+	result.Method = verifyChain
+	var prev []byte
+	var offset int64
+	for _, line := range strings.Split(strings.TrimRight(string(chain), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		entry, err := parseChainEntry(line)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if entry.offset < offset || entry.offset > result.Size {
+			result.Error = fmt.Sprintf("file was truncated before byte %d", entry.offset)
+			return result
+		}
+		hash := chainHash(key, prev, content[offset:entry.offset])
+		if !hmac.Equal(hash, entry.hash) {
+			result.Error = fmt.Sprintf("content changed between bytes %d and %d", offset, entry.offset)
+			return result
+		}
+		prev, offset = hash, entry.offset
+	}
+	result.Valid = true
+	result.VerifiedBytes = offset
+	return result
+}
+
+// VerifyLog checks a log file in the logs directory
+func (l *Logger) VerifyLog(filename string) (LogVerification, error) {
+	filename, err := validateLogName(filename)
+	if err != nil {
+		return LogVerification{}, err
+	}
+	if _, err := os.Stat(filepath.Join(l.dir, filename)); err != nil {
+		return LogVerification{}, fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	l.logMutex.Lock()
+	key := l.signingKey
+	l.logMutex.Unlock()
+	return verifyLogPath(key, filepath.Join(l.dir, filename)), nil
+}
+
+// registerVerifyRoutes registers the log verification endpoint
+func registerVerifyRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/logs/:filename/verify", func(c *gin.Context) {
+		if chatServer.Config().Signing.Key == "" {
+			apiError(c, http.StatusNotFound, "log signing is not configured")
+			return
+		}
+		if refusePrivateLog(c, c.Param("filename")) {
+			return
+		}
+		result, err := chatServer.logger.VerifyLog(c.Param("filename"))
+		if err != nil {
+			logFileError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+}
+
+// runVerifyCommand implements `cylog verify`: it checks every log file in
+// the logs directory and its archive, and returns the process exit code
+func runVerifyCommand() int {
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 2
+	}
+	if cfg.Signing.Key == "" {
+		fmt.Fprintln(os.Stderr, "Log signing is not configured (signing.key is empty)")
+		return 2
+	}
+
+	paths := make([]string, 0)
+	for _, dir := range []string{logsDir, filepath.Join(logsDir, archiveDirName)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry.Name(), ".gz")
+			if !entry.IsDir() && logFileKind(name) != "" {
+				paths = append(paths, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	failed := 0
+	for _, path := range paths {
+		result := verifyLogPath([]byte(cfg.Signing.Key), path)
+		switch {
+		case result.Valid && result.Method == verifyChain:
+			fmt.Printf("OK        %s (hash chain, %d of %d bytes)\n", path, result.VerifiedBytes, result.Size)
+		case result.Valid:
+			fmt.Printf("OK        %s\n", path)
+		case result.Method == verifyNone:
+			fmt.Printf("UNSIGNED  %s\n", path)
+		default:
+			failed++
+			fmt.Printf("FAILED    %s: %s\n", path, result.Error)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d log files failed verification\n", failed, len(paths))
+		return 1
+	}
+	return 0
+}
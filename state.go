@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// stateFileName is the file in the logs directory the recent message buffer
+// is saved to at shutdown
+const stateFileName = ".state.json"
+
+// defaultStateMaxAge is how many minutes old a saved state may be by default
+const defaultStateMaxAge = 60
+
+// stateMessage encodes a message with its fields as stored, unlike the API
+// contract, so it is restored exactly
+type stateMessage Message
+
+// serverState is the in-memory state carried over a restart
+type serverState struct {
+	SavedAt  time.Time      `json:"saved_at"`
+	Seq      uint64         `json:"seq"`
+	Messages []stateMessage `json:"messages"`
+}
+
+// statePath returns where the server state is saved
+func statePath() string {
+	return filepath.Join(logsDir, stateFileName)
+}
+
+// SaveState writes the recent message buffer and sequence counter to the
+// state file; it runs after the hub has shut down, so nothing changes them
+func (s *ChatServer) SaveState() error {
+	data, err := s.encodeState()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(statePath(), data); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// encodeState returns the recent message buffer and sequence counter in
+// the state file format
+func (s *ChatServer) encodeState() ([]byte, error) {
+	s.messagesMux.RLock()
+	state := serverState{
+		SavedAt:  time.Now(),
+		Seq:      atomic.LoadUint64(&s.seq),
+		Messages: make([]stateMessage, len(s.messages)),
+	}
+	for i, msg := range s.messages {
+		state.Messages[i] = stateMessage(msg)
+	}
+	s.messagesMux.RUnlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state: %w", err)
+	}
+	return data, nil
+}
+
+// loadState reads and removes the state file, so it is only restored once;
+// it returns nil when there is none. A state saved more than maxAge ago is
+// an error, since the channel has moved on.
+func loadState(maxAge time.Duration) (*serverState, error) {
+	data, err := os.ReadFile(statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	removeFile(statePath())
+
+	var state serverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	if age := time.Since(state.SavedAt); age > maxAge {
+		return nil, fmt.Errorf("state file is stale: saved %s ago", age.Round(time.Second))
+	}
+	return &state, nil
+}
+
+// RestoreState refills the recent message buffer and continues the sequence
+// from a saved state. A state older than the logs, which hold messages it
+// lacks, is ignored. It must be called before Run.
+func (s *ChatServer) RestoreState(state *serverState) {
+	if state.Seq < s.seq {
+		log.Printf("Ignoring saved state: it ends at seq %d but the logs reach %d", state.Seq, s.seq)
+		return
+	}
+
+	messages := make([]Message, 0, recentMessageLimit)
+	for _, msg := range state.Messages {
+		messages = append(messages, Message(msg))
+	}
+	if len(messages) > recentMessageLimit {
+		messages = messages[len(messages)-recentMessageLimit:]
+	}
+
+	s.messagesMux.Lock()
+	defer s.messagesMux.Unlock()
+	s.messages = messages
+	s.seq = state.Seq
+	s.evictedSeq = state.Seq
+	if len(messages) > 0 {
+		s.evictedSeq = messages[0].Seq - 1
+		s.bufferSince = messages[0].Timestamp
+	}
+	log.Printf("Restored %d buffered messages and seq %d saved at %s", len(messages), state.Seq, state.SavedAt.Format(logTimeFormat))
+}
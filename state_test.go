@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	cfg := defaultConfig()
+	chatServer, _ := newTestServer(t, cfg)
+
+	at := time.Date(2025, 4, 16, 20, 15, 0, 0, time.UTC)
+	saved := []Message{
+		{ID: "1", Seq: 41, Type: messageTypeChat, Username: "alice", Rank: 2, Timestamp: at, Content: "hi @bob https://example.com", HTML: "hi @bob <a href=\"https://example.com\">https://example.com</a>", Links: []string{"https://example.com"}, Mentions: []string{"bob"}, Color: "#de4369", Previews: []string{"https://example.com"}},
+		{ID: "2", Seq: 42, Type: messageTypeAction, Username: "bob", Timestamp: at.Add(time.Second), Content: "waves", Tags: []string{"greeting"}, Meta: map[string]interface{}{"emote": "wave"}, Source: messageSourceLocal},
+		{ID: "3", Seq: 43, Type: messageTypeChat, Username: "carol", Timestamp: at.Add(-time.Minute), Content: "late", RawContent: "\x1b[1mlate", Truncated: true, Late: true},
+	}
+	chatServer.messages = saved
+	chatServer.seq = 45
+	if err := chatServer.SaveState(); err != nil {
+		t.Fatalf("saving the state: %v", err)
+	}
+	chatServer.logger.Close()
+
+	state, err := loadState(time.Minute)
+	if err != nil || state == nil {
+		t.Fatalf("loading the state: %v, %v", state, err)
+	}
+	restarted, err := openChatServer("", cfg)
+	if err != nil {
+		t.Fatalf("reopening the chat server: %v", err)
+	}
+	t.Cleanup(func() { restarted.logger.Close() })
+	restarted.RestoreState(state)
+
+	if !reflect.DeepEqual(restarted.messages, saved) {
+		t.Errorf("restored messages = %+v, want %+v", restarted.messages, saved)
+	}
+	if restarted.seq != 45 {
+		t.Errorf("seq = %d, want 45", restarted.seq)
+	}
+	if restarted.evictedSeq != 40 {
+		t.Errorf("evicted seq = %d, want 40, before the first restored message", restarted.evictedSeq)
+	}
+	if !restarted.bufferSince.Equal(at) {
+		t.Errorf("buffer since %s, want %s", restarted.bufferSince, at)
+	}
+
+	// The state is only restored once
+	if state, err := loadState(time.Minute); state != nil || err != nil {
+		t.Errorf("loading the state again = %v, %v, want nothing", state, err)
+	}
+	if _, err := os.Stat(statePath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("state file left behind: %v", err)
+	}
+}
+
+func TestStateStaleOrBehindLogs(t *testing.T) {
+	chatServer, _ := newTestServer(t, defaultConfig())
+	chatServer.messages = []Message{{ID: "1", Seq: 1, Type: messageTypeChat, Username: "alice", Timestamp: time.Now(), Content: "old"}}
+	chatServer.seq = 1
+	if err := chatServer.SaveState(); err != nil {
+		t.Fatalf("saving the state: %v", err)
+	}
+	if _, err := loadState(0); err == nil {
+		t.Error("a state older than the maximum age was loaded")
+	}
+
+	// A state the logs have moved past is ignored
+	if err := chatServer.SaveState(); err != nil {
+		t.Fatalf("saving the state: %v", err)
+	}
+	state, err := loadState(time.Minute)
+	if err != nil {
+		t.Fatalf("loading the state: %v", err)
+	}
+	chatServer.messages = nil
+	chatServer.seq = 5
+	chatServer.RestoreState(state)
+	if len(chatServer.messages) != 0 || chatServer.seq != 5 {
+		t.Errorf("restored %d messages and seq %d over logs at seq 5", len(chatServer.messages), chatServer.seq)
+	}
+}
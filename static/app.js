@@ -21,7 +21,21 @@ document.addEventListener('DOMContentLoaded', () => {
     
     socket.onmessage = (event) => {
         const message = JSON.parse(event.data);
-        addMessage(message);
+        // Control frames describe the connection rather than the chat
+        switch (message.type) {
+            case 'hello':
+                console.log(`Server ${message.server}, protocol ${message.protocol}, ${message.backlog} messages to replay`);
+                return;
+            case 'backlog':
+                message.messages.forEach(showMessage);
+                return;
+            case 'configured':
+                return;
+            case 'error':
+                console.error(`Server rejected a frame: ${message.error}`);
+                return;
+        }
+        showMessage(message);
     };
     
     socket.onerror = (error) => {
@@ -36,6 +50,21 @@ document.addEventListener('DOMContentLoaded', () => {
         }, 5000);
     };
     
+    // Add a message to the chat, updating the warning on log write events
+    function showMessage(message) {
+        if (message.meta && message.meta.event === 'log_write') {
+            updateLogWarning(message);
+        }
+        addMessage(message);
+    }
+    
+    // Failed log writes show a warning until the server reports recovery
+    function updateLogWarning(message) {
+        const banner = document.getElementById('logwarning');
+        banner.textContent = message.content;
+        banner.hidden = message.meta.state !== 'failing';
+    }
+    
     // Add a message to the chat
     function addMessage(message) {
         // Skip if we've already added this message
@@ -71,6 +100,9 @@ document.addEventListener('DOMContentLoaded', () => {
             const username = document.createElement('span');
             username.classList.add('username');
             username.textContent = message.username;
+            if (message.color) {
+                username.style.color = message.color;
+            }
             
             const content = document.createElement('span');
             content.classList.add('content');
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserStats holds per-user message statistics
+type UserStats struct {
+	Username      string    `json:"username"`
+	MessageCount  int       `json:"message_count"`
+	FirstMessage  time.Time `json:"first_message"`
+	LastMessage   time.Time `json:"last_message"`
+	AverageLength float64   `json:"average_length"`
+	totalLength   int
+}
+
+// add records a message in the user's statistics
+func (u *UserStats) add(msg Message) {
+	if u.MessageCount == 0 || msg.Timestamp.Before(u.FirstMessage) {
+		u.FirstMessage = msg.Timestamp
+	}
+	if msg.Timestamp.After(u.LastMessage) {
+		u.LastMessage = msg.Timestamp
+	}
+	u.MessageCount++
+	u.totalLength += utf8.RuneCountInString(msg.Content)
+	u.AverageLength = float64(u.totalLength) / float64(u.MessageCount)
+}
+
+// merge folds other into u
+func (u *UserStats) merge(other *UserStats) {
+	if u.MessageCount == 0 || other.FirstMessage.Before(u.FirstMessage) {
+		u.FirstMessage = other.FirstMessage
+	}
+	if other.LastMessage.After(u.LastMessage) {
+		u.LastMessage = other.LastMessage
+	}
+	u.MessageCount += other.MessageCount
+	u.totalLength += other.totalLength
+	u.AverageLength = float64(u.totalLength) / float64(u.MessageCount)
+}
+
+// activityBucket is the granularity at which per-file activity is recorded;
+// a quarter hour lets hourly buckets be rebuilt in any timezone
+const activityBucket = 15 * time.Minute
+
+// fileStats holds the aggregated statistics of a single log file
+type fileStats struct {
+	users map[string]*UserStats
+
+	// activity counts messages per quarter hour, keyed by unix bucket start
+	activity map[int64]int
+
+	// words counts normalized words and tokens counts raw whitespace-separated
+	// tokens, which are matched against the emote list at query time
+	words  map[string]int
+	tokens map[string]int
+
+	// offset is how far into the file has been scanned, so the live file
+	// can be scanned incrementally
+	offset int64
+	closed bool
+}
+
+// isChatEntry reports whether a parsed log entry was said by a user; status
+// messages, server notices and media changes are not chat
+func isChatEntry(msg Message) bool {
+	if hasTag(msg.Tags, statusTag) {
+		return false
+	}
+	switch msg.Kind() {
+	case messageTypeSystem, messageTypeMedia, messageTypeStatus:
+		return false
+	}
+	return true
+}
+
+// add records a parsed log entry in the file statistics, skipping what
+// isn't chat
+func (f *fileStats) add(msg Message) {
+	if !isChatEntry(msg) {
+		return
+	}
+
+	user, ok := f.users[msg.Username]
+	if !ok {
+		user = &UserStats{Username: msg.Username}
+		f.users[msg.Username] = user
+	}
+	user.add(msg)
+
+	f.activity[msg.Timestamp.Truncate(activityBucket).Unix()]++
+
+	for _, word := range tokenizeWords(msg.Content) {
+		f.words[word]++
+	}
+	for _, token := range strings.Fields(msg.Content) {
+		f.tokens[token]++
+	}
+	if len(f.words) > maxTrackedTerms {
+		pruneTerms(f.words, maxTrackedTerms)
+	}
+	if len(f.tokens) > maxTrackedTerms {
+		pruneTerms(f.tokens, maxTrackedTerms)
+	}
+}
+
+// newFileStats creates empty file statistics
+func newFileStats() *fileStats {
+	return &fileStats{
+		users:    make(map[string]*UserStats),
+		activity: make(map[int64]int),
+		words:    make(map[string]int),
+		tokens:   make(map[string]int),
+	}
+}
+
+// StatsCache caches log file statistics; closed files are scanned once and
+// the live file is scanned incrementally from where the last scan stopped
+type StatsCache struct {
+	logger *Logger
+	files  map[string]*fileStats
+	mutex  sync.Mutex
+}
+
+// NewStatsCache creates a statistics cache for the logger's files
+func NewStatsCache(logger *Logger) *StatsCache {
+	return &StatsCache{
+		logger: logger,
+		files:  make(map[string]*fileStats),
+	}
+}
+
+// Collect calls fn with the statistics of each of the given log files
+func (c *StatsCache) Collect(filenames []string, fn func(*fileStats)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	current := c.logger.CurrentLogFile()
+	now := time.Now()
+
+	for _, filename := range filenames {
+		stats, ok := c.files[filename]
+		if !ok || !stats.closed {
+			if !ok {
+				stats = newFileStats()
+			}
+			if err := c.scan(filename, stats); err != nil {
+				return err
+			}
+			_, _, end, _ := logFilePeriod(filename)
+			stats.closed = filename != current && !end.After(now)
+			c.files[filename] = stats
+		}
+		fn(stats)
+	}
+
+	return nil
+}
+
+// scan reads complete lines from the file starting at stats.offset
+func (c *StatsCache) scan(filename string, stats *fileStats) error {
+	reader, err := c.logger.openLogLines(filename, stats.offset)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		line, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			// Leave partially written lines for the next scan
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		stats.offset = reader.Offset()
+		if msg, ok := parseLogEntry(line); ok {
+			stats.add(msg)
+		}
+	}
+}
+
+// parseDateRange parses the from and to query parameters as YYYY-MM-DD dates
+func parseDateRange(c *gin.Context) (time.Time, time.Time, error) {
+	var from, to time.Time
+	var err error
+
+	if value := c.Query("from"); value != "" {
+		from, err = time.ParseInLocation(logDateFormat, value, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid from date: %w", err)
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		to, err = time.ParseInLocation(logDateFormat, value, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to date: %w", err)
+		}
+	}
+
+	return from, to, nil
+}
+
+// registerStatsRoutes registers the statistics API endpoints
+func registerStatsRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/stats/users", func(c *gin.Context) {
+		from, to, err := parseDateRange(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		top := 0
+		if value := c.Query("top"); value != "" {
+			top, err = strconv.Atoi(value)
+			if err != nil || top < 0 {
+				apiError(c, http.StatusBadRequest, "invalid top parameter")
+				return
+			}
+		}
+
+		files, err := chatServer.logger.GetLogsInRange(from, to)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		resolve := wantsAliasResolution(c)
+		merged := make(map[string]*UserStats)
+		err = chatServer.stats.Collect(files, func(stats *fileStats) {
+			for username, user := range stats.users {
+				if resolve {
+					username = chatServer.aliases.Resolve(username)
+				}
+				total, ok := merged[username]
+				if !ok {
+					total = &UserStats{Username: username}
+					merged[username] = total
+				}
+				total.merge(user)
+			}
+		})
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		username, match := c.Query("user"), parseUsernameMatch(c, false)
+		users := make([]*UserStats, 0, len(merged))
+		for _, user := range merged {
+			if username == "" || matchUsername(match, username, user.Username) {
+				users = append(users, user)
+			}
+		}
+
+		switch c.DefaultQuery("sort", "count") {
+		case "count":
+			sort.Slice(users, func(i, j int) bool {
+				if users[i].MessageCount != users[j].MessageCount {
+					return users[i].MessageCount > users[j].MessageCount
+				}
+				return users[i].Username < users[j].Username
+			})
+		case "username":
+			sort.Slice(users, func(i, j int) bool {
+				return users[i].Username < users[j].Username
+			})
+		default:
+			apiError(c, http.StatusBadRequest, "invalid sort parameter")
+			return
+		}
+
+		if top > 0 && len(users) > top {
+			users = users[:top]
+		}
+
+		c.JSON(http.StatusOK, users)
+	})
+
+	api.GET("/stats/activity", func(c *gin.Context) {
+		granularity := c.DefaultQuery("granularity", "hour")
+		if granularity != "hour" && granularity != "day" {
+			apiError(c, http.StatusBadRequest, "granularity must be hour or day")
+			return
+		}
+
+		from, to, err := parseDateRange(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		buckets, err := activityHistogram(chatServer, granularity, from, to)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		c.JSON(http.StatusOK, buckets)
+	})
+}
+
+// maxActivityBuckets caps the size of an activity histogram response
+const maxActivityBuckets = 24 * 92
+
+// ActivityBucket is the message count for one histogram bucket
+type ActivityBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// activityHistogram counts messages per hour or day between the from and to
+// dates (inclusive) in the configured timezone, including empty buckets
+func activityHistogram(chatServer *ChatServer, granularity string, from, to time.Time) ([]ActivityBucket, error) {
+	loc := chatServer.Config().Location()
+
+	now := time.Now().In(loc)
+	if to.IsZero() {
+		to = now
+	}
+	if from.IsZero() {
+		if granularity == "hour" {
+			from = to.AddDate(0, 0, -6)
+		} else {
+			from = to.AddDate(0, 0, -29)
+		}
+	}
+
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+	if !start.Before(end) {
+		return nil, fmt.Errorf("from must not be after to")
+	}
+
+	// next returns the start of the bucket following t
+	next := func(t time.Time) time.Time {
+		if granularity == "hour" {
+			return t.Add(time.Hour)
+		}
+		return t.AddDate(0, 0, 1)
+	}
+
+	buckets := make([]ActivityBucket, 0)
+	for t := start; t.Before(end); t = next(t) {
+		if len(buckets) >= maxActivityBuckets {
+			return nil, fmt.Errorf("range too large: at most %d buckets", maxActivityBuckets)
+		}
+		buckets = append(buckets, ActivityBucket{Start: t})
+	}
+
+	// Log files are named by local date, so widen the file range by a day on
+	// each side to cover timezone differences
+	files, err := chatServer.logger.GetLogsInRange(start.AddDate(0, 0, -1), end.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	err = chatServer.stats.Collect(files, func(stats *fileStats) {
+		for unix, count := range stats.activity {
+			t := time.Unix(unix, 0).In(loc)
+			if t.Before(start) || !t.Before(end) {
+				continue
+			}
+			// Buckets are sorted, so find the last one starting at or before t
+			i := sort.Search(len(buckets), func(i int) bool {
+				return buckets[i].Start.After(t)
+			})
+			buckets[i-1].Count += count
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
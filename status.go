@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Status is the response of the status endpoint
+type Status struct {
+	Upstream UpstreamStatus `json:"upstream"`
+
+	// Users is the number of users in the channel
+	Users int `json:"users"`
+
+	// Viewers is the number of WebSocket clients, not counting bots
+	Viewers int `json:"viewers"`
+
+	// Logging reports whether log files are written and the free disk space
+	Logging LoggingStatus `json:"logging"`
+
+	// DryRun is set when cylog runs with --dry-run and records nothing
+	DryRun bool `json:"dry_run"`
+
+	// Update is the last update check, when update_check is on
+	Update *UpdateStatus `json:"update,omitempty"`
+}
+
+// Status returns a snapshot of the server's state
+func (s *ChatServer) Status() Status {
+	status := Status{
+		Upstream: s.UpstreamStatus(),
+		Users:    s.userlist.Count(),
+		Viewers:  s.viewers.Count(),
+		Logging:  s.LoggingStatus(),
+		DryRun:   !writable(),
+	}
+	if updateCheckEnabled(s.Config()) {
+		status.Update = s.updates.Status()
+	}
+	return status
+}
+
+// registerStatusRoutes registers the status endpoint
+func registerStatusRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.Status())
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultTailMaxWindowHours caps the window of a tail request by default
+const defaultTailMaxWindowHours = 24
+
+// maxTailMessages bounds the messages a tail request reads back from the logs
+const maxTailMessages = 50000
+
+// Where the messages of a tail response came from
+const (
+	tailSourceBuffer = "buffer"
+	tailSourceLogs   = "logs"
+)
+
+// TailConfig configures the time-windowed tail endpoint
+type TailConfig struct {
+	// MaxWindowHours is the longest window a tail request may ask for;
+	// longer ones are pointed to the history endpoint
+	MaxWindowHours int `yaml:"max_window_hours"`
+}
+
+// validate checks the tail settings
+func (c TailConfig) validate() error {
+	if c.MaxWindowHours <= 0 {
+		return fmt.Errorf("invalid tail max_window_hours %d: must be positive", c.MaxWindowHours)
+	}
+	return nil
+}
+
+// MaxWindow returns the longest window of a tail request
+func (c TailConfig) MaxWindow() time.Duration {
+	return time.Duration(c.MaxWindowHours) * time.Hour
+}
+
+// TailMeta is the last line of a tail response
+type TailMeta struct {
+	Type  string    `json:"type"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	Count int       `json:"count"`
+
+	// NextSince is the since of the next request, so consecutive requests
+	// neither skip nor repeat messages
+	NextSince time.Time `json:"next_since"`
+
+	// Source is "buffer" or "logs", and Incomplete is set when the logs may
+	// miss messages, as while logging is paused or sampled, or when they mark
+	// a gap in the window
+	Source     string `json:"source"`
+	Incomplete bool   `json:"incomplete"`
+}
+
+// tailWindow reads the since and until parameters. Log lines have whole
+// seconds, so the window is too; until defaults to the reorder window
+// before now, so batched messages still being placed aren't skipped.
+func tailWindow(c *gin.Context, cfg *Config, now time.Time) (time.Time, time.Time, error) {
+	since, err := time.Parse(time.RFC3339, c.Query("since"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid since parameter: must be an RFC 3339 time")
+	}
+	since = since.Truncate(time.Second)
+
+	latest := now.Add(-cfg.WebSocket.ReorderWindow()).Truncate(time.Second)
+	until := latest
+	if value := c.Query("until"); value != "" {
+		if until, err = time.Parse(time.RFC3339, value); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid until parameter: must be an RFC 3339 time")
+		}
+		until = until.Truncate(time.Second)
+		if until.After(latest) {
+			until = latest
+		}
+	}
+
+	if !since.Before(until) {
+		// Polling again soon after the last request finds nothing yet
+		if c.Query("until") == "" && !since.After(now) {
+			return since, since, nil
+		}
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid window: since must be before until, and until is at most %s ago", cfg.WebSocket.ReorderWindow())
+	}
+	if max := cfg.Tail.MaxWindow(); until.Sub(since) > max {
+		return time.Time{}, time.Time{}, fmt.Errorf("window longer than %s: use /api/v2/messages for older history", max)
+	}
+	return since, until, nil
+}
+
+// inTailWindow reports whether a message's time, to the second, is in
+// [since, until)
+func inTailWindow(msg Message, since, until time.Time) bool {
+	at := msg.Timestamp.Truncate(time.Second)
+	return !at.Before(since) && at.Before(until)
+}
+
+// tailMessages returns the messages in [since, until) matching query in
+// timestamp order, from the recent buffer when it holds every message since
+// then and otherwise from the log files, where they came from, and whether
+// the logs mark a gap in the window
+func (s *ChatServer) tailMessages(since, until time.Time, query messageQuery) ([]Message, string, bool, error) {
+	s.messagesMux.RLock()
+	covered := since.After(s.bufferSince)
+	var msgs []Message
+	if covered {
+		for _, msg := range s.messages {
+			if inTailWindow(msg, since, until) && query.matches(msg) {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	s.messagesMux.RUnlock()
+	if covered {
+		sortByTimestamp(msgs)
+		return msgs, tailSourceBuffer, false, nil
+	}
+
+	// The logs are only complete up to the messages waiting to be written
+	s.writer.Flush(s.quit)
+	logs, err := s.logger.GetAvailableLogs()
+	if err != nil {
+		return nil, "", false, err
+	}
+	gap := false
+	for kind := range logs {
+		if recordKinds[kind] {
+			continue
+		}
+		// Late batched messages are in the files of the day they arrived
+		files, err := s.logger.logsInRange(kind, since, until.Add(maxBatchLateness))
+		if err != nil {
+			return nil, "", false, err
+		}
+		for _, file := range files {
+			var fileGap bool
+			if msgs, fileGap, err = s.tailLogFile(file, since, until, query, msgs); err != nil {
+				return nil, "", false, err
+			}
+			gap = gap || fileGap
+		}
+	}
+	sortByTimestamp(msgs)
+	return msgs, tailSourceLogs, gap, nil
+}
+
+// tailLogFile reads a log file line by line, appending its messages in
+// [since, until) matching query to msgs, and reports whether a gap marker
+// falls in the window
+func (s *ChatServer) tailLogFile(name string, since, until time.Time, query messageQuery, msgs []Message) ([]Message, bool, error) {
+	reader, err := s.logger.openLogLines(name, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	gap := false
+	for {
+		line, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return msgs, gap, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		msg, ok := parseLogEntry(line)
+		if !ok || !inTailWindow(msg, since, until) {
+			continue
+		}
+		if isGapEntry(msg) {
+			gap = true
+			continue
+		}
+		if isStatusEntry(msg) || !query.matches(msg) {
+			continue
+		}
+		if len(msgs) >= maxTailMessages {
+			return nil, false, newAPIError(http.StatusBadRequest, fmt.Sprintf("window too busy: at most %d messages; use a shorter window or /api/v2/messages", maxTailMessages))
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// tailIncomplete reports whether the log files may be missing messages of
+// the window: logging isn't in its normal mode or chat is sampled
+func (s *ChatServer) tailIncomplete() bool {
+	status := s.LoggingStatus()
+	return (status.Mode != loggingModeNormal && status.Mode != loggingModeLowSpace) || status.SamplingRate > 1
+}
+
+// registerTailRoutes registers the time-windowed tail endpoint for scripts
+func registerTailRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/tail", func(c *gin.Context) {
+		if format := c.Query("format"); format != "" && format != "jsonl" {
+			apiError(c, http.StatusBadRequest, "invalid format: must be jsonl")
+			return
+		}
+		since, until, err := tailWindow(c, chatServer.Config(), time.Now())
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		query, err := parseMessageQuery(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		msgs, source, gap, err := chatServer.tailMessages(since, until, query)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		meta := TailMeta{
+			Type:      "tail_meta",
+			Since:     since,
+			Until:     until,
+			Count:     len(msgs),
+			NextSince: until,
+			Source:    source,
+		}
+		meta.Incomplete = source == tailSourceLogs && (gap || chatServer.tailIncomplete())
+
+		c.Header("Content-Type", "application/x-ndjson; charset=utf-8")
+		c.Header("X-Tail-Source", source)
+		c.Header("X-Tail-Incomplete", strconv.FormatBool(meta.Incomplete))
+		c.Header("X-Tail-Next-Since", until.Format(time.RFC3339))
+		c.Status(http.StatusOK)
+
+		encoder := json.NewEncoder(c.Writer)
+		for i, msg := range msgs {
+			if err := encoder.Encode(msg); err != nil {
+				return
+			}
+			if (i+1)%logEntryFlushInterval == 0 {
+				c.Writer.Flush()
+			}
+		}
+		encoder.Encode(meta)
+	})
+}
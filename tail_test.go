@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailMarksGapsIncomplete(t *testing.T) {
+	chatServer, router := newTestServer(t, defaultConfig())
+	go chatServer.runLogWriter()
+	t.Cleanup(func() {
+		close(chatServer.quit)
+		<-chatServer.writer.done
+	})
+
+	// Logging was paused for ten minutes between two messages
+	now := time.Now().UTC().Truncate(time.Second)
+	say := func(content string, at time.Time) {
+		msg := Message{ID: content, Type: messageTypeChat, Username: "alice", Timestamp: at, Content: content}
+		if err := chatServer.logger.LogMessages([]Message{msg}); err != nil {
+			t.Fatalf("logging a message: %v", err)
+		}
+	}
+	say("before", now.Add(-time.Hour))
+	if _, err := chatServer.logger.Hold(now.Add(-50 * time.Minute)); err != nil {
+		t.Fatalf("pausing logging: %v", err)
+	}
+	if _, err := chatServer.logger.Unhold(now.Add(-40 * time.Minute)); err != nil {
+		t.Fatalf("resuming logging: %v", err)
+	}
+	say("after", now.Add(-30*time.Minute))
+
+	tests := []struct {
+		name       string
+		since      time.Duration
+		until      time.Duration
+		count      int
+		incomplete bool
+	}{
+		{"window before the pause", -2 * time.Hour, -55 * time.Minute, 1, false},
+		{"window with the pause starting", -2 * time.Hour, -45 * time.Minute, 1, true},
+		{"window with the pause ending", -45 * time.Minute, -20 * time.Minute, 1, true},
+		{"window across the pause", -2 * time.Hour, -20 * time.Minute, 2, true},
+		{"window after the pause", -35 * time.Minute, -20 * time.Minute, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{
+				"since": {now.Add(tt.since).Format(time.RFC3339)},
+				"until": {now.Add(tt.until).Format(time.RFC3339)},
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/tail?"+query.Encode(), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+			var meta TailMeta
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &meta); err != nil {
+				t.Fatalf("decoding the meta line: %v", err)
+			}
+			if meta.Source != tailSourceLogs {
+				t.Errorf("source = %q, want %q", meta.Source, tailSourceLogs)
+			}
+			if meta.Count != tt.count || len(lines) != tt.count+1 {
+				t.Errorf("count = %d with %d lines, want %d messages", meta.Count, len(lines), tt.count)
+			}
+			if meta.Incomplete != tt.incomplete {
+				t.Errorf("incomplete = %v, want %v", meta.Incomplete, tt.incomplete)
+			}
+			if got, want := w.Header().Get("X-Tail-Incomplete"), strconv.FormatBool(tt.incomplete); got != want {
+				t.Errorf("X-Tail-Incomplete = %s, want %s", got, want)
+			}
+		})
+	}
+}
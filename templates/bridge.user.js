@@ -0,0 +1,301 @@
+// ==UserScript==
+// @name         Cylog-Tampermonkey Bridge
+// @namespace    http://tampermonkey.net/
+// @version      {{.Version}}
+// @description  Bridge between Cylog desktop app and Cytube ChatStyleAdjuster Tampermonkey script
+// @author       Cylog
+// @match        {{.Origin}}/*
+// @match        https://cytu.be/*
+// @match        https://om3tcw.com/*
+// @grant        none
+// ==/UserScript==
+
+(function() {
+    'use strict';
+    
+    // Generated by the Cylog server the script was installed from
+    const cylog = {
+        origin: '{{js .Origin}}',
+        host: '{{js .Host}}',
+        basePath: '{{js .BasePath}}',
+        // Replace with a token with the ingest scope when the server requires tokens
+        token: '{{js .Token}}',
+        protocol: {{.Protocol}},
+        bridgeVersion: {{.Version}}
+    };
+    
+    // Configuration
+    const config = {
+        debug: true,
+        isCylogApp: window.location.host === cylog.host,
+        isCytubeOrigin: window.location.host.includes('cytube.') || window.location.host.includes('cytu.') || window.location.host.includes('om3tcw.com')
+    };
+    
+    // Logging function
+    function log(message, level = 'info') {
+        if (!config.debug && level === 'debug') return;
+        console[level](`[Cylog Bridge] ${message}`);
+    }
+    
+    log('Bridge script loaded');
+    
+    // Track if we're running inside Cylog or Cytube
+    if (config.isCylogApp) {
+        log('Running in Cylog app - initializing bridge');
+        initCylogBridge();
+    } else if (config.isCytubeOrigin) {
+        log('Running in Cytube - looking for ChatStyleAdjuster');
+        initCytubeBridge();
+    } else {
+        log('Not running in either Cylog or Cytube - bridge inactive', 'warn');
+    }
+    
+    // Initialize bridge in Cylog app
+    function initCylogBridge() {
+        // Expose necessary elements and functions for the ChatStyleAdjuster
+        window.addEventListener('DOMContentLoaded', () => {
+            log('DOM loaded in Cylog, setting up bridge elements');
+            checkBridgeVersion();
+            
+            // Create a pollwrap element for compatibility
+            if (!document.getElementById('pollwrap')) {
+                const pollwrap = document.createElement('div');
+                pollwrap.id = 'pollwrap';
+                pollwrap.style.display = 'none';
+                document.body.appendChild(pollwrap);
+                log('Added pollwrap element for compatibility');
+            }
+            
+            // Wait for Cylog to be ready
+            document.addEventListener('cylog-ready', (event) => {
+                log('Cylog app is ready, connecting to ChatStyleAdjuster');
+                
+                // Announce our presence to Tampermonkey scripts
+                window.postMessage('tampermonkey-cytube-ready', '*');
+                
+                // Listen for style changes from ChatStyleAdjuster
+                monitorTampermonkeyChanges();
+            });
+            
+            // Listen for font size changes from Cylog and relay them to ChatStyleAdjuster
+            document.addEventListener('cylog-font-size-change', (event) => {
+                log(`Font size changed: ${event.detail.fontSize}px, action: ${event.detail.action}`);
+                // This event is already dispatched by Cylog and will be picked up by ChatStyleAdjuster
+            });
+            
+            // Listen for width changes from Cylog and relay them to ChatStyleAdjuster
+            document.addEventListener('cylog-width-change', (event) => {
+                log(`Chat width changed: ${event.detail.chatWidth}em, action: ${event.detail.action}`);
+                // This event is already dispatched by Cylog and will be picked up by ChatStyleAdjuster
+            });
+        });
+    }
+    
+    // Ask the server whether it still accepts this version of the script,
+    // and offer the update when it doesn't
+    function checkBridgeVersion() {
+        const headers = {};
+        if (cylog.token && cylog.token !== '{{js .TokenPlaceholder}}') {
+            headers['Authorization'] = `Bearer ${cylog.token}`;
+        }
+        fetch(`${cylog.origin}${cylog.basePath}/tampermonkey/manifest`, { headers })
+            .then(response => response.ok ? response.json() : null)
+            .then(manifest => {
+                if (!manifest) return;
+                if (cylog.bridgeVersion < manifest.min_version) {
+                    promptUpdate(`Cylog needs bridge version ${manifest.min_version} or newer; this is version ${cylog.bridgeVersion}.`);
+                } else if (manifest.protocol !== cylog.protocol) {
+                    log(`Server speaks protocol ${manifest.protocol}, this script ${cylog.protocol}`, 'warn');
+                }
+            })
+            .catch(err => log(`Could not check the bridge version: ${err}`, 'warn'));
+    }
+    
+    // Offer to install the current script, as when the server answers a
+    // message with a bridge_outdated error frame
+    function promptUpdate(reason) {
+        log(reason, 'warn');
+        if (confirm(`${reason}\n\nInstall the updated Cylog bridge script now?`)) {
+            window.open(`${cylog.origin}${cylog.basePath}/tampermonkey/bridge.user.js`, '_blank');
+        }
+    }
+    
+    // Initialize bridge in Cytube
+    function initCytubeBridge() {
+        // Wait for ChatStyleAdjuster to be initialized
+        const checkInterval = setInterval(() => {
+            if (window.chatStyleAdjuster) {
+                clearInterval(checkInterval);
+                log('ChatStyleAdjuster found, connecting bridge');
+                
+                // Create a bridge to relay messages to Cylog
+                createMessageBridge();
+            }
+        }, 1000);
+        
+        // Give up after 10 seconds if ChatStyleAdjuster isn't found
+        setTimeout(() => {
+            clearInterval(checkInterval);
+            log('ChatStyleAdjuster not found after timeout', 'warn');
+        }, 10000);
+    }
+    
+    // Monitor for changes made by Tampermonkey script
+    function monitorTampermonkeyChanges() {
+        // Watch for changes to the chat area that might be made by Tampermonkey
+        const chatwrap = document.getElementById('chatwrap');
+        const observer = new MutationObserver((mutations) => {
+            mutations.forEach(mutation => {
+                if (mutation.type === 'attributes') {
+                    log(`Attribute ${mutation.attributeName} changed on chatwrap`);
+                    
+                    // If width was changed externally, update our internal state
+                    if (mutation.attributeName === 'style' && chatwrap.style.width) {
+                        const width = chatwrap.style.width;
+                        const match = width.match(/^([\d\.]+)(em|px)$/);
+                        if (match) {
+                            const value = parseFloat(match[1]);
+                            const unit = match[2];
+                            log(`Detected width change to ${value}${unit}`);
+                            
+                            // Update Cylog's internal state if available
+                            if (window.cylogStyleManager) {
+                                // Don't adjust width directly to avoid loops, just update the variable
+                                if (unit === 'em') {
+                                    window.chatWidth = value;
+                                    log(`Updated Cylog chatWidth to ${value}em`);
+                                }
+                            }
+                        }
+                    }
+                }
+            });
+        });
+        
+        // Start observing
+        observer.observe(chatwrap, { 
+            attributes: true,
+            attributeFilter: ['style']
+        });
+        
+        log('Now monitoring for Tampermonkey style changes');
+    }
+    
+    // Create a bridge to relay messages from Cytube to Cylog. Messages are
+    // queued with a uuid as they are observed and sent in batch frames, so
+    // those seen while the socket was down, say while the machine slept, are
+    // delivered late instead of lost, and resending them is harmless.
+    function createMessageBridge() {
+        const maxBatch = 100; // websocket.max_batch by default
+        const reconnectDelay = 5000;
+        const sourceKey = 'cylog-bridge-source';
+        const queue = [];
+        let source = localStorage.getItem(sourceKey) || '';
+        let ws = null;
+        let sending = false;
+        let outdated = false;
+
+        function connect() {
+            if (outdated) return;
+            let url = `${cylog.origin.replace(/^http/, 'ws')}/ws`;
+            if (cylog.token && cylog.token !== '{{js .TokenPlaceholder}}') {
+                url += `?token=${encodeURIComponent(cylog.token)}`;
+            }
+            ws = new WebSocket(url);
+            ws.onopen = () => {
+                log('Connected to Cylog');
+                // Declare the script version, checked against min_bridge_version
+                ws.send(JSON.stringify({ type: 'hello', bot: true, bridge: cylog.bridgeVersion }));
+                sending = false;
+                sendBatch();
+            };
+            ws.onmessage = (event) => {
+                try {
+                    handleFrame(JSON.parse(event.data));
+                } catch (err) {
+                    log(`Unreadable frame from Cylog: ${err}`, 'debug');
+                }
+            };
+            ws.onclose = () => {
+                ws = null;
+                sending = false;
+                if (!outdated) {
+                    log(`Disconnected from Cylog, reconnecting in ${reconnectDelay / 1000}s`, 'warn');
+                    setTimeout(connect, reconnectDelay);
+                }
+            };
+        }
+
+        // Send the oldest queued messages, one batch at a time
+        function sendBatch() {
+            if (sending || !ws || ws.readyState !== WebSocket.OPEN || queue.length === 0) return;
+            const batch = { type: 'batch', bridge: cylog.bridgeVersion, messages: queue.slice(0, maxBatch) };
+            if (source) batch.source = source;
+            ws.send(JSON.stringify(batch));
+            sending = true;
+        }
+
+        function handleFrame(frame) {
+            if (frame.type === 'batched') {
+                // Keep the source the server assigned for every later batch
+                if (frame.source && frame.source !== source) {
+                    source = frame.source;
+                    localStorage.setItem(sourceKey, source);
+                }
+                const done = new Set((frame.items || []).map(item => item.uuid));
+                for (const item of frame.items || []) {
+                    if (item.status === 'rejected') {
+                        log(`Message ${item.uuid} rejected: ${item.error}`, 'warn');
+                    }
+                }
+                for (let i = queue.length - 1; i >= 0; i--) {
+                    if (done.has(queue[i].uuid)) queue.splice(i, 1);
+                }
+                sending = false;
+                sendBatch();
+            } else if (frame.type === 'error' && frame.code === 'bridge_outdated') {
+                // Stop relaying until the script is updated
+                outdated = true;
+                ws.close();
+                promptUpdate(frame.error);
+            } else if (frame.type === 'error') {
+                log(`Cylog refused a frame (${frame.code}): ${frame.error}`, 'warn');
+            }
+        }
+
+        // Queue a Cytube chatMsg, stamped with the time it was said. Its
+        // msg is HTML; the text is parsed out without running anything in it.
+        function relay(msg) {
+            if (!msg || !msg.username) return;
+            const html = msg.msg || '';
+            queue.push({
+                uuid: crypto.randomUUID(),
+                username: msg.username,
+                content: new DOMParser().parseFromString(html, 'text/html').body.textContent,
+                html,
+                timestamp: new Date(msg.time || Date.now()).toISOString()
+            });
+            sendBatch();
+        }
+
+        // Listen on Cytube's socket, or hook ChatStyleAdjuster's chat
+        // listener when the socket isn't exposed
+        if (window.socket && typeof window.socket.on === 'function') {
+            window.socket.on('chatMsg', relay);
+            log('Relaying chat messages from the Cytube socket');
+        } else if (window.chatListener) {
+            const originalHandleMessage = window.chatListener.handleMessage;
+            window.chatListener.handleMessage = function(msg) {
+                originalHandleMessage.call(window.chatListener, msg);
+                relay(msg);
+            };
+            log('Chat listener hooked for message relay');
+        } else {
+            log('No chat source found, nothing to relay', 'warn');
+            return;
+        }
+
+        connect();
+        log('Message bridge ready');
+    }
+})(); 
\ No newline at end of file
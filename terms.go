@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Term statistics limits
+const (
+	defaultTopTerms = 50
+	maxTopTerms     = 1000
+
+	// maxTrackedTerms bounds the size of a term table; when exceeded, the
+	// rarest terms are pruned
+	maxTrackedTerms = 50000
+)
+
+// stopwords are common words excluded from word frequency statistics
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "do": true, "for": true, "from": true,
+	"have": true, "he": true, "i": true, "if": true, "in": true, "is": true,
+	"it": true, "its": true, "me": true, "my": true, "no": true, "not": true,
+	"of": true, "on": true, "or": true, "so": true, "that": true, "the": true,
+	"this": true, "to": true, "was": true, "we": true, "what": true, "with": true,
+	"you": true, "your": true, "just": true, "im": true, "it's": true, "i'm": true,
+}
+
+// cytubeEmote is an entry of the channel emote list sent by Cytube
+type cytubeEmote struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// EmoteSet holds the channel's known emotes and their image URLs
+type EmoteSet struct {
+	names map[string]string
+	mutex sync.RWMutex
+}
+
+// NewEmoteSet creates an empty emote set
+func NewEmoteSet() *EmoteSet {
+	return &EmoteSet{names: make(map[string]string)}
+}
+
+// SetEmotes replaces the known emotes
+func (e *EmoteSet) SetEmotes(emotes []cytubeEmote) {
+	set := make(map[string]string, len(emotes))
+	for _, emote := range emotes {
+		set[emote.Name] = emote.Image
+	}
+
+	e.mutex.Lock()
+	e.names = set
+	e.mutex.Unlock()
+}
+
+// Image returns the image URL of a listed emote
+func (e *EmoteSet) Image(name string) (string, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	image, ok := e.names[name]
+	return image, ok && image != ""
+}
+
+// IsEmote reports whether token is an emote. Without an emote list, tokens
+// written as :name: are treated as emotes.
+func (e *EmoteSet) IsEmote(token string) bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if len(e.names) > 0 {
+		_, ok := e.names[token]
+		return ok
+	}
+	return len(token) > 2 && strings.HasPrefix(token, ":") && strings.HasSuffix(token, ":")
+}
+
+// tokenizeWords splits content into lowercased words, skipping URLs and stopwords
+func tokenizeWords(content string) []string {
+	var words []string
+	for _, field := range strings.Fields(content) {
+		if strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://") {
+			continue
+		}
+
+		for _, word := range strings.FieldsFunc(strings.ToLower(field), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\''
+		}) {
+			word = strings.Trim(word, "'")
+			if len([]rune(word)) < 2 || stopwords[word] {
+				continue
+			}
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// pruneTerms removes the rarest terms from counts until it is within limit
+func pruneTerms(counts map[string]int, limit int) {
+	for minCount := 1; len(counts) > limit; minCount++ {
+		for term, count := range counts {
+			if count <= minCount {
+				delete(counts, term)
+			}
+		}
+	}
+}
+
+// TermCount is the number of occurrences of a term
+type TermCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// registerTermRoutes registers the term frequency statistics endpoint
+func registerTermRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/stats/terms", func(c *gin.Context) {
+		from, to, err := parseDateRange(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		top := defaultTopTerms
+		if value := c.Query("top"); value != "" {
+			top, err = strconv.Atoi(value)
+			if err != nil || top <= 0 || top > maxTopTerms {
+				apiError(c, http.StatusBadRequest, "invalid top parameter")
+				return
+			}
+		}
+
+		termType := c.DefaultQuery("type", "word")
+		if termType != "word" && termType != "emote" {
+			apiError(c, http.StatusBadRequest, "type must be word or emote")
+			return
+		}
+
+		files, err := chatServer.logger.GetLogsInRange(from, to)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		merged := make(map[string]int)
+		err = chatServer.stats.Collect(files, func(stats *fileStats) {
+			if termType == "word" {
+				for term, count := range stats.words {
+					merged[term] += count
+				}
+			} else {
+				for token, count := range stats.tokens {
+					if chatServer.emotes.IsEmote(token) {
+						merged[token] += count
+					}
+				}
+			}
+			if len(merged) > maxTrackedTerms {
+				pruneTerms(merged, maxTrackedTerms)
+			}
+		})
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		terms := make([]TermCount, 0, len(merged))
+		for term, count := range merged {
+			terms = append(terms, TermCount{Term: term, Count: count})
+		}
+		sort.Slice(terms, func(i, j int) bool {
+			if terms[i].Count != terms[j].Count {
+				return terms[i].Count > terms[j].Count
+			}
+			return terms[i].Term < terms[j].Term
+		})
+		if len(terms) > top {
+			terms = terms[:top]
+		}
+
+		c.JSON(http.StatusOK, terms)
+	})
+}
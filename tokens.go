@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// API token scopes; admin includes the others
+const (
+	scopeRead   = "read"
+	scopeIngest = "ingest"
+	scopeAdmin  = "admin"
+)
+
+// UI roles: viewers read, admins also manage log files
+const (
+	roleViewer = "viewer"
+	roleAdmin  = "admin"
+)
+
+// tokenHashPrefix starts the token hashes printed by "cylog token hash"
+const tokenHashPrefix = "sha256:"
+
+// tokenHashPattern matches a token hash in the config file
+var tokenHashPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// tokenKey is the gin context key of the token a request authenticated with
+const tokenKey = "token"
+
+// defaultAdminName names admin_token in the audit and access logs
+const defaultAdminName = "admin"
+
+// APIToken is a named API token with its scopes. Only the token's hash is
+// configured, so the token itself is never stored on disk.
+type APIToken struct {
+	Name   string   `yaml:"name"`
+	Hash   string   `yaml:"hash"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// authToken is the token a request or WebSocket client authenticated with
+type authToken struct {
+	name   string
+	hash   string
+	scopes []string
+}
+
+// allows reports whether the token has one of the scopes
+func (t authToken) allows(scopes ...string) bool {
+	for _, have := range t.scopes {
+		if have == scopeAdmin {
+			return true
+		}
+		for _, want := range scopes {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// role returns the UI role of the token
+func (t authToken) role() string {
+	if t.allows(scopeAdmin) {
+		return roleAdmin
+	}
+	return roleViewer
+}
+
+// hashToken returns the hash of a token as written in the config file
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// validateTokens checks the configured tokens, lowercasing their hashes
+func validateTokens(tokens []APIToken) error {
+	names := make(map[string]bool)
+	for i := range tokens {
+		token := &tokens[i]
+		if token.Name == "" {
+			return fmt.Errorf("invalid token: name is required")
+		}
+		if token.Name == defaultAdminName || names[token.Name] {
+			return fmt.Errorf("invalid token %q: duplicate name", token.Name)
+		}
+		names[token.Name] = true
+
+		token.Hash = strings.ToLower(token.Hash)
+		if !tokenHashPattern.MatchString(token.Hash) {
+			return fmt.Errorf("invalid token %q: hash must be the output of cylog token hash", token.Name)
+		}
+		if len(token.Scopes) == 0 {
+			return fmt.Errorf("invalid token %q: scopes are required", token.Name)
+		}
+		for _, scope := range token.Scopes {
+			if scope != scopeRead && scope != scopeIngest && scope != scopeAdmin {
+				return fmt.Errorf("invalid token %q: unknown scope %q (must be read, ingest or admin)", token.Name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupToken finds the token with the given hash; admin_token has every
+// scope, and login sessions have the login's scopes
+func (c *Config) lookupToken(hash string) (authToken, bool) {
+	if hash == "" {
+		return authToken{}, false
+	}
+	if strings.HasPrefix(hash, sessionPrefix) {
+		if !c.Login.enabled() || hash != c.Login.sessionHash() {
+			return authToken{}, false
+		}
+		return authToken{name: c.Login.Username, hash: hash, scopes: c.Login.sessionScopes()}, true
+	}
+	if c.AdminToken != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(c.AdminToken))) == 1 {
+		return authToken{name: defaultAdminName, hash: hash, scopes: []string{scopeAdmin}}, true
+	}
+	for _, token := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) == 1 {
+			return authToken{name: token.Name, hash: hash, scopes: token.Scopes}, true
+		}
+	}
+	return authToken{}, false
+}
+
+// adminEnabled reports whether any token, or the login's sessions, can use
+// the admin API
+func (c *Config) adminEnabled() bool {
+	if c.AdminToken != "" {
+		return true
+	}
+	if c.Login.enabled() && (authToken{scopes: c.Login.sessionScopes()}).allows(scopeAdmin) {
+		return true
+	}
+	for _, token := range c.Tokens {
+		if (authToken{scopes: token.Scopes}).allows(scopeAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestToken returns the token a request carries, from an
+// "Authorization: Bearer" header or, for WebSocket and feed clients that
+// can't set headers, a token query parameter
+func requestToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return c.Query("token")
+}
+
+// authenticate returns the configured token a request carries, or else its
+// login session. A session only counts for requests that change state when
+// they send the CSRF token.
+func authenticate(c *gin.Context, cfg *Config) (authToken, bool) {
+	if token := requestToken(c); token != "" {
+		return cfg.lookupToken(hashToken(token))
+	}
+	if isMutatingRequest(c) && !validCSRF(c) {
+		return authToken{}, false
+	}
+	// WebSocket upgrades are GETs, out of reach of the CSRF check, and
+	// browsers send the cookie with them from any page, so a session only
+	// counts for upgrades from the server's own pages
+	if websocket.IsWebSocketUpgrade(c.Request) && !sameOrigin(c.Request) {
+		return authToken{}, false
+	}
+	return sessions.Verify(c, cfg)
+}
+
+// requestAuthToken returns the token the middleware authenticated a
+// request with
+func requestAuthToken(c *gin.Context) (authToken, bool) {
+	value, ok := c.Get(tokenKey)
+	if !ok {
+		return authToken{}, false
+	}
+	token, ok := value.(authToken)
+	return token, ok
+}
+
+// tokenName returns the name of the token a request authenticated with, for
+// the audit and access logs
+func tokenName(c *gin.Context) string {
+	token, _ := requestAuthToken(c)
+	return token.name
+}
+
+// requestRole returns the UI role of a request; requests without a token
+// or session are viewers
+func requestRole(c *gin.Context) string {
+	token, _ := requestAuthToken(c)
+	return token.role()
+}
+
+// mayReadPrivateMessages reports whether a request's token or session has
+// the admin scope, which PMs and their log files need
+func mayReadPrivateMessages(c *gin.Context) bool {
+	token, _ := requestAuthToken(c)
+	return token.allows(scopeAdmin)
+}
+
+// requireScope returns middleware that, with require_tokens or the login
+// set, only lets requests through that carry a token or session with one
+// of the scopes. Without it
+// every request passes, but a valid token still names it in the logs.
+// Refused requests that would change state are for admin routes, so they
+// are audited.
+func requireScope(store *ConfigStore, scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := store.Get()
+		token, ok := authenticate(c, cfg)
+		if ok {
+			c.Set(tokenKey, token)
+		}
+
+		if cfg.authRequired() {
+			if !ok {
+				if isMutatingRequest(c) {
+					recordAuthFailure(c, http.StatusUnauthorized)
+				}
+				apiError(c, http.StatusUnauthorized, "missing or invalid token")
+				return
+			}
+			if !token.allows(scopes...) {
+				if isMutatingRequest(c) {
+					recordAuthFailure(c, http.StatusForbidden)
+				}
+				apiError(c, http.StatusForbidden, fmt.Sprintf("token lacks the %s scope", strings.Join(scopes, " or ")))
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// redactedQuery returns a request's query string with the token hidden, for
+// the audit and access logs
+func redactedQuery(u *url.URL) string {
+	query := u.Query()
+	if !query.Has("token") {
+		return u.RawQuery
+	}
+	query.Set("token", "REDACTED")
+	return query.Encode()
+}
+
+// closeRevokedClients closes the WebSocket clients whose token was removed
+// from the config, or lost the scopes needed to connect; it must run on the
+// hub goroutine
+func (s *ChatServer) closeRevokedClients() {
+	cfg := s.Config()
+	for client := range s.clients {
+		if client.token.hash == "" {
+			continue
+		}
+		token, ok := cfg.lookupToken(client.token.hash)
+		if ok && (!cfg.authRequired() || token.allows(scopeRead, scopeIngest)) {
+			continue
+		}
+		closeFrame := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token revoked")
+		client.conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(clientCloseTimeout))
+		s.removeClient(client)
+	}
+}
+
+// RevokeClients closes the WebSocket clients of revoked tokens
+func (s *ChatServer) RevokeClients() {
+	select {
+	case s.revoke <- struct{}{}:
+	case <-s.quit:
+	}
+}
+
+// runTokenCommand implements "cylog token hash [token]", which prints the
+// hash of a token for the tokens setting
+func runTokenCommand(args []string) int {
+	if len(args) == 0 || args[0] != "hash" || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: cylog token hash [token]")
+		return 2
+	}
+
+	token, err := secretArg(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read token: %v\n", err)
+		return 1
+	}
+
+	fmt.Println(hashToken(token))
+	return 0
+}
+
+// secretArg returns the secret given as the only argument, or else the
+// first line of stdin, which keeps it out of the shell history
+func secretArg(args []string) (string, error) {
+	secret := ""
+	if len(args) > 0 {
+		secret = args[0]
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		secret = strings.TrimRight(line, "\r\n")
+	}
+	if secret == "" {
+		return "", errors.New("it must not be empty")
+	}
+	return secret, nil
+}
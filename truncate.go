@@ -0,0 +1,64 @@
+package main
+
+// truncationMarker ends truncated content and HTML
+const truncationMarker = "…"
+
+// Default message limits, in characters
+const (
+	defaultMaxMessageContent = 10000
+	defaultMaxMessageHTML    = 40000
+)
+
+// Truncation metrics
+var (
+	messagesTruncated      = metrics.Counter("cylog_messages_truncated_total", "Messages whose content or HTML was truncated at ingest")
+	truncatedOriginalBytes = metrics.Counter("cylog_messages_truncated_original_bytes_total", "Original size in bytes of the content and HTML of truncated messages")
+)
+
+// MessageLimits caps the size of messages from Cytube and local clients
+// before they are stored, logged or broadcast
+type MessageLimits struct {
+	// MaxContentLength and MaxHTMLLength are how many characters of a
+	// message's content and HTML are kept; longer ones are cut and end in
+	// an ellipsis. Zero means unlimited.
+	MaxContentLength int `yaml:"max_content_length"`
+	MaxHTMLLength    int `yaml:"max_html_length"`
+}
+
+// Apply truncates a message over the limits, marking it Truncated. HTML is
+// sanitized after the cut so tags it left open are closed.
+func (l MessageLimits) Apply(msg Message) Message {
+	content, contentCut := cutRunes(msg.Content, l.MaxContentLength)
+	html, htmlCut := cutRunes(msg.HTML, l.MaxHTMLLength)
+	if !contentCut && !htmlCut {
+		return msg
+	}
+
+	messagesTruncated.Inc()
+	truncatedOriginalBytes.Add(int64(len(msg.Content) + len(msg.HTML)))
+
+	msg.Truncated = true
+	if contentCut {
+		msg.Content = content + truncationMarker
+	}
+	if htmlCut {
+		msg.HTML = sanitizeHTML(html) + truncationMarker
+	}
+	return msg
+}
+
+// cutRunes returns the first max characters of s, never splitting a
+// character, and whether anything was cut; a max of zero keeps s whole
+func cutRunes(s string, max int) (string, bool) {
+	if max <= 0 || len(s) <= max {
+		return s, false
+	}
+	count := 0
+	for i := range s {
+		if count == max {
+			return s[:i], true
+		}
+		count++
+	}
+	return s, false
+}
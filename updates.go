@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Update check settings
+const (
+	updateReleasesURL   = "https://api.github.com/repos/Halffd/cylog/releases/latest"
+	updateCheckInterval = 24 * time.Hour
+	updateRetryDelay    = time.Minute
+	updateCheckTimeout  = 10 * time.Second
+	updateCheckFileName = ".update-check.json"
+
+	// disableUpdateCheckEnv turns the update check off whatever the config says
+	disableUpdateCheckEnv = "CYLOG_DISABLE_UPDATE_CHECK"
+)
+
+// UpdateStatus is the result of the last update check
+type UpdateStatus struct {
+	Current   string    `json:"current"`
+	Latest    string    `json:"latest"`
+	Available bool      `json:"available"`
+	URL       string    `json:"url,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// githubRelease is the part of a GitHub release response the check reads
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	HTMLURL string `json:"html_url"`
+}
+
+// UpdateChecker compares the running version with the latest GitHub
+// release. It never downloads anything; a newer release is reported in the
+// status endpoint, on the logs page and once in app.log.
+type UpdateChecker struct {
+	last      *UpdateStatus
+	failures  int
+	announced string
+	client    *http.Client
+	mutex     sync.Mutex
+}
+
+// NewUpdateChecker creates a checker, starting from the result cached by
+// an earlier run so frequent restarts don't query GitHub each time
+func NewUpdateChecker() *UpdateChecker {
+	u := &UpdateChecker{client: &http.Client{Timeout: updateCheckTimeout}}
+	data, err := os.ReadFile(updateCheckPath())
+	if err != nil {
+		return u
+	}
+	var cached UpdateStatus
+	if err := json.Unmarshal(data, &cached); err == nil && cached.Current == version() {
+		u.last = &cached
+	}
+	return u
+}
+
+// updateCheckPath returns where the last check result is cached
+func updateCheckPath() string {
+	return filepath.Join(logsDir, updateCheckFileName)
+}
+
+// updateCheckEnabled reports whether update checks are on: opted into in
+// the config and not disabled by the environment
+func updateCheckEnabled(cfg *Config) bool {
+	return cfg.UpdateCheck && os.Getenv(disableUpdateCheckEnv) == ""
+}
+
+// Status returns the result of the last successful check, or nil before one
+func (u *UpdateChecker) Status() *UpdateStatus {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.last == nil {
+		return nil
+	}
+	status := *u.last
+	return &status
+}
+
+// nextCheck returns when to check again: a day after the last successful
+// check, or after a delay doubling with each failure while offline
+func (u *UpdateChecker) nextCheck() time.Duration {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.failures > 0 {
+		return min(updateRetryDelay<<min(u.failures-1, 10), updateCheckInterval)
+	}
+	if u.last == nil {
+		return updateCheckInterval
+	}
+	return max(time.Until(u.last.CheckedAt.Add(updateCheckInterval)), updateRetryDelay)
+}
+
+// Check queries the latest release unless the cached result is recent.
+// Failures are not reported, so running offline stays quiet; they only
+// shorten the delay before the next attempt.
+func (u *UpdateChecker) Check(ctx context.Context) error {
+	current := version()
+	if _, ok := parseVersion(current); !ok {
+		// Development builds have nothing to compare
+		return nil
+	}
+	if last := u.Status(); last != nil && time.Since(last.CheckedAt) < updateCheckInterval {
+		u.announce(*last)
+		return nil
+	}
+
+	release, err := u.latestRelease(ctx)
+	u.mutex.Lock()
+	if err != nil {
+		u.failures++
+		u.mutex.Unlock()
+		return nil
+	}
+	u.failures = 0
+	status := UpdateStatus{
+		Current:   current,
+		Latest:    release.TagName,
+		Available: newerVersion(release.TagName, current),
+		URL:       release.HTMLURL,
+		CheckedAt: time.Now(),
+	}
+	u.last = &status
+	u.mutex.Unlock()
+
+	if data, err := json.Marshal(status); err == nil {
+		if err := writeFileAtomic(updateCheckPath(), data); err != nil {
+			log.Printf("Error saving update check result: %v", err)
+		}
+	}
+	u.announce(status)
+	return nil
+}
+
+// announce writes a single app.log line per newer release
+func (u *UpdateChecker) announce(status UpdateStatus) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !status.Available || u.announced == status.Latest {
+		return
+	}
+	u.announced = status.Latest
+	log.Printf("Update available: cylog %s (running %s) at %s", status.Latest, status.Current, status.URL)
+}
+
+// latestRelease fetches the latest release from the GitHub API
+func (u *UpdateChecker) latestRelease(ctx context.Context) (githubRelease, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, updateReleasesURL, nil)
+	if err != nil {
+		return githubRelease{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "cylog/"+version())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return githubRelease{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return githubRelease{}, fmt.Errorf("releases request returned %s", resp.Status)
+	}
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return githubRelease{}, err
+	}
+	if _, ok := parseVersion(release.TagName); !ok {
+		return githubRelease{}, errors.New("latest release has no version tag")
+	}
+	return release, nil
+}
+
+// parseVersion parses a release version like v1.2.3 or 1.2.3-rc1 into its
+// numbers and whether it is a pre-release
+func parseVersion(v string) ([4]int, bool) {
+	core, pre, _ := strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return [4]int{}, false
+	}
+
+	var parsed [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return [4]int{}, false
+		}
+		parsed[i] = n
+	}
+	// A release sorts after its pre-releases
+	if pre == "" {
+		parsed[3] = 1
+	}
+	return parsed, true
+}
+
+// newerVersion reports whether version latest is newer than current
+func newerVersion(latest, current string) bool {
+	l, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Upstream connection defaults
+const (
+	discoveryTimeout    = 10 * time.Second
+	defaultPingInterval = 25 * time.Second
+	defaultStallTimeout = 60 * time.Second
+)
+
+// UpstreamConfig configures how the Cytube WebSocket servers are found
+type UpstreamConfig struct {
+	// URLs are the WebSocket URLs tried in order on each reconnect
+	URLs []string `yaml:"urls"`
+
+	// DiscoveryURL is a channel socketconfig URL such as
+	// https://cytu.be/socketconfig/mychannel.json, queried for the current
+	// servers when every known URL fails
+	DiscoveryURL string `yaml:"discovery_url"`
+
+	// Proxy is the outbound proxy URL (http://, https:// or socks5://). When
+	// empty, HTTPS_PROXY, HTTP_PROXY and ALL_PROXY are honored; "direct"
+	// disables proxying.
+	Proxy string `yaml:"proxy"`
+
+	// Headers are extra HTTP headers sent with the WebSocket handshake, such
+	// as User-Agent
+	Headers map[string]string `yaml:"headers"`
+
+	// Cookies are sent with the handshake in addition to any from CookiesFile
+	Cookies map[string]string `yaml:"cookies"`
+
+	// CookiesFile is a Netscape-format cookies.txt file exported from a browser
+	CookiesFile string `yaml:"cookies_file"`
+
+	// TLS configures verification of the upstream servers' certificates
+	TLS UpstreamTLSConfig `yaml:"tls"`
+
+	// PingIntervalSeconds is how often a Socket.IO ping is sent upstream
+	PingIntervalSeconds int `yaml:"ping_interval_seconds"`
+
+	// StallTimeoutSeconds is how long the connection may deliver no frames
+	// at all before it is closed and redialed
+	StallTimeoutSeconds int `yaml:"stall_timeout_seconds"`
+}
+
+// PingInterval returns the upstream ping interval, defaulting to 25 seconds
+func (c UpstreamConfig) PingInterval() time.Duration {
+	if c.PingIntervalSeconds <= 0 {
+		return defaultPingInterval
+	}
+	return time.Duration(c.PingIntervalSeconds) * time.Second
+}
+
+// StallTimeout returns the upstream stall timeout, defaulting to a minute
+func (c UpstreamConfig) StallTimeout() time.Duration {
+	if c.StallTimeoutSeconds <= 0 {
+		return defaultStallTimeout
+	}
+	return time.Duration(c.StallTimeoutSeconds) * time.Second
+}
+
+// UpstreamTLSConfig configures TLS for upstream connections
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle of additional trusted certificate authorities
+	CAFile string `yaml:"ca_file"`
+
+	// InsecureSkipVerify disables certificate verification entirely
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// proxyFunc returns the proxy selection function for upstream requests
+func (c UpstreamConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	switch c.Proxy {
+	case "direct":
+		return nil, nil
+	case "":
+		return func(req *http.Request) (*url.URL, error) {
+			proxyURL, err := http.ProxyFromEnvironment(req)
+			if proxyURL != nil || err != nil {
+				return proxyURL, err
+			}
+			for _, name := range []string{"ALL_PROXY", "all_proxy"} {
+				if value := os.Getenv(name); value != "" {
+					return url.Parse(value)
+				}
+			}
+			return nil, nil
+		}, nil
+	}
+
+	proxyURL, err := url.Parse(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// tlsConfig builds the TLS configuration for upstream connections
+func (c UpstreamConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: c.TLS.InsecureSkipVerify}
+	if c.TLS.CAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(c.TLS.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", c.TLS.CAFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+// dialer builds the WebSocket dialer for upstream connections
+func (c UpstreamConfig) dialer() (*websocket.Dialer, error) {
+	proxy, err := c.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &websocket.Dialer{
+		Proxy:            proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}, nil
+}
+
+// httpClient builds the HTTP client for upstream requests such as discovery
+func (c UpstreamConfig) httpClient() (*http.Client, error) {
+	proxy, err := c.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout: discoveryTimeout,
+		Transport: &http.Transport{
+			Proxy:           proxy,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// UpstreamStatus describes the state of the Cytube connection
+type UpstreamStatus struct {
+	Active      string    `json:"active"`
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connected_at,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	ErrorKind   string    `json:"error_kind,omitempty"`
+	Candidates  []string  `json:"candidates"`
+	Account     string    `json:"account,omitempty"`
+
+	LastFrameAt           time.Time `json:"last_frame_at,omitempty"`
+	SecondsSinceLastFrame float64   `json:"seconds_since_last_frame"`
+}
+
+// upstreamState tracks the known upstream servers and which one last worked
+type upstreamState struct {
+	discovered  []string
+	lastGood    string
+	active      string
+	connected   bool
+	connectedAt time.Time
+	lastError   string
+	errorKind   string
+	lastFrameAt time.Time
+	conn        *websocket.Conn
+	account     string
+	mutex       sync.Mutex
+
+	// writeMutex serializes writes to the connection, which allows only one
+	// concurrent writer
+	writeMutex sync.Mutex
+}
+
+// candidates returns the URLs to try, the last working one first, followed
+// by the configured and then the discovered URLs
+func (u *upstreamState) candidates(cfg UpstreamConfig) []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	seen := make(map[string]bool)
+	urls := make([]string, 0, len(cfg.URLs)+len(u.discovered)+1)
+	for _, list := range [][]string{{u.lastGood}, cfg.URLs, u.discovered} {
+		for _, candidate := range list {
+			if candidate == "" || seen[candidate] {
+				continue
+			}
+			seen[candidate] = true
+			urls = append(urls, candidate)
+		}
+	}
+	return urls
+}
+
+// setConnected records a successful connection to url
+func (u *upstreamState) setConnected(url string, conn *websocket.Conn) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.conn = conn
+
+	u.lastGood = url
+	u.active = url
+	u.connected = true
+	u.connectedAt = time.Now()
+	u.lastError = ""
+	u.errorKind = ""
+	u.lastFrameAt = u.connectedAt
+}
+
+// setDisconnected records that the connection was lost or could not be made
+func (u *upstreamState) setDisconnected(err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.connected = false
+	u.conn = nil
+	u.account = ""
+	if err != nil {
+		u.lastError = err.Error()
+		u.errorKind = ""
+		if errors.Is(err, errCookiesExpired) {
+			u.errorKind = "cookies_expired"
+		}
+	}
+}
+
+// setAccount records the Cytube account the connection is logged in as
+func (u *upstreamState) setAccount(name string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.account = name
+}
+
+// session returns the live connection and the account it is logged in as
+func (u *upstreamState) session() (*websocket.Conn, string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.conn, u.account
+}
+
+// frameReceived records that a frame arrived from upstream at now
+func (u *upstreamState) frameReceived(now time.Time) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.lastFrameAt = now
+}
+
+// sinceLastFrame returns how long ago the last upstream frame arrived, or
+// zero if none has been received yet
+func (u *upstreamState) sinceLastFrame() time.Duration {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.lastFrameAt.IsZero() {
+		return 0
+	}
+	return time.Since(u.lastFrameAt)
+}
+
+// setDiscovered replaces the discovered server list
+func (u *upstreamState) setDiscovered(urls []string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.discovered = urls
+}
+
+// UpstreamStatus returns the current state of the Cytube connection
+func (s *ChatServer) UpstreamStatus() UpstreamStatus {
+	return s.upstream.status(s.Config().Upstream)
+}
+
+// status returns the state of the connection, tried at the candidates of cfg
+func (u *upstreamState) status(cfg UpstreamConfig) UpstreamStatus {
+	candidates := u.candidates(cfg)
+	sinceLastFrame := u.sinceLastFrame()
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return UpstreamStatus{
+		Active:                u.active,
+		Connected:             u.connected,
+		ConnectedAt:           u.connectedAt,
+		LastError:             u.lastError,
+		ErrorKind:             u.errorKind,
+		Candidates:            candidates,
+		Account:               u.account,
+		LastFrameAt:           u.lastFrameAt,
+		SecondsSinceLastFrame: sinceLastFrame.Seconds(),
+	}
+}
+
+// writeUpstream sends a text frame to the Cytube connection
+func (s *ChatServer) writeUpstream(conn *websocket.Conn, data []byte) error {
+	s.upstream.writeMutex.Lock()
+	defer s.upstream.writeMutex.Unlock()
+
+	s.raw.Record(rawOutbound, data, time.Now())
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// pingUpstream sends Socket.IO pings at the configured interval until done is closed
+func (s *ChatServer) pingUpstream(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(s.Config().Upstream.PingInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := s.writeUpstream(conn, []byte(engineIOPing)); err != nil {
+				log.Printf("Error sending ping to Cytube: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// dialUpstream tries each candidate URL in order, re-running discovery if all
+// of them fail, and returns the first connection that succeeds
+func (s *ChatServer) dialUpstream(ctx context.Context) (*websocket.Conn, string, error) {
+	cfg := s.Config().Upstream
+
+	conn, url, err := s.dialCandidates(ctx, s.upstream.candidates(cfg))
+	if err == nil || cfg.DiscoveryURL == "" || ctx.Err() != nil {
+		return conn, url, err
+	}
+
+	discovered, discoverErr := discoverUpstreams(ctx, cfg)
+	if discoverErr != nil {
+		return nil, "", fmt.Errorf("%v; discovery failed: %w", err, discoverErr)
+	}
+	log.Printf("Discovered Cytube servers: %v", discovered)
+	s.upstream.setDiscovered(discovered)
+
+	return s.dialCandidates(ctx, discovered)
+}
+
+// dialCandidates dials the URLs in order, returning the first success
+func (s *ChatServer) dialCandidates(ctx context.Context, urls []string) (*websocket.Conn, string, error) {
+	if len(urls) == 0 {
+		return nil, "", fmt.Errorf("no Cytube WebSocket URLs configured")
+	}
+
+	var lastErr error
+	for _, candidate := range urls {
+		conn, err := s.connectToCytube(ctx, candidate)
+		if err == nil {
+			return conn, candidate, nil
+		}
+		log.Printf("Failed to connect to %s: %v", candidate, err)
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", lastErr
+}
+
+// socketConfig is the response of a Cytube socketconfig discovery request
+type socketConfig struct {
+	Servers []struct {
+		URL    string `json:"url"`
+		Secure bool   `json:"secure"`
+	} `json:"servers"`
+}
+
+// discoverUpstreams queries a Cytube socketconfig URL and returns the
+// Socket.IO WebSocket URLs of the listed servers, secure servers first
+func discoverUpstreams(ctx context.Context, cfg UpstreamConfig) ([]string, error) {
+	client, err := cfg.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.DiscoveryURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery URL: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discovery request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery request returned %s", resp.Status)
+	}
+
+	var config socketConfig
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid discovery response: %w", err)
+	}
+
+	var secure, insecure []string
+	for _, server := range config.Servers {
+		wsURL, err := socketIOWebSocketURL(server.URL)
+		if err != nil {
+			log.Printf("Skipping discovered server %q: %v", server.URL, err)
+			continue
+		}
+		if server.Secure {
+			secure = append(secure, wsURL)
+		} else {
+			insecure = append(insecure, wsURL)
+		}
+	}
+
+	urls := append(secure, insecure...)
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("discovery returned no servers")
+	}
+	return urls, nil
+}
+
+// socketIOWebSocketURL converts a server base URL like https://host:443 into
+// its Socket.IO WebSocket endpoint
+func socketIOWebSocketURL(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+
+	switch u.Scheme {
+	case "https", "wss":
+		u.Scheme = "wss"
+	case "http", "ws":
+		u.Scheme = "ws"
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/socket.io/"
+	u.RawQuery = "EIO=3&transport=websocket"
+	return u.String(), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cylog/internal/testsupport"
+)
+
+func TestUpstreamReconnectsDontLeakGoroutines(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	_, baseURL := runTestServer(t.Context(), t, defaultConfig(), upstream)
+	client := testsupport.Dial(t, baseURL, "/ws")
+	upstream.WaitConnected(e2eTimeout)
+	upstream.WaitEvent("joinChannel", e2eTimeout)
+	baseline := runtime.NumGoroutine()
+
+	// Cytube keeps dropping the connection while chat goes on
+	for i := 0; i < 20; i++ {
+		upstream.Disconnect()
+		upstream.WaitConnected(e2eTimeout)
+		upstream.WaitEvent("joinChannel", e2eTimeout)
+		upstream.ChatMsg("alice", "still here")
+	}
+	upstream.ChatMsg("alice", "last message")
+	client.WaitFor(e2eTimeout, frameContaining("last message"))
+
+	waitGoroutines(t, baseline)
+}
+
+// socks5Proxy is a SOCKS5 server without authentication that records the
+// addresses it was asked to connect to
+type socks5Proxy struct {
+	listener net.Listener
+
+	mutex   sync.Mutex
+	targets []string
+	conns   []net.Conn
+}
+
+// newSOCKS5Proxy starts a SOCKS5 server on a random local port, closed
+// with its connections when the test ends
+func newSOCKS5Proxy(t *testing.T) *socks5Proxy {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening for the proxy: %v", err)
+	}
+	p := &socks5Proxy{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		for _, conn := range p.conns {
+			conn.Close()
+		}
+	})
+	return p
+}
+
+// Targets returns the addresses the proxy connected to
+func (p *socks5Proxy) Targets() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// serve handles the greeting and CONNECT request of one client, then relays
+// its connection to the target
+func (p *socks5Proxy) serve(conn net.Conn) {
+	p.mutex.Lock()
+	p.conns = append(p.conns, conn)
+	p.mutex.Unlock()
+
+	target, err := readSOCKS5Connect(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	p.mutex.Lock()
+	p.targets = append(p.targets, target)
+	p.conns = append(p.conns, upstream)
+	p.mutex.Unlock()
+
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+// readSOCKS5Connect accepts a client without authentication and returns
+// the address of its CONNECT request
+func readSOCKS5Connect(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[0] != 5 || request[1] != 1 {
+		return "", errors.New("not a SOCKS5 CONNECT request")
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if request[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errors.New("unknown SOCKS5 address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func TestUpstreamDialsThroughSOCKS5(t *testing.T) {
+	upstream := testsupport.NewFakeCytube(t)
+	proxy := newSOCKS5Proxy(t)
+	cfg := defaultConfig()
+	cfg.Upstream.Proxy = "socks5://" + proxy.listener.Addr().String()
+	_, baseURL := runTestServer(t.Context(), t, cfg, upstream)
+	client := testsupport.Dial(t, baseURL, "/ws")
+	upstream.WaitConnected(e2eTimeout)
+
+	upstream.ChatMsg("alice", "through the proxy")
+	client.WaitFor(e2eTimeout, frameContaining("through the proxy"))
+
+	want := strings.SplitN(upstream.URL(), "/", 4)[2]
+	if targets := proxy.Targets(); len(targets) == 0 || targets[0] != want {
+		t.Errorf("proxy connected to %v, want %s", targets, want)
+	}
+}
+
+func TestUpstreamProxyUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	upstream := testsupport.NewFakeCytube(t)
+	cfg := defaultConfig()
+	cfg.Upstream.URLs = []string{upstream.URL()}
+	cfg.Upstream.Proxy = "socks5://" + addr
+	dialer, err := cfg.Upstream.dialer()
+	if err != nil {
+		t.Fatalf("building the dialer: %v", err)
+	}
+	if conn, _, err := dialer.DialContext(t.Context(), upstream.URL(), nil); err == nil {
+		conn.Close()
+		t.Error("dialed upstream around a proxy that isn't listening")
+	}
+}
+
+func TestUpstreamCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(cfg UpstreamConfig) error {
+		client, err := cfg.httpClient()
+		if err != nil {
+			return err
+		}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if err := get(UpstreamConfig{Proxy: "direct"}); err == nil {
+		t.Error("a server with an unknown CA was trusted")
+	}
+	if err := get(UpstreamConfig{Proxy: "direct", TLS: UpstreamTLSConfig{CAFile: caFile}}); err != nil {
+		t.Errorf("a server signed by the CA file was refused: %v", err)
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (UpstreamConfig{TLS: UpstreamTLSConfig{CAFile: notPEM}}).tlsConfig(); err == nil {
+		t.Error("a CA file without certificates was accepted")
+	}
+}
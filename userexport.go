@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// User export formats
+const (
+	exportFormatJSONL = "jsonl"
+	exportFormatCSV   = "csv"
+	exportFormatText  = "text"
+)
+
+// exportContentTypes are the response content types of the export formats
+var exportContentTypes = map[string]string{
+	exportFormatJSONL: "application/x-ndjson; charset=utf-8",
+	exportFormatCSV:   "text/csv; charset=utf-8",
+	exportFormatText:  "text/plain; charset=utf-8",
+}
+
+// exportFile is a message log file in the logs directory or its archive
+type exportFile struct {
+	path  string
+	start time.Time
+	seq   int
+}
+
+// userExportFiles lists the message log files of every kind, the archive
+// included, grouped by the start of their period, oldest first. PM logs are
+// only included when pms is set.
+func (l *Logger) userExportFiles(pms bool) ([][]exportFile, error) {
+	files := make([]exportFile, 0)
+	for _, dir := range []string{l.dir, filepath.Join(l.dir, archiveDirName)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read logs directory: %w", err)
+		}
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry.Name(), ".gz")
+			kind := logFileKind(name)
+			if entry.IsDir() || kind == "" || recordKinds[kind] || (kind == logKindPM && !pms) {
+				continue
+			}
+			start, seq, ok := parseLogFileName(name)
+			if !ok {
+				continue
+			}
+			files = append(files, exportFile{path: filepath.Join(dir, entry.Name()), start: start, seq: seq})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].start.Equal(files[j].start) {
+			return files[i].start.Before(files[j].start)
+		}
+		if files[i].seq != files[j].seq {
+			return files[i].seq < files[j].seq
+		}
+		return files[i].path < files[j].path
+	})
+
+	groups := make([][]exportFile, 0)
+	for i, file := range files {
+		if i == 0 || !file.start.Equal(files[i-1].start) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], file)
+	}
+	return groups, nil
+}
+
+// userExportWriter writes exported messages in one of the export formats
+type userExportWriter struct {
+	format string
+	out    io.Writer
+	csv    *csv.Writer
+}
+
+// newUserExportWriter creates a writer for format, writing the CSV header
+func newUserExportWriter(format string, out io.Writer) (*userExportWriter, error) {
+	w := &userExportWriter{format: format, out: out}
+	if format == exportFormatCSV {
+		w.csv = csv.NewWriter(out)
+		if err := w.csv.Write([]string{"timestamp", "seq", "type", "username", "content"}); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Write writes a single message
+func (w *userExportWriter) Write(msg Message) error {
+	switch w.format {
+	case exportFormatCSV:
+		seq := ""
+		if msg.Seq > 0 {
+			seq = strconv.FormatUint(msg.Seq, 10)
+		}
+		return w.csv.Write([]string{msg.Timestamp.Format(messageTimeFormat), seq, msg.Kind(), msg.Username, msg.Content})
+	case exportFormatText:
+		_, err := io.WriteString(w.out, formatLogEntry(msg))
+		return err
+	default:
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		_, err = w.out.Write(append(data, '\n'))
+		return err
+	}
+}
+
+// Flush flushes buffered CSV records
+func (w *userExportWriter) Flush() error {
+	if w.csv == nil {
+		return nil
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// exportUserMessages streams every message sent by username in the given
+// files, oldest first, flushing after each period so large archives show
+// progress. With aliases, messages sent under any name of the user's alias
+// group match.
+func (s *ChatServer) exportUserMessages(c *gin.Context, groups [][]exportFile, username string, match usernameMatch, format string, pms, aliases bool) (int, error) {
+	matches := func(msg Message) bool {
+		if aliases {
+			return matchUsername(match, s.aliases.Resolve(username), s.aliases.Resolve(msg.Username))
+		}
+		return matchUsername(match, username, msg.Username)
+	}
+
+	c.Header("Content-Type", exportContentTypes[format])
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="cylog-%s.%s"`, exportFilenamePart(username), format))
+	c.Status(http.StatusOK)
+	writer, err := newUserExportWriter(format, c.Writer)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := c.Request.Context()
+	count := 0
+	for _, group := range groups {
+		msgs := make([]Message, 0)
+		for _, file := range group {
+			if err := ctx.Err(); err != nil {
+				return count, err
+			}
+			content, err := s.logger.readLogFile(file.path)
+			if err != nil {
+				return count, fmt.Errorf("failed to read %s: %w", filepath.Base(file.path), err)
+			}
+			for _, line := range strings.Split(content, "\n") {
+				msg, ok := parseLogEntry(line)
+				if !ok || isStatusEntry(msg) || (msg.Kind() == messageTypePM && !pms) || !matches(msg) {
+					continue
+				}
+				msgs = append(msgs, msg)
+			}
+		}
+
+		// Kinds of the same period are merged in time order
+		sort.SliceStable(msgs, func(i, j int) bool {
+			return msgs[i].Timestamp.Before(msgs[j].Timestamp)
+		})
+		for _, msg := range msgs {
+			if err := writer.Write(msg); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if err := writer.Flush(); err != nil {
+			return count, err
+		}
+		c.Writer.Flush()
+	}
+	return count, nil
+}
+
+// exportFilenamePart reduces a username to characters safe in a filename
+func exportFilenamePart(username string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, username)
+}
+
+// registerUserExportRoutes registers the per-user history export endpoint
+func registerUserExportRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/users/:name/export", func(c *gin.Context) {
+		username := strings.TrimSpace(c.Param("name"))
+		if username == "" {
+			apiError(c, http.StatusBadRequest, "username is required")
+			return
+		}
+		format := c.DefaultQuery("format", exportFormatJSONL)
+		if _, ok := exportContentTypes[format]; !ok {
+			apiError(c, http.StatusBadRequest, "invalid format: must be jsonl, csv or text")
+			return
+		}
+
+		// PMs are private, so a wrong token is refused rather than ignored,
+		// and only tokens with the admin scope include them
+		pms := false
+		if requestToken(c) != "" {
+			token, ok := authenticate(c, chatServer.Config())
+			if !ok {
+				recordAuthFailure(c, http.StatusUnauthorized)
+				apiError(c, http.StatusUnauthorized, "invalid token")
+				return
+			}
+			if token.allows(scopeAdmin) {
+				pms = true
+				defer recordAudit(c)
+				auditLog(c, "export_user", username+" including private messages")
+			}
+		}
+
+		groups, err := chatServer.logger.userExportFiles(pms)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		count, err := chatServer.exportUserMessages(c, groups, username, parseUsernameMatch(c, false), format, pms, wantsAliasResolution(c))
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				logf(c, "User export of %s canceled after %d messages", username, count)
+				return
+			}
+			logf(c, "Error exporting messages of %s after %d messages: %v", username, count, err)
+		}
+	})
+}
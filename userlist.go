@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChannelUser is a user currently in the Cytube channel
+type ChannelUser struct {
+	Name         string `json:"name"`
+	Rank         int    `json:"rank"`
+	AFK          bool   `json:"afk"`
+	ProfileImage string `json:"profile_image,omitempty"`
+	Color        string `json:"color,omitempty"`
+}
+
+// newChannelUser converts a Cytube userlist entry
+func newChannelUser(user cytubeUser) ChannelUser {
+	return ChannelUser{
+		Name:         user.Name,
+		Rank:         user.Rank,
+		AFK:          user.Meta.AFK,
+		ProfileImage: user.Profile.Image,
+	}
+}
+
+// UserList is the set of users currently in the channel, as last reported
+// by Cytube
+type UserList struct {
+	users map[string]*ChannelUser
+	mutex sync.RWMutex
+}
+
+// NewUserList creates an empty user list
+func NewUserList() *UserList {
+	return &UserList{users: make(map[string]*ChannelUser)}
+}
+
+// Replace swaps in a full userlist snapshot, dropping users from a stale one
+func (u *UserList) Replace(users []ChannelUser) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.users = make(map[string]*ChannelUser, len(users))
+	for i := range users {
+		user := users[i]
+		u.users[strings.ToLower(user.Name)] = &user
+	}
+}
+
+// Add adds or replaces a user
+func (u *UserList) Add(user ChannelUser) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.users[strings.ToLower(user.Name)] = &user
+}
+
+// Remove removes a user, reporting whether they were listed
+func (u *UserList) Remove(name string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	key := strings.ToLower(name)
+	_, ok := u.users[key]
+	delete(u.users, key)
+	return ok
+}
+
+// Get returns a listed user by name
+func (u *UserList) Get(name string) (ChannelUser, bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	user, ok := u.users[strings.ToLower(name)]
+	if !ok {
+		return ChannelUser{}, false
+	}
+	return *user, true
+}
+
+// Update applies a change to a listed user and returns the result
+func (u *UserList) Update(name string, change func(user *ChannelUser)) (ChannelUser, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	user, ok := u.users[strings.ToLower(name)]
+	if !ok {
+		return ChannelUser{}, false
+	}
+	change(user)
+	return *user, true
+}
+
+// List returns the users sorted by rank, highest first, then by name
+func (u *UserList) List() []ChannelUser {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	users := make([]ChannelUser, 0, len(u.users))
+	for _, user := range u.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Rank != users[j].Rank {
+			return users[i].Rank > users[j].Rank
+		}
+		return strings.ToLower(users[i].Name) < strings.ToLower(users[j].Name)
+	})
+	return users
+}
+
+// Count returns the number of users in the channel
+func (u *UserList) Count() int {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return len(u.users)
+}
+
+// userlistMessage builds a userlist event for WebSocket clients. The full
+// list is included for snapshots, the affected user for incremental changes.
+func (s *ChatServer) userlistMessage(event string, user *ChannelUser) Message {
+	meta := map[string]interface{}{
+		"event": event,
+		"count": s.userlist.Count(),
+	}
+
+	content := fmt.Sprintf("%d users in the channel", s.userlist.Count())
+	if user != nil {
+		colored := *user
+		colored.Color = s.Config().UsernameColor(user.Name)
+		meta["user"] = colored
+		content = fmt.Sprintf("%s: %s", event, user.Name)
+	} else {
+		meta["users"] = s.channelUsers()
+	}
+
+	return Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Type:      messageTypeUserlist,
+		Username:  "System",
+		Timestamp: time.Now(),
+		Content:   content,
+		Meta:      meta,
+	}
+}
+
+// channelUsers returns the users in the channel with their colors
+func (s *ChatServer) channelUsers() []ChannelUser {
+	cfg := s.Config()
+	users := s.userlist.List()
+	for i := range users {
+		users[i].Color = cfg.UsernameColor(users[i].Name)
+	}
+	return users
+}
+
+// publishUserlist broadcasts a userlist change; userlist events are neither
+// logged nor kept in the recent buffer
+func (s *ChatServer) publishUserlist(event string, user *ChannelUser) {
+	s.broadcastMessage(s.userlistMessage(event, user))
+}
+
+// registerUserlistRoutes registers the channel userlist endpoint
+func registerUserlistRoutes(api *gin.RouterGroup, chatServer *ChatServer) {
+	api.GET("/userlist", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chatServer.channelUsers())
+	})
+}
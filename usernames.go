@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/cases"
+)
+
+// fuzzyUsernameMaxDistance is the largest edit distance, relative to the
+// longer name, at which a fuzzy username filter still matches
+const fuzzyUsernameMaxDistance = 0.34
+
+// usernameMatch selects how a username filter compares names
+type usernameMatch int
+
+// Username matching modes; the zero value matches normalized names
+const (
+	usernameMatchNormalized usernameMatch = iota
+	usernameMatchExact
+	usernameMatchFuzzy
+)
+
+// zeroWidthReplacer strips invisible characters that ride along when
+// usernames are copied from chat
+var zeroWidthReplacer = strings.NewReplacer(
+	"\u200b", "", // zero width space
+	"\u200c", "", // zero width non-joiner
+	"\u200d", "", // zero width joiner
+	"\u2060", "", // word joiner
+	"\ufeff", "", // zero width no-break space
+	"\u00ad", "", // soft hyphen
+)
+
+// normalizeUsername casefolds a username and strips zero-width characters,
+// so names compare the way people type them
+func normalizeUsername(name string) string {
+	return cases.Fold().String(zeroWidthReplacer.Replace(strings.TrimSpace(name)))
+}
+
+// usernamesEqual reports whether two usernames are the same person's once
+// normalized
+func usernamesEqual(a, b string) bool {
+	return normalizeUsername(a) == normalizeUsername(b)
+}
+
+// matchUsername reports whether name is selected by a username filter
+func matchUsername(mode usernameMatch, want, name string) bool {
+	switch mode {
+	case usernameMatchExact:
+		return name == want
+	case usernameMatchFuzzy:
+		return usernameDistance(normalizeUsername(want), normalizeUsername(name)) <= fuzzyUsernameMaxDistance
+	default:
+		return usernamesEqual(want, name)
+	}
+}
+
+// parseUsernameMatch parses the exact=1 escape hatch, and fuzzy=1 where
+// fuzzy matching is allowed
+func parseUsernameMatch(c *gin.Context, fuzzy bool) usernameMatch {
+	switch {
+	case c.Query("exact") == "1":
+		return usernameMatchExact
+	case fuzzy && c.Query("fuzzy") == "1":
+		return usernameMatchFuzzy
+	default:
+		return usernameMatchNormalized
+	}
+}
+
+// usernameDistance returns the Levenshtein distance between two names in
+// runes, divided by the length of the longer one
+func usernameDistance(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 0
+	}
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return float64(prev[len(rb)]) / float64(longest)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"already normal", "alice", "alice"},
+		{"upper case", "ALICE", "alice"},
+		{"mixed case", "AlIcE_99", "alice_99"},
+		{"surrounding space", "  alice\t", "alice"},
+		{"zero width space", "al\u200bice", "alice"},
+		{"zero width joiners", "\u200cal\u200dice\u2060", "alice"},
+		{"byte order mark", "\ufeffalice", "alice"},
+		{"soft hyphen", "ali\u00adce", "alice"},
+		{"German sharp s", "Straße", "strasse"},
+		{"Greek final sigma", "ΟΔΥΣΣΕΥΣ", "οδυσσευσ"},
+		{"Cyrillic", "ПРИВЕТ", "привет"},
+		{"empty", "", ""},
+		{"only invisible", "\u200b\ufeff", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeUsername(tt.in); got != tt.want {
+				t.Errorf("normalizeUsername(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchUsername(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       usernameMatch
+		want, user string
+		match      bool
+	}{
+		{"normalized same", usernameMatchNormalized, "alice", "Alice", true},
+		{"normalized pasted", usernameMatchNormalized, "alice", "ali\u200bce", true},
+		{"normalized different", usernameMatchNormalized, "alice", "alicia", false},
+		{"exact same", usernameMatchExact, "Alice", "Alice", true},
+		{"exact other case", usernameMatchExact, "alice", "Alice", false},
+		{"fuzzy typo", usernameMatchFuzzy, "alise", "Alice", true},
+		{"fuzzy transposition too far", usernameMatchFuzzy, "alcie", "alice", false},
+		{"fuzzy missing letter", usernameMatchFuzzy, "alce", "alice", true},
+		{"fuzzy unrelated", usernameMatchFuzzy, "bob", "alice", false},
+		{"fuzzy empty", usernameMatchFuzzy, "", "alice", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchUsername(tt.mode, tt.want, tt.user); got != tt.match {
+				t.Errorf("matchUsername(%q, %q) = %v, want %v", tt.want, tt.user, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestUsernameDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 0},
+		{"alice", "alice", 0},
+		{"alice", "", 1},
+		{"kitten", "sitting", 3.0 / 7},
+		{"alice", "alcie", 2.0 / 5},
+		{"ñandú", "nandu", 2.0 / 5},
+	}
+	for _, tt := range tests {
+		got := usernameDistance(tt.a, tt.b)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("usernameDistance(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if back := usernameDistance(tt.b, tt.a); back != got {
+			t.Errorf("usernameDistance(%q, %q) = %v, but %v the other way", tt.a, tt.b, got, back)
+		}
+	}
+}
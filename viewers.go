@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sync"
+	"time"
+)
+
+// viewerBroadcastInterval is the least time between viewers messages, so
+// connection churn doesn't flood clients
+const viewerBroadcastInterval = 5 * time.Second
+
+// ViewerCounter counts the connected WebSocket clients that haven't
+// identified as bots and publishes the count when it changes, at most once
+// per interval
+type ViewerCounter struct {
+	mutex    sync.Mutex
+	count    int
+	sent     int
+	sentAt   time.Time
+	pending  *time.Timer
+	interval time.Duration
+	publish  func(count int)
+}
+
+// NewViewerCounter creates a counter that calls publish with the new count
+func NewViewerCounter(interval time.Duration, publish func(count int)) *ViewerCounter {
+	return &ViewerCounter{interval: interval, publish: publish}
+}
+
+// Join counts a connected client unless it is a bot
+func (v *ViewerCounter) Join(client *Client) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if !client.bot && !client.counted {
+		client.counted = true
+		v.change(1)
+	}
+}
+
+// Leave stops counting a client, when it disconnects or turns out to be a bot
+func (v *ViewerCounter) Leave(client *Client) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.counted {
+		client.counted = false
+		v.change(-1)
+	}
+}
+
+// Count returns the number of viewers
+func (v *ViewerCounter) Count() int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.count
+}
+
+// change adjusts the count and schedules a publish unless one is pending
+func (v *ViewerCounter) change(delta int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.count += delta
+	if v.pending != nil {
+		return
+	}
+	delay := v.interval - time.Since(v.sentAt)
+	if delay < 0 {
+		delay = 0
+	}
+	v.pending = time.AfterFunc(delay, v.flush)
+}
+
+// flush publishes the count if it differs from the last one published
+func (v *ViewerCounter) flush() {
+	defer recoverPanic("viewer counter")
+
+	v.mutex.Lock()
+	v.pending = nil
+	if v.count == v.sent {
+		v.mutex.Unlock()
+		return
+	}
+	v.sent = v.count
+	v.sentAt = time.Now()
+	count := v.count
+	v.mutex.Unlock()
+
+	v.publish(count)
+}
+
+// publishViewers broadcasts the viewer count; like userlist events, viewers
+// messages are neither logged nor kept in the recent buffer
+func (s *ChatServer) publishViewers(count int) {
+	content := fmt.Sprintf("%d watching through cylog", count)
+	s.broadcastMessage(Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Type:      messageTypeViewers,
+		Username:  "System",
+		Timestamp: time.Now(),
+		Content:   content,
+		HTML:      html.EscapeString(content),
+		Meta:      map[string]interface{}{"count": count},
+	})
+}
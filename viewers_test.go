@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"cylog/internal/testsupport"
+)
+
+func TestViewerCountDebouncedUnderChurn(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	var mutex sync.Mutex
+	var published []int
+	var times []time.Time
+	viewers := NewViewerCounter(interval, func(count int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		published = append(published, count)
+		times = append(times, time.Now())
+	})
+
+	// Twenty connections each join ten clients and drop half of them again,
+	// a few milliseconds apart; bots never count
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				client := newClient(nil, "127.0.0.1", encodingJSON, "test")
+				client.bot = j == 9
+				viewers.Join(client)
+				if j%2 == 0 {
+					time.Sleep(time.Millisecond)
+					viewers.Leave(client)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	churn := time.Since(start)
+
+	const want = 20 * 4
+	if got := viewers.Count(); got != want {
+		t.Fatalf("count = %d, want %d", got, want)
+	}
+	testsupport.Eventually(t, time.Second, "final count not published", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(published) > 0 && published[len(published)-1] == want
+	})
+
+	// Allow for the timer firing a little late after the previous publish
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < interval*8/10 {
+			t.Errorf("publish %d came %s after the previous one, want at least %s", i, gap, interval)
+		}
+	}
+	if max := int(churn/interval) + 2; len(published) > max {
+		t.Errorf("%d publishes during %s of churn, want at most %d", len(published), churn, max)
+	}
+}
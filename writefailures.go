@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Classes of failed log writes
+const (
+	writeFailureNoSpace    = "no_space"
+	writeFailureIO         = "io"
+	writeFailurePermission = "permission"
+	writeFailureClosed     = "closed"
+	writeFailureOther      = "other"
+)
+
+// Log files are reopened after logReopenAfter consecutive failed writes, at
+// most once per logReopenInterval
+const (
+	logReopenAfter    = 3
+	logReopenInterval = 30 * time.Second
+)
+
+var (
+	logWriteFailures = metrics.Counter("cylog_log_write_failures_total", "Batches of messages that failed to be written to the log files")
+	logReopens       = metrics.Counter("cylog_log_reopens_total", "Times the log files were reopened after repeated write failures")
+)
+
+// LogWriteError is a failed log file write or open with its class
+type LogWriteError struct {
+	Class string
+	Err   error
+}
+
+// Error returns the message of the underlying error
+func (e *LogWriteError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *LogWriteError) Unwrap() error {
+	return e.Err
+}
+
+// Transient reports whether the failure may clear by itself, as a full disk
+// does once space is freed; missing permissions need the operator
+func (e *LogWriteError) Transient() bool {
+	return e.Class != writeFailurePermission
+}
+
+// newLogWriteError classifies a failed log file write or open
+func newLogWriteError(err error) error {
+	return &LogWriteError{Class: classifyWriteError(err), Err: err}
+}
+
+// classifyWriteError returns the class of a failed write
+func classifyWriteError(err error) string {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return writeFailureNoSpace
+	case errors.Is(err, os.ErrPermission), errors.Is(err, syscall.EROFS):
+		return writeFailurePermission
+	case errors.Is(err, syscall.EIO):
+		return writeFailureIO
+	case errors.Is(err, os.ErrClosed), errors.Is(err, os.ErrInvalid):
+		return writeFailureClosed
+	}
+	return writeFailureOther
+}
+
+// LogWriteFailure is the last failed log write, reported by the status
+// endpoint
+type LogWriteFailure struct {
+	Class     string    `json:"class"`
+	Error     string    `json:"error"`
+	Transient bool      `json:"transient"`
+	At        time.Time `json:"at"`
+}
+
+// logWriteHealth tracks failed log writes; an episode lasts from the first
+// failure to the next successful write
+type logWriteHealth struct {
+	consecutive  int
+	failingSince time.Time
+	last         *LogWriteFailure
+	reopenedAt   time.Time
+	mutex        sync.Mutex
+}
+
+// writeFailures returns the number of consecutive failed writes and the
+// last failure, if any
+func (s *ChatServer) writeFailures() (int, *LogWriteFailure) {
+	s.writeHealth.mutex.Lock()
+	defer s.writeHealth.mutex.Unlock()
+
+	return s.writeHealth.consecutive, s.writeHealth.last
+}
+
+// recordLogWrite updates the write health after a batch was written, or
+// failed to be. The first failure of an episode is logged and announced to
+// clients, as is the recovery; failures that persist reopen the log files.
+func (s *ChatServer) recordLogWrite(err error, now time.Time) {
+	health := &s.writeHealth
+	health.mutex.Lock()
+	if err == nil {
+		failures, since := health.consecutive, health.failingSince
+		health.consecutive = 0
+		health.failingSince = time.Time{}
+		health.mutex.Unlock()
+
+		if failures > 0 {
+			log.Printf("Log files are written again after %d failed writes since %s", failures, since.Format(time.RFC3339))
+			s.publishLogWriteEvent("recovered", "Log files are written again", nil)
+		}
+		return
+	}
+
+	logWriteFailures.Inc()
+	class := writeFailureOther
+	var writeErr *LogWriteError
+	if errors.As(err, &writeErr) {
+		class = writeErr.Class
+	}
+	failure := &LogWriteFailure{Class: class, Error: err.Error(), Transient: class != writeFailurePermission, At: now}
+	health.last = failure
+	health.consecutive++
+	failures := health.consecutive
+	if failures == 1 {
+		health.failingSince = now
+	}
+
+	// A full disk pauses the log files until the disk monitor resumes them
+	reopen := class != writeFailureNoSpace && failures >= logReopenAfter && now.Sub(health.reopenedAt) >= logReopenInterval
+	if reopen {
+		health.reopenedAt = now
+	}
+	health.mutex.Unlock()
+
+	if failures == 1 {
+		log.Printf("Error logging messages (%s): %v", class, err)
+		captureError("chat logger", err)
+		s.publishLogWriteEvent("failing", fmt.Sprintf("Log files can't be written (%s); messages are still shown", class), failure)
+	}
+	if reopen {
+		logReopens.Inc()
+		if err := s.logger.Reopen(); err != nil {
+			log.Printf("Error reopening log files after %d failed writes: %v", failures, err)
+		} else {
+			log.Printf("Reopened log files after %d failed writes", failures)
+		}
+	}
+}
+
+// publishLogWriteEvent broadcasts a system message about log writes failing
+// or recovering, for clients to show a warning
+func (s *ChatServer) publishLogWriteEvent(state, content string, failure *LogWriteFailure) {
+	meta := map[string]interface{}{"event": "log_write", "state": state}
+	if failure != nil {
+		meta["class"] = failure.Class
+		meta["error"] = failure.Error
+		meta["transient"] = failure.Transient
+	}
+	s.publishMessage(Message{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Type:      messageTypeSystem,
+		Username:  "System",
+		Timestamp: time.Now(),
+		Content:   content,
+		HTML:      html.EscapeString(content),
+		Meta:      meta,
+	})
+}
+
+// Reopen closes the live log file of every kind and opens it again, as a
+// restart would, for failures a new file handle may clear, such as a
+// remounted volume
+func (l *Logger) Reopen() error {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	if l.closed || !writable() {
+		return nil
+	}
+	var firstErr error
+	for _, stream := range l.streams {
+		if stream.file != nil {
+			stream.file.Close()
+			stream.file = nil
+		}
+		if stream.chain != nil {
+			stream.chain.Close()
+			stream.chain = nil
+		}
+		if err := l.rotateLogFile(stream, false); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}